@@ -0,0 +1,421 @@
+package modbus
+
+import (
+	"log"
+	"sort"
+	"sync"
+)
+
+// Address router object, dispatching requests to sub-handlers by address range.
+// AddressRouter satisfies the RequestHandler interface and can be passed to
+// NewServer (or registered with a UnitMux) to compose a device out of blocks
+// owned by different handlers.
+// Requests spanning multiple blocks are split into one request per block, and
+// the results are reassembled before being returned to the server. Requests
+// covering addresses outside of any block (gaps) are answered with an illegal
+// data address exception, without invoking any sub-handler.
+// Sub-handlers are passed requests with absolute addresses (i.e. not relative
+// to the start of their block).
+// Write requests spanning multiple blocks are not atomic: segments are written
+// in ascending address order and the first failing sub-handler aborts the
+// request, leaving the segments before it written.
+type AddressRouter struct {
+	lock             sync.RWMutex
+	rmwLock          sync.Mutex
+	logger           *logger
+	coils            []addressRoute
+	discreteInputs   []addressRoute
+	holdingRegisters []addressRoute
+	inputRegisters   []addressRoute
+}
+
+type addressRoute struct {
+	addrRange AddressRange
+	handler   RequestHandler
+}
+
+// routeSegment describes the part of a request to be passed to a sub-handler.
+type routeSegment struct {
+	handler  RequestHandler
+	addr     uint16
+	quantity uint16
+	// offset of the segment from the start of the request
+	offset   int
+}
+
+// Returns a new, empty address router.
+func NewAddressRouter() (ar *AddressRouter) {
+	ar = &AddressRouter{
+		logger: newLogger("address-router", nil),
+	}
+
+	return
+}
+
+// Sets the logger used to report routing and sub-handler errors.
+// If customLogger is nil, messages are written to stdout.
+func (ar *AddressRouter) SetLogger(customLogger *log.Logger) {
+	ar.lock.Lock()
+	ar.logger	= newLogger("address-router", customLogger)
+	ar.lock.Unlock()
+
+	return
+}
+
+// Routes coil requests covering addresses within addrRange to handler.
+// Returns ErrConfigurationError if addrRange is invalid or overlaps with a
+// previously routed coil range.
+func (ar *AddressRouter) RouteCoils(addrRange AddressRange, handler RequestHandler) (err error) {
+	err	= ar.addRoute(&ar.coils, addrRange, handler)
+
+	return
+}
+
+// Routes discrete input requests covering addresses within addrRange to handler.
+func (ar *AddressRouter) RouteDiscreteInputs(addrRange AddressRange, handler RequestHandler) (err error) {
+	err	= ar.addRoute(&ar.discreteInputs, addrRange, handler)
+
+	return
+}
+
+// Routes holding register requests covering addresses within addrRange to handler.
+func (ar *AddressRouter) RouteHoldingRegisters(addrRange AddressRange, handler RequestHandler) (err error) {
+	err	= ar.addRoute(&ar.holdingRegisters, addrRange, handler)
+
+	return
+}
+
+// Routes input register requests covering addresses within addrRange to handler.
+func (ar *AddressRouter) RouteInputRegisters(addrRange AddressRange, handler RequestHandler) (err error) {
+	err	= ar.addRoute(&ar.inputRegisters, addrRange, handler)
+
+	return
+}
+
+// HandleCoils implements the RequestHandler interface.
+// Writes spanning multiple blocks are not atomic (see AddressRouter).
+func (ar *AddressRouter) HandleCoils(req *CoilsRequest) (res []bool, err error) {
+	var segs	[]routeSegment
+	var values	[]bool
+
+	segs, err	= ar.split(&ar.coils, req.Addr, req.Quantity)
+	if err != nil {
+		return
+	}
+
+	for _, seg := range segs {
+		var subReq	= *req
+
+		subReq.Addr	= seg.addr
+		subReq.Quantity	= seg.quantity
+		if req.IsWrite {
+			subReq.Args	= req.Args[seg.offset:seg.offset + int(seg.quantity)]
+		}
+
+		values, err	= seg.handler.HandleCoils(&subReq)
+		if err != nil {
+			return
+		}
+
+		if !req.IsWrite {
+			err	= ar.checkLength(len(values), seg.quantity)
+			if err != nil {
+				return
+			}
+			res	= append(res, values...)
+		}
+	}
+
+	return
+}
+
+// HandleDiscreteInputs implements the RequestHandler interface.
+func (ar *AddressRouter) HandleDiscreteInputs(req *DiscreteInputsRequest) (res []bool, err error) {
+	var segs	[]routeSegment
+	var values	[]bool
+
+	segs, err	= ar.split(&ar.discreteInputs, req.Addr, req.Quantity)
+	if err != nil {
+		return
+	}
+
+	for _, seg := range segs {
+		var subReq	= *req
+
+		subReq.Addr	= seg.addr
+		subReq.Quantity	= seg.quantity
+
+		values, err	= seg.handler.HandleDiscreteInputs(&subReq)
+		if err != nil {
+			return
+		}
+
+		err	= ar.checkLength(len(values), seg.quantity)
+		if err != nil {
+			return
+		}
+		res	= append(res, values...)
+	}
+
+	return
+}
+
+// HandleHoldingRegisters implements the RequestHandler interface.
+// Writes spanning multiple blocks are not atomic (see AddressRouter).
+func (ar *AddressRouter) HandleHoldingRegisters(req *HoldingRegistersRequest) (res []uint16, err error) {
+	var segs	[]routeSegment
+	var values	[]uint16
+
+	segs, err	= ar.split(&ar.holdingRegisters, req.Addr, req.Quantity)
+	if err != nil {
+		return
+	}
+
+	for _, seg := range segs {
+		var subReq	= *req
+
+		subReq.Addr	= seg.addr
+		subReq.Quantity	= seg.quantity
+		if req.IsWrite {
+			subReq.Args	= req.Args[seg.offset:seg.offset + int(seg.quantity)]
+		}
+
+		values, err	= seg.handler.HandleHoldingRegisters(&subReq)
+		if err != nil {
+			return
+		}
+
+		if !req.IsWrite {
+			err	= ar.checkLength(len(values), seg.quantity)
+			if err != nil {
+				return
+			}
+			res	= append(res, values...)
+		}
+	}
+
+	return
+}
+
+// HandleInputRegisters implements the RequestHandler interface.
+func (ar *AddressRouter) HandleInputRegisters(req *InputRegistersRequest) (res []uint16, err error) {
+	var segs	[]routeSegment
+	var values	[]uint16
+
+	segs, err	= ar.split(&ar.inputRegisters, req.Addr, req.Quantity)
+	if err != nil {
+		return
+	}
+
+	for _, seg := range segs {
+		var subReq	= *req
+
+		subReq.Addr	= seg.addr
+		subReq.Quantity	= seg.quantity
+
+		values, err	= seg.handler.HandleInputRegisters(&subReq)
+		if err != nil {
+			return
+		}
+
+		err	= ar.checkLength(len(values), seg.quantity)
+		if err != nil {
+			return
+		}
+		res	= append(res, values...)
+	}
+
+	return
+}
+
+// HandleMaskWriteRegister implements the MaskWriteRegisterHandler interface.
+func (ar *AddressRouter) HandleMaskWriteRegister(req *MaskWriteRegisterRequest) (err error) {
+	var segs	[]routeSegment
+	var mwrh	MaskWriteRegisterHandler
+	var ok		bool
+
+	segs, err	= ar.split(&ar.holdingRegisters, req.Addr, 1)
+	if err != nil {
+		return
+	}
+
+	mwrh, ok	= segs[0].handler.(MaskWriteRegisterHandler)
+	if ok {
+		err	= mwrh.HandleMaskWriteRegister(req)
+	} else {
+		err	= rmwMaskWriteRegister(segs[0].handler, &ar.rmwLock, ar.getLogger(), req)
+	}
+
+	return
+}
+
+// HandleReadWriteRegisters implements the ReadWriteRegistersHandler interface.
+// If both the read and write ranges fall within the same block, the request is
+// passed as is to the sub-handler, otherwise (or if the sub-handlers of both
+// ranges can't be compared) the write and read operations are performed in turn
+// through HandleHoldingRegisters.
+func (ar *AddressRouter) HandleReadWriteRegisters(req *ReadWriteRegistersRequest) (res []uint16, err error) {
+	var readSegs	[]routeSegment
+	var writeSegs	[]routeSegment
+	var rwrh	ReadWriteRegistersHandler
+	var ok		bool
+
+	// make sure both operations are valid before writing anything
+	readSegs, err	= ar.split(&ar.holdingRegisters, req.ReadAddr, req.ReadQuantity)
+	if err != nil {
+		return
+	}
+
+	writeSegs, err	= ar.split(&ar.holdingRegisters, req.WriteAddr, req.WriteQuantity)
+	if err != nil {
+		return
+	}
+
+	if len(readSegs) == 1 && len(writeSegs) == 1 &&
+	   sameHandler(readSegs[0].handler, writeSegs[0].handler) {
+		rwrh, ok	= readSegs[0].handler.(ReadWriteRegistersHandler)
+		if ok {
+			res, err	= rwrh.HandleReadWriteRegisters(req)
+			return
+		}
+	}
+
+	res, err	= rmwReadWriteRegisters(ar, &ar.rmwLock, req)
+
+	return
+}
+
+// HandleFIFOQueue implements the FIFOQueueHandler interface, routing requests by
+// the address of their FIFO pointer register (within holding register blocks).
+func (ar *AddressRouter) HandleFIFOQueue(req *FIFOQueueRequest) (res []uint16, err error) {
+	var segs	[]routeSegment
+	var fqh		FIFOQueueHandler
+	var ok		bool
+
+	segs, err	= ar.split(&ar.holdingRegisters, req.Addr, 1)
+	if err != nil {
+		return
+	}
+
+	fqh, ok	= segs[0].handler.(FIFOQueueHandler)
+	if ok {
+		res, err	= fqh.HandleFIFOQueue(req)
+	} else {
+		err		= ErrIllegalFunction
+	}
+
+	return
+}
+
+/*** unexported methods ***/
+// Adds a route to routes, keeping routes sorted by start address.
+func (ar *AddressRouter) addRoute(routes *[]addressRoute, addrRange AddressRange,
+	handler RequestHandler) (err error) {
+	if addrRange.Start > addrRange.End || handler == nil {
+		err	= ErrConfigurationError
+		return
+	}
+
+	ar.lock.Lock()
+	defer ar.lock.Unlock()
+
+	for _, route := range *routes {
+		if addrRange.Start <= route.addrRange.End &&
+		   addrRange.End >= route.addrRange.Start {
+			ar.logger.Errorf("address range %v-%v overlaps with %v-%v",
+				addrRange.Start, addrRange.End,
+				route.addrRange.Start, route.addrRange.End)
+			err	= ErrConfigurationError
+			return
+		}
+	}
+
+	*routes	= append(*routes, addressRoute{
+		addrRange: addrRange,
+		handler:   handler,
+	})
+
+	sort.Slice(*routes, func(i int, j int) bool {
+		return (*routes)[i].addrRange.Start < (*routes)[j].addrRange.Start
+	})
+
+	return
+}
+
+// Splits the address range covered by a request into one segment per route of
+// table (one of ar.coils, ar.discreteInputs, ar.holdingRegisters or
+// ar.inputRegisters).
+// Returns ErrIllegalDataAddress if any address is not covered by a route.
+func (ar *AddressRouter) split(table *[]addressRoute, addr uint16, quantity uint16) (
+	segs []routeSegment, err error) {
+	var routes	[]addressRoute
+	var next	uint32
+	var end		uint32
+	var segEnd	uint32
+	var found	bool
+
+	ar.lock.RLock()
+	defer ar.lock.RUnlock()
+
+	routes	= *table
+
+	next	= uint32(addr)
+	end	= uint32(addr) + uint32(quantity) - 1
+	if quantity == 0 || end > 0xffff {
+		err	= ErrIllegalDataAddress
+		return
+	}
+
+	for next <= end {
+		found	= false
+
+		for _, route := range routes {
+			if next >= uint32(route.addrRange.Start) &&
+			   next <= uint32(route.addrRange.End) {
+				segEnd	= uint32(route.addrRange.End)
+				if segEnd > end {
+					segEnd	= end
+				}
+
+				segs	= append(segs, routeSegment{
+					handler:  route.handler,
+					addr:     uint16(next),
+					quantity: uint16(segEnd - next + 1),
+					offset:   int(next - uint32(addr)),
+				})
+
+				next	= segEnd + 1
+				found	= true
+				break
+			}
+		}
+
+		if !found {
+			segs	= nil
+			err	= ErrIllegalDataAddress
+			return
+		}
+	}
+
+	return
+}
+
+// Makes sure a sub-handler returned the expected number of values.
+func (ar *AddressRouter) checkLength(length int, quantity uint16) (err error) {
+	if length != int(quantity) {
+		ar.getLogger().Errorf("handler returned %v values, expected %v",
+				 length, quantity)
+		err	= ErrServerDeviceFailure
+	}
+
+	return
+}
+
+// Returns the logger of the router.
+func (ar *AddressRouter) getLogger() (l *logger) {
+	ar.lock.RLock()
+	l	= ar.logger
+	ar.lock.RUnlock()
+
+	return
+}
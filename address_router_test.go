@@ -0,0 +1,233 @@
+package modbus
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestAddressRouter(t *testing.T) {
+	var ar     *AddressRouter
+	var ident  *MemoryStore
+	var meas   *MemoryStore
+	var setp   *MemoryStore
+	var th     *tcpTestHandler
+	var err    error
+	var regs   []uint16
+	var logs   bytes.Buffer
+
+	ident, _	= NewMemoryStore(&MemoryStoreConfiguration{
+		HoldingRegisters:	[]AddressRange{{Start: 0, End: 9}},
+		InputRegisters:		[]AddressRange{{Start: 0, End: 99}},
+	})
+	meas, _		= NewMemoryStore(&MemoryStoreConfiguration{
+		InputRegisters:		[]AddressRange{{Start: 100, End: 199}},
+	})
+	setp, _		= NewMemoryStore(&MemoryStoreConfiguration{
+		HoldingRegisters:	[]AddressRange{{Start: 10, End: 19}},
+	})
+	th		= &tcpTestHandler{}
+
+	ar	= NewAddressRouter()
+	ar.SetLogger(log.New(&logs, "", 0))
+
+	for _, tc := range []struct {
+		routeFn func(AddressRange, RequestHandler) error
+		r       AddressRange
+		h       RequestHandler
+	}{
+		{ar.RouteHoldingRegisters, AddressRange{Start: 0,   End: 9},   ident},
+		{ar.RouteHoldingRegisters, AddressRange{Start: 10,  End: 19},  setp},
+		{ar.RouteInputRegisters,   AddressRange{Start: 0,   End: 99},  ident},
+		{ar.RouteInputRegisters,   AddressRange{Start: 100, End: 199}, meas},
+		{ar.RouteCoils,            AddressRange{Start: 0,   End: 4},   th},
+		{ar.RouteCoils,            AddressRange{Start: 8,   End: 9},   th},
+	} {
+		err	= tc.routeFn(tc.r, tc.h)
+		if err != nil {
+			t.Errorf("failed to add route %v: %v", tc.r, err)
+		}
+	}
+
+	// overlapping ranges should be rejected
+	err	= ar.RouteInputRegisters(AddressRange{Start: 150, End: 250}, th)
+	if err != ErrConfigurationError {
+		t.Errorf("RouteInputRegisters() should have returned ErrConfigurationError, got: %v", err)
+	}
+	if !strings.Contains(logs.String(), "address range 150-250 overlaps with 100-199") {
+		t.Errorf("unexpected logs: '%s'", logs.String())
+	}
+
+	err	= ar.RouteCoils(AddressRange{Start: 5, End: 4}, th)
+	if err != ErrConfigurationError {
+		t.Errorf("RouteCoils() should have returned ErrConfigurationError, got: %v", err)
+	}
+
+	// writes spanning two blocks should be split
+	_, err	= ar.HandleHoldingRegisters(&HoldingRegistersRequest{
+		Addr: 8, Quantity: 4, IsWrite: true, Args: []uint16{1, 2, 3, 4},
+	})
+	if err != nil {
+		t.Errorf("HandleHoldingRegisters() should have succeeded, got: %v", err)
+	}
+
+	regs, _	= ident.GetRegisters(8, 2, HOLDING_REGISTER)
+	if len(regs) != 2 || regs[0] != 1 || regs[1] != 2 {
+		t.Errorf("unexpected register values: %v", regs)
+	}
+
+	regs, _	= setp.GetRegisters(10, 2, HOLDING_REGISTER)
+	if len(regs) != 2 || regs[0] != 3 || regs[1] != 4 {
+		t.Errorf("unexpected register values: %v", regs)
+	}
+
+	// reads spanning two blocks should be reassembled
+	ident.SetRegister(99, 0x1234, INPUT_REGISTER)
+	meas.SetRegister(100, 0x5678, INPUT_REGISTER)
+
+	regs, err	= ar.HandleInputRegisters(&InputRegistersRequest{
+		Addr: 98, Quantity: 3,
+	})
+	if err != nil {
+		t.Errorf("HandleInputRegisters() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 3 || regs[0] != 0x0000 || regs[1] != 0x1234 || regs[2] != 0x5678 {
+		t.Errorf("unexpected register values: %v", regs)
+	}
+
+	// gaps should yield illegal data address exceptions without any write
+	// taking place
+	_, err	= ar.HandleCoils(&CoilsRequest{
+		UnitId: 9, Addr: 3, Quantity: 6, IsWrite: true,
+		Args: []bool{true, true, true, true, true, true},
+	})
+	if err != ErrIllegalDataAddress {
+		t.Errorf("HandleCoils() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+	if th.coils[3] {
+		t.Errorf("coil #3 should not have been written")
+	}
+
+	_, err	= ar.HandleInputRegisters(&InputRegistersRequest{
+		Addr: 199, Quantity: 2,
+	})
+	if err != ErrIllegalDataAddress {
+		t.Errorf("HandleInputRegisters() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	_, err	= ar.HandleDiscreteInputs(&DiscreteInputsRequest{
+		Addr: 0, Quantity: 1,
+	})
+	if err != ErrIllegalDataAddress {
+		t.Errorf("HandleDiscreteInputs() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	// sub-handler errors should be passed through
+	_, err	= ar.HandleCoils(&CoilsRequest{
+		UnitId: 8, Addr: 0, Quantity: 1,
+	})
+	if err != ErrIllegalFunction {
+		t.Errorf("HandleCoils() should have returned ErrIllegalFunction, got: %v", err)
+	}
+
+	_, err	= ar.HandleCoils(&CoilsRequest{
+		UnitId: 9, Addr: 8, Quantity: 2, IsWrite: true, Args: []bool{true, false},
+	})
+	if err != nil {
+		t.Errorf("HandleCoils() should have succeeded, got: %v", err)
+	}
+	if !th.coils[8] || th.coils[9] {
+		t.Errorf("unexpected coil values: %v", th.coils)
+	}
+
+	// read/write requests spanning blocks should be supported
+	regs, err	= ar.HandleReadWriteRegisters(&ReadWriteRegistersRequest{
+		ReadAddr: 9, ReadQuantity: 2,
+		WriteAddr: 9, WriteQuantity: 2, Args: []uint16{0xaaaa, 0xbbbb},
+	})
+	if err != nil {
+		t.Errorf("HandleReadWriteRegisters() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 2 || regs[0] != 0xaaaa || regs[1] != 0xbbbb {
+		t.Errorf("unexpected register values: %v", regs)
+	}
+
+	err	= ar.HandleMaskWriteRegister(&MaskWriteRegisterRequest{
+		Addr: 10, AndMask: 0x00ff, OrMask: 0x1100,
+	})
+	if err != nil {
+		t.Errorf("HandleMaskWriteRegister() should have succeeded, got: %v", err)
+	}
+
+	regs, _	= setp.GetRegisters(10, 1, HOLDING_REGISTER)
+	if len(regs) != 1 || regs[0] != 0x11bb {
+		t.Errorf("unexpected register values: %v", regs)
+	}
+
+	return
+}
+
+func TestAddressRouterNonComparableHandler(t *testing.T) {
+	var ar   *AddressRouter
+	var sh   sliceTestHandler
+	var err  error
+	var regs []uint16
+
+	// sliceTestHandler values hold a slice, hence can't be compared with ==
+	sh	= sliceTestHandler{holding: make([]uint16, 10)}
+	ar	= NewAddressRouter()
+
+	err	= ar.RouteHoldingRegisters(AddressRange{Start: 0, End: 9}, sh)
+	if err != nil {
+		t.Errorf("RouteHoldingRegisters() should have succeeded, got: %v", err)
+	}
+
+	regs, err	= ar.HandleReadWriteRegisters(&ReadWriteRegistersRequest{
+		ReadAddr: 1, ReadQuantity: 2,
+		WriteAddr: 2, WriteQuantity: 1, Args: []uint16{0x1234},
+	})
+	if err != nil {
+		t.Errorf("HandleReadWriteRegisters() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 2 || regs[0] != 0x0000 || regs[1] != 0x1234 {
+		t.Errorf("unexpected register values: %v", regs)
+	}
+
+	return
+}
+
+// sliceTestHandler is a handler of a non-comparable type, serving holding
+// registers only.
+type sliceTestHandler struct {
+	holding []uint16
+}
+
+func (sh sliceTestHandler) HandleCoils(req *CoilsRequest) (res []bool, err error) {
+	err	= ErrIllegalFunction
+
+	return
+}
+
+func (sh sliceTestHandler) HandleDiscreteInputs(req *DiscreteInputsRequest) (res []bool, err error) {
+	err	= ErrIllegalFunction
+
+	return
+}
+
+func (sh sliceTestHandler) HandleHoldingRegisters(req *HoldingRegistersRequest) (res []uint16, err error) {
+	for i := 0; i < int(req.Quantity); i++ {
+		if req.IsWrite {
+			sh.holding[int(req.Addr) + i]	= req.Args[i]
+		}
+		res	= append(res, sh.holding[int(req.Addr) + i])
+	}
+
+	return
+}
+
+func (sh sliceTestHandler) HandleInputRegisters(req *InputRegistersRequest) (res []uint16, err error) {
+	err	= ErrIllegalFunction
+
+	return
+}
@@ -0,0 +1,331 @@
+package modbus
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+const (
+	// table names, as used in authorization rules
+	tableCoils            string = "coils"
+	tableDiscreteInputs   string = "discreteInputs"
+	tableHoldingRegisters string = "holdingRegisters"
+	tableInputRegisters   string = "inputRegisters"
+)
+
+// Authorization policy object, mapping client roles to the requests they are
+// allowed to make (see the AuthorizationPolicy property of ServerConfiguration).
+// Policies can be loaded from JSON files (see LoadAuthorizationPolicy()), e.g.:
+//	{
+//	  "roles": {
+//	    "operator": [
+//	      {"functionCodes": [1, 3], "unitIds": [1, 2]},
+//	      {"functionCodes": [5, 6, 15, 16], "tables": ["coils", "holdingRegisters"],
+//	       "addressRanges": [{"start": 100, "end": 199}]}
+//	    ],
+//	    "engineer": [{}]
+//	  }
+//	}
+type AuthorizationPolicy struct {
+	// Roles maps role names, as found in client certificates (tcp+tls only),
+	// to the list of rules granting access to clients holding that role.
+	// Clients without a role (e.g. all clients of servers not using TLS) are
+	// subject to the rules of the empty ("") role.
+	// Requests are allowed if at least one rule of the client role allows
+	// them. Clients holding a role not listed here are denied all requests.
+	Roles map[string][]AuthorizationRule `json:"roles"`
+}
+
+// Authorization rule object. A rule allows requests matching all of its
+// (non-empty) criteria.
+type AuthorizationRule struct {
+	// FunctionCodes lists the allowed function codes. If empty, all function
+	// codes are allowed.
+	FunctionCodes []uint         `json:"functionCodes"`
+	// Tables lists the tables which can be accessed, among "coils",
+	// "discreteInputs", "holdingRegisters" and "inputRegisters".
+	// If non-empty, requests not accessing any of these tables (e.g.
+	// diagnostics requests) are not allowed by the rule.
+	// Read FIFO queue requests (0x18) are considered to only access their
+	// FIFO pointer register (holding register table), while read/write file
+	// record requests (0x14/0x15) access no table at all, hence never match
+	// rules with Tables or AddressRanges set.
+	Tables        []string       `json:"tables"`
+	// UnitIds lists the unit ids which can be addressed. If empty, all unit
+	// ids are allowed.
+	UnitIds       []uint         `json:"unitIds"`
+	// AddressRanges lists the addresses which can be accessed. Requests covering
+	// any address outside of these ranges are denied with an illegal data
+	// address exception.
+	// If non-empty, requests not accessing any table are not allowed by the rule.
+	// Read FIFO queue requests (0x18) are only checked against the address of
+	// their FIFO pointer register, not against the registers of the queue.
+	AddressRanges []AddressRange `json:"addressRanges"`
+}
+
+// tableAccess describes the range of a table accessed by a request.
+type tableAccess struct {
+	table    string
+	addr     uint16
+	quantity uint16
+}
+
+// LoadAuthorizationPolicy loads an authorization policy from a JSON file.
+func LoadAuthorizationPolicy(filePath string) (policy *AuthorizationPolicy, err error) {
+	var buf     []byte
+	var decoder *json.Decoder
+
+	buf, err	= os.ReadFile(filePath)
+	if err != nil {
+		return
+	}
+
+	// reject unknown fields, as a typo could otherwise silently widen the
+	// scope of a rule
+	policy		= &AuthorizationPolicy{}
+	decoder		= json.NewDecoder(bytes.NewReader(buf))
+	decoder.DisallowUnknownFields()
+
+	err		= decoder.Decode(policy)
+	if err != nil {
+		policy	= nil
+		err	= fmt.Errorf("%v: %v", filePath, err)
+		return
+	}
+
+	err		= policy.validate()
+	if err != nil {
+		policy	= nil
+		err	= fmt.Errorf("%v: %v", filePath, err)
+		return
+	}
+
+	return
+}
+
+// Makes sure all rules of the policy are valid.
+func (ap *AuthorizationPolicy) validate() (err error) {
+	for role, rules := range ap.Roles {
+		for i, rule := range rules {
+			for _, fc := range rule.FunctionCodes {
+				if fc == 0 || fc > 0x7f {
+					err = fmt.Errorf("role '%s', rule #%v: invalid function code %v",
+							 role, i, fc)
+					return
+				}
+			}
+
+			for _, table := range rule.Tables {
+				switch table {
+				case tableCoils, tableDiscreteInputs,
+				     tableHoldingRegisters, tableInputRegisters:
+				default:
+					err = fmt.Errorf("role '%s', rule #%v: unknown table '%s'",
+							 role, i, table)
+					return
+				}
+			}
+
+			for _, unitId := range rule.UnitIds {
+				if unitId > 0xff {
+					err = fmt.Errorf("role '%s', rule #%v: invalid unit id %v",
+							 role, i, unitId)
+					return
+				}
+			}
+
+			for _, r := range rule.AddressRanges {
+				if r.Start > r.End {
+					err = fmt.Errorf("role '%s', rule #%v: invalid address range %v-%v",
+							 role, i, r.Start, r.End)
+					return
+				}
+			}
+		}
+	}
+
+	return
+}
+
+// Checks a request against the policy.
+// Returns ErrIllegalFunction if no rule of the role allows the function code,
+// unit id and tables of the request, or ErrIllegalDataAddress if some rules do
+// but none of them allows all addresses covered by the request.
+func (ap *AuthorizationPolicy) authorize(req *pdu, role string, accesses []tableAccess) (err error) {
+	var rules	[]AuthorizationRule
+	var ok		bool
+
+	rules, ok	= ap.Roles[role]
+	if !ok {
+		err	= ErrIllegalFunction
+		return
+	}
+
+	// deny by default
+	err	= ErrIllegalFunction
+
+	for _, rule := range rules {
+		if !rule.allowsFunction(req, accesses) {
+			continue
+		}
+
+		if rule.allowsAddresses(accesses) {
+			err	= nil
+			return
+		}
+
+		err	= ErrIllegalDataAddress
+	}
+
+	return
+}
+
+// Returns true if the function code, unit id and tables of the request are
+// allowed by the rule.
+func (ar *AuthorizationRule) allowsFunction(req *pdu, accesses []tableAccess) (yes bool) {
+	if len(ar.FunctionCodes) > 0 && !containsUint(ar.FunctionCodes, uint(req.functionCode)) {
+		return
+	}
+
+	if len(ar.UnitIds) > 0 && !containsUint(ar.UnitIds, uint(req.unitId)) {
+		return
+	}
+
+	if len(ar.Tables) > 0 {
+		if len(accesses) == 0 {
+			return
+		}
+
+		for _, access := range accesses {
+			if !containsString(ar.Tables, access.table) {
+				return
+			}
+		}
+	}
+
+	yes	= true
+
+	return
+}
+
+// Returns true if all addresses accessed by the request are allowed by the rule.
+func (ar *AuthorizationRule) allowsAddresses(accesses []tableAccess) (yes bool) {
+	if len(ar.AddressRanges) == 0 {
+		yes	= true
+		return
+	}
+
+	if len(accesses) == 0 {
+		return
+	}
+
+	for _, access := range accesses {
+		if !covers(ar.AddressRanges, access.addr, access.quantity) {
+			return
+		}
+	}
+
+	yes	= true
+
+	return
+}
+
+// describeAccesses returns the table ranges accessed by a request, if any.
+// ok is false if the request is too short to be decoded, in which case it
+// should be denied.
+func describeAccesses(req *pdu) (accesses []tableAccess, ok bool) {
+	var table	string
+	var quantity	uint16
+
+	switch req.functionCode {
+	case fcReadCoils, fcReadDiscreteInputs, fcReadHoldingRegisters,
+	     fcReadInputRegisters, fcWriteMultipleCoils, fcWriteMultipleRegisters:
+		if len(req.payload) < 4 {
+			return
+		}
+
+		switch req.functionCode {
+		case fcReadCoils, fcWriteMultipleCoils:
+			table	= tableCoils
+		case fcReadDiscreteInputs:
+			table	= tableDiscreteInputs
+		case fcReadHoldingRegisters, fcWriteMultipleRegisters:
+			table	= tableHoldingRegisters
+		case fcReadInputRegisters:
+			table	= tableInputRegisters
+		}
+
+		quantity	= bytesToUint16(BIG_ENDIAN, req.payload[2:4])
+		if quantity == 0 {
+			return
+		}
+
+		accesses	= append(accesses, tableAccess{
+			table:    table,
+			addr:     bytesToUint16(BIG_ENDIAN, req.payload[0:2]),
+			quantity: quantity,
+		})
+
+	case fcWriteSingleCoil, fcWriteSingleRegister, fcMaskWriteRegister, fcReadFifoQueue:
+		if len(req.payload) < 2 {
+			return
+		}
+
+		table	= tableHoldingRegisters
+		if req.functionCode == fcWriteSingleCoil {
+			table	= tableCoils
+		}
+
+		accesses	= append(accesses, tableAccess{
+			table:    table,
+			addr:     bytesToUint16(BIG_ENDIAN, req.payload[0:2]),
+			quantity: 1,
+		})
+
+	case fcReadWriteMultipleRegisters:
+		if len(req.payload) < 8 ||
+		   bytesToUint16(BIG_ENDIAN, req.payload[2:4]) == 0 ||
+		   bytesToUint16(BIG_ENDIAN, req.payload[6:8]) == 0 {
+			return
+		}
+
+		// read then write ranges
+		accesses	= append(accesses, tableAccess{
+			table:    tableHoldingRegisters,
+			addr:     bytesToUint16(BIG_ENDIAN, req.payload[0:2]),
+			quantity: bytesToUint16(BIG_ENDIAN, req.payload[2:4]),
+		}, tableAccess{
+			table:    tableHoldingRegisters,
+			addr:     bytesToUint16(BIG_ENDIAN, req.payload[4:6]),
+			quantity: bytesToUint16(BIG_ENDIAN, req.payload[6:8]),
+		})
+	}
+
+	ok	= true
+
+	return
+}
+
+func containsUint(list []uint, value uint) (yes bool) {
+	for _, v := range list {
+		if v == value {
+			yes	= true
+			return
+		}
+	}
+
+	return
+}
+
+func containsString(list []string, value string) (yes bool) {
+	for _, v := range list {
+		if v == value {
+			yes	= true
+			return
+		}
+	}
+
+	return
+}
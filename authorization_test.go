@@ -0,0 +1,314 @@
+package modbus
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadAuthorizationPolicy(t *testing.T) {
+	var err    error
+	var dir    string
+	var path   string
+	var policy *AuthorizationPolicy
+
+	dir	= t.TempDir()
+	path	= filepath.Join(dir, "policy.json")
+
+	// unknown fields should be rejected
+	err	= os.WriteFile(path, []byte(`{"roles": {"operator": [{"functionCode": [3]}]}}`), 0600)
+	if err != nil {
+		t.Fatalf("failed to write policy file: %v", err)
+	}
+
+	_, err	= LoadAuthorizationPolicy(path)
+	if err == nil {
+		t.Errorf("LoadAuthorizationPolicy() should have failed")
+	}
+
+	// so should unknown tables
+	err	= os.WriteFile(path, []byte(`{"roles": {"operator": [{"tables": ["registers"]}]}}`), 0600)
+	if err != nil {
+		t.Fatalf("failed to write policy file: %v", err)
+	}
+
+	_, err	= LoadAuthorizationPolicy(path)
+	if err == nil {
+		t.Errorf("LoadAuthorizationPolicy() should have failed")
+	}
+
+	// and invalid address ranges
+	err	= os.WriteFile(path, []byte(`{"roles": {"operator": [{"addressRanges": [{"start": 10, "end": 9}]}]}}`), 0600)
+	if err != nil {
+		t.Fatalf("failed to write policy file: %v", err)
+	}
+
+	_, err	= LoadAuthorizationPolicy(path)
+	if err == nil {
+		t.Errorf("LoadAuthorizationPolicy() should have failed")
+	}
+
+	err	= os.WriteFile(path, []byte(`{
+		"roles": {
+			"operator": [
+				{"functionCodes": [1, 3], "unitIds": [1, 2]},
+				{"functionCodes": [5, 6, 15, 16], "tables": ["coils", "holdingRegisters"],
+				 "addressRanges": [{"start": 100, "end": 199}]}
+			],
+			"engineer": [{}]
+		}
+	}`), 0600)
+	if err != nil {
+		t.Fatalf("failed to write policy file: %v", err)
+	}
+
+	policy, err	= LoadAuthorizationPolicy(path)
+	if err != nil {
+		t.Errorf("LoadAuthorizationPolicy() should have succeeded, got: %v", err)
+		return
+	}
+
+	if len(policy.Roles) != 2 || len(policy.Roles["operator"]) != 2 ||
+	   len(policy.Roles["engineer"]) != 1 {
+		t.Errorf("unexpected policy: %v", policy)
+		return
+	}
+
+	if policy.Roles["operator"][1].AddressRanges[0].Start != 100 ||
+	   policy.Roles["operator"][1].AddressRanges[0].End != 199 {
+		t.Errorf("unexpected address range: %v", policy.Roles["operator"][1].AddressRanges)
+	}
+
+	return
+}
+
+func TestAuthorizationPolicy(t *testing.T) {
+	var err    error
+	var policy *AuthorizationPolicy
+	var check  = func(role string, unitId uint8, fc uint8, payload []byte) error {
+		var accesses	[]tableAccess
+		var req		= &pdu{unitId: unitId, functionCode: fc, payload: payload}
+
+		accesses, _	= describeAccesses(req)
+
+		return policy.authorize(req, role, accesses)
+	}
+
+	policy	= &AuthorizationPolicy{
+		Roles: map[string][]AuthorizationRule{
+			"operator": {
+				{
+					FunctionCodes: []uint{0x01, 0x03},
+					UnitIds:       []uint{1, 2},
+				}, {
+					FunctionCodes: []uint{0x05, 0x06, 0x0f, 0x10, 0x17},
+					Tables:        []string{"coils", "holdingRegisters"},
+					AddressRanges: []AddressRange{{Start: 100, End: 199}},
+				},
+			},
+			"engineer": {{}},
+		},
+	}
+
+	// read holding registers 0-9 on unit 1: allowed by the first rule
+	err	= check("operator", 1, fcReadHoldingRegisters, []byte{0x00, 0x00, 0x00, 0x0a})
+	if err != nil {
+		t.Errorf("expected nil, got: %v", err)
+	}
+
+	// same request to unit 3: denied
+	err	= check("operator", 3, fcReadHoldingRegisters, []byte{0x00, 0x00, 0x00, 0x0a})
+	if err != ErrIllegalFunction {
+		t.Errorf("expected ErrIllegalFunction, got: %v", err)
+	}
+
+	// input registers aren't allowed at all
+	err	= check("operator", 1, fcReadInputRegisters, []byte{0x00, 0x00, 0x00, 0x01})
+	if err != ErrIllegalFunction {
+		t.Errorf("expected ErrIllegalFunction, got: %v", err)
+	}
+
+	// write single register 150: allowed by the second rule
+	err	= check("operator", 5, fcWriteSingleRegister, []byte{0x00, 0x96, 0x12, 0x34})
+	if err != nil {
+		t.Errorf("expected nil, got: %v", err)
+	}
+
+	// write multiple registers 198-201: partly out of range
+	err	= check("operator", 5, fcWriteMultipleRegisters,
+		     []byte{0x00, 0xc6, 0x00, 0x04, 0x08, 0, 0, 0, 0, 0, 0, 0, 0})
+	if err != ErrIllegalDataAddress {
+		t.Errorf("expected ErrIllegalDataAddress, got: %v", err)
+	}
+
+	// read/write multiple registers: read range out of bounds
+	err	= check("operator", 5, fcReadWriteMultipleRegisters,
+		     []byte{0x00, 0x00, 0x00, 0x01, 0x00, 0x64, 0x00, 0x01, 0x02, 0x00, 0x00})
+	if err != ErrIllegalDataAddress {
+		t.Errorf("expected ErrIllegalDataAddress, got: %v", err)
+	}
+
+	// read/write multiple registers: both ranges in bounds
+	err	= check("operator", 5, fcReadWriteMultipleRegisters,
+		     []byte{0x00, 0x64, 0x00, 0x01, 0x00, 0x65, 0x00, 0x01, 0x02, 0x00, 0x00})
+	if err != nil {
+		t.Errorf("expected nil, got: %v", err)
+	}
+
+	// diagnostics requests don't access any table and are denied to operators
+	err	= check("operator", 1, fcDiagnostics, []byte{0x00, 0x00, 0x12, 0x34})
+	if err != ErrIllegalFunction {
+		t.Errorf("expected ErrIllegalFunction, got: %v", err)
+	}
+
+	// ... but allowed to engineers
+	err	= check("engineer", 1, fcDiagnostics, []byte{0x00, 0x00, 0x12, 0x34})
+	if err != nil {
+		t.Errorf("expected nil, got: %v", err)
+	}
+
+	// unknown roles are denied everything
+	err	= check("guest", 1, fcReadHoldingRegisters, []byte{0x00, 0x00, 0x00, 0x01})
+	if err != ErrIllegalFunction {
+		t.Errorf("expected ErrIllegalFunction, got: %v", err)
+	}
+
+	err	= check("", 1, fcReadHoldingRegisters, []byte{0x00, 0x00, 0x00, 0x01})
+	if err != ErrIllegalFunction {
+		t.Errorf("expected ErrIllegalFunction, got: %v", err)
+	}
+
+	return
+}
+
+func TestServerAuthorization(t *testing.T) {
+	var err    error
+	var server *ModbusServer
+	var client *ModbusClient
+	var mem    *MemoryStore
+	var audit  bytes.Buffer
+	var regs   []uint16
+	var reg    uint16
+	var coil   bool
+
+	mem, err	= NewMemoryStore(&MemoryStoreConfiguration{
+		Coils:			[]AddressRange{{Start: 0, End: 99}},
+		HoldingRegisters:	[]AddressRange{{Start: 0, End: 99}},
+	})
+	if err != nil {
+		t.Errorf("NewMemoryStore() should have succeeded, got: %v", err)
+		return
+	}
+
+	_, err	= NewServer(&ServerConfiguration{
+		URL:			"tcp://localhost:5518",
+		AuthorizationPolicy:	&AuthorizationPolicy{
+			Roles: map[string][]AuthorizationRule{
+				"": {{FunctionCodes: []uint{0}}},
+			},
+		},
+	}, mem)
+	if err != ErrConfigurationError {
+		t.Errorf("NewServer() should have returned ErrConfigurationError, got: %v", err)
+	}
+
+	// plain TCP clients have no role: grant read access to all holding
+	// registers and write access to registers 10-19 to the "" role
+	server, err	= NewServer(&ServerConfiguration{
+		URL:			"tcp://localhost:5518",
+		AuthorizationPolicy:	&AuthorizationPolicy{
+			Roles: map[string][]AuthorizationRule{
+				"": {
+					{
+						FunctionCodes: []uint{0x03},
+					}, {
+						FunctionCodes: []uint{0x06, 0x10},
+						AddressRanges: []AddressRange{{Start: 10, End: 19}},
+					},
+				},
+			},
+		},
+		AuditLogger:		log.New(&audit, "", 0),
+	}, mem)
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+
+	err	= server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+		return
+	}
+	defer server.Stop()
+
+	client, err	= NewClient(&ClientConfiguration{
+		URL:		"tcp://localhost:5518",
+		Timeout:	1 * time.Second,
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+
+	err	= client.Open()
+	if err != nil {
+		t.Errorf("failed to open client: %v", err)
+		return
+	}
+	defer client.Close()
+
+	err	= client.WriteRegisters(10, []uint16{0x1111, 0x2222})
+	if err != nil {
+		t.Errorf("client.WriteRegisters() should have succeeded, got: %v", err)
+	}
+
+	err	= client.WriteRegister(20, 0x3333)
+	if err != ErrIllegalDataAddress {
+		t.Errorf("client.WriteRegister() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	err	= client.WriteCoil(0, true)
+	if err != ErrIllegalFunction {
+		t.Errorf("client.WriteCoil() should have returned ErrIllegalFunction, got: %v", err)
+	}
+
+	regs, err	= client.ReadRegisters(9, 3, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("client.ReadRegisters() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 3 || regs[0] != 0 || regs[1] != 0x1111 || regs[2] != 0x2222 {
+		t.Errorf("unexpected register values: %v", regs)
+	}
+
+	// denied requests should never reach the handler
+	reg, _		= mem.GetRegister(20, HOLDING_REGISTER)
+	coil, _		= mem.GetCoil(0)
+	if reg != 0 || coil {
+		t.Errorf("denied requests should not have been applied")
+	}
+
+	// requests too short to be checked should be denied as well (the
+	// server then closes the connection)
+	_, err	= client.ExecuteRaw(0x03, []byte{0x00})
+	if err == nil {
+		t.Errorf("client.ExecuteRaw() should have failed")
+	}
+
+	// ... and should be logged to the audit log
+	server.Stop()
+	if !strings.Contains(audit.String(), "denied malformed request") {
+		t.Errorf("unexpected audit log: '%s'", audit.String())
+	}
+	if strings.Count(audit.String(), "denied request") != 2 ||
+	   !strings.Contains(audit.String(), "function code: 0x06") ||
+	   !strings.Contains(audit.String(), "function code: 0x05") {
+		t.Errorf("unexpected audit log: '%s'", audit.String())
+	}
+
+	return
+}
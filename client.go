@@ -1,8 +1,10 @@
 package modbus
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -15,6 +17,7 @@ import (
 type RegType	uint
 type Endianness uint
 type WordOrder	uint
+type DeviceIdCategory uint8
 const (
 	PARITY_NONE         uint = 0
 	PARITY_EVEN         uint = 1
@@ -30,6 +33,21 @@ const (
 	// word order of 32-bit registers
 	HIGH_WORD_FIRST     WordOrder = 1
 	LOW_WORD_FIRST      WordOrder = 2
+
+	// read device identification codes (categories of objects to read)
+	DEVICE_ID_BASIC      DeviceIdCategory = 0x01 // stream access, objects 0x00-0x02
+	DEVICE_ID_REGULAR    DeviceIdCategory = 0x02 // stream access, objects 0x00-0x06
+	DEVICE_ID_EXTENDED   DeviceIdCategory = 0x03 // stream access, objects 0x00-0xff
+	DEVICE_ID_INDIVIDUAL DeviceIdCategory = 0x04 // access to a single object
+
+	// device identification object ids
+	OBJECT_ID_VENDOR_NAME           uint8 = 0x00
+	OBJECT_ID_PRODUCT_CODE          uint8 = 0x01
+	OBJECT_ID_MAJOR_MINOR_REVISION  uint8 = 0x02
+	OBJECT_ID_VENDOR_URL            uint8 = 0x03
+	OBJECT_ID_PRODUCT_NAME          uint8 = 0x04
+	OBJECT_ID_MODEL_NAME            uint8 = 0x05
+	OBJECT_ID_USER_APPLICATION_NAME uint8 = 0x06
 )
 
 // Modbus client configuration object.
@@ -47,17 +65,75 @@ type ClientConfiguration struct {
 	StopBits      uint
 	// Timeout sets the request timeout value
 	Timeout       time.Duration
+	// TurnaroundDelay sets the delay observed after sending a broadcast request
+	// (unit id 0), to give remote devices time to process it (rtu, rtuovertcp
+	// and rtuoverudp only). Defaults to 100ms.
+	TurnaroundDelay time.Duration
 	// TLSClientCert sets the client-side TLS key pair (tcp+tls only)
 	TLSClientCert *tls.Certificate
 	// TLSRootCAs sets the list of CA certificates used to authenticate
 	// the server (tcp+tls only). Leaf (i.e. server) certificates can also
 	// be used in case of self-signed certs, or if cert pinning is required.
 	TLSRootCAs    *x509.CertPool
+	// TLSCRLFiles lists certificate revocation list (CRL) files, each holding
+	// either a DER-encoded CRL or one or more PEM-encoded CRLs (tcp+tls only).
+	// Connections to servers presenting a revoked certificate are rejected.
+	TLSCRLFiles   []string
+	// TLSCRLReloadInterval sets how often CRL files are checked for changes
+	// and reloaded. Defaults to 1 minute.
+	TLSCRLReloadInterval time.Duration
+	// TLSConfig optionally sets the base TLS configuration of the client
+	// (tcp+tls only), e.g. to restrict cipher suites, require TLS 1.3, set
+	// the server name (SNI) or enable session resumption (ClientSessionCache).
+	// The configuration is cloned, then completed with TLSClientCert and
+	// TLSRootCAs, which take precedence over Certificates and RootCAs.
+	// Server certificates are always verified (InsecureSkipVerify is not
+	// allowed), TLS versions below 1.2 are never negotiated and CRL checks
+	// (see TLSCRLFiles) run after VerifyConnection.
+	TLSConfig     *tls.Config
 	// Logger provides a custom sink for log messages.
 	// If nil, messages will be written to stdout.
 	Logger        *log.Logger
 }
 
+// Raw PDU object, as returned by ExecuteRaw().
+type RawPDU struct {
+	// UnitId is the unit id (slave id) of the device which sent the PDU
+	UnitId       uint8
+	// FunctionCode is the function code of the PDU
+	FunctionCode uint8
+	// Payload holds the PDU data following the function code
+	Payload      []byte
+}
+
+// Communication event log object, as returned by GetCommEventLog().
+type CommEventLog struct {
+	// Status is 0xffff if the device is still processing a previous
+	// command, 0x0000 otherwise
+	Status       uint16
+	// EventCount is the comm event counter (see GetCommEventCounter())
+	EventCount   uint16
+	// MessageCount is the number of messages processed by the device since
+	// its last restart, clear counters operation or power-up
+	MessageCount uint16
+	// Events holds up to 64 event bytes, most recent first
+	Events       []uint8
+}
+
+// File record object, used to describe read/write file record sub-requests.
+type FileRecord struct {
+	// FileNumber is the number of the file to access (1-65535)
+	FileNumber   uint16
+	// RecordNumber is the number of the first record to access within
+	// the file (0-9999)
+	RecordNumber uint16
+	// Length is the number of consecutive 16-bit registers to read
+	// (reads only)
+	Length       uint16
+	// Data holds the 16-bit register values to write (writes only)
+	Data         []uint16
+}
+
 // Modbus client object.
 type ModbusClient struct {
 	conf          ClientConfiguration
@@ -68,6 +144,8 @@ type ModbusClient struct {
 	transport     transport
 	unitId        uint8
 	transportType transportType
+	crls          *crlStore
+	tlsConfig     *tls.Config
 }
 
 // NewClient creates, configures and returns a modbus client object.
@@ -117,6 +195,10 @@ func NewClient(conf *ClientConfiguration) (mc *ModbusClient, err error) {
 			mc.conf.Timeout = 300 * time.Millisecond
 		}
 
+		if mc.conf.TurnaroundDelay == 0 {
+			mc.conf.TurnaroundDelay = 100 * time.Millisecond
+		}
+
 		mc.transportType    = modbusRTU
 
 	case "rtuovertcp":
@@ -128,6 +210,10 @@ func NewClient(conf *ClientConfiguration) (mc *ModbusClient, err error) {
 			mc.conf.Timeout = 1 * time.Second
 		}
 
+		if mc.conf.TurnaroundDelay == 0 {
+			mc.conf.TurnaroundDelay = 100 * time.Millisecond
+		}
+
 		mc.transportType    = modbusRTUOverTCP
 
 	case "rtuoverudp":
@@ -139,6 +225,10 @@ func NewClient(conf *ClientConfiguration) (mc *ModbusClient, err error) {
 			mc.conf.Timeout = 1 * time.Second
 		}
 
+		if mc.conf.TurnaroundDelay == 0 {
+			mc.conf.TurnaroundDelay = 100 * time.Millisecond
+		}
+
 		mc.transportType    = modbusRTUOverUDP
 
 	case "tcp":
@@ -153,19 +243,25 @@ func NewClient(conf *ClientConfiguration) (mc *ModbusClient, err error) {
 			mc.conf.Timeout = 1 * time.Second
 		}
 
-		// expect a client-side certificate for mutual auth as the
-		// modbus/mpab protocol has no inherent auth facility.
-		// (see requirements R-08 and R-19 of the MBAPS spec)
-		if mc.conf.TLSClientCert == nil {
-			mc.logger.Errorf("missing client certificate")
-			err = ErrConfigurationError
-			return
+		// load certificate revocation lists, if any
+		if len(mc.conf.TLSCRLFiles) > 0 {
+			if mc.conf.TLSCRLReloadInterval == 0 {
+				mc.conf.TLSCRLReloadInterval = 1 * time.Minute
+			}
+
+			mc.crls, err = newCRLStore(mc.conf.TLSCRLFiles,
+				mc.conf.TLSCRLReloadInterval, mc.logger)
+			if err != nil {
+				mc.logger.Errorf("failed to load CRLs: %v", err)
+				err = ErrConfigurationError
+				return
+			}
 		}
 
-		// expect a CertPool object containing at least 1 CA or
-		// leaf certificate to validate the server-side cert
-		if mc.conf.TLSRootCAs == nil {
-			mc.logger.Errorf("missing CA/server certificate")
+		// build the TLS configuration used by Open()
+		mc.tlsConfig, err = mc.buildTLSConfig()
+		if err != nil {
+			mc.logger.Errorf("%v", err)
 			err = ErrConfigurationError
 			return
 		}
@@ -272,16 +368,9 @@ func (mc *ModbusClient) Open() (err error) {
 		sock, err = tls.DialWithDialer(
 			&net.Dialer{
 				Deadline: time.Now().Add(15 * time.Second),
-			}, "tcp", mc.conf.URL,
-			&tls.Config{
-				Certificates: []tls.Certificate{
-					*mc.conf.TLSClientCert,
-				},
-				RootCAs:     mc.conf.TLSRootCAs,
-				// mandate TLS 1.2 or higher (see R-01 of the MBAPS spec)
-				MinVersion:  tls.VersionTLS12,
-			})
+			}, "tcp", mc.conf.URL, mc.tlsConfig)
 		if err != nil {
+			mc.logger.Warningf("TLS connection to %s failed: %v", mc.conf.URL, err)
 			return
 		}
 
@@ -590,6 +679,11 @@ func (mc *ModbusClient) WriteCoil(addr uint16, value bool) (err error) {
 		return
 	}
 
+	// broadcasts are never answered
+	if res == nil {
+		return
+	}
+
 	// validate the response code
 	switch {
 	case res.functionCode == req.functionCode:
@@ -673,6 +767,11 @@ func (mc *ModbusClient) WriteCoils(addr uint16, values []bool) (err error) {
 		return
 	}
 
+	// broadcasts are never answered
+	if res == nil {
+		return
+	}
+
 	// validate the response code
 	switch {
 	case res.functionCode == req.functionCode:
@@ -727,6 +826,11 @@ func (mc *ModbusClient) WriteRegister(addr uint16, value uint16) (err error) {
 		return
 	}
 
+	// broadcasts are never answered
+	if res == nil {
+		return
+	}
+
 	// validate the response code
 	switch {
 	case res.functionCode == req.functionCode:
@@ -873,99 +977,98 @@ func (mc *ModbusClient) WriteRawBytes(addr uint16, values []byte) (err error) {
 	return
 }
 
-/*** unexported methods ***/
-// Reads one or multiple 16-bit registers (function code 03 or 04) as bytes.
-func (mc *ModbusClient) readBytes(addr uint16, quantity uint16, regType RegType, observeEndianness bool) (values []byte, err error) {
-	var regCount uint16
+// Writes multiple 16-bit holding registers then reads multiple 16-bit
+// holding registers in a single transaction (function code 23).
+// The write operation is performed before the read.
+func (mc *ModbusClient) ReadWriteRegisters(readAddr uint16, readQuantity uint16,
+	writeAddr uint16, values []uint16) (readValues []uint16, err error) {
+	var payload	[]byte
+	var mbPayload	[]byte
 
-	// read enough registers to get the requested number of bytes
-	// (2 bytes per reg)
-	regCount = (quantity / 2) + (quantity % 2)
+	// turn registers to bytes
+	for _, value := range values {
+		payload	= append(payload, uint16ToBytes(mc.endianness, value)...)
+	}
 
-	values, err = mc.readRegisters(addr, regCount, regType)
+	mbPayload, err	= mc.readWriteRegisters(readAddr, readQuantity, writeAddr, payload)
 	if err != nil {
 		return
 	}
 
-	// swap bytes on register boundaries if requested by the caller
-	// and endianness is set to little endian
-	if observeEndianness && mc.endianness == LITTLE_ENDIAN {
-		for i := 0; i < len(values); i += 2 {
-			values[i], values[i+1] = values[i+1], values[i]
-		}
+	// decode payload bytes as uint16s
+	readValues	= bytesToUint16s(mc.endianness, mbPayload)
+
+	return
+}
+
+// Writes multiple 32-bit registers then reads multiple 32-bit registers
+// in a single transaction (function code 23).
+func (mc *ModbusClient) ReadWriteUint32s(readAddr uint16, readQuantity uint16,
+	writeAddr uint16, values []uint32) (readValues []uint32, err error) {
+	var payload	[]byte
+	var mbPayload	[]byte
+
+	// turn registers to bytes
+	for _, value := range values {
+		payload	= append(payload, uint32ToBytes(mc.endianness, mc.wordOrder, value)...)
 	}
 
-	// pop the last byte on odd quantities
-	if quantity % 2 == 1 {
-		values = values[0:len(values) - 1]
+	// read 2 * readQuantity uint16 registers, as bytes
+	mbPayload, err	= mc.readWriteRegisters(readAddr, readQuantity * 2, writeAddr, payload)
+	if err != nil {
+		return
 	}
 
+	// decode payload bytes as uint32s
+	readValues	= bytesToUint32s(mc.endianness, mc.wordOrder, mbPayload)
+
 	return
 }
 
-// Writes the given slice of bytes to 16-bit registers starting at addr.
-func (mc *ModbusClient) writeBytes(addr uint16, values []byte, observeEndianness bool) (err error) {
-	// pad odd quantities to make for full registers
-	if len(values) % 2 == 1 {
-		values = append(values, 0x00)
+// Writes multiple 32-bit float registers then reads multiple 32-bit float
+// registers in a single transaction (function code 23).
+func (mc *ModbusClient) ReadWriteFloat32s(readAddr uint16, readQuantity uint16,
+	writeAddr uint16, values []float32) (readValues []float32, err error) {
+	var payload	[]byte
+	var mbPayload	[]byte
+
+	// turn registers to bytes
+	for _, value := range values {
+		payload	= append(payload, float32ToBytes(mc.endianness, mc.wordOrder, value)...)
 	}
 
-	// swap bytes on register boundaries if requested by the caller
-	// and endianness is set to little endian
-	if observeEndianness && mc.endianness == LITTLE_ENDIAN {
-		for i := 0; i < len(values); i += 2 {
-			values[i], values[i+1] = values[i+1], values[i]
-		}
+	// read 2 * readQuantity uint16 registers, as bytes
+	mbPayload, err	= mc.readWriteRegisters(readAddr, readQuantity * 2, writeAddr, payload)
+	if err != nil {
+		return
 	}
 
-	err = mc.writeRegisters(addr, values)
+	// decode payload bytes as float32s
+	readValues	= bytesToFloat32s(mc.endianness, mc.wordOrder, mbPayload)
 
 	return
 }
 
-// Reads and returns quantity booleans.
-// Digital inputs are read if di is true, otherwise coils are read.
-func (mc *ModbusClient) readBools(addr uint16, quantity uint16, di bool) (values []bool, err error) {
+// Reads the contents of a FIFO queue of 16-bit registers (function code 24).
+// addr is the address of the FIFO pointer register. Up to 31 queued register
+// values are returned, in queue order.
+func (mc *ModbusClient) ReadFIFOQueue(addr uint16) (values []uint16, err error) {
 	var req		*pdu
 	var res		*pdu
-	var expectedLen	int
+	var byteCount	uint16
+	var fifoCount	uint16
 
 	mc.lock.Lock()
 	defer mc.lock.Unlock()
 
-	if quantity == 0 {
-		err	= ErrUnexpectedParameters
-		mc.logger.Error("quantity of coils/discrete inputs is 0")
-		return
-	}
-
-	if quantity > 2000 {
-		err	= ErrUnexpectedParameters
-		mc.logger.Error("quantity of coils/discrete inputs exceeds 2000")
-		return
-	}
-
-	if uint32(addr) + uint32(quantity) - 1 > 0xffff {
-		err	= ErrUnexpectedParameters
-		mc.logger.Error("end coil/discrete input address is past 0xffff")
-		return
-	}
-
 	// create and fill in the request object
 	req	= &pdu{
-		unitId:	mc.unitId,
-	}
-
-	if di {
-		req.functionCode = fcReadDiscreteInputs
-	} else {
-		req.functionCode = fcReadCoils
+		unitId:	      mc.unitId,
+		functionCode: fcReadFifoQueue,
 	}
 
-	// start address
+	// FIFO pointer address
 	req.payload	= uint16ToBytes(BIG_ENDIAN, addr)
-	// quantity
-	req.payload	= append(req.payload, uint16ToBytes(BIG_ENDIAN, quantity)...)
 
 	// run the request across the transport and wait for a response
 	res, err	= mc.executeRequest(req)
@@ -976,27 +1079,31 @@ func (mc *ModbusClient) readBools(addr uint16, quantity uint16, di bool) (values
 	// validate the response code
 	switch {
 	case res.functionCode == req.functionCode:
-		// expect a payload of 1 byte (byte count) + 1 byte for 8 coils/discrete inputs)
-		expectedLen	= 1
-		expectedLen	+= int(quantity) / 8
-		if quantity % 8 != 0 {
-			expectedLen++
+		// expect at least 4 bytes (2 bytes of byte count + 2 bytes of FIFO count)
+		if len(res.payload) < 4 {
+			err = ErrProtocolError
+			return
 		}
 
-		if len(res.payload) != expectedLen {
+		byteCount	= bytesToUint16(BIG_ENDIAN, res.payload[0:2])
+		fifoCount	= bytesToUint16(BIG_ENDIAN, res.payload[2:4])
+
+		// the queue count should never exceed 31
+		if fifoCount > 31 {
 			err = ErrProtocolError
 			return
 		}
 
-		// validate the byte count field
-		if int(res.payload[0]) + 1 != expectedLen {
+		// the byte count field should cover the FIFO count field and
+		// 2 bytes per register, as well as the rest of the payload
+		if int(byteCount) != 2 + 2 * int(fifoCount) ||
+		   len(res.payload) != 2 + int(byteCount) {
 			err = ErrProtocolError
 			return
 		}
 
-		// turn bits into a bool slice
-		values = decodeBools(quantity, res.payload[1:])
-
+		// decode payload bytes as uint16s
+		values	= bytesToUint16s(mc.endianness, res.payload[4:])
 
 	case res.functionCode == (req.functionCode | 0x80):
 		if len(res.payload) != 1 {
@@ -1014,50 +1121,65 @@ func (mc *ModbusClient) readBools(addr uint16, quantity uint16, di bool) (values
 	return
 }
 
-// Reads and returns quantity registers of type regType, as bytes.
-func (mc *ModbusClient) readRegisters(addr uint16, quantity uint16, regType RegType) (bytes []byte, err error) {
+// Reads one or multiple groups of file records (function code 20).
+// Each record object describes a sub-request by file number, record number
+// and length (in 16-bit registers). The returned slice holds one slice of
+// register values per sub-request, in request order.
+func (mc *ModbusClient) ReadFileRecords(records []FileRecord) (values [][]uint16, err error) {
 	var req		*pdu
 	var res		*pdu
+	var resLength	int
+	var subResLen	int
+	var offset	int
 
 	mc.lock.Lock()
 	defer mc.lock.Unlock()
 
-	// create and fill in the request object
-	req	= &pdu{
-		unitId:	mc.unitId,
-	}
-
-	switch regType {
-	case HOLDING_REGISTER: req.functionCode = fcReadHoldingRegisters
-	case INPUT_REGISTER:   req.functionCode = fcReadInputRegisters
-	default:
-		err = ErrUnexpectedParameters
-		mc.logger.Errorf("unexpected register type (%v)", regType)
+	if len(records) == 0 {
+		err	= ErrUnexpectedParameters
+		mc.logger.Error("no file record to read")
 		return
 	}
 
-	if quantity == 0 {
-		err = ErrUnexpectedParameters
-		mc.logger.Error("quantity of registers is 0")
-		return
+	// create and fill in the request object
+	req	= &pdu{
+		unitId:	      mc.unitId,
+		functionCode: fcReadFileRecord,
+		payload:      []byte{0},
 	}
 
-	if quantity > 125 {
-		err = ErrUnexpectedParameters
-		mc.logger.Error("quantity of registers exceeds 125")
-		return
-	}
+	for _, record := range records {
+		err	= mc.validateFileRecord(&record, record.Length)
+		if err != nil {
+			return
+		}
 
-	if uint32(addr) + uint32(quantity) - 1 > 0xffff {
-		err = ErrUnexpectedParameters
-		mc.logger.Error("end register address is past 0xffff")
+		// reference type (always 6)
+		req.payload	= append(req.payload, 0x06)
+		// file number
+		req.payload	= append(req.payload,
+					 uint16ToBytes(BIG_ENDIAN, record.FileNumber)...)
+		// record number
+		req.payload	= append(req.payload,
+					 uint16ToBytes(BIG_ENDIAN, record.RecordNumber)...)
+		// record length
+		req.payload	= append(req.payload,
+					 uint16ToBytes(BIG_ENDIAN, record.Length)...)
+
+		// each sub-response takes 2 bytes (length and reference type)
+		// + 2 bytes per register
+		resLength	+= 2 + 2 * int(record.Length)
+	}
+
+	// make sure both the request and the response fit in a PDU
+	if len(req.payload) - 1 > 0xf5 || resLength > 0xf5 {
+		err	= ErrUnexpectedParameters
+		mc.logger.Error("file record request or response too long")
 		return
 	}
 
-	// start address
-	req.payload	= uint16ToBytes(BIG_ENDIAN, addr)
-	// quantity
-	req.payload	= append(req.payload, uint16ToBytes(BIG_ENDIAN, quantity)...)
+	// byte count
+	req.payload[0]	= byte(len(req.payload) - 1)
 
 	// run the request across the transport and wait for a response
 	res, err	= mc.executeRequest(req)
@@ -1069,21 +1191,32 @@ func (mc *ModbusClient) readRegisters(addr uint16, quantity uint16, regType RegT
 	switch {
 	case res.functionCode == req.functionCode:
 		// make sure the payload length is what we expect
-		// (1 byte of length + 2 bytes per register)
-		if len(res.payload) != 1 + 2 * int(quantity) {
+		// (1 byte of response data length + sub-responses)
+		if len(res.payload) != 1 + resLength ||
+		   int(res.payload[0]) != resLength {
 			err = ErrProtocolError
 			return
 		}
 
-		// validate the byte count field
-		// (2 bytes per register * number of registers)
-		if uint(res.payload[0]) != 2 * uint(quantity) {
-			err = ErrProtocolError
-			return
-		}
+		// walk through sub-responses
+		offset	= 1
+		for _, record := range records {
+			subResLen	= 1 + 2 * int(record.Length)
+
+			// validate the file response length and reference type fields
+			if int(res.payload[offset]) != subResLen ||
+			   res.payload[offset + 1] != 0x06 {
+				err	= ErrProtocolError
+				values	= nil
+				return
+			}
 
-		// remove the byte count field from the returned slice
-		bytes	= res.payload[1:]
+			// decode record data as uint16s
+			values	= append(values, bytesToUint16s(mc.endianness,
+					 res.payload[offset + 2:offset + 1 + subResLen]))
+
+			offset	+= 1 + subResLen
+		}
 
 	case res.functionCode == (req.functionCode | 0x80):
 		if len(res.payload) != 1 {
@@ -1101,52 +1234,69 @@ func (mc *ModbusClient) readRegisters(addr uint16, quantity uint16, regType RegT
 	return
 }
 
-// Writes multiple registers starting from base address addr.
-// Register values are passed as bytes, each value being exactly 2 bytes.
-func (mc *ModbusClient) writeRegisters(addr uint16, values []byte) (err error) {
-	var req           *pdu
-	var res           *pdu
-	var payloadLength uint16
-	var quantity      uint16
+// Writes one or multiple groups of file records (function code 21).
+// Each record object describes a sub-request by file number, record number
+// and data (the record length being that of the data slice).
+func (mc *ModbusClient) WriteFileRecords(records []FileRecord) (err error) {
+	var req		*pdu
+	var res		*pdu
 
 	mc.lock.Lock()
 	defer mc.lock.Unlock()
 
-	payloadLength = uint16(len(values))
-	quantity      = payloadLength / 2
-
-	if quantity == 0 {
-		err = ErrUnexpectedParameters
-		mc.logger.Error("quantity of registers is 0")
-		return
-	}
-
-	if quantity > 123 {
-		err = ErrUnexpectedParameters
-		mc.logger.Error("quantity of registers exceeds 123")
-		return
-	}
-
-	if uint32(addr) + uint32(quantity) - 1 > 0xffff {
-		err = ErrUnexpectedParameters
-		mc.logger.Error("end register address is past 0xffff")
+	if len(records) == 0 {
+		err	= ErrUnexpectedParameters
+		mc.logger.Error("no file record to write")
 		return
 	}
 
 	// create and fill in the request object
 	req	= &pdu{
 		unitId:	      mc.unitId,
-		functionCode: fcWriteMultipleRegisters,
+		functionCode: fcWriteFileRecord,
+		payload:      []byte{0},
 	}
 
-	// base address
-	req.payload	= uint16ToBytes(BIG_ENDIAN, addr)
-	// quantity of registers (2 bytes per register)
-	req.payload	= append(req.payload, uint16ToBytes(BIG_ENDIAN, quantity)...)
-	// byte count
-	req.payload	= append(req.payload, byte(payloadLength))
-	// registers value
-	req.payload	= append(req.payload, values...)
+	for _, record := range records {
+		if len(record.Data) > 0xffff {
+			err	= ErrUnexpectedParameters
+			mc.logger.Error("file record data too long")
+			return
+		}
+
+		err	= mc.validateFileRecord(&record, uint16(len(record.Data)))
+		if err != nil {
+			return
+		}
+
+		// reference type (always 6)
+		req.payload	= append(req.payload, 0x06)
+		// file number
+		req.payload	= append(req.payload,
+					 uint16ToBytes(BIG_ENDIAN, record.FileNumber)...)
+		// record number
+		req.payload	= append(req.payload,
+					 uint16ToBytes(BIG_ENDIAN, record.RecordNumber)...)
+		// record length
+		req.payload	= append(req.payload,
+					 uint16ToBytes(BIG_ENDIAN, uint16(len(record.Data)))...)
+
+		// record data
+		for _, value := range record.Data {
+			req.payload	= append(req.payload,
+						 uint16ToBytes(mc.endianness, value)...)
+		}
+
+		// make sure the request fits in a PDU
+		if len(req.payload) - 1 > 0xfb {
+			err	= ErrUnexpectedParameters
+			mc.logger.Error("file record request too long")
+			return
+		}
+	}
+
+	// request data length
+	req.payload[0]	= byte(len(req.payload) - 1)
 
 	// run the request across the transport and wait for a response
 	res, err	= mc.executeRequest(req)
@@ -1154,18 +1304,19 @@ func (mc *ModbusClient) writeRegisters(addr uint16, values []byte) (err error) {
 		return
 	}
 
+	// broadcasts are never answered
+	if res == nil {
+		return
+	}
+
 	// validate the response code
 	switch {
 	case res.functionCode == req.functionCode:
-		// expect 4 bytes (2 byte of address + 2 bytes of quantity)
-		if len(res.payload) != 4 ||
-		   // bytes 1-2 should be the base register address
-		   bytesToUint16(BIG_ENDIAN, res.payload[0:2]) != addr ||
-		   // bytes 3-4 should be the quantity of registers (2 bytes per register)
-		   bytesToUint16(BIG_ENDIAN, res.payload[2:4]) != quantity {
-			   err = ErrProtocolError
-			   return
-		   }
+		// the response should be an echo of the request
+		if !bytes.Equal(res.payload, req.payload) {
+			err = ErrProtocolError
+			return
+		}
 
 	case res.functionCode == (req.functionCode | 0x80):
 		if len(res.payload) != 1 {
@@ -1183,12 +1334,1277 @@ func (mc *ModbusClient) writeRegisters(addr uint16, values []byte) (err error) {
 	return
 }
 
-func (mc *ModbusClient) executeRequest(req *pdu) (res *pdu, err error) {
-	// send the request over the wire, wait for and decode the response
-	res, err	= mc.transport.ExecuteRequest(req)
-	if err != nil {
-		// map i/o timeouts to ErrRequestTimedOut
-		if os.IsTimeout(err) {
+// Reads device identification objects (function code 43 / MEI type 14).
+// category selects either one of the stream access categories (DEVICE_ID_BASIC,
+// DEVICE_ID_REGULAR or DEVICE_ID_EXTENDED), in which case objectId is the id
+// of the first object to read, or individual access (DEVICE_ID_INDIVIDUAL).
+// When the server needs more than one response to send all objects of the
+// requested category, as many requests as necessary are made.
+// Objects are returned as a map of object ids to object values.
+func (mc *ModbusClient) ReadDeviceIdentification(category DeviceIdCategory, objectId uint8) (
+	objects map[uint8]string, err error) {
+	var req		*pdu
+	var res		*pdu
+	var moreFollows	bool
+	var nextId	uint8
+	var objCount	int
+	var objLen	int
+	var offset	int
+
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	if category < DEVICE_ID_BASIC || category > DEVICE_ID_INDIVIDUAL {
+		err	= ErrUnexpectedParameters
+		mc.logger.Errorf("unexpected device id category (%v)", category)
+		return
+	}
+
+	objects	= make(map[uint8]string)
+	nextId	= objectId
+
+	// there are at most 256 objects, hence as many transactions
+	for txnCount := 0; ; txnCount++ {
+		if txnCount == 256 {
+			err	= ErrProtocolError
+			objects	= nil
+			mc.logger.Error("too many device identification transactions")
+			return
+		}
+
+		// create and fill in the request object
+		req	= &pdu{
+			unitId:	      mc.unitId,
+			functionCode: fcEncapsulatedInterface,
+			payload:      []byte{
+				meiReadDeviceIdentification, uint8(category), nextId,
+			},
+		}
+
+		// run the request across the transport and wait for a response
+		res, err	= mc.executeRequest(req)
+		if err != nil {
+			objects	= nil
+			return
+		}
+
+		// validate the response code
+		switch {
+		case res.functionCode == req.functionCode:
+			// expect at least 6 bytes (MEI type, read device id code,
+			// conformity level, more follows, next object id and
+			// number of objects)
+			if len(res.payload) < 6 ||
+			   res.payload[0] != meiReadDeviceIdentification ||
+			   res.payload[1] != uint8(category) {
+				err	= ErrProtocolError
+				break
+			}
+
+			moreFollows	= (res.payload[3] == 0xff)
+			nextId		= res.payload[4]
+			objCount	= int(res.payload[5])
+
+			// decode objects: 1 byte of object id, 1 byte of length
+			// and length bytes of value per object
+			offset		= 6
+			for i := 0; i < objCount && err == nil; i++ {
+				if len(res.payload) < offset + 2 {
+					err	= ErrProtocolError
+					break
+				}
+
+				objLen	= int(res.payload[offset + 1])
+				if len(res.payload) < offset + 2 + objLen {
+					err	= ErrProtocolError
+					break
+				}
+
+				objects[res.payload[offset]] =
+					string(res.payload[offset + 2:offset + 2 + objLen])
+				offset	+= 2 + objLen
+			}
+
+			// make sure there's no trailing data
+			if err == nil && offset != len(res.payload) {
+				err	= ErrProtocolError
+			}
+
+			// more follows is only allowed in stream access mode and
+			// the server must make progress, otherwise we'd loop forever
+			if err == nil && moreFollows &&
+			   (category == DEVICE_ID_INDIVIDUAL || objCount == 0) {
+				err	= ErrProtocolError
+			}
+
+		case res.functionCode == (req.functionCode | 0x80):
+			if len(res.payload) != 1 {
+				err	= ErrProtocolError
+				break
+			}
+
+			err	= mapExceptionCodeToError(res.payload[0])
+
+		default:
+			err	= ErrProtocolError
+			mc.logger.Warningf("unexpected response code (%v)", res.functionCode)
+		}
+
+		if err != nil {
+			objects	= nil
+			return
+		}
+
+		// stop once the server has sent all objects
+		if !moreFollows {
+			break
+		}
+	}
+
+	return
+}
+
+// Modifies the contents of a single 16-bit holding register using a combination
+// of an AND mask and an OR mask (function code 22).
+// The server computes the new register value as
+// (current value AND andMask) OR (orMask AND (NOT andMask)), in a single transaction.
+func (mc *ModbusClient) MaskWriteRegister(addr uint16, andMask uint16, orMask uint16) (err error) {
+	var req		*pdu
+	var res		*pdu
+
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	// create and fill in the request object
+	req	= &pdu{
+		unitId:	      mc.unitId,
+		functionCode: fcMaskWriteRegister,
+	}
+
+	// register address
+	req.payload	= uint16ToBytes(BIG_ENDIAN, addr)
+	// AND mask
+	req.payload	= append(req.payload, uint16ToBytes(mc.endianness, andMask)...)
+	// OR mask
+	req.payload	= append(req.payload, uint16ToBytes(mc.endianness, orMask)...)
+
+	// run the request across the transport and wait for a response
+	res, err	= mc.executeRequest(req)
+	if err != nil {
+		return
+	}
+
+	// broadcasts are never answered
+	if res == nil {
+		return
+	}
+
+	// validate the response code
+	switch {
+	case res.functionCode == req.functionCode:
+		// expect 6 bytes (2 bytes of address + 2 bytes of AND mask +
+		// 2 bytes of OR mask), echoing those of the request
+		if len(res.payload) != 6 ||
+		   // bytes 1-2 should be the register address
+		   bytesToUint16(BIG_ENDIAN, res.payload[0:2]) != addr ||
+		   // bytes 3-4 should be the AND mask
+		   bytesToUint16(mc.endianness, res.payload[2:4]) != andMask ||
+		   // bytes 5-6 should be the OR mask
+		   bytesToUint16(mc.endianness, res.payload[4:6]) != orMask {
+			   err = ErrProtocolError
+			   return
+		   }
+
+	case res.functionCode == (req.functionCode | 0x80):
+		if len(res.payload) != 1 {
+			err	= ErrProtocolError
+			return
+		}
+
+		err	= mapExceptionCodeToError(res.payload[0])
+
+	default:
+		err	= ErrProtocolError
+		mc.logger.Warningf("unexpected response code (%v)", res.functionCode)
+	}
+
+	return
+}
+
+// Reads the 8 exception status bits of the remote device (function code 07).
+// The meaning of each bit is device specific.
+func (mc *ModbusClient) ReadExceptionStatus() (status uint8, err error) {
+	var req		*pdu
+	var res		*pdu
+
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	// create and fill in the request object
+	req	= &pdu{
+		unitId:       mc.unitId,
+		functionCode: fcReadExceptionStatus,
+	}
+
+	// run the request across the transport and wait for a response
+	res, err	= mc.executeRequest(req)
+	if err != nil {
+		return
+	}
+
+	// validate the response code
+	switch {
+	case res.functionCode == req.functionCode:
+		// expect a single byte of status
+		if len(res.payload) != 1 {
+			err	= ErrProtocolError
+			return
+		}
+
+		status	= res.payload[0]
+
+	case res.functionCode == (req.functionCode | 0x80):
+		if len(res.payload) != 1 {
+			err	= ErrProtocolError
+			return
+		}
+
+		err	= mapExceptionCodeToError(res.payload[0])
+
+	default:
+		err	= ErrProtocolError
+		mc.logger.Warningf("unexpected response code (%v)", res.functionCode)
+	}
+
+	return
+}
+
+// Reads the server id and run indicator status of the remote device
+// (function code 0x11).
+// The contents of the server id are device specific. The run indicator status
+// is expected as the last byte of the response, with all preceding bytes
+// returned as-is in id (including any additional device specific data).
+func (mc *ModbusClient) ReportServerID() (id []byte, running bool, err error) {
+	var req		*pdu
+	var res		*pdu
+
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	// create and fill in the request object
+	req	= &pdu{
+		unitId:       mc.unitId,
+		functionCode: fcReportServerId,
+	}
+
+	// run the request across the transport and wait for a response
+	res, err	= mc.executeRequest(req)
+	if err != nil {
+		return
+	}
+
+	// validate the response code
+	switch {
+	case res.functionCode == req.functionCode:
+		// expect 1 byte of byte count followed by at least 1 byte
+		// of run indicator status
+		if len(res.payload) < 2 ||
+		   int(res.payload[0]) != len(res.payload) - 1 {
+			err	= ErrProtocolError
+			return
+		}
+
+		// the run indicator status is either 0x00 (off) or 0xff (on)
+		switch res.payload[len(res.payload) - 1] {
+		case 0x00:	running	= false
+		case 0xff:	running	= true
+		default:
+			err	= ErrProtocolError
+			return
+		}
+
+		id	= res.payload[1:len(res.payload) - 1]
+
+	case res.functionCode == (req.functionCode | 0x80):
+		if len(res.payload) != 1 {
+			err	= ErrProtocolError
+			return
+		}
+
+		err	= mapExceptionCodeToError(res.payload[0])
+
+	default:
+		err	= ErrProtocolError
+		mc.logger.Warningf("unexpected response code (%v)", res.functionCode)
+	}
+
+	return
+}
+
+// Sends data to the remote device and expects it to be echoed back
+// (diagnostics function code 08, sub-function 00: return query data).
+// data holds between 1 and 125 words of arbitrary content.
+func (mc *ModbusClient) ReturnQueryData(data []uint16) (err error) {
+	var query	[]byte
+	var echo	[]byte
+
+	if len(data) == 0 {
+		err	= ErrUnexpectedParameters
+		mc.logger.Error("no query data to send")
+		return
+	}
+
+	// the PDU (function code + sub-function + data) must not exceed 253 bytes
+	if len(data) > 125 {
+		err	= ErrUnexpectedParameters
+		mc.logger.Error("quantity of query data words exceeds 125")
+		return
+	}
+
+	query		= uint16sToBytes(BIG_ENDIAN, data)
+
+	echo, err	= mc.executeDiagnostics(diagReturnQueryData, query)
+	if err != nil {
+		return
+	}
+
+	if !bytes.Equal(echo, query) {
+		mc.logger.Warningf("loopback data mismatch (sent 0x%x, got 0x%x)",
+				   query, echo)
+		err	= ErrProtocolError
+	}
+
+	return
+}
+
+// Restarts the communications port of the remote device, clearing its
+// diagnostic counters and, if clearEventLog is true, its comm event log
+// (diagnostics function code 08, sub-function 01).
+// This also brings the device out of listen only mode, in which case it will
+// not respond: use a short timeout or expect ErrRequestTimedOut.
+func (mc *ModbusClient) RestartCommunications(clearEventLog bool) (err error) {
+	var data	uint16
+
+	if clearEventLog {
+		data	= 0xff00
+	}
+
+	_, err	= mc.diagnostics(diagRestartCommunications, data)
+
+	return
+}
+
+// Returns the contents of the diagnostic register of the remote device
+// (diagnostics function code 08, sub-function 02).
+func (mc *ModbusClient) ReturnDiagnosticRegister() (value uint16, err error) {
+	value, err	= mc.diagnostics(diagReturnDiagnosticRegister, 0x0000)
+
+	return
+}
+
+// Forces the remote device into listen only mode, in which it will neither act
+// upon nor respond to any request until a RestartCommunications() request is
+// received (diagnostics function code 08, sub-function 04).
+// No response is expected from the device.
+func (mc *ModbusClient) ForceListenOnlyMode() (err error) {
+	var req		*pdu
+
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	// create and fill in the request object
+	req	= &pdu{
+		unitId:       mc.unitId,
+		functionCode: fcDiagnostics,
+	}
+
+	// sub-function
+	req.payload	= uint16ToBytes(BIG_ENDIAN, diagForceListenOnlyMode)
+	// data
+	req.payload	= append(req.payload, 0x00, 0x00)
+
+	// send the request, no response being expected
+	_, err	= mc.executeRequest(req)
+
+	return
+}
+
+// Clears all diagnostic counters and the diagnostic register of the remote
+// device (diagnostics function code 08, sub-function 0x0a).
+func (mc *ModbusClient) ClearCounters() (err error) {
+	_, err	= mc.diagnostics(diagClearCounters, 0x0000)
+
+	return
+}
+
+// Returns the number of messages detected on the bus by the remote device
+// (diagnostics function code 08, sub-function 0x0b).
+func (mc *ModbusClient) ReturnBusMessageCount() (count uint16, err error) {
+	count, err	= mc.diagnostics(diagReturnBusMessageCount, 0x0000)
+
+	return
+}
+
+// Returns the number of CRC errors encountered by the remote device
+// (diagnostics function code 08, sub-function 0x0c).
+func (mc *ModbusClient) ReturnBusCommErrorCount() (count uint16, err error) {
+	count, err	= mc.diagnostics(diagReturnBusCommErrorCount, 0x0000)
+
+	return
+}
+
+// Returns the number of exception responses returned by the remote device
+// (diagnostics function code 08, sub-function 0x0d).
+func (mc *ModbusClient) ReturnBusExceptionErrorCount() (count uint16, err error) {
+	count, err	= mc.diagnostics(diagReturnBusExceptionCount, 0x0000)
+
+	return
+}
+
+// Returns the number of messages addressed to and processed by the remote device
+// (diagnostics function code 08, sub-function 0x0e).
+func (mc *ModbusClient) ReturnServerMessageCount() (count uint16, err error) {
+	count, err	= mc.diagnostics(diagReturnServerMessageCount, 0x0000)
+
+	return
+}
+
+// Returns the number of messages addressed to the remote device for which it
+// returned no response (diagnostics function code 08, sub-function 0x0f).
+func (mc *ModbusClient) ReturnServerNoResponseCount() (count uint16, err error) {
+	count, err	= mc.diagnostics(diagReturnServerNoResponseCount, 0x0000)
+
+	return
+}
+
+// Returns the number of negative acknowledge exceptions returned by the remote
+// device (diagnostics function code 08, sub-function 0x10).
+func (mc *ModbusClient) ReturnServerNAKCount() (count uint16, err error) {
+	count, err	= mc.diagnostics(diagReturnServerNAKCount, 0x0000)
+
+	return
+}
+
+// Returns the number of server device busy exceptions returned by the remote
+// device (diagnostics function code 08, sub-function 0x11).
+func (mc *ModbusClient) ReturnServerBusyCount() (count uint16, err error) {
+	count, err	= mc.diagnostics(diagReturnServerBusyCount, 0x0000)
+
+	return
+}
+
+// Returns the number of messages the remote device could not handle due to
+// character overruns (diagnostics function code 08, sub-function 0x12).
+func (mc *ModbusClient) ReturnBusCharOverrunCount() (count uint16, err error) {
+	count, err	= mc.diagnostics(diagReturnBusCharOverrunCount, 0x0000)
+
+	return
+}
+
+// Clears the character overrun counter of the remote device
+// (diagnostics function code 08, sub-function 0x14).
+func (mc *ModbusClient) ClearOverrunCounter() (err error) {
+	_, err	= mc.diagnostics(diagClearOverrunCounter, 0x0000)
+
+	return
+}
+
+// Returns the status word (0xffff if the device is still processing a previous
+// command, 0x0000 otherwise) and comm event counter of the remote device
+// (function code 0x0b).
+// The event counter is incremented once per successfully completed request.
+func (mc *ModbusClient) GetCommEventCounter() (status uint16, eventCount uint16, err error) {
+	var req		*pdu
+	var res		*pdu
+
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	// create and fill in the request object
+	req	= &pdu{
+		unitId:       mc.unitId,
+		functionCode: fcGetCommEventCounter,
+	}
+
+	// run the request across the transport and wait for a response
+	res, err	= mc.executeRequest(req)
+	if err != nil {
+		return
+	}
+
+	// validate the response code
+	switch {
+	case res.functionCode == req.functionCode:
+		// expect 4 bytes (2 bytes of status + 2 bytes of event count)
+		if len(res.payload) != 4 {
+			err	= ErrProtocolError
+			return
+		}
+
+		status		= bytesToUint16(BIG_ENDIAN, res.payload[0:2])
+		eventCount	= bytesToUint16(BIG_ENDIAN, res.payload[2:4])
+
+	case res.functionCode == (req.functionCode | 0x80):
+		if len(res.payload) != 1 {
+			err	= ErrProtocolError
+			return
+		}
+
+		err	= mapExceptionCodeToError(res.payload[0])
+
+	default:
+		err	= ErrProtocolError
+		mc.logger.Warningf("unexpected response code (%v)", res.functionCode)
+	}
+
+	return
+}
+
+// Returns the comm event log of the remote device (function code 0x0c).
+func (mc *ModbusClient) GetCommEventLog() (eventLog *CommEventLog, err error) {
+	var req		*pdu
+	var res		*pdu
+
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	// create and fill in the request object
+	req	= &pdu{
+		unitId:       mc.unitId,
+		functionCode: fcGetCommEventLog,
+	}
+
+	// run the request across the transport and wait for a response
+	res, err	= mc.executeRequest(req)
+	if err != nil {
+		return
+	}
+
+	// validate the response code
+	switch {
+	case res.functionCode == req.functionCode:
+		// expect 1 byte of byte count, 6 bytes of status, event count and
+		// message count, then up to 64 bytes of events
+		if len(res.payload) < 7 || len(res.payload) > 7 + maxCommEvents ||
+		   int(res.payload[0]) != len(res.payload) - 1 {
+			err	= ErrProtocolError
+			return
+		}
+
+		eventLog	= &CommEventLog{
+			Status:		bytesToUint16(BIG_ENDIAN, res.payload[1:3]),
+			EventCount:	bytesToUint16(BIG_ENDIAN, res.payload[3:5]),
+			MessageCount:	bytesToUint16(BIG_ENDIAN, res.payload[5:7]),
+			Events:		res.payload[7:],
+		}
+
+	case res.functionCode == (req.functionCode | 0x80):
+		if len(res.payload) != 1 {
+			err	= ErrProtocolError
+			return
+		}
+
+		err	= mapExceptionCodeToError(res.payload[0])
+
+	default:
+		err	= ErrProtocolError
+		mc.logger.Warningf("unexpected response code (%v)", res.functionCode)
+	}
+
+	return
+}
+
+// Sends a request made of an arbitrary function code and payload, e.g. for
+// user-defined function codes (65-72 and 100-110), and returns the response
+// as-is. Exception responses are mapped to errors.
+// Over RTU links, the end of responses to function codes unknown to this
+// package is detected by waiting for the line to fall silent.
+// Broadcast requests (unit id 0 over RTU framing) and force listen only mode
+// diagnostics requests are sent without waiting for a response, in which case
+// both res and err are nil.
+func (mc *ModbusClient) ExecuteRaw(functionCode uint8, payload []byte) (res *RawPDU, err error) {
+	var req		*pdu
+	var rawRes	*pdu
+
+	// function codes with the MSB set are reserved for exception responses
+	if functionCode == 0 || functionCode & 0x80 == 0x80 {
+		err	= ErrUnexpectedParameters
+		mc.logger.Errorf("invalid function code 0x%02x", functionCode)
+		return
+	}
+
+	// the PDU (function code + payload) must not exceed 253 bytes
+	if len(payload) > 252 {
+		err	= ErrUnexpectedParameters
+		mc.logger.Errorf("payload too long (%v bytes, max. 252)", len(payload))
+		return
+	}
+
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	// create and fill in the request object
+	req	= &pdu{
+		unitId:       mc.unitId,
+		functionCode: functionCode,
+		payload:      payload,
+	}
+
+	// run the request across the transport and wait for a response
+	rawRes, err	= mc.executeRequest(req)
+	if err != nil {
+		return
+	}
+
+	// broadcasts are never answered
+	if rawRes == nil {
+		return
+	}
+
+	// validate the response code
+	switch {
+	case rawRes.functionCode == req.functionCode:
+		res	= &RawPDU{
+			UnitId:		rawRes.unitId,
+			FunctionCode:	rawRes.functionCode,
+			Payload:	rawRes.payload,
+		}
+
+	case rawRes.functionCode == (req.functionCode | 0x80):
+		if len(rawRes.payload) != 1 {
+			err	= ErrProtocolError
+			return
+		}
+
+		err	= mapExceptionCodeToError(rawRes.payload[0])
+
+	default:
+		err	= ErrProtocolError
+		mc.logger.Warningf("unexpected response code (%v)", rawRes.functionCode)
+	}
+
+	return
+}
+
+/*** unexported methods ***/
+// Clones the base TLS configuration, if any, and completes it with the client
+// certificate, root CAs and MBAPS requirements.
+func (mc *ModbusClient) buildTLSConfig() (tlsConfig *tls.Config, err error) {
+	if mc.conf.TLSConfig != nil {
+		tlsConfig = mc.conf.TLSConfig.Clone()
+	} else {
+		tlsConfig = &tls.Config{}
+	}
+
+	// the server must always be authenticated
+	if tlsConfig.InsecureSkipVerify {
+		err = errors.New("InsecureSkipVerify is not allowed in TLSConfig")
+		return
+	}
+
+	// mandate TLS 1.2 or higher (see R-01 of the MBAPS spec)
+	err = requireTLS12(tlsConfig)
+	if err != nil {
+		return
+	}
+
+	if mc.conf.TLSClientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{
+			*mc.conf.TLSClientCert,
+		}
+	}
+
+	if mc.conf.TLSRootCAs != nil {
+		tlsConfig.RootCAs = mc.conf.TLSRootCAs
+	}
+
+	// expect a client-side certificate for mutual auth as the
+	// modbus/mpab protocol has no inherent auth facility.
+	// (see requirements R-08 and R-19 of the MBAPS spec)
+	if len(tlsConfig.Certificates) == 0 && tlsConfig.GetClientCertificate == nil {
+		err = errors.New("missing client certificate")
+		return
+	}
+
+	// expect a CertPool object containing at least 1 CA or
+	// leaf certificate to validate the server-side cert
+	if tlsConfig.RootCAs == nil {
+		err = errors.New("missing CA/server certificate")
+		return
+	}
+
+	// reject revoked server certificates, after any check from the base
+	// configuration
+	if mc.crls != nil {
+		tlsConfig.VerifyConnection = chainConnectionVerifiers(
+			tlsConfig.VerifyConnection, mc.crls.verifyConnection)
+	}
+
+	return
+}
+
+// Runs a diagnostics request (function code 08) carrying 2 bytes of data and
+// returns the 2 bytes of data of the response.
+func (mc *ModbusClient) diagnostics(subFunction uint16, data uint16) (resData uint16, err error) {
+	var res		[]byte
+
+	res, err	= mc.executeDiagnostics(subFunction, uint16ToBytes(BIG_ENDIAN, data))
+	if err != nil {
+		return
+	}
+
+	// all sub-functions other than return query data answer with 2 bytes
+	if len(res) != 2 {
+		err	= ErrProtocolError
+		return
+	}
+
+	resData	= bytesToUint16(BIG_ENDIAN, res)
+
+	return
+}
+
+// Sends a diagnostics request carrying the given sub-function and data, and
+// returns the data field of the response.
+func (mc *ModbusClient) executeDiagnostics(subFunction uint16, data []byte) (resData []byte, err error) {
+	var req		*pdu
+	var res		*pdu
+
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	// create and fill in the request object
+	req	= &pdu{
+		unitId:       mc.unitId,
+		functionCode: fcDiagnostics,
+	}
+
+	// sub-function
+	req.payload	= uint16ToBytes(BIG_ENDIAN, subFunction)
+	// data
+	req.payload	= append(req.payload, data...)
+
+	// run the request across the transport and wait for a response
+	res, err	= mc.executeRequest(req)
+	if err != nil {
+		return
+	}
+
+	// validate the response code
+	switch {
+	case res.functionCode == req.functionCode:
+		// expect 2 bytes of sub-function, echoing that of the request,
+		// followed by at least 2 bytes of data
+		if len(res.payload) < 4 || len(res.payload) % 2 != 0 ||
+		   bytesToUint16(BIG_ENDIAN, res.payload[0:2]) != subFunction {
+			err	= ErrProtocolError
+			return
+		}
+
+		resData	= res.payload[2:]
+
+	case res.functionCode == (req.functionCode | 0x80):
+		if len(res.payload) != 1 {
+			err	= ErrProtocolError
+			return
+		}
+
+		err	= mapExceptionCodeToError(res.payload[0])
+
+	default:
+		err	= ErrProtocolError
+		mc.logger.Warningf("unexpected response code (%v)", res.functionCode)
+	}
+
+	return
+}
+
+// Reads one or multiple 16-bit registers (function code 03 or 04) as bytes.
+func (mc *ModbusClient) readBytes(addr uint16, quantity uint16, regType RegType, observeEndianness bool) (values []byte, err error) {
+	var regCount uint16
+
+	// read enough registers to get the requested number of bytes
+	// (2 bytes per reg)
+	regCount = (quantity / 2) + (quantity % 2)
+
+	values, err = mc.readRegisters(addr, regCount, regType)
+	if err != nil {
+		return
+	}
+
+	// swap bytes on register boundaries if requested by the caller
+	// and endianness is set to little endian
+	if observeEndianness && mc.endianness == LITTLE_ENDIAN {
+		for i := 0; i < len(values); i += 2 {
+			values[i], values[i+1] = values[i+1], values[i]
+		}
+	}
+
+	// pop the last byte on odd quantities
+	if quantity % 2 == 1 {
+		values = values[0:len(values) - 1]
+	}
+
+	return
+}
+
+// Writes the given slice of bytes to 16-bit registers starting at addr.
+func (mc *ModbusClient) writeBytes(addr uint16, values []byte, observeEndianness bool) (err error) {
+	// pad odd quantities to make for full registers
+	if len(values) % 2 == 1 {
+		values = append(values, 0x00)
+	}
+
+	// swap bytes on register boundaries if requested by the caller
+	// and endianness is set to little endian
+	if observeEndianness && mc.endianness == LITTLE_ENDIAN {
+		for i := 0; i < len(values); i += 2 {
+			values[i], values[i+1] = values[i+1], values[i]
+		}
+	}
+
+	err = mc.writeRegisters(addr, values)
+
+	return
+}
+
+// Reads and returns quantity booleans.
+// Digital inputs are read if di is true, otherwise coils are read.
+func (mc *ModbusClient) readBools(addr uint16, quantity uint16, di bool) (values []bool, err error) {
+	var req		*pdu
+	var res		*pdu
+	var expectedLen	int
+
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	if quantity == 0 {
+		err	= ErrUnexpectedParameters
+		mc.logger.Error("quantity of coils/discrete inputs is 0")
+		return
+	}
+
+	if quantity > 2000 {
+		err	= ErrUnexpectedParameters
+		mc.logger.Error("quantity of coils/discrete inputs exceeds 2000")
+		return
+	}
+
+	if uint32(addr) + uint32(quantity) - 1 > 0xffff {
+		err	= ErrUnexpectedParameters
+		mc.logger.Error("end coil/discrete input address is past 0xffff")
+		return
+	}
+
+	// create and fill in the request object
+	req	= &pdu{
+		unitId:	mc.unitId,
+	}
+
+	if di {
+		req.functionCode = fcReadDiscreteInputs
+	} else {
+		req.functionCode = fcReadCoils
+	}
+
+	// start address
+	req.payload	= uint16ToBytes(BIG_ENDIAN, addr)
+	// quantity
+	req.payload	= append(req.payload, uint16ToBytes(BIG_ENDIAN, quantity)...)
+
+	// run the request across the transport and wait for a response
+	res, err	= mc.executeRequest(req)
+	if err != nil {
+		return
+	}
+
+	// validate the response code
+	switch {
+	case res.functionCode == req.functionCode:
+		// expect a payload of 1 byte (byte count) + 1 byte for 8 coils/discrete inputs)
+		expectedLen	= 1
+		expectedLen	+= int(quantity) / 8
+		if quantity % 8 != 0 {
+			expectedLen++
+		}
+
+		if len(res.payload) != expectedLen {
+			err = ErrProtocolError
+			return
+		}
+
+		// validate the byte count field
+		if int(res.payload[0]) + 1 != expectedLen {
+			err = ErrProtocolError
+			return
+		}
+
+		// turn bits into a bool slice
+		values = decodeBools(quantity, res.payload[1:])
+
+
+	case res.functionCode == (req.functionCode | 0x80):
+		if len(res.payload) != 1 {
+			err	= ErrProtocolError
+			return
+		}
+
+		err	= mapExceptionCodeToError(res.payload[0])
+
+	default:
+		err	= ErrProtocolError
+		mc.logger.Warningf("unexpected response code (%v)", res.functionCode)
+	}
+
+	return
+}
+
+// Reads and returns quantity registers of type regType, as bytes.
+func (mc *ModbusClient) readRegisters(addr uint16, quantity uint16, regType RegType) (bytes []byte, err error) {
+	var req		*pdu
+	var res		*pdu
+
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	// create and fill in the request object
+	req	= &pdu{
+		unitId:	mc.unitId,
+	}
+
+	switch regType {
+	case HOLDING_REGISTER: req.functionCode = fcReadHoldingRegisters
+	case INPUT_REGISTER:   req.functionCode = fcReadInputRegisters
+	default:
+		err = ErrUnexpectedParameters
+		mc.logger.Errorf("unexpected register type (%v)", regType)
+		return
+	}
+
+	if quantity == 0 {
+		err = ErrUnexpectedParameters
+		mc.logger.Error("quantity of registers is 0")
+		return
+	}
+
+	if quantity > 125 {
+		err = ErrUnexpectedParameters
+		mc.logger.Error("quantity of registers exceeds 125")
+		return
+	}
+
+	if uint32(addr) + uint32(quantity) - 1 > 0xffff {
+		err = ErrUnexpectedParameters
+		mc.logger.Error("end register address is past 0xffff")
+		return
+	}
+
+	// start address
+	req.payload	= uint16ToBytes(BIG_ENDIAN, addr)
+	// quantity
+	req.payload	= append(req.payload, uint16ToBytes(BIG_ENDIAN, quantity)...)
+
+	// run the request across the transport and wait for a response
+	res, err	= mc.executeRequest(req)
+	if err != nil {
+		return
+	}
+
+	// validate the response code
+	switch {
+	case res.functionCode == req.functionCode:
+		// make sure the payload length is what we expect
+		// (1 byte of length + 2 bytes per register)
+		if len(res.payload) != 1 + 2 * int(quantity) {
+			err = ErrProtocolError
+			return
+		}
+
+		// validate the byte count field
+		// (2 bytes per register * number of registers)
+		if uint(res.payload[0]) != 2 * uint(quantity) {
+			err = ErrProtocolError
+			return
+		}
+
+		// remove the byte count field from the returned slice
+		bytes	= res.payload[1:]
+
+	case res.functionCode == (req.functionCode | 0x80):
+		if len(res.payload) != 1 {
+			err	= ErrProtocolError
+			return
+		}
+
+		err	= mapExceptionCodeToError(res.payload[0])
+
+	default:
+		err	= ErrProtocolError
+		mc.logger.Warningf("unexpected response code (%v)", res.functionCode)
+	}
+
+	return
+}
+
+// Writes multiple registers starting from base address addr.
+// Register values are passed as bytes, each value being exactly 2 bytes.
+func (mc *ModbusClient) writeRegisters(addr uint16, values []byte) (err error) {
+	var req           *pdu
+	var res           *pdu
+	var payloadLength uint16
+	var quantity      uint16
+
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	payloadLength = uint16(len(values))
+	quantity      = payloadLength / 2
+
+	if quantity == 0 {
+		err = ErrUnexpectedParameters
+		mc.logger.Error("quantity of registers is 0")
+		return
+	}
+
+	if quantity > 123 {
+		err = ErrUnexpectedParameters
+		mc.logger.Error("quantity of registers exceeds 123")
+		return
+	}
+
+	if uint32(addr) + uint32(quantity) - 1 > 0xffff {
+		err = ErrUnexpectedParameters
+		mc.logger.Error("end register address is past 0xffff")
+		return
+	}
+
+	// create and fill in the request object
+	req	= &pdu{
+		unitId:	      mc.unitId,
+		functionCode: fcWriteMultipleRegisters,
+	}
+
+	// base address
+	req.payload	= uint16ToBytes(BIG_ENDIAN, addr)
+	// quantity of registers (2 bytes per register)
+	req.payload	= append(req.payload, uint16ToBytes(BIG_ENDIAN, quantity)...)
+	// byte count
+	req.payload	= append(req.payload, byte(payloadLength))
+	// registers value
+	req.payload	= append(req.payload, values...)
+
+	// run the request across the transport and wait for a response
+	res, err	= mc.executeRequest(req)
+	if err != nil {
+		return
+	}
+
+	// broadcasts are never answered
+	if res == nil {
+		return
+	}
+
+	// validate the response code
+	switch {
+	case res.functionCode == req.functionCode:
+		// expect 4 bytes (2 byte of address + 2 bytes of quantity)
+		if len(res.payload) != 4 ||
+		   // bytes 1-2 should be the base register address
+		   bytesToUint16(BIG_ENDIAN, res.payload[0:2]) != addr ||
+		   // bytes 3-4 should be the quantity of registers (2 bytes per register)
+		   bytesToUint16(BIG_ENDIAN, res.payload[2:4]) != quantity {
+			   err = ErrProtocolError
+			   return
+		   }
+
+	case res.functionCode == (req.functionCode | 0x80):
+		if len(res.payload) != 1 {
+			err	= ErrProtocolError
+			return
+		}
+
+		err	= mapExceptionCodeToError(res.payload[0])
+
+	default:
+		err	= ErrProtocolError
+		mc.logger.Warningf("unexpected response code (%v)", res.functionCode)
+	}
+
+	return
+}
+
+// Writes multiple registers starting from base address writeAddr, then reads
+// readQuantity registers starting from base address readAddr, as bytes.
+// Register values to be written are passed as bytes, each value being exactly 2 bytes.
+func (mc *ModbusClient) readWriteRegisters(readAddr uint16, readQuantity uint16,
+	writeAddr uint16, values []byte) (bytes []byte, err error) {
+	var req           *pdu
+	var res           *pdu
+	var payloadLength uint16
+	var writeQuantity uint16
+
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	payloadLength = uint16(len(values))
+	writeQuantity = payloadLength / 2
+
+	if readQuantity == 0 {
+		err = ErrUnexpectedParameters
+		mc.logger.Error("quantity of registers to read is 0")
+		return
+	}
+
+	if readQuantity > 125 {
+		err = ErrUnexpectedParameters
+		mc.logger.Error("quantity of registers to read exceeds 125")
+		return
+	}
+
+	if uint32(readAddr) + uint32(readQuantity) - 1 > 0xffff {
+		err = ErrUnexpectedParameters
+		mc.logger.Error("end read register address is past 0xffff")
+		return
+	}
+
+	if writeQuantity == 0 {
+		err = ErrUnexpectedParameters
+		mc.logger.Error("quantity of registers to write is 0")
+		return
+	}
+
+	if writeQuantity > 121 {
+		err = ErrUnexpectedParameters
+		mc.logger.Error("quantity of registers to write exceeds 121")
+		return
+	}
+
+	if uint32(writeAddr) + uint32(writeQuantity) - 1 > 0xffff {
+		err = ErrUnexpectedParameters
+		mc.logger.Error("end write register address is past 0xffff")
+		return
+	}
+
+	// create and fill in the request object
+	req	= &pdu{
+		unitId:	      mc.unitId,
+		functionCode: fcReadWriteMultipleRegisters,
+	}
+
+	// read base address
+	req.payload	= uint16ToBytes(BIG_ENDIAN, readAddr)
+	// quantity of registers to read
+	req.payload	= append(req.payload, uint16ToBytes(BIG_ENDIAN, readQuantity)...)
+	// write base address
+	req.payload	= append(req.payload, uint16ToBytes(BIG_ENDIAN, writeAddr)...)
+	// quantity of registers to write
+	req.payload	= append(req.payload, uint16ToBytes(BIG_ENDIAN, writeQuantity)...)
+	// byte count
+	req.payload	= append(req.payload, byte(payloadLength))
+	// registers value
+	req.payload	= append(req.payload, values...)
+
+	// run the request across the transport and wait for a response
+	res, err	= mc.executeRequest(req)
+	if err != nil {
+		return
+	}
+
+	// validate the response code
+	switch {
+	case res.functionCode == req.functionCode:
+		// make sure the payload length is what we expect
+		// (1 byte of length + 2 bytes per register)
+		if len(res.payload) != 1 + 2 * int(readQuantity) {
+			err = ErrProtocolError
+			return
+		}
+
+		// validate the byte count field
+		// (2 bytes per register * number of registers)
+		if uint(res.payload[0]) != 2 * uint(readQuantity) {
+			err = ErrProtocolError
+			return
+		}
+
+		// remove the byte count field from the returned slice
+		bytes	= res.payload[1:]
+
+	case res.functionCode == (req.functionCode | 0x80):
+		if len(res.payload) != 1 {
+			err	= ErrProtocolError
+			return
+		}
+
+		err	= mapExceptionCodeToError(res.payload[0])
+
+	default:
+		err	= ErrProtocolError
+		mc.logger.Warningf("unexpected response code (%v)", res.functionCode)
+	}
+
+	return
+}
+
+// Validates the file number, record number and length of a file record
+// sub-request.
+func (mc *ModbusClient) validateFileRecord(record *FileRecord, length uint16) (err error) {
+	if record.FileNumber == 0 {
+		err = ErrUnexpectedParameters
+		mc.logger.Error("file number is 0")
+		return
+	}
+
+	if record.RecordNumber > 0x270f {
+		err = ErrUnexpectedParameters
+		mc.logger.Error("record number exceeds 9999")
+		return
+	}
+
+	if length == 0 {
+		err = ErrUnexpectedParameters
+		mc.logger.Error("record length is 0")
+		return
+	}
+
+	return
+}
+
+// Broadcast requests (unit id 0 over RTU framing) and requests calling for no
+// response (see expectsResponse()) are sent without waiting for a response, in
+// which case both res and err are nil.
+func (mc *ModbusClient) executeRequest(req *pdu) (res *pdu, err error) {
+	if req.unitId == 0 && mc.isRTUFramed() {
+		// only write requests can be broadcast
+		if !isBroadcastable(req.functionCode) {
+			err	= ErrUnexpectedParameters
+			mc.logger.Errorf("function code 0x%02x cannot be broadcast " +
+					 "(unit id 0)", req.functionCode)
+			return
+		}
+
+		err	= mc.writeRequest(req)
+		if err != nil {
+			return
+		}
+
+		// give remote devices time to process the request
+		time.Sleep(mc.conf.TurnaroundDelay)
+
+		return
+	}
+
+	// don't wait for responses which are never going to come
+	if !expectsResponse(req) {
+		err	= mc.writeRequest(req)
+		return
+	}
+
+	// send the request over the wire, wait for and decode the response
+	res, err	= mc.transport.ExecuteRequest(req)
+	if err != nil {
+		// map i/o timeouts to ErrRequestTimedOut
+		if os.IsTimeout(err) {
 			err = ErrRequestTimedOut
 		}
 		return
@@ -1208,3 +2624,34 @@ func (mc *ModbusClient) executeRequest(req *pdu) (res *pdu, err error) {
 
 	return
 }
+
+// Sends a request without waiting for a response.
+func (mc *ModbusClient) writeRequest(req *pdu) (err error) {
+	err	= mc.transport.WriteRequest(req)
+
+	// map i/o timeouts to ErrRequestTimedOut
+	if err != nil && os.IsTimeout(err) {
+		err	= ErrRequestTimedOut
+	}
+
+	return
+}
+
+// Returns false if req calls for no response at all, i.e. if it is a force
+// listen only mode diagnostics request.
+func expectsResponse(req *pdu) (yes bool) {
+	yes	= !(req.functionCode == fcDiagnostics && len(req.payload) >= 2 &&
+		    bytesToUint16(BIG_ENDIAN, req.payload[0:2]) == diagForceListenOnlyMode)
+
+	return
+}
+
+// Returns true if the client uses RTU framing (i.e. talks to serial devices,
+// either directly or through a gateway), where unit id 0 is used for broadcasts.
+func (mc *ModbusClient) isRTUFramed() (yes bool) {
+	yes	= mc.transportType == modbusRTU ||
+		  mc.transportType == modbusRTUOverTCP ||
+		  mc.transportType == modbusRTUOverUDP
+
+	return
+}
@@ -0,0 +1,225 @@
+package modbus
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// crlStore holds certificate revocation lists (CRLs) loaded from files and
+// checks peer certificates against them.
+// Files are checked for changes at most once per reload interval, on the first
+// handshake following the expiry of the interval.
+type crlStore struct {
+	paths     []string
+	interval  time.Duration
+	logger    *logger
+	lock      sync.Mutex
+	watcher   *fileWatcher
+	checkedAt time.Time
+	crls      []*revocationList
+}
+
+// revocationList is a parsed CRL, along with the set of serial numbers it lists.
+type revocationList struct {
+	path    string
+	crl     *pkix.CertificateList
+	issuer  string
+	revoked map[string]time.Time
+}
+
+func newCRLStore(paths []string, interval time.Duration, logger *logger) (
+	cs *crlStore, err error) {
+	cs	= &crlStore{
+		paths:    paths,
+		interval: interval,
+		logger:   logger,
+		watcher:  newFileWatcher(paths...),
+	}
+
+	cs.watcher.update()
+	cs.checkedAt	= time.Now()
+
+	cs.crls, err	= loadCRLs(paths)
+	if err != nil {
+		cs	= nil
+		return
+	}
+
+	return
+}
+
+// Verifies that no certificate of the chains verified by the TLS stack has been
+// revoked. The signature matches that of tls.Config.VerifyConnection, which
+// unlike VerifyPeerCertificate is also called on resumed sessions.
+func (cs *crlStore) verifyConnection(state tls.ConnectionState) (err error) {
+	var crls	[]*revocationList
+
+	cs.lock.Lock()
+	cs.refresh()
+	crls	= cs.crls
+	cs.lock.Unlock()
+
+	for _, chain := range state.VerifiedChains {
+		// the last certificate of the chain is the trust anchor, which
+		// has no issuer to be revoked by
+		for i := 0; i < len(chain) - 1; i++ {
+			err	= checkRevocation(crls, chain[i], chain[i + 1])
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// Reloads CRLs if the reload interval has elapsed and files have changed.
+// Must be called with cs.lock held.
+func (cs *crlStore) refresh() {
+	var crls	[]*revocationList
+	var err		error
+
+	if time.Since(cs.checkedAt) < cs.interval {
+		return
+	}
+	cs.checkedAt	= time.Now()
+
+	if !cs.watcher.changed() {
+		return
+	}
+	cs.watcher.update()
+
+	crls, err	= loadCRLs(cs.paths)
+	if err != nil {
+		// keep using the current lists and try again on the next check
+		cs.logger.Warningf("failed to reload CRLs, keeping previous ones: %v", err)
+		cs.watcher.reset()
+		return
+	}
+
+	cs.crls	= crls
+	cs.logger.Infof("reloaded %v CRL(s)", len(crls))
+
+	return
+}
+
+// Returns an error if cert was revoked by issuer, according to any of crls.
+func checkRevocation(crls []*revocationList, cert *x509.Certificate,
+	issuer *x509.Certificate) (err error) {
+	var revokedAt	time.Time
+	var found	bool
+	var issuerName	pkix.RDNSequence
+
+	// compare names the same way they're decoded from CRLs
+	_, err	= asn1.Unmarshal(cert.RawIssuer, &issuerName)
+	if err != nil {
+		return
+	}
+
+	for _, rl := range crls {
+		// only consider CRLs issued (and signed) by the issuer of cert
+		if rl.issuer != issuerName.String() {
+			continue
+		}
+
+		if issuer.CheckCRLSignature(rl.crl) != nil {
+			continue
+		}
+
+		revokedAt, found	= rl.revoked[cert.SerialNumber.String()]
+		if found {
+			err	= fmt.Errorf("certificate '%s' (serial %v) was revoked on %v (%s)",
+					     cert.Subject.String(), cert.SerialNumber,
+					     revokedAt.UTC().Format(time.RFC3339), rl.path)
+			return
+		}
+	}
+
+	return
+}
+
+// Loads CRLs from all files, which may either hold a single DER-encoded CRL or
+// one or more PEM-encoded CRLs.
+func loadCRLs(paths []string) (crls []*revocationList, err error) {
+	var buf		[]byte
+	var block	*pem.Block
+	var rest	[]byte
+	var rl		*revocationList
+	var count	int
+
+	for _, path := range paths {
+		buf, err	= ioutil.ReadFile(path)
+		if err != nil {
+			return
+		}
+
+		// DER-encoded CRL
+		if !bytes.Contains(buf, []byte("-----BEGIN")) {
+			rl, err	= parseCRL(path, buf)
+			if err != nil {
+				return
+			}
+			crls	= append(crls, rl)
+			continue
+		}
+
+		// PEM-encoded CRL(s)
+		rest	= buf
+		count	= 0
+		for {
+			block, rest	= pem.Decode(rest)
+			if block == nil {
+				break
+			}
+
+			if block.Type != "X509 CRL" {
+				continue
+			}
+
+			rl, err	= parseCRL(path, block.Bytes)
+			if err != nil {
+				return
+			}
+			crls	= append(crls, rl)
+			count++
+		}
+
+		if count == 0 {
+			err	= fmt.Errorf("%v: no CRL found", path)
+			return
+		}
+	}
+
+	return
+}
+
+func parseCRL(path string, der []byte) (rl *revocationList, err error) {
+	var crl	*pkix.CertificateList
+
+	crl, err	= x509.ParseDERCRL(der)
+	if err != nil {
+		err	= fmt.Errorf("%v: %w", path, err)
+		return
+	}
+
+	rl	= &revocationList{
+		path:    path,
+		crl:     crl,
+		issuer:  crl.TBSCertList.Issuer.String(),
+		revoked: make(map[string]time.Time),
+	}
+
+	for _, rc := range crl.TBSCertList.RevokedCertificates {
+		rl.revoked[rc.SerialNumber.String()]	= rc.RevocationTime
+	}
+
+	return
+}
@@ -0,0 +1,249 @@
+package modbus
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadCRLs(t *testing.T) {
+	var err   error
+	var dir   string
+	var ca1   tls.Certificate
+	var ca2   tls.Certificate
+	var leaf  tls.Certificate
+	var crl1  []byte
+	var crl2  []byte
+	var crls  []*revocationList
+
+	dir	= t.TempDir()
+
+	ca1, _, _	= genTestKeyPair(t, "ca 1", nil)
+	ca2, _, _	= genTestKeyPair(t, "ca 2", nil)
+	leaf, _, _	= genTestKeyPair(t, "leaf", &ca1)
+	crl1		= genTestCRL(t, &ca1, leaf.Leaf.SerialNumber)
+	crl2		= genTestCRL(t, &ca2)
+
+	// two PEM-encoded CRLs in one file, along with a DER-encoded one
+	writeTestFile(t, filepath.Join(dir, "crls.pem"), append(
+		pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl1}),
+		pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl2})...), 1)
+	writeTestFile(t, filepath.Join(dir, "crl.der"), crl2, 1)
+
+	crls, err	= loadCRLs([]string{
+		filepath.Join(dir, "crls.pem"), filepath.Join(dir, "crl.der"),
+	})
+	if err != nil {
+		t.Errorf("loadCRLs() should have succeeded, got: %v", err)
+		return
+	}
+
+	if len(crls) != 3 || len(crls[0].revoked) != 1 || len(crls[1].revoked) != 0 {
+		t.Errorf("unexpected CRLs: %v", crls)
+	}
+
+	// the leaf cert should be reported as revoked by its issuer only
+	err	= checkRevocation(crls, leaf.Leaf, ca1.Leaf)
+	if err == nil || !strings.Contains(err.Error(), "was revoked") {
+		t.Errorf("expected a revocation error, got: %v", err)
+	}
+
+	err	= checkRevocation(crls, ca2.Leaf, ca2.Leaf)
+	if err != nil {
+		t.Errorf("expected nil, got: %v", err)
+	}
+
+	// files without any CRL should be rejected
+	writeTestFile(t, filepath.Join(dir, "empty.pem"), pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: ca1.Leaf.Raw}), 1)
+	_, err	= loadCRLs([]string{filepath.Join(dir, "empty.pem")})
+	if err == nil {
+		t.Errorf("loadCRLs() should have failed")
+	}
+
+	// so should garbage and missing files
+	writeTestFile(t, filepath.Join(dir, "junk.der"), []byte("somejunk"), 1)
+	_, err	= loadCRLs([]string{filepath.Join(dir, "junk.der")})
+	if err == nil {
+		t.Errorf("loadCRLs() should have failed")
+	}
+
+	_, err	= loadCRLs([]string{filepath.Join(dir, "missing.der")})
+	if err == nil {
+		t.Errorf("loadCRLs() should have failed")
+	}
+
+	return
+}
+
+func TestTLSServerCRL(t *testing.T) {
+	var err      error
+	var dir      string
+	var server   *ModbusServer
+	var logs     bytes.Buffer
+	var ca       tls.Certificate
+	var serverKp tls.Certificate
+	var client1  tls.Certificate
+	var client2  tls.Certificate
+	var cp       *x509.CertPool
+	var c1       *ModbusClient
+	var c2       *ModbusClient
+	var c3       *ModbusClient
+	var newClient = func(keyPair *tls.Certificate, crlFile string) (mc *ModbusClient) {
+		var conf	= &ClientConfiguration{
+			URL:           "tcp+tls://localhost:5527",
+			Timeout:       1 * time.Second,
+			TLSClientCert: keyPair,
+			TLSRootCAs:    cp,
+		}
+
+		if crlFile != "" {
+			conf.TLSCRLFiles	= []string{crlFile}
+		}
+
+		mc, err	= NewClient(conf)
+		if err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+		mc.SetUnitId(9)
+
+		return
+	}
+
+	dir		= t.TempDir()
+	ca, _, _	= genTestKeyPair(t, "ca", nil)
+	serverKp, _, _	= genTestKeyPair(t, "server", &ca)
+	client1, _, _	= genTestKeyPair(t, "client 1", &ca)
+	client2, _, _	= genTestKeyPair(t, "client 2", &ca)
+	cp		= x509.NewCertPool()
+	cp.AddCert(ca.Leaf)
+
+	// revoke the second client's certificate
+	writeTestFile(t, filepath.Join(dir, "crl.der"),
+		      genTestCRL(t, &ca, client2.Leaf.SerialNumber), 1)
+
+	_, err	= NewServer(&ServerConfiguration{
+		URL:           "tcp+tls://localhost:5527",
+		TLSServerCert: &serverKp,
+		TLSClientCAs:  cp,
+		TLSCRLFiles:   []string{filepath.Join(dir, "missing.der")},
+	}, &tcpTestHandler{})
+	if err != ErrConfigurationError {
+		t.Errorf("NewServer() should have returned ErrConfigurationError, got: %v", err)
+	}
+
+	server, err	= NewServer(&ServerConfiguration{
+		URL:                  "tcp+tls://localhost:5527",
+		MaxClients:           5,
+		TLSServerCert:        &serverKp,
+		TLSClientCAs:         cp,
+		TLSCRLFiles:          []string{filepath.Join(dir, "crl.der")},
+		TLSCRLReloadInterval: 10 * time.Millisecond,
+		Logger:               log.New(&logs, "", 0),
+	}, &tcpTestHandler{})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	err	= server.Start()
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Stop()
+
+	c1	= newClient(&client1, "")
+	err	= c1.Open()
+	if err != nil {
+		t.Fatalf("c1.Open() should have succeeded, got: %v", err)
+	}
+	defer c1.Close()
+
+	_, err	= c1.ReadRegisters(0, 2, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("c1.ReadRegisters() should have succeeded, got: %v", err)
+	}
+
+	// the revoked client should be turned away
+	c2	= newClient(&client2, "")
+	err	= c2.Open()
+	if err == nil {
+		_, err	= c2.ReadRegisters(0, 2, HOLDING_REGISTER)
+		c2.Close()
+	}
+	if err == nil {
+		t.Errorf("c2 should have been rejected")
+	}
+
+	// revoke the first client's certificate as well and wait for the CRL
+	// to be reloaded
+	writeTestFile(t, filepath.Join(dir, "crl.der"), genTestCRL(t, &ca,
+		      client1.Leaf.SerialNumber, client2.Leaf.SerialNumber), 2)
+	time.Sleep(20 * time.Millisecond)
+
+	c3	= newClient(&client1, "")
+	err	= c3.Open()
+	if err == nil {
+		_, err	= c3.ReadRegisters(0, 2, HOLDING_REGISTER)
+		c3.Close()
+	}
+	if err == nil {
+		t.Errorf("c3 should have been rejected")
+	}
+
+	// clients should reject revoked server certificates
+	writeTestFile(t, filepath.Join(dir, "server-crl.der"),
+		      genTestCRL(t, &ca, serverKp.Leaf.SerialNumber), 1)
+	c3	= newClient(&client1, filepath.Join(dir, "server-crl.der"))
+	err	= c3.Open()
+	if err == nil {
+		c3.Close()
+		t.Errorf("c3.Open() should have failed")
+	}
+
+	// wait for all sessions to end before looking at logs
+	server.Shutdown(context.Background())
+	if strings.Count(logs.String(), "was revoked") != 2 ||
+	   !strings.Contains(logs.String(), "CN=client 2") ||
+	   !strings.Contains(logs.String(), "reloaded 1 CRL(s)") {
+		t.Errorf("unexpected server logs: '%s'", logs.String())
+	}
+
+	return
+}
+
+// genTestCRL returns a DER-encoded CRL issued by ca, revoking serials.
+func genTestCRL(t *testing.T, ca *tls.Certificate, serials ...*big.Int) (der []byte) {
+	var err      error
+	var template = &x509.RevocationList{
+		Number:     big.NewInt(time.Now().UnixNano()),
+		ThisUpdate: time.Now().Add(-1 * time.Hour),
+		NextUpdate: time.Now().Add(24 * time.Hour),
+	}
+
+	for _, serial := range serials {
+		template.RevokedCertificates	= append(template.RevokedCertificates,
+			pkix.RevokedCertificate{
+				SerialNumber:   serial,
+				RevocationTime: time.Now().Add(-1 * time.Minute),
+			})
+	}
+
+	der, err	= x509.CreateRevocationList(rand.Reader, template, ca.Leaf,
+						   ca.PrivateKey.(crypto.Signer))
+	if err != nil {
+		t.Fatalf("failed to create CRL: %v", err)
+	}
+
+	return
+}
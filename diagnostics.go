@@ -0,0 +1,361 @@
+package modbus
+
+import (
+	"sync"
+)
+
+const (
+	// diagnostics (0x08) sub-function codes
+	diagReturnQueryData             uint16 = 0x0000
+	diagRestartCommunications       uint16 = 0x0001
+	diagReturnDiagnosticRegister    uint16 = 0x0002
+	diagForceListenOnlyMode         uint16 = 0x0004
+	diagClearCounters               uint16 = 0x000a
+	diagReturnBusMessageCount       uint16 = 0x000b
+	diagReturnBusCommErrorCount     uint16 = 0x000c
+	diagReturnBusExceptionCount     uint16 = 0x000d
+	diagReturnServerMessageCount    uint16 = 0x000e
+	diagReturnServerNoResponseCount uint16 = 0x000f
+	diagReturnServerNAKCount        uint16 = 0x0010
+	diagReturnServerBusyCount       uint16 = 0x0011
+	diagReturnBusCharOverrunCount   uint16 = 0x0012
+	diagClearOverrunCounter         uint16 = 0x0014
+
+	// communication event log entries
+	evCommRestart                   uint8  = 0x00
+	evEnteredListenOnlyMode         uint8  = 0x04
+	evReceive                       uint8  = 0x80
+	evReceiveCommError              uint8  = 0x02
+	evReceiveListenOnly             uint8  = 0x20
+	evReceiveBroadcast              uint8  = 0x40
+	evSend                          uint8  = 0x40
+	evSendReadException             uint8  = 0x01
+	evSendAbortException            uint8  = 0x02
+	evSendBusyException             uint8  = 0x04
+	evSendListenOnly                uint8  = 0x20
+
+	// the comm event log holds up to 64 events
+	maxCommEvents                   int    = 64
+)
+
+// linkDiagnostics holds the diagnostic counters, communication event counter
+// and communication event log of a single link (i.e. client connection or
+// serial line), as defined by the modbus serial line spec.
+// linkDiagnostics objects are updated by the goroutine serving the link, but
+// may also be accessed by handler goroutines still running after their request
+// timed out, hence are guarded by a lock.
+type linkDiagnostics struct {
+	lock                    sync.Mutex
+	listenOnly              bool
+	busMessageCount         uint16
+	busCommErrorCount       uint16
+	busExceptionCount       uint16
+	serverMessageCount      uint16
+	serverNoResponseCount   uint16
+	serverBusyCount         uint16
+	eventCount              uint16
+	events                  []uint8
+}
+
+// Returns true if the link is in listen only mode.
+func (ld *linkDiagnostics) isListenOnly() (yes bool) {
+	ld.lock.Lock()
+	yes	= ld.listenOnly
+	ld.lock.Unlock()
+
+	return
+}
+
+// Records the reception of a message addressed to this device.
+func (ld *linkDiagnostics) messageReceived() {
+	var event uint8 = evReceive
+
+	ld.lock.Lock()
+	defer ld.lock.Unlock()
+
+	ld.busMessageCount++
+	ld.serverMessageCount++
+
+	if ld.listenOnly {
+		event	|= evReceiveListenOnly
+	}
+	ld.logEvent(event)
+
+	return
+}
+
+// Records the reception of a broadcast message (unit id 0).
+func (ld *linkDiagnostics) broadcastReceived() {
+	var event uint8 = evReceive | evReceiveBroadcast
+
+	ld.lock.Lock()
+	defer ld.lock.Unlock()
+
+	ld.busMessageCount++
+	ld.serverMessageCount++
+
+	if ld.listenOnly {
+		event	|= evReceiveListenOnly
+	}
+	ld.logEvent(event)
+
+	return
+}
+
+// Records the reception of a message addressed to another device.
+func (ld *linkDiagnostics) busMessageReceived() {
+	ld.lock.Lock()
+	defer ld.lock.Unlock()
+
+	ld.busMessageCount++
+
+	return
+}
+
+// Records the reception of a corrupted message (e.g. bad CRC).
+func (ld *linkDiagnostics) commErrorReceived() {
+	ld.lock.Lock()
+	defer ld.lock.Unlock()
+
+	ld.busMessageCount++
+	ld.busCommErrorCount++
+	ld.logEvent(evReceive | evReceiveCommError)
+
+	return
+}
+
+// Records the completion of a request for which no response was sent.
+func (ld *linkDiagnostics) noResponseSent() {
+	var event uint8 = evSend
+
+	ld.lock.Lock()
+	defer ld.lock.Unlock()
+
+	ld.serverNoResponseCount++
+
+	if ld.listenOnly {
+		event	|= evSendListenOnly
+	}
+	ld.logEvent(event)
+
+	return
+}
+
+// Records the completion of a request for which a response was sent.
+// exceptionCode is 0 for normal responses.
+func (ld *linkDiagnostics) responseSent(functionCode uint8, exceptionCode uint8) {
+	var event uint8 = evSend
+
+	ld.lock.Lock()
+	defer ld.lock.Unlock()
+
+	switch exceptionCode {
+	case 0x00:
+		// the event counter is not incremented by exception responses
+		// or by get comm event counter requests
+		if functionCode != fcGetCommEventCounter {
+			ld.eventCount++
+		}
+
+	case exIllegalFunction, exIllegalDataAddress, exIllegalDataValue:
+		ld.busExceptionCount++
+		event	|= evSendReadException
+
+	case exServerDeviceFailure:
+		ld.busExceptionCount++
+		event	|= evSendAbortException
+
+	case exServerDeviceBusy:
+		ld.busExceptionCount++
+		ld.serverBusyCount++
+		event	|= evSendBusyException
+
+	default:
+		ld.busExceptionCount++
+	}
+
+	ld.logEvent(event)
+
+	return
+}
+
+// Adds an event to the comm event log, most recent first.
+// Must be called with ld.lock held.
+func (ld *linkDiagnostics) logEvent(event uint8) {
+	ld.events	= append([]uint8{event}, ld.events...)
+
+	if len(ld.events) > maxCommEvents {
+		ld.events	= ld.events[0:maxCommEvents]
+	}
+
+	return
+}
+
+// Clears all counters. The comm event log is left untouched.
+// Must be called with ld.lock held.
+func (ld *linkDiagnostics) clearCounters() {
+	ld.busMessageCount		= 0
+	ld.busCommErrorCount		= 0
+	ld.busExceptionCount		= 0
+	ld.serverMessageCount		= 0
+	ld.serverNoResponseCount	= 0
+	ld.serverBusyCount		= 0
+	ld.eventCount			= 0
+
+	return
+}
+
+// Handles diagnostics (0x08), get comm event counter (0x0b) and get comm event
+// log (0x0c) requests.
+// Returns a nil response (and a nil error) when no response should be sent, i.e.
+// when entering listen only mode or when restarting communications while in
+// listen only mode.
+func (ld *linkDiagnostics) handleRequest(req *pdu) (res *pdu, err error) {
+	var subFunction	uint16
+	var data	uint16
+	var payload	[]byte
+
+	ld.lock.Lock()
+	defer ld.lock.Unlock()
+
+	switch req.functionCode {
+	case fcGetCommEventCounter:
+		if len(req.payload) != 0 {
+			err	= ErrProtocolError
+			return
+		}
+
+		// status word (0x0000: no previous command still being processed)
+		// and event count
+		payload	= uint16ToBytes(BIG_ENDIAN, 0x0000)
+		payload	= append(payload, uint16ToBytes(BIG_ENDIAN, ld.eventCount)...)
+
+	case fcGetCommEventLog:
+		if len(req.payload) != 0 {
+			err	= ErrProtocolError
+			return
+		}
+
+		// byte count, status word, event count, message count and events
+		payload	= []byte{uint8(6 + len(ld.events))}
+		payload	= append(payload, uint16ToBytes(BIG_ENDIAN, 0x0000)...)
+		payload	= append(payload, uint16ToBytes(BIG_ENDIAN, ld.eventCount)...)
+		payload	= append(payload, uint16ToBytes(BIG_ENDIAN, ld.busMessageCount)...)
+		payload	= append(payload, ld.events...)
+
+	case fcDiagnostics:
+		if len(req.payload) < 4 {
+			err	= ErrProtocolError
+			return
+		}
+
+		subFunction	= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
+
+		// return query data echoes the request back, whatever the number
+		// of 2-byte words of data it carries
+		if subFunction == diagReturnQueryData {
+			if len(req.payload) % 2 != 0 {
+				err	= ErrProtocolError
+				return
+			}
+			payload	= req.payload
+			break
+		}
+
+		// all other sub-functions carry exactly 2 bytes of data
+		if len(req.payload) != 4 {
+			err	= ErrProtocolError
+			return
+		}
+		data		= bytesToUint16(BIG_ENDIAN, req.payload[2:4])
+
+		// reject unsupported sub-functions (e.g. those specific to ASCII mode)
+		switch subFunction {
+		case diagRestartCommunications, diagReturnDiagnosticRegister,
+		     diagForceListenOnlyMode, diagClearCounters,
+		     diagReturnBusMessageCount, diagReturnBusCommErrorCount,
+		     diagReturnBusExceptionCount, diagReturnServerMessageCount,
+		     diagReturnServerNoResponseCount, diagReturnServerNAKCount,
+		     diagReturnServerBusyCount, diagReturnBusCharOverrunCount,
+		     diagClearOverrunCounter:
+		default:
+			err	= ErrIllegalFunction
+			return
+		}
+
+		// the only valid data value for the restart communications option
+		// sub-function other than 0x0000 is 0xff00 (clear comm event log)
+		if data != 0x0000 &&
+		   !(subFunction == diagRestartCommunications && data == 0xff00) {
+			err	= ErrIllegalDataValue
+			return
+		}
+
+		switch subFunction {
+		case diagRestartCommunications:
+			var wasListenOnly	= ld.listenOnly
+
+			ld.listenOnly	= false
+			ld.clearCounters()
+			if data == 0xff00 {
+				ld.events	= nil
+			}
+			ld.logEvent(evCommRestart)
+
+			// no response is sent when restarting from listen only mode
+			if wasListenOnly {
+				return
+			}
+
+			payload	= req.payload
+
+		case diagForceListenOnlyMode:
+			ld.listenOnly	= true
+			ld.logEvent(evEnteredListenOnlyMode)
+
+			// no response is ever sent for this sub-function
+			return
+
+		case diagClearCounters, diagClearOverrunCounter:
+			// character overruns are not tracked, hence always 0
+			if subFunction == diagClearCounters {
+				ld.clearCounters()
+			}
+			payload	= req.payload
+
+		case diagReturnDiagnosticRegister:
+			// no diagnostic register bits are defined by this server
+			data	= 0x0000
+		case diagReturnBusMessageCount:
+			data	= ld.busMessageCount
+		case diagReturnBusCommErrorCount:
+			data	= ld.busCommErrorCount
+		case diagReturnBusExceptionCount:
+			data	= ld.busExceptionCount
+		case diagReturnServerMessageCount:
+			data	= ld.serverMessageCount
+		case diagReturnServerNoResponseCount:
+			data	= ld.serverNoResponseCount
+		case diagReturnServerNAKCount, diagReturnBusCharOverrunCount:
+			// this server never returns NAK exceptions and has no way
+			// of detecting character overruns
+			data	= 0x0000
+		case diagReturnServerBusyCount:
+			data	= ld.serverBusyCount
+		}
+
+		// echo the sub-function code followed by the returned data
+		if payload == nil {
+			payload	= uint16ToBytes(BIG_ENDIAN, subFunction)
+			payload	= append(payload, uint16ToBytes(BIG_ENDIAN, data)...)
+		}
+	}
+
+	res	= &pdu{
+		unitId:		req.unitId,
+		functionCode:	req.functionCode,
+		payload:	payload,
+	}
+
+	return
+}
@@ -0,0 +1,104 @@
+package modbus
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// disconnectWatcher wraps a client connection to detect disconnections while
+// requests are being served, i.e. at times the transport isn't reading from
+// the connection.
+// Data received while watching (e.g. pipelined requests) is buffered and
+// returned by subsequent reads, so that transports can safely read from the
+// watcher as they would from the connection itself.
+type disconnectWatcher struct {
+	net.Conn
+	cancel  context.CancelFunc
+	pending []byte
+	readErr error
+	done    chan struct{}
+}
+
+func newDisconnectWatcher(conn net.Conn, cancel context.CancelFunc) (dw *disconnectWatcher) {
+	dw = &disconnectWatcher{
+		Conn:   conn,
+		cancel: cancel,
+	}
+
+	return
+}
+
+// Reads from the connection, returning data (then errors) received while
+// watching first.
+func (dw *disconnectWatcher) Read(buf []byte) (rlen int, err error) {
+	if len(dw.pending) > 0 {
+		rlen		= copy(buf, dw.pending)
+		dw.pending	= dw.pending[rlen:]
+		return
+	}
+
+	if dw.readErr != nil {
+		err	= dw.readErr
+		return
+	}
+
+	rlen, err	= dw.Conn.Read(buf)
+
+	return
+}
+
+// Starts watching the connection from a goroutine.
+// The connection must not be read from until stop() is called.
+func (dw *disconnectWatcher) start() {
+	// clear any read deadline left by the transport
+	dw.Conn.SetReadDeadline(time.Time{})
+
+	dw.done	= make(chan struct{})
+	go dw.watch()
+
+	return
+}
+
+// Stops watching the connection, waiting for the watching goroutine to return.
+func (dw *disconnectWatcher) stop() {
+	// unblock the pending read, if any
+	dw.Conn.SetReadDeadline(time.Now())
+	<-dw.done
+
+	return
+}
+
+/*** unexported methods ***/
+// Reads from the connection until either an error occurs or stop() is called,
+// cancelling the session context if the connection is closed.
+func (dw *disconnectWatcher) watch() {
+	var rxbuf	[]byte
+	var rlen	int
+	var err		error
+
+	defer close(dw.done)
+
+	// don't bother watching a connection which already failed
+	if dw.readErr != nil {
+		return
+	}
+
+	rxbuf	= make([]byte, maxTCPFrameLength)
+
+	for {
+		rlen, err	= dw.Conn.Read(rxbuf)
+		dw.pending	= append(dw.pending, rxbuf[0:rlen]...)
+
+		if err != nil {
+			// a deadline error means stop() was called
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				dw.readErr	= err
+				dw.cancel()
+			}
+			return
+		}
+	}
+}
@@ -132,6 +132,9 @@ func main() {
 		TLSServerCert: &serverKeyPair,
 		// use the client cert/CA pool to verify client certificates
 		TLSClientCAs:  clientCertPool,
+		// (to rotate certificates without restarting the server, use
+		// TLSGetServerCert and TLSGetClientCAs along with
+		// modbus.NewKeyPairLoader() and modbus.NewCertPoolLoader() instead)
 	}, eh)
 	if err != nil {
 		fmt.Printf("failed to create server: %v\n", err)
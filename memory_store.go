@@ -0,0 +1,802 @@
+package modbus
+
+import (
+	"sync"
+)
+
+// Address range object, covering addresses Start to End (inclusive).
+type AddressRange struct {
+	Start uint16
+	End   uint16
+}
+
+// Memory store configuration object.
+type MemoryStoreConfiguration struct {
+	// Coils, DiscreteInputs, HoldingRegisters and InputRegisters set the
+	// address ranges of each table. Requests covering addresses outside of
+	// these ranges are answered with an illegal data address exception.
+	// Tables without any range are not exposed at all.
+	Coils                    []AddressRange
+	DiscreteInputs           []AddressRange
+	HoldingRegisters         []AddressRange
+	InputRegisters           []AddressRange
+	// ReadOnlyCoils and ReadOnlyHoldingRegisters set address ranges which can
+	// be read but not written by clients. Write requests covering any of
+	// these addresses are answered with an illegal data address exception.
+	// The application can still update read-only values through the store
+	// accessors.
+	ReadOnlyCoils            []AddressRange
+	ReadOnlyHoldingRegisters []AddressRange
+	// Endianness and WordOrder set the encoding used by register accessors
+	// (e.g. SetFloat32, GetUint32), and should match those of clients.
+	// Default to BIG_ENDIAN and HIGH_WORD_FIRST.
+	Endianness               Endianness
+	WordOrder                WordOrder
+}
+
+// In-memory data store object, holding coils, discrete inputs, holding and input
+// registers.
+// MemoryStore satisfies the RequestHandler interface and can be passed to
+// NewServer as is. The application side accesses values through the Get* and
+// Set* methods, all of which are safe for concurrent use.
+// Unit ids are ignored: the same values are served to all unit ids.
+type MemoryStore struct {
+	conf             MemoryStoreConfiguration
+	lock             *sync.RWMutex
+	coils            []bool
+	discreteInputs   []bool
+	holdingRegisters []uint16
+	inputRegisters   []uint16
+	// undo log of the transaction in progress (see Update())
+	journal          []memoryStoreWrite
+}
+
+// memoryStoreWrite holds the previous values of a table region, as overwritten
+// during a transaction.
+type memoryStoreWrite struct {
+	bools    []bool
+	regs     []uint16
+	addr     uint16
+	oldBools []bool
+	oldRegs  []uint16
+}
+
+// Returns a new memory store, with all values initialized to zero (false).
+func NewMemoryStore(conf *MemoryStoreConfiguration) (mem *MemoryStore, err error) {
+	mem = &MemoryStore{
+		conf: *conf,
+		lock: &sync.RWMutex{},
+	}
+
+	if mem.conf.Endianness == 0 {
+		mem.conf.Endianness = BIG_ENDIAN
+	}
+
+	if mem.conf.WordOrder == 0 {
+		mem.conf.WordOrder = HIGH_WORD_FIRST
+	}
+
+	if mem.conf.Endianness != BIG_ENDIAN && mem.conf.Endianness != LITTLE_ENDIAN {
+		err = ErrConfigurationError
+		return
+	}
+
+	if mem.conf.WordOrder != HIGH_WORD_FIRST && mem.conf.WordOrder != LOW_WORD_FIRST {
+		err = ErrConfigurationError
+		return
+	}
+
+	for _, ranges := range [][]AddressRange{
+		mem.conf.Coils, mem.conf.DiscreteInputs,
+		mem.conf.HoldingRegisters, mem.conf.InputRegisters,
+		mem.conf.ReadOnlyCoils, mem.conf.ReadOnlyHoldingRegisters,
+	} {
+		for _, r := range ranges {
+			if r.Start > r.End {
+				err = ErrConfigurationError
+				return
+			}
+		}
+	}
+
+	// only allocate tables which are exposed
+	if len(mem.conf.Coils) > 0 {
+		mem.coils            = make([]bool, 0x10000)
+	}
+	if len(mem.conf.DiscreteInputs) > 0 {
+		mem.discreteInputs   = make([]bool, 0x10000)
+	}
+	if len(mem.conf.HoldingRegisters) > 0 {
+		mem.holdingRegisters = make([]uint16, 0x10000)
+	}
+	if len(mem.conf.InputRegisters) > 0 {
+		mem.inputRegisters   = make([]uint16, 0x10000)
+	}
+
+	return
+}
+
+// Runs fn as a single atomic operation: fn is passed a transaction object giving
+// access to the same values as the store itself, and no client request is served
+// while fn runs.
+// If fn returns an error, all changes made through the transaction object are
+// rolled back and the error is returned.
+// The transaction object must not be used once fn has returned.
+func (mem *MemoryStore) Update(fn func(tx *MemoryStore) (error)) (err error) {
+	var tx	*MemoryStore
+
+	// nested transactions are part of the enclosing one
+	if mem.lock == nil {
+		err	= fn(mem)
+		return
+	}
+
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
+
+	// the transaction object shares the tables of the store but performs
+	// no locking of its own
+	tx	= &MemoryStore{
+		conf:             mem.conf,
+		coils:            mem.coils,
+		discreteInputs:   mem.discreteInputs,
+		holdingRegisters: mem.holdingRegisters,
+		inputRegisters:   mem.inputRegisters,
+		journal:          []memoryStoreWrite{},
+	}
+
+	err	= fn(tx)
+	if err != nil {
+		// undo writes in reverse order
+		for i := len(tx.journal) - 1; i >= 0; i-- {
+			if tx.journal[i].bools != nil {
+				copy(tx.journal[i].bools[tx.journal[i].addr:], tx.journal[i].oldBools)
+			} else {
+				copy(tx.journal[i].regs[tx.journal[i].addr:], tx.journal[i].oldRegs)
+			}
+		}
+	}
+
+	tx.journal	= nil
+
+	return
+}
+
+// Reads multiple coils.
+func (mem *MemoryStore) GetCoils(addr uint16, quantity uint16) (values []bool, err error) {
+	mem.rlock()
+	defer mem.runlock()
+
+	values, err	= mem.readBools(mem.coils, mem.conf.Coils, addr, quantity)
+
+	return
+}
+
+// Reads a single coil.
+func (mem *MemoryStore) GetCoil(addr uint16) (value bool, err error) {
+	var values	[]bool
+
+	values, err	= mem.GetCoils(addr, 1)
+	if err == nil {
+		value	= values[0]
+	}
+
+	return
+}
+
+// Sets multiple coils, including read-only ones.
+func (mem *MemoryStore) SetCoils(addr uint16, values []bool) (err error) {
+	mem.wlock()
+	defer mem.wunlock()
+
+	err	= mem.writeBools(mem.coils, mem.conf.Coils, addr, values)
+
+	return
+}
+
+// Sets a single coil, even if read-only.
+func (mem *MemoryStore) SetCoil(addr uint16, value bool) (err error) {
+	err	= mem.SetCoils(addr, []bool{value})
+
+	return
+}
+
+// Reads multiple discrete inputs.
+func (mem *MemoryStore) GetDiscreteInputs(addr uint16, quantity uint16) (values []bool, err error) {
+	mem.rlock()
+	defer mem.runlock()
+
+	values, err	= mem.readBools(mem.discreteInputs, mem.conf.DiscreteInputs, addr, quantity)
+
+	return
+}
+
+// Reads a single discrete input.
+func (mem *MemoryStore) GetDiscreteInput(addr uint16) (value bool, err error) {
+	var values	[]bool
+
+	values, err	= mem.GetDiscreteInputs(addr, 1)
+	if err == nil {
+		value	= values[0]
+	}
+
+	return
+}
+
+// Sets multiple discrete inputs.
+func (mem *MemoryStore) SetDiscreteInputs(addr uint16, values []bool) (err error) {
+	mem.wlock()
+	defer mem.wunlock()
+
+	err	= mem.writeBools(mem.discreteInputs, mem.conf.DiscreteInputs, addr, values)
+
+	return
+}
+
+// Sets a single discrete input.
+func (mem *MemoryStore) SetDiscreteInput(addr uint16, value bool) (err error) {
+	err	= mem.SetDiscreteInputs(addr, []bool{value})
+
+	return
+}
+
+// Reads multiple 16-bit holding or input registers.
+func (mem *MemoryStore) GetRegisters(addr uint16, quantity uint16, regType RegType) (values []uint16, err error) {
+	var buf	[]byte
+
+	buf, err	= mem.getBytes(addr, uint32(quantity), regType)
+	if err != nil {
+		return
+	}
+
+	values	= bytesToUint16s(mem.conf.Endianness, buf)
+
+	return
+}
+
+// Reads a single 16-bit register.
+func (mem *MemoryStore) GetRegister(addr uint16, regType RegType) (value uint16, err error) {
+	var values	[]uint16
+
+	values, err	= mem.GetRegisters(addr, 1, regType)
+	if err == nil {
+		value	= values[0]
+	}
+
+	return
+}
+
+// Sets multiple 16-bit registers, including read-only ones.
+func (mem *MemoryStore) SetRegisters(addr uint16, values []uint16, regType RegType) (err error) {
+	err	= mem.setBytes(addr, uint16sToBytes(mem.conf.Endianness, values), regType)
+
+	return
+}
+
+// Sets a single 16-bit register, even if read-only.
+func (mem *MemoryStore) SetRegister(addr uint16, value uint16, regType RegType) (err error) {
+	err	= mem.SetRegisters(addr, []uint16{value}, regType)
+
+	return
+}
+
+// Reads multiple 32-bit registers.
+func (mem *MemoryStore) GetUint32s(addr uint16, quantity uint16, regType RegType) (values []uint32, err error) {
+	var buf	[]byte
+
+	buf, err	= mem.getBytes(addr, uint32(quantity) * 2, regType)
+	if err != nil {
+		return
+	}
+
+	values	= bytesToUint32s(mem.conf.Endianness, mem.conf.WordOrder, buf)
+
+	return
+}
+
+// Reads a single 32-bit register.
+func (mem *MemoryStore) GetUint32(addr uint16, regType RegType) (value uint32, err error) {
+	var values	[]uint32
+
+	values, err	= mem.GetUint32s(addr, 1, regType)
+	if err == nil {
+		value	= values[0]
+	}
+
+	return
+}
+
+// Sets multiple 32-bit registers.
+func (mem *MemoryStore) SetUint32s(addr uint16, values []uint32, regType RegType) (err error) {
+	var buf	[]byte
+
+	for _, value := range values {
+		buf	= append(buf, uint32ToBytes(mem.conf.Endianness, mem.conf.WordOrder, value)...)
+	}
+
+	err	= mem.setBytes(addr, buf, regType)
+
+	return
+}
+
+// Sets a single 32-bit register.
+func (mem *MemoryStore) SetUint32(addr uint16, value uint32, regType RegType) (err error) {
+	err	= mem.SetUint32s(addr, []uint32{value}, regType)
+
+	return
+}
+
+// Reads multiple 32-bit float registers.
+func (mem *MemoryStore) GetFloat32s(addr uint16, quantity uint16, regType RegType) (values []float32, err error) {
+	var buf	[]byte
+
+	buf, err	= mem.getBytes(addr, uint32(quantity) * 2, regType)
+	if err != nil {
+		return
+	}
+
+	values	= bytesToFloat32s(mem.conf.Endianness, mem.conf.WordOrder, buf)
+
+	return
+}
+
+// Reads a single 32-bit float register.
+func (mem *MemoryStore) GetFloat32(addr uint16, regType RegType) (value float32, err error) {
+	var values	[]float32
+
+	values, err	= mem.GetFloat32s(addr, 1, regType)
+	if err == nil {
+		value	= values[0]
+	}
+
+	return
+}
+
+// Sets multiple 32-bit float registers.
+func (mem *MemoryStore) SetFloat32s(addr uint16, values []float32, regType RegType) (err error) {
+	var buf	[]byte
+
+	for _, value := range values {
+		buf	= append(buf, float32ToBytes(mem.conf.Endianness, mem.conf.WordOrder, value)...)
+	}
+
+	err	= mem.setBytes(addr, buf, regType)
+
+	return
+}
+
+// Sets a single 32-bit float register.
+func (mem *MemoryStore) SetFloat32(addr uint16, value float32, regType RegType) (err error) {
+	err	= mem.SetFloat32s(addr, []float32{value}, regType)
+
+	return
+}
+
+// Reads multiple 64-bit registers.
+func (mem *MemoryStore) GetUint64s(addr uint16, quantity uint16, regType RegType) (values []uint64, err error) {
+	var buf	[]byte
+
+	buf, err	= mem.getBytes(addr, uint32(quantity) * 4, regType)
+	if err != nil {
+		return
+	}
+
+	values	= bytesToUint64s(mem.conf.Endianness, mem.conf.WordOrder, buf)
+
+	return
+}
+
+// Reads a single 64-bit register.
+func (mem *MemoryStore) GetUint64(addr uint16, regType RegType) (value uint64, err error) {
+	var values	[]uint64
+
+	values, err	= mem.GetUint64s(addr, 1, regType)
+	if err == nil {
+		value	= values[0]
+	}
+
+	return
+}
+
+// Sets multiple 64-bit registers.
+func (mem *MemoryStore) SetUint64s(addr uint16, values []uint64, regType RegType) (err error) {
+	var buf	[]byte
+
+	for _, value := range values {
+		buf	= append(buf, uint64ToBytes(mem.conf.Endianness, mem.conf.WordOrder, value)...)
+	}
+
+	err	= mem.setBytes(addr, buf, regType)
+
+	return
+}
+
+// Sets a single 64-bit register.
+func (mem *MemoryStore) SetUint64(addr uint16, value uint64, regType RegType) (err error) {
+	err	= mem.SetUint64s(addr, []uint64{value}, regType)
+
+	return
+}
+
+// Reads multiple 64-bit float registers.
+func (mem *MemoryStore) GetFloat64s(addr uint16, quantity uint16, regType RegType) (values []float64, err error) {
+	var buf	[]byte
+
+	buf, err	= mem.getBytes(addr, uint32(quantity) * 4, regType)
+	if err != nil {
+		return
+	}
+
+	values	= bytesToFloat64s(mem.conf.Endianness, mem.conf.WordOrder, buf)
+
+	return
+}
+
+// Reads a single 64-bit float register.
+func (mem *MemoryStore) GetFloat64(addr uint16, regType RegType) (value float64, err error) {
+	var values	[]float64
+
+	values, err	= mem.GetFloat64s(addr, 1, regType)
+	if err == nil {
+		value	= values[0]
+	}
+
+	return
+}
+
+// Sets multiple 64-bit float registers.
+func (mem *MemoryStore) SetFloat64s(addr uint16, values []float64, regType RegType) (err error) {
+	var buf	[]byte
+
+	for _, value := range values {
+		buf	= append(buf, float64ToBytes(mem.conf.Endianness, mem.conf.WordOrder, value)...)
+	}
+
+	err	= mem.setBytes(addr, buf, regType)
+
+	return
+}
+
+// Sets a single 64-bit float register.
+func (mem *MemoryStore) SetFloat64(addr uint16, value float64, regType RegType) (err error) {
+	err	= mem.SetFloat64s(addr, []float64{value}, regType)
+
+	return
+}
+
+// HandleCoils implements the RequestHandler interface.
+func (mem *MemoryStore) HandleCoils(req *CoilsRequest) (res []bool, err error) {
+	if req.IsWrite {
+		mem.wlock()
+		defer mem.wunlock()
+
+		if overlaps(mem.conf.ReadOnlyCoils, req.Addr, req.Quantity) {
+			err	= ErrIllegalDataAddress
+			return
+		}
+
+		err	= mem.writeBools(mem.coils, mem.conf.Coils, req.Addr, req.Args)
+		return
+	}
+
+	mem.rlock()
+	defer mem.runlock()
+
+	res, err	= mem.readBools(mem.coils, mem.conf.Coils, req.Addr, req.Quantity)
+
+	return
+}
+
+// HandleDiscreteInputs implements the RequestHandler interface.
+func (mem *MemoryStore) HandleDiscreteInputs(req *DiscreteInputsRequest) (res []bool, err error) {
+	res, err	= mem.GetDiscreteInputs(req.Addr, req.Quantity)
+
+	return
+}
+
+// HandleHoldingRegisters implements the RequestHandler interface.
+func (mem *MemoryStore) HandleHoldingRegisters(req *HoldingRegistersRequest) (res []uint16, err error) {
+	if req.IsWrite {
+		mem.wlock()
+		defer mem.wunlock()
+
+		if overlaps(mem.conf.ReadOnlyHoldingRegisters, req.Addr, req.Quantity) {
+			err	= ErrIllegalDataAddress
+			return
+		}
+
+		err	= mem.writeRegs(
+			mem.holdingRegisters, mem.conf.HoldingRegisters, req.Addr, req.Args)
+		return
+	}
+
+	mem.rlock()
+	defer mem.runlock()
+
+	res, err	= mem.readRegs(
+		mem.holdingRegisters, mem.conf.HoldingRegisters, req.Addr, req.Quantity)
+
+	return
+}
+
+// HandleInputRegisters implements the RequestHandler interface.
+func (mem *MemoryStore) HandleInputRegisters(req *InputRegistersRequest) (res []uint16, err error) {
+	mem.rlock()
+	defer mem.runlock()
+
+	res, err	= mem.readRegs(
+		mem.inputRegisters, mem.conf.InputRegisters, req.Addr, req.Quantity)
+
+	return
+}
+
+// HandleMaskWriteRegister implements the MaskWriteRegisterHandler interface,
+// applying both masks atomically.
+func (mem *MemoryStore) HandleMaskWriteRegister(req *MaskWriteRegisterRequest) (err error) {
+	var values	[]uint16
+
+	mem.wlock()
+	defer mem.wunlock()
+
+	if overlaps(mem.conf.ReadOnlyHoldingRegisters, req.Addr, 1) {
+		err	= ErrIllegalDataAddress
+		return
+	}
+
+	values, err	= mem.readRegs(
+		mem.holdingRegisters, mem.conf.HoldingRegisters, req.Addr, 1)
+	if err != nil {
+		return
+	}
+
+	values[0]	= (values[0] & req.AndMask) | (req.OrMask & ^req.AndMask)
+	err		= mem.writeRegs(
+		mem.holdingRegisters, mem.conf.HoldingRegisters, req.Addr, values)
+
+	return
+}
+
+// HandleReadWriteRegisters implements the ReadWriteRegistersHandler interface,
+// performing the write and read operations atomically.
+func (mem *MemoryStore) HandleReadWriteRegisters(req *ReadWriteRegistersRequest) (res []uint16, err error) {
+	mem.wlock()
+	defer mem.wunlock()
+
+	// make sure both operations are valid before writing anything
+	if overlaps(mem.conf.ReadOnlyHoldingRegisters, req.WriteAddr, req.WriteQuantity) ||
+	   !covers(mem.conf.HoldingRegisters, req.WriteAddr, req.WriteQuantity) ||
+	   !covers(mem.conf.HoldingRegisters, req.ReadAddr, req.ReadQuantity) {
+		err	= ErrIllegalDataAddress
+		return
+	}
+
+	err	= mem.writeRegs(
+		mem.holdingRegisters, mem.conf.HoldingRegisters, req.WriteAddr, req.Args)
+	if err != nil {
+		return
+	}
+
+	res, err	= mem.readRegs(
+		mem.holdingRegisters, mem.conf.HoldingRegisters, req.ReadAddr, req.ReadQuantity)
+
+	return
+}
+
+/*** unexported methods ***/
+// Locking helpers. Transaction objects (see Update()) have no lock of their
+// own, as the store lock is held for the whole duration of the transaction.
+func (mem *MemoryStore) rlock() {
+	if mem.lock != nil {
+		mem.lock.RLock()
+	}
+}
+
+func (mem *MemoryStore) runlock() {
+	if mem.lock != nil {
+		mem.lock.RUnlock()
+	}
+}
+
+func (mem *MemoryStore) wlock() {
+	if mem.lock != nil {
+		mem.lock.Lock()
+	}
+}
+
+func (mem *MemoryStore) wunlock() {
+	if mem.lock != nil {
+		mem.lock.Unlock()
+	}
+}
+
+// Returns the register table and address ranges matching regType.
+func (mem *MemoryStore) registerTable(regType RegType) (table []uint16, ranges []AddressRange, err error) {
+	switch regType {
+	case HOLDING_REGISTER:
+		table	= mem.holdingRegisters
+		ranges	= mem.conf.HoldingRegisters
+	case INPUT_REGISTER:
+		table	= mem.inputRegisters
+		ranges	= mem.conf.InputRegisters
+	default:
+		err	= ErrUnexpectedParameters
+	}
+
+	return
+}
+
+// Reads quantity registers as bytes (2 bytes per register, big endian).
+func (mem *MemoryStore) getBytes(addr uint16, quantity uint32, regType RegType) (values []byte, err error) {
+	var table	[]uint16
+	var ranges	[]AddressRange
+	var regs	[]uint16
+
+	table, ranges, err	= mem.registerTable(regType)
+	if err != nil {
+		return
+	}
+
+	if quantity > 0xffff {
+		err	= ErrIllegalDataAddress
+		return
+	}
+
+	mem.rlock()
+	defer mem.runlock()
+
+	regs, err	= mem.readRegs(table, ranges, addr, uint16(quantity))
+	if err != nil {
+		return
+	}
+
+	values	= uint16sToBytes(BIG_ENDIAN, regs)
+
+	return
+}
+
+// Writes registers from bytes (2 bytes per register, big endian).
+func (mem *MemoryStore) setBytes(addr uint16, values []byte, regType RegType) (err error) {
+	var table	[]uint16
+	var ranges	[]AddressRange
+
+	table, ranges, err	= mem.registerTable(regType)
+	if err != nil {
+		return
+	}
+
+	mem.wlock()
+	defer mem.wunlock()
+
+	err	= mem.writeRegs(table, ranges, addr, bytesToUint16s(BIG_ENDIAN, values))
+
+	return
+}
+
+// Reads quantity values from table, starting at addr. The caller must hold the lock.
+func (mem *MemoryStore) readBools(table []bool, ranges []AddressRange,
+	addr uint16, quantity uint16) (values []bool, err error) {
+	if quantity == 0 || !covers(ranges, addr, quantity) {
+		err	= ErrIllegalDataAddress
+		return
+	}
+
+	values	= make([]bool, quantity)
+	copy(values, table[addr:])
+
+	return
+}
+
+// Writes values to table, starting at addr. The caller must hold the lock.
+func (mem *MemoryStore) writeBools(table []bool, ranges []AddressRange,
+	addr uint16, values []bool) (err error) {
+	if len(values) == 0 || len(values) > 0xffff ||
+	   !covers(ranges, addr, uint16(len(values))) {
+		err	= ErrIllegalDataAddress
+		return
+	}
+
+	// keep track of overwritten values when in a transaction
+	if mem.journal != nil {
+		mem.journal	= append(mem.journal, memoryStoreWrite{
+			bools:    table,
+			addr:     addr,
+			oldBools: append([]bool{}, table[addr:int(addr) + len(values)]...),
+		})
+	}
+
+	copy(table[addr:], values)
+
+	return
+}
+
+// Reads quantity registers from table, starting at addr. The caller must hold
+// the lock.
+func (mem *MemoryStore) readRegs(table []uint16, ranges []AddressRange,
+	addr uint16, quantity uint16) (values []uint16, err error) {
+	if quantity == 0 || !covers(ranges, addr, quantity) {
+		err	= ErrIllegalDataAddress
+		return
+	}
+
+	values	= make([]uint16, quantity)
+	copy(values, table[addr:])
+
+	return
+}
+
+// Writes registers to table, starting at addr. The caller must hold the lock.
+func (mem *MemoryStore) writeRegs(table []uint16, ranges []AddressRange,
+	addr uint16, values []uint16) (err error) {
+	if len(values) == 0 || len(values) > 0xffff ||
+	   !covers(ranges, addr, uint16(len(values))) {
+		err	= ErrIllegalDataAddress
+		return
+	}
+
+	// keep track of overwritten values when in a transaction
+	if mem.journal != nil {
+		mem.journal	= append(mem.journal, memoryStoreWrite{
+			regs:    table,
+			addr:    addr,
+			oldRegs: append([]uint16{}, table[addr:int(addr) + len(values)]...),
+		})
+	}
+
+	copy(table[addr:], values)
+
+	return
+}
+
+// Returns true if every address from addr to addr + quantity - 1 falls within
+// one of ranges.
+func covers(ranges []AddressRange, addr uint16, quantity uint16) (yes bool) {
+	var next	uint32
+	var end		uint32
+	var found	bool
+
+	next	= uint32(addr)
+	end	= uint32(addr) + uint32(quantity) - 1
+	if quantity == 0 || end > 0xffff {
+		return
+	}
+
+	// walk through the requested addresses, jumping from range to range
+	for next <= end {
+		found	= false
+		for _, r := range ranges {
+			if next >= uint32(r.Start) && next <= uint32(r.End) {
+				next	= uint32(r.End) + 1
+				found	= true
+				break
+			}
+		}
+
+		if !found {
+			return
+		}
+	}
+
+	yes	= true
+
+	return
+}
+
+// Returns true if any address from addr to addr + quantity - 1 falls within
+// one of ranges.
+func overlaps(ranges []AddressRange, addr uint16, quantity uint16) (yes bool) {
+	var end	uint32
+
+	if quantity == 0 {
+		return
+	}
+	end	= uint32(addr) + uint32(quantity) - 1
+
+	for _, r := range ranges {
+		if uint32(r.Start) <= end && uint32(r.End) >= uint32(addr) {
+			yes	= true
+			return
+		}
+	}
+
+	return
+}
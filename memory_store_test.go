@@ -0,0 +1,338 @@
+package modbus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreRanges(t *testing.T) {
+	var mem    *MemoryStore
+	var err    error
+	var coils  []bool
+	var regs   []uint16
+
+	_, err	= NewMemoryStore(&MemoryStoreConfiguration{
+		Coils:	[]AddressRange{{Start: 10, End: 5}},
+	})
+	if err != ErrConfigurationError {
+		t.Errorf("NewMemoryStore() should have returned ErrConfigurationError, got: %v", err)
+	}
+
+	mem, err	= NewMemoryStore(&MemoryStoreConfiguration{
+		Coils:				[]AddressRange{{Start: 0, End: 9}},
+		HoldingRegisters:		[]AddressRange{
+			{Start: 100, End: 109}, {Start: 110, End: 119}, {Start: 200, End: 209},
+		},
+		ReadOnlyCoils:			[]AddressRange{{Start: 8, End: 9}},
+		ReadOnlyHoldingRegisters:	[]AddressRange{{Start: 200, End: 200}},
+	})
+	if err != nil {
+		t.Errorf("NewMemoryStore() should have succeeded, got: %v", err)
+		return
+	}
+
+	// adjacent ranges should be treated as a single range
+	regs, err	= mem.HandleHoldingRegisters(&HoldingRegistersRequest{
+		Addr: 105, Quantity: 10, IsWrite: true,
+		Args: []uint16{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+	})
+	if err != nil {
+		t.Errorf("HandleHoldingRegisters() should have succeeded, got: %v", err)
+	}
+
+	regs, err	= mem.HandleHoldingRegisters(&HoldingRegistersRequest{
+		Addr: 104, Quantity: 3,
+	})
+	if err != nil {
+		t.Errorf("HandleHoldingRegisters() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 3 || regs[0] != 0 || regs[1] != 1 || regs[2] != 2 {
+		t.Errorf("unexpected register values: %v", regs)
+	}
+
+	// gaps between ranges should not be readable
+	_, err		= mem.HandleHoldingRegisters(&HoldingRegistersRequest{
+		Addr: 118, Quantity: 3,
+	})
+	if err != ErrIllegalDataAddress {
+		t.Errorf("HandleHoldingRegisters() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	_, err		= mem.HandleHoldingRegisters(&HoldingRegistersRequest{
+		Addr: 0xffff, Quantity: 1,
+	})
+	if err != ErrIllegalDataAddress {
+		t.Errorf("HandleHoldingRegisters() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	// unconfigured tables should not be accessible
+	_, err		= mem.HandleInputRegisters(&InputRegistersRequest{
+		Addr: 0, Quantity: 1,
+	})
+	if err != ErrIllegalDataAddress {
+		t.Errorf("HandleInputRegisters() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	_, err		= mem.HandleDiscreteInputs(&DiscreteInputsRequest{
+		Addr: 0, Quantity: 1,
+	})
+	if err != ErrIllegalDataAddress {
+		t.Errorf("HandleDiscreteInputs() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	// read-only regions should be writable by the application only
+	_, err		= mem.HandleCoils(&CoilsRequest{
+		Addr: 7, Quantity: 2, IsWrite: true, Args: []bool{true, true},
+	})
+	if err != ErrIllegalDataAddress {
+		t.Errorf("HandleCoils() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	err		= mem.SetCoils(7, []bool{true, true})
+	if err != nil {
+		t.Errorf("SetCoils() should have succeeded, got: %v", err)
+	}
+
+	coils, err	= mem.HandleCoils(&CoilsRequest{Addr: 6, Quantity: 4})
+	if err != nil {
+		t.Errorf("HandleCoils() should have succeeded, got: %v", err)
+	}
+	if len(coils) != 4 || coils[0] || !coils[1] || !coils[2] || coils[3] {
+		t.Errorf("unexpected coil values: %v", coils)
+	}
+
+	err		= mem.HandleMaskWriteRegister(&MaskWriteRegisterRequest{
+		Addr: 200, AndMask: 0x0000, OrMask: 0xffff,
+	})
+	if err != ErrIllegalDataAddress {
+		t.Errorf("HandleMaskWriteRegister() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	_, err		= mem.HandleReadWriteRegisters(&ReadWriteRegistersRequest{
+		ReadAddr: 100, ReadQuantity: 2,
+		WriteAddr: 199, WriteQuantity: 2, Args: []uint16{1, 2},
+	})
+	if err != ErrIllegalDataAddress {
+		t.Errorf("HandleReadWriteRegisters() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	return
+}
+
+func TestMemoryStoreAccessors(t *testing.T) {
+	var mem  *MemoryStore
+	var err  error
+	var regs []uint16
+	var u32  uint32
+	var f32  float32
+	var u64  uint64
+	var f64  float64
+
+	mem, err	= NewMemoryStore(&MemoryStoreConfiguration{
+		HoldingRegisters:	[]AddressRange{{Start: 0, End: 99}},
+		InputRegisters:		[]AddressRange{{Start: 0, End: 99}},
+		Endianness:		LITTLE_ENDIAN,
+		WordOrder:		LOW_WORD_FIRST,
+	})
+	if err != nil {
+		t.Errorf("NewMemoryStore() should have succeeded, got: %v", err)
+		return
+	}
+
+	err	= mem.SetUint32(10, 0x11223344, INPUT_REGISTER)
+	if err != nil {
+		t.Errorf("SetUint32() should have succeeded, got: %v", err)
+	}
+
+	// registers are exposed to clients in wire order
+	regs, err	= mem.HandleInputRegisters(&InputRegistersRequest{
+		Addr: 10, Quantity: 2,
+	})
+	if err != nil {
+		t.Errorf("HandleInputRegisters() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 2 || regs[0] != 0x4433 || regs[1] != 0x2211 {
+		t.Errorf("unexpected register values: %v", regs)
+	}
+
+	u32, err	= mem.GetUint32(10, INPUT_REGISTER)
+	if err != nil || u32 != 0x11223344 {
+		t.Errorf("GetUint32() should have returned 0x11223344, got: 0x%08x (%v)", u32, err)
+	}
+
+	err	= mem.SetFloat32(20, -1.5, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("SetFloat32() should have succeeded, got: %v", err)
+	}
+
+	f32, err	= mem.GetFloat32(20, HOLDING_REGISTER)
+	if err != nil || f32 != -1.5 {
+		t.Errorf("GetFloat32() should have returned -1.5, got: %v (%v)", f32, err)
+	}
+
+	err	= mem.SetUint64(30, 0x1122334455667788, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("SetUint64() should have succeeded, got: %v", err)
+	}
+
+	u64, err	= mem.GetUint64(30, HOLDING_REGISTER)
+	if err != nil || u64 != 0x1122334455667788 {
+		t.Errorf("GetUint64() should have returned 0x1122334455667788, got: 0x%016x (%v)", u64, err)
+	}
+
+	err	= mem.SetFloat64(96, 3.25, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("SetFloat64() should have succeeded, got: %v", err)
+	}
+
+	f64, err	= mem.GetFloat64(96, HOLDING_REGISTER)
+	if err != nil || f64 != 3.25 {
+		t.Errorf("GetFloat64() should have returned 3.25, got: %v (%v)", f64, err)
+	}
+
+	// values must not straddle the end of the table
+	err	= mem.SetFloat64(97, 3.25, HOLDING_REGISTER)
+	if err != ErrIllegalDataAddress {
+		t.Errorf("SetFloat64() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	return
+}
+
+func TestMemoryStoreUpdate(t *testing.T) {
+	var mem  *MemoryStore
+	var err  error
+	var regs []uint16
+
+	mem, err	= NewMemoryStore(&MemoryStoreConfiguration{
+		Coils:			[]AddressRange{{Start: 0, End: 9}},
+		HoldingRegisters:	[]AddressRange{{Start: 0, End: 9}},
+	})
+	if err != nil {
+		t.Errorf("NewMemoryStore() should have succeeded, got: %v", err)
+		return
+	}
+
+	err	= mem.Update(func(tx *MemoryStore) (err error) {
+		err	= tx.SetRegisters(0, []uint16{1, 2}, HOLDING_REGISTER)
+		if err != nil {
+			return
+		}
+
+		err	= tx.SetUint32(8, 0x00030004, HOLDING_REGISTER)
+
+		return
+	})
+	if err != nil {
+		t.Errorf("Update() should have succeeded, got: %v", err)
+	}
+
+	// a failed update should leave the store untouched
+	err	= mem.Update(func(tx *MemoryStore) (err error) {
+		err	= tx.SetRegisters(0, []uint16{5, 6}, HOLDING_REGISTER)
+		if err != nil {
+			return
+		}
+
+		err	= tx.SetCoil(0, true)
+		if err != nil {
+			return
+		}
+
+		// register #10 is out of range
+		err	= tx.SetUint32(9, 0x00070008, HOLDING_REGISTER)
+
+		return
+	})
+	if err != ErrIllegalDataAddress {
+		t.Errorf("Update() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	regs, err	= mem.GetRegisters(0, 10, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("GetRegisters() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 10 || regs[0] != 1 || regs[1] != 2 || regs[8] != 3 || regs[9] != 4 {
+		t.Errorf("unexpected register values: %v", regs)
+	}
+
+	if coil, _ := mem.GetCoil(0); coil {
+		t.Errorf("coil #0 should have been rolled back")
+	}
+
+	return
+}
+
+func TestMemoryStoreServer(t *testing.T) {
+	var server *ModbusServer
+	var client *ModbusClient
+	var mem    *MemoryStore
+	var err    error
+	var f32    float32
+
+	mem, err	= NewMemoryStore(&MemoryStoreConfiguration{
+		HoldingRegisters:	[]AddressRange{{Start: 0, End: 99}},
+	})
+	if err != nil {
+		t.Errorf("NewMemoryStore() should have succeeded, got: %v", err)
+		return
+	}
+
+	server, err	= NewServer(&ServerConfiguration{
+		URL:	"tcp://localhost:5516",
+	}, mem)
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+
+	err	= server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+		return
+	}
+	defer server.Stop()
+
+	client, err	= NewClient(&ClientConfiguration{
+		URL:		"tcp://localhost:5516",
+		Timeout:	100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+
+	err	= client.Open()
+	if err != nil {
+		t.Errorf("failed to open client: %v", err)
+		return
+	}
+	defer client.Close()
+
+	err	= mem.SetFloat32(10, 12.5, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("SetFloat32() should have succeeded, got: %v", err)
+	}
+
+	f32, err	= client.ReadFloat32(10, HOLDING_REGISTER)
+	if err != nil || f32 != 12.5 {
+		t.Errorf("client.ReadFloat32() should have returned 12.5, got: %v (%v)", f32, err)
+	}
+
+	err	= client.WriteFloat32(20, -0.5)
+	if err != nil {
+		t.Errorf("client.WriteFloat32() should have succeeded, got: %v", err)
+	}
+
+	f32, err	= mem.GetFloat32(20, HOLDING_REGISTER)
+	if err != nil || f32 != -0.5 {
+		t.Errorf("GetFloat32() should have returned -0.5, got: %v (%v)", f32, err)
+	}
+
+	_, err		= client.ReadRegisters(99, 2, HOLDING_REGISTER)
+	if err != ErrIllegalDataAddress {
+		t.Errorf("client.ReadRegisters() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	return
+}
@@ -0,0 +1,168 @@
+package modbus
+
+import (
+	"context"
+)
+
+// Request object passed through the middleware chain (see ModbusServer.Use()).
+// Requests are not decoded at this stage: only the raw PDU data following the
+// function code is provided in Payload, laid out as defined by the modbus
+// application protocol spec (e.g. a big-endian start address followed by a
+// big-endian quantity for function codes 0x01 to 0x04). Middlewares needing
+// addresses or values must decode Payload themselves, keeping in mind that
+// it may be malformed.
+type Request struct {
+	Context      context.Context // the request context (see RequestHandler)
+	ClientAddr   string          // the source (client) IP address
+	ClientRole   string          // the client role as encoded in the client certificate (tcp+tls only)
+	UnitId       uint8           // the requested unit id (slave id)
+	FunctionCode uint8           // the function code of the request
+	Payload      []byte          // the request data following the function code
+	// diagnostic counters of the link the request was received on
+	diag         *linkDiagnostics
+}
+
+// Response object returned through the middleware chain.
+// Exceptions, including those caused by unsupported function codes, are never
+// returned as responses but as errors (e.g. ErrIllegalFunction or
+// ErrIllegalDataAddress), as with RequestHandler. The payload holds the raw PDU
+// data following the function code.
+// Responses whose function code differs from that of the request (including
+// exception-flagged ones) are answered with a server device failure exception.
+type Response struct {
+	FunctionCode uint8           // the function code of the response
+	Payload      []byte          // the response data following the function code
+}
+
+// The Handler interface is implemented by each link of the middleware chain.
+// ServeModbus returns either a response, an error to be mapped to an exception
+// code or ErrNoResponse to drop the request without any response.
+type Handler interface {
+	ServeModbus(req *Request) (res *Response, err error)
+}
+
+// HandlerFunc allows plain functions to be used as middleware chain handlers.
+type HandlerFunc func(req *Request) (res *Response, err error)
+
+// ServeModbus implements the Handler interface.
+func (hf HandlerFunc) ServeModbus(req *Request) (res *Response, err error) {
+	res, err = hf(req)
+
+	return
+}
+
+// Middlewares wrap the next handler of the chain, e.g.:
+//	func logRequests(next modbus.Handler) modbus.Handler {
+//		return modbus.HandlerFunc(func(req *modbus.Request) (*modbus.Response, error) {
+//			res, err := next.ServeModbus(req)
+//			log.Printf("%s: fc 0x%02x, err: %v", req.ClientAddr, req.FunctionCode, err)
+//			return res, err
+//		})
+//	}
+// Middlewares can observe, alter or answer requests on their own (without
+// calling next), and observe or alter responses and errors.
+type Middleware func(next Handler) Handler
+
+// Appends middlewares to the middleware chain of the server, through which every
+// request goes before being checked against the authorization policy, decoded
+// and passed to the request handler.
+// Middlewares are called in the order they were added, i.e. the first one sees
+// requests first and responses last.
+func (ms *ModbusServer) Use(middlewares ...Middleware) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.middlewares	= append(ms.middlewares, middlewares...)
+
+	// rebuild the chain from the innermost handler outwards
+	ms.chain	= HandlerFunc(ms.serveModbus)
+	for i := len(ms.middlewares) - 1; i >= 0; i-- {
+		ms.chain	= ms.middlewares[i](ms.chain)
+	}
+
+	return
+}
+
+/*** unexported methods ***/
+// Passes a request through the middleware chain.
+func (ms *ModbusServer) dispatch(ctx context.Context, req *pdu, clientAddr string,
+	clientRole string, diag *linkDiagnostics) (res *pdu, err error) {
+	var chain	Handler
+	var chainRes	*Response
+
+	ms.lock.Lock()
+	chain	= ms.chain
+	ms.lock.Unlock()
+
+	chainRes, err	= chain.ServeModbus(&Request{
+		Context:      ctx,
+		ClientAddr:   clientAddr,
+		ClientRole:   clientRole,
+		UnitId:       req.unitId,
+		FunctionCode: req.functionCode,
+		Payload:      req.payload,
+		diag:         diag,
+	})
+
+	// exceptions are to be returned as errors: reject responses flagged as
+	// exceptions or otherwise not matching the request
+	if err == nil && chainRes != nil && chainRes.FunctionCode != req.functionCode {
+		ms.logger.Errorf("middleware chain returned a response with function " +
+				 "code 0x%02x to a request with function code 0x%02x",
+				 chainRes.FunctionCode, req.functionCode)
+		err	= ErrServerDeviceFailure
+		return
+	}
+
+	// responses always carry the unit id of the request
+	if err == nil && chainRes != nil {
+		res	= &pdu{
+			unitId:       req.unitId,
+			functionCode: chainRes.FunctionCode,
+			payload:      chainRes.Payload,
+		}
+	}
+
+	return
+}
+
+// Innermost handler of the middleware chain: enforces the authorization policy,
+// then decodes and serves the request.
+func (ms *ModbusServer) serveModbus(req *Request) (res *Response, err error) {
+	var p		*pdu
+	var ctx		context.Context
+	var diag	*linkDiagnostics
+
+	// requests built from scratch by middlewares may lack a context or
+	// diagnostic counters
+	ctx	= req.Context
+	if ctx == nil {
+		ctx	= context.Background()
+	}
+
+	diag	= req.diag
+	if diag == nil {
+		diag	= &linkDiagnostics{}
+	}
+
+	p	= &pdu{
+		unitId:       req.UnitId,
+		functionCode: req.FunctionCode,
+		payload:      req.Payload,
+	}
+
+	err	= ms.authorize(p, req.ClientAddr, req.ClientRole)
+	if err != nil {
+		return
+	}
+
+	p, err	= ms.handleRequest(ctx, p, req.ClientAddr, req.ClientRole, diag)
+	if p != nil {
+		res	= &Response{
+			FunctionCode: p.functionCode,
+			Payload:      p.payload,
+		}
+	}
+
+	return
+}
@@ -0,0 +1,191 @@
+package modbus
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServerMiddlewares(t *testing.T) {
+	var err    error
+	var server *ModbusServer
+	var client *ModbusClient
+	var lock   sync.Mutex
+	var events []string
+	var order  []string
+	var regs   []uint16
+	var res    *RawPDU
+
+	server, err	= NewServer(&ServerConfiguration{
+		URL:	"tcp://localhost:5524",
+	}, &tcpTestHandler{})
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+
+	// outermost middleware: record requests and their outcome
+	server.Use(func(next Handler) Handler {
+		return HandlerFunc(func(req *Request) (res *Response, err error) {
+			lock.Lock()
+			order	= append(order, "log")
+			lock.Unlock()
+
+			res, err	= next.ServeModbus(req)
+
+			lock.Lock()
+			if err != nil {
+				events	= append(events, fmt.Sprintf("%v/0x%02x: %v",
+						  req.UnitId, req.FunctionCode, err))
+			} else {
+				events	= append(events, fmt.Sprintf("%v/0x%02x: 0x%02x %v",
+						  req.UnitId, req.FunctionCode,
+						  res.FunctionCode, res.Payload))
+			}
+			if req.ClientAddr == "" || req.Context == nil {
+				t.Errorf("unexpected request: %+v", req)
+			}
+			lock.Unlock()
+
+			return
+		})
+	})
+
+	// inner middlewares: answer function code 0x41 on their own, throttle
+	// unit id 13 and offset register values by one
+	server.Use(func(next Handler) Handler {
+		return HandlerFunc(func(req *Request) (res *Response, err error) {
+			lock.Lock()
+			order	= append(order, "filter")
+			lock.Unlock()
+
+			if req.FunctionCode == 0x41 {
+				res	= &Response{FunctionCode: 0x41, Payload: []byte{0xaa}}
+				return
+			}
+
+			// misbehave by returning an exception as a response
+			if req.FunctionCode == 0x43 {
+				res	= &Response{FunctionCode: 0xc3}
+				return
+			}
+
+			if req.UnitId == 13 {
+				err	= ErrServerDeviceBusy
+				return
+			}
+
+			res, err	= next.ServeModbus(req)
+
+			return
+		})
+	}, func(next Handler) Handler {
+		return HandlerFunc(func(req *Request) (res *Response, err error) {
+			// forward register reads to unit id 9
+			var fwd	= *req
+
+			fwd.UnitId	= 9
+			res, err	= next.ServeModbus(&fwd)
+			if err == nil && res.FunctionCode == fcReadHoldingRegisters {
+				res.Payload[2]++
+			}
+
+			return
+		})
+	})
+
+	err	= server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+		return
+	}
+	defer server.Stop()
+
+	client, err	= NewClient(&ClientConfiguration{
+		URL:		"tcp://localhost:5524",
+		Timeout:	1 * time.Second,
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+
+	err	= client.Open()
+	if err != nil {
+		t.Errorf("failed to open client: %v", err)
+		return
+	}
+	defer client.Close()
+
+	client.SetUnitId(1)
+
+	err	= client.WriteRegister(0, 0x1200)
+	if err != nil {
+		t.Errorf("client.WriteRegister() should have succeeded, got: %v", err)
+	}
+
+	regs, err	= client.ReadRegisters(0, 1, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("client.ReadRegisters() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 1 || regs[0] != 0x1201 {
+		t.Errorf("unexpected register values: %v", regs)
+	}
+
+	_, err	= client.ReadRegisters(9, 2, HOLDING_REGISTER)
+	if err != ErrIllegalDataAddress {
+		t.Errorf("client.ReadRegisters() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	res, err	= client.ExecuteRaw(0x41, []byte{0x01})
+	if err != nil {
+		t.Errorf("client.ExecuteRaw() should have succeeded, got: %v", err)
+	}
+	if res == nil || len(res.Payload) != 1 || res.Payload[0] != 0xaa {
+		t.Errorf("unexpected response: %v", res)
+	}
+
+	// unsupported function codes should reach middlewares as errors
+	_, err	= client.ExecuteRaw(0x42, []byte{0x01})
+	if err != ErrIllegalFunction {
+		t.Errorf("client.ExecuteRaw() should have returned ErrIllegalFunction, got: %v", err)
+	}
+
+	// responses not matching the request should be turned into server
+	// device failure exceptions
+	_, err	= client.ExecuteRaw(0x43, []byte{0x01})
+	if err != ErrServerDeviceFailure {
+		t.Errorf("client.ExecuteRaw() should have returned ErrServerDeviceFailure, got: %v", err)
+	}
+
+	client.SetUnitId(13)
+	_, err	= client.ReadRegisters(0, 1, HOLDING_REGISTER)
+	if err != ErrServerDeviceBusy {
+		t.Errorf("client.ReadRegisters() should have returned ErrServerDeviceBusy, got: %v", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	for i, expected := range []string{
+		"1/0x06: 0x06 [0 0 18 0]",
+		"1/0x03: 0x03 [2 18 1]",
+		"1/0x03: illegal data address",
+		"1/0x41: 0x41 [170]",
+		"1/0x42: illegal function",
+		"1/0x43: 0xc3 []",
+		"13/0x03: server device busy",
+	} {
+		if i >= len(events) || events[i] != expected {
+			t.Errorf("expected event #%v to be '%s', got: %v", i, expected, events)
+			break
+		}
+	}
+
+	if len(order) != 14 || order[0] != "log" || order[1] != "filter" {
+		t.Errorf("unexpected middleware order: %v", order)
+	}
+
+	return
+}
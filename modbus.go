@@ -40,6 +40,17 @@ const (
 	fcReadFileRecord             uint8 = 0x14
 	fcWriteFileRecord            uint8 = 0x15
 
+	// diagnostics and identification (serial line only)
+	fcReadExceptionStatus        uint8 = 0x07
+	fcDiagnostics                uint8 = 0x08
+	fcGetCommEventCounter        uint8 = 0x0b
+	fcGetCommEventLog            uint8 = 0x0c
+	fcReportServerId             uint8 = 0x11
+
+	// encapsulated interface transport
+	fcEncapsulatedInterface      uint8 = 0x2b
+	meiReadDeviceIdentification  uint8 = 0x0e
+
 	// exception codes
 	exIllegalFunction            uint8 = 0x01
 	exIllegalDataAddress         uint8 = 0x02
@@ -70,6 +81,15 @@ const (
 	ErrBadTransactionId          Error = "bad transaction id"
 	ErrUnknownProtocolId         Error = "unknown protocol identifier"
 	ErrUnexpectedParameters      Error = "unexpected parameters"
+	// ErrNoResponse may be returned by server-side handlers to drop a
+	// request without sending any response, not even an exception
+	ErrNoResponse                Error = "no response"
+	// ErrServerStopped is passed to server-side disconnection hooks when
+	// sessions are closed by ModbusServer.Stop()
+	ErrServerStopped             Error = "server stopped"
+	// ErrSessionEvicted is passed to server-side disconnection hooks when
+	// sessions are closed to make room for new clients (see EvictionPolicy)
+	ErrSessionEvicted            Error = "session evicted"
 )
 
 // mapExceptionCodeToError turns a modbus exception code into a higher level Error object.
@@ -109,3 +129,22 @@ func mapErrorToExceptionCode(err error) (exceptionCode uint8) {
 
 	return
 }
+
+// isBroadcastable returns true if requests carrying the given function code may
+// be broadcast (i.e. sent to unit id 0). Only write requests can be broadcast as
+// broadcasts are never answered. Function codes unknown to this package (e.g.
+// user-defined function codes) are left to the application.
+func isBroadcastable(functionCode uint8) (yes bool) {
+	switch functionCode {
+	case fcReadCoils, fcReadDiscreteInputs, fcReadHoldingRegisters,
+	     fcReadInputRegisters, fcReadWriteMultipleRegisters, fcReadFifoQueue,
+	     fcReadFileRecord, fcReadExceptionStatus, fcDiagnostics,
+	     fcGetCommEventCounter, fcGetCommEventLog, fcReportServerId,
+	     fcEncapsulatedInterface:
+		yes = false
+	default:
+		yes = true
+	}
+
+	return
+}
@@ -4,11 +4,14 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"os"
 	"time"
 )
 
 const (
 	maxRTUFrameLength	int = 256
+	// minimum silence marking the end of frames of unknown length
+	minFrameSilence		time.Duration = 20 * time.Millisecond
 )
 
 type rtuTransport struct {
@@ -18,6 +21,9 @@ type rtuTransport struct {
 	lastActivity time.Time
 	t35          time.Duration
 	t1           time.Duration
+	// if non-zero, ReadRequest() gives up waiting for a request after
+	// idleTimeout (used to close idle client connections on server links)
+	idleTimeout  time.Duration
 }
 
 type rtuLink interface {
@@ -57,6 +63,34 @@ func (rt *rtuTransport) Close() (err error) {
 
 // Runs a request across the rtu link and returns a response.
 func (rt *rtuTransport) ExecuteRequest(req *pdu) (res *pdu, err error) {
+	err	= rt.WriteRequest(req)
+	if err != nil {
+		return
+	}
+
+	// observe inter-frame delays
+	time.Sleep(rt.lastActivity.Add(rt.t35).Sub(time.Now()))
+
+	// read the response back from the wire
+	res, err = rt.readRTUFrame(req)
+
+	if err == ErrBadCRC || err == ErrProtocolError || err == ErrShortFrame {
+		// wait for and flush any data coming off the link to allow
+		// devices to re-sync
+		time.Sleep(time.Duration(maxRTUFrameLength) * rt.t1)
+		discard(rt.link)
+	}
+
+	// mark the time if we heard anything back
+	if err != ErrRequestTimedOut {
+		rt.lastActivity = time.Now()
+	}
+
+	return
+}
+
+// Writes a request to the rtu link without waiting for a response.
+func (rt *rtuTransport) WriteRequest(req *pdu) (err error) {
 	var ts time.Time
 	var t  time.Duration
 	var n  int
@@ -88,31 +122,124 @@ func (rt *rtuTransport) ExecuteRequest(req *pdu) (res *pdu, err error) {
 	// immediately rather than block until the buffer is drained
 	rt.lastActivity = ts.Add(time.Duration(n) * rt.t1)
 
-	// observe inter-frame delays
-	time.Sleep(rt.lastActivity.Add(rt.t35).Sub(time.Now()))
+	return
+}
 
-	// read the response back from the wire
-	res, err = rt.readRTUFrame()
+// Reads a request from the rtu link, blocking until one is received.
+// Malformed frames (i.e. short, overlong or with a bad CRC) are discarded along
+// with any trailing data until the link falls silent, and reported as either
+// ErrShortFrame or ErrBadCRC: callers should keep reading requests.
+func (rt *rtuTransport) ReadRequest() (req *pdu, err error) {
+	var rxbuf		[]byte
+	var byteCount		int
+	var frameLength		int
+	var fixedLength		int
+	var hasByteCount	bool
+	var crc			crc
+	var idleSince		time.Time
+	var deadline		time.Time
+
+	rxbuf	= make([]byte, maxRTUFrameLength)
+
+	// wait for the first byte of a frame (unit id)
+	idleSince	= time.Now()
+	for {
+		deadline	= time.Now().Add(rt.timeout)
+
+		if rt.idleTimeout > 0 {
+			if time.Since(idleSince) >= rt.idleTimeout {
+				err	= ErrRequestTimedOut
+				return
+			}
+
+			if deadline.After(idleSince.Add(rt.idleTimeout)) {
+				deadline	= idleSince.Add(rt.idleTimeout)
+			}
+		}
+
+		err	= rt.link.SetDeadline(deadline)
+		if err != nil {
+			return
+		}
+
+		byteCount, err	= rt.link.Read(rxbuf[0:1])
+		if byteCount == 1 {
+			break
+		}
+		if err != nil && err != ErrRequestTimedOut && !os.IsTimeout(err) {
+			return
+		}
+	}
 
-	if err == ErrBadCRC || err == ErrProtocolError || err == ErrShortFrame {
-		// wait for and flush any data coming off the link to allow
-		// devices to re-sync
-		time.Sleep(time.Duration(maxRTUFrameLength) * rt.t1)
-		discard(rt.link)
+	// the rest of the frame is expected to follow without delay
+	err	= rt.link.SetDeadline(time.Now().Add(rt.timeout))
+	if err != nil {
+		return
 	}
 
-	// mark the time if we heard anything back
-	if err != ErrRequestTimedOut {
-		rt.lastActivity = time.Now()
+	// read the function code
+	frameLength, err	= rt.readBytes(rxbuf, 1, 1)
+
+	if err == nil {
+		fixedLength, hasByteCount	= expectedRequestLength(rxbuf[1])
+
+		if fixedLength < 0 {
+			// the length of the request is unknown: read until the link
+			// falls silent, the last 2 bytes being the CRC
+			frameLength, err	= rt.readUntilSilence(rxbuf, frameLength)
+			if err == nil && frameLength < 4 {
+				err	= ErrShortFrame
+			}
+		} else {
+			// read the fixed-length part of the request...
+			frameLength, err	= rt.readBytes(rxbuf, frameLength, fixedLength)
+
+			// ...then as many bytes as announced by the byte count, if any...
+			if err == nil && hasByteCount {
+				frameLength, err	= rt.readBytes(
+					rxbuf, frameLength, int(rxbuf[frameLength - 1]))
+			}
+
+			// ...and finally the CRC
+			if err == nil {
+				frameLength, err	= rt.readBytes(rxbuf, frameLength, 2)
+			}
+		}
 	}
 
-	return
-}
+	if err == nil {
+		// compute the CRC on the entire frame, excluding the CRC
+		crc.init()
+		crc.add(rxbuf[0:frameLength - 2])
 
-// Reads a request from the rtu link.
-func (rt *rtuTransport) ReadRequest() (req *pdu, err error) {
-	// reading requests from RTU links is currently unsupported
-	err	= fmt.Errorf("unimplemented")
+		if !crc.isEqual(rxbuf[frameLength - 2], rxbuf[frameLength - 1]) {
+			err	= ErrBadCRC
+		}
+	}
+
+	// mark the time at which we last heard from the link
+	rt.lastActivity	= time.Now()
+
+	if err != nil {
+		// map timeouts and framing errors to ErrShortFrame
+		if err == ErrRequestTimedOut || os.IsTimeout(err) ||
+		   err == ErrProtocolError {
+			err	= ErrShortFrame
+		}
+
+		// drop any trailing data to re-sync with the next frame
+		if err == ErrShortFrame || err == ErrBadCRC {
+			rt.resync()
+		}
+
+		return
+	}
+
+	req	= &pdu{
+		unitId:		rxbuf[0],
+		functionCode:	rxbuf[1],
+		payload:	rxbuf[2:frameLength - 2],
+	}
 
 	return
 }
@@ -121,6 +248,16 @@ func (rt *rtuTransport) ReadRequest() (req *pdu, err error) {
 func (rt *rtuTransport) WriteResponse(res *pdu) (err error) {
 	var n int
 
+	// set an i/o deadline on the link, as reading requests of unknown
+	// length leaves an expired one behind
+	err	= rt.link.SetDeadline(time.Now().Add(rt.timeout))
+	if err != nil {
+		return
+	}
+
+	// let t3.5 expire after the request before transmitting
+	time.Sleep(rt.lastActivity.Add(rt.t35).Sub(time.Now()))
+
 	// build an RTU ADU out of the request object and
 	// send the final ADU+CRC on the wire
 	n, err	= rt.link.Write(rt.assembleRTUFrame(res))
@@ -134,18 +271,22 @@ func (rt *rtuTransport) WriteResponse(res *pdu) (err error) {
 }
 
 // Waits for, reads and decodes a frame from the rtu link.
-func (rt *rtuTransport) readRTUFrame() (res *pdu, err error) {
-	var rxbuf	[]byte
-	var byteCount	int
-	var bytesNeeded	int
-	var crc		crc
+// req is the request the frame is expected to answer, if any, and is used to
+// size responses whose length depends on that of the request.
+func (rt *rtuTransport) readRTUFrame(req *pdu) (res *pdu, err error) {
+	var rxbuf		[]byte
+	var byteCount		int
+	var bytesNeeded		int
+	var headerLength	int
+	var crc			crc
 
 	rxbuf		= make([]byte, maxRTUFrameLength)
 
 	// read the serial ADU header: unit id (1 byte), function code (1 byte) and
 	// PDU length/exception code (1 byte)
-	byteCount, err	= io.ReadFull(rt.link, rxbuf[0:3])
-	if (byteCount > 0 || err == nil) && byteCount != 3 {
+	headerLength	= 3
+	byteCount, err	= io.ReadFull(rt.link, rxbuf[0:headerLength])
+	if (byteCount > 0 || err == nil) && byteCount != headerLength {
 		err = ErrShortFrame
 		return
 	}
@@ -153,37 +294,87 @@ func (rt *rtuTransport) readRTUFrame() (res *pdu, err error) {
 		return
 	}
 
-	// figure out how many further bytes to read
-	bytesNeeded, err = expectedResponseLenth(uint8(rxbuf[1]), uint8(rxbuf[2]))
-	if err != nil {
-		return
+	// read FIFO queue responses carry a 2-byte byte count field, of which
+	// we only have the high byte so far: read the low byte as well
+	if rxbuf[1] == fcReadFifoQueue {
+		byteCount, err	= io.ReadFull(rt.link, rxbuf[headerLength:headerLength + 1])
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return
+		}
+		if byteCount != 1 {
+			err = ErrShortFrame
+			return
+		}
+
+		// the FIFO byte count can never exceed 64 bytes (2 bytes of FIFO count
+		// + 31 2-byte registers), hence the high byte must be 0
+		if rxbuf[headerLength - 1] != 0x00 {
+			err = ErrProtocolError
+			return
+		}
+		headerLength++
 	}
 
-	// we need to read 2 additional bytes of CRC after the payload
-	bytesNeeded	+= 2
-
-	// never read more than the max allowed frame length
-	if byteCount + bytesNeeded > maxRTUFrameLength {
-		err	= ErrProtocolError
-		return
+	// read device identification responses are made of a variable number of
+	// variable-length objects: read them all as part of the header
+	if rxbuf[1] == fcEncapsulatedInterface {
+		headerLength, err	= rt.readDeviceIdObjects(rxbuf, headerLength)
+		if err != nil {
+			return
+		}
 	}
 
-	byteCount, err	= io.ReadFull(rt.link, rxbuf[3:3 + bytesNeeded])
-	if err != nil && err != io.ErrUnexpectedEOF {
-		return
+	// figure out how many further bytes to read
+	bytesNeeded	= expectedResponseLenth(
+		uint8(rxbuf[1]), uint8(rxbuf[headerLength - 1]))
+
+	// diagnostics responses echo the sub-function and data of the request,
+	// the latter being of variable length on return query data requests
+	if rxbuf[1] == fcDiagnostics && req != nil &&
+	   req.functionCode == fcDiagnostics && len(req.payload) > 0 {
+		bytesNeeded	= len(req.payload) - 1
 	}
-	if byteCount != bytesNeeded {
-		rt.logger.Warningf("expected %v bytes, received %v", bytesNeeded, byteCount)
-		err = ErrShortFrame
-		return
+
+	if bytesNeeded < 0 {
+		// the length of the response is unknown: read until the link
+		// falls silent, the last 2 bytes being the CRC
+		byteCount, err	= rt.readUntilSilence(rxbuf, headerLength)
+		if err != nil {
+			return
+		}
+		if byteCount < 4 {
+			err = ErrShortFrame
+			return
+		}
+		bytesNeeded	= byteCount - headerLength
+	} else {
+		// we need to read 2 additional bytes of CRC after the payload
+		bytesNeeded	+= 2
+
+		// never read more than the max allowed frame length
+		if headerLength + bytesNeeded > maxRTUFrameLength {
+			err	= ErrProtocolError
+			return
+		}
+
+		byteCount, err	= io.ReadFull(rt.link, rxbuf[headerLength:headerLength + bytesNeeded])
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return
+		}
+		if byteCount != bytesNeeded {
+			rt.logger.Warningf("expected %v bytes, received %v", bytesNeeded, byteCount)
+			err = ErrShortFrame
+			return
+		}
 	}
 
 	// compute the CRC on the entire frame, excluding the CRC
 	crc.init()
-	crc.add(rxbuf[0:3 + bytesNeeded - 2])
+	crc.add(rxbuf[0:headerLength + bytesNeeded - 2])
 
 	// compare CRC values
-	if !crc.isEqual(rxbuf[3 + bytesNeeded - 2], rxbuf[3 + bytesNeeded - 1]) {
+	if !crc.isEqual(rxbuf[headerLength + bytesNeeded - 2],
+			rxbuf[headerLength + bytesNeeded - 1]) {
 		err = ErrBadCRC
 		return
 	}
@@ -192,12 +383,146 @@ func (rt *rtuTransport) readRTUFrame() (res *pdu, err error) {
 		unitId:		rxbuf[0],
 		functionCode:	rxbuf[1],
 		// pass the byte count + trailing data as payload, withtout the CRC
-		payload:	rxbuf[2:3 + bytesNeeded  - 2],
+		payload:	rxbuf[2:headerLength + bytesNeeded  - 2],
 	}
 
 	return
 }
 
+// Reads the remainder of a read device identification response header and
+// all objects of the response into rxbuf, starting at offset (i.e. right after
+// the MEI type field). Returns the total number of bytes read so far.
+func (rt *rtuTransport) readDeviceIdObjects(rxbuf []byte, offset int) (length int, err error) {
+	var objCount	int
+
+	// only the read device identification MEI type is supported
+	if rxbuf[offset - 1] != meiReadDeviceIdentification {
+		err	= ErrProtocolError
+		return
+	}
+
+	// read the read device id code, conformity level, more follows,
+	// next object id and number of objects fields
+	length, err	= rt.readBytes(rxbuf, offset, 5)
+	if err != nil {
+		return
+	}
+	objCount	= int(rxbuf[length - 1])
+
+	for i := 0; i < objCount; i++ {
+		// read the object id and object length fields...
+		length, err	= rt.readBytes(rxbuf, length, 2)
+		if err != nil {
+			return
+		}
+
+		// ...then the object value
+		length, err	= rt.readBytes(rxbuf, length, int(rxbuf[length - 1]))
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Reads bytes from the link into rxbuf, starting at offset, until the link
+// falls silent for longer than the inter-frame delay (with a floor of
+// minFrameSilence to absorb driver buffering and network jitter).
+// Returns the total number of bytes held in rxbuf.
+func (rt *rtuTransport) readUntilSilence(rxbuf []byte, offset int) (length int, err error) {
+	var byteCount	int
+	var silence	time.Duration
+
+	silence	= rt.t35
+	if silence < minFrameSilence {
+		silence	= minFrameSilence
+	}
+
+	length	= offset
+	err	= rt.link.SetDeadline(time.Now().Add(silence))
+	if err != nil {
+		return
+	}
+
+	for {
+		// never read more than the max allowed frame length
+		if length >= len(rxbuf) {
+			err	= ErrProtocolError
+			return
+		}
+
+		byteCount, err	= rt.link.Read(rxbuf[length:])
+		length		+= byteCount
+
+		// the frame is complete once the link times out (or, on
+		// datagram-oriented links, once the datagram is consumed)
+		if err == ErrRequestTimedOut || os.IsTimeout(err) || err == io.EOF {
+			err	= nil
+			break
+		}
+		if err != nil {
+			return
+		}
+
+		// push the deadline back every time we receive data
+		if byteCount > 0 {
+			err	= rt.link.SetDeadline(time.Now().Add(silence))
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// Reads and discards data off the link until it falls silent.
+func (rt *rtuTransport) resync() {
+	var err		error
+	var rxbuf	[]byte
+
+	rxbuf	= make([]byte, maxRTUFrameLength)
+
+	for {
+		// readUntilSilence() returns ErrProtocolError when the buffer
+		// fills up before the link falls silent
+		_, err	= rt.readUntilSilence(rxbuf, 0)
+		if err != ErrProtocolError {
+			break
+		}
+	}
+
+	rt.lastActivity	= time.Now()
+
+	return
+}
+
+// Reads exactly count bytes from the link into rxbuf, starting at offset,
+// leaving enough room for a CRC. Returns the offset of the next byte.
+func (rt *rtuTransport) readBytes(rxbuf []byte, offset int, count int) (next int, err error) {
+	var byteCount	int
+
+	// never read more than the max allowed frame length
+	if offset + count + 2 > len(rxbuf) {
+		err	= ErrProtocolError
+		return
+	}
+
+	byteCount, err	= io.ReadFull(rt.link, rxbuf[offset:offset + count])
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return
+	}
+	if byteCount != count {
+		err	= ErrShortFrame
+		return
+	}
+	err	= nil
+	next	= offset + count
+
+	return
+}
+
 // Turns a PDU object into bytes.
 func (rt *rtuTransport) assembleRTUFrame(p *pdu) (adu []byte) {
 	var crc		crc
@@ -217,27 +542,75 @@ func (rt *rtuTransport) assembleRTUFrame(p *pdu) (adu []byte) {
 }
 
 // Computes the expected length of a modbus RTU response.
-func expectedResponseLenth(responseCode uint8, responseLength uint8) (byteCount int, err error) {
+// responseLength is the last byte of the response header, i.e. either the byte
+// count, the low byte of the 2-byte byte count (read FIFO queue) or the first
+// byte of the payload. Read device identification responses are entirely read
+// as part of the header.
+// Returns -1 if the length of the response cannot be inferred from its header,
+// as is the case with user-defined or otherwise unknown function codes.
+func expectedResponseLenth(responseCode uint8, responseLength uint8) (byteCount int) {
 	switch responseCode {
 	case fcReadHoldingRegisters,
 	     fcReadInputRegisters,
 	     fcReadCoils,
-	     fcReadDiscreteInputs:            byteCount = int(responseLength)
+	     fcReadDiscreteInputs,
+	     fcReadWriteMultipleRegisters,
+	     fcReadFifoQueue,
+	     fcReadFileRecord,
+	     fcWriteFileRecord,
+	     fcGetCommEventLog,
+	     fcReportServerId:                    byteCount = int(responseLength)
 	case fcWriteSingleRegister,
 	     fcWriteMultipleRegisters,
 	     fcWriteSingleCoil,
-	     fcWriteMultipleCoils:            byteCount = 3
-	case fcMaskWriteRegister:             byteCount = 5
-	case fcReadHoldingRegisters | 0x80,
-	     fcReadInputRegisters | 0x80,
-	     fcReadCoils | 0x80,
-	     fcReadDiscreteInputs | 0x80,
-	     fcWriteSingleRegister | 0x80,
-	     fcWriteMultipleRegisters | 0x80,
-	     fcWriteSingleCoil | 0x80,
-	     fcWriteMultipleCoils | 0x80,
-	     fcMaskWriteRegister | 0x80:      byteCount = 0
-	default: err = ErrProtocolError
+	     fcWriteMultipleCoils,
+	     fcGetCommEventCounter:               byteCount = 3
+	case fcMaskWriteRegister:                 byteCount = 5
+	case fcReadExceptionStatus:               byteCount = 0
+	case fcEncapsulatedInterface:             byteCount = 0
+	case fcDiagnostics:                       byteCount = 3
+	default:
+		if responseCode & 0x80 == 0x80 {
+			// exception responses only carry an exception code,
+			// already read as part of the header
+			byteCount = 0
+		} else {
+			byteCount = -1
+		}
+	}
+
+	return
+}
+
+// Computes the expected length of a modbus RTU request, excluding unit id,
+// function code and CRC.
+// Returns the length of the fixed part of the request and whether its last byte
+// is a byte count announcing further bytes, or -1 if the length of the request
+// cannot be inferred from its function code.
+func expectedRequestLength(functionCode uint8) (fixedLength int, hasByteCount bool) {
+	switch functionCode {
+	case fcReadCoils,
+	     fcReadDiscreteInputs,
+	     fcReadHoldingRegisters,
+	     fcReadInputRegisters,
+	     fcWriteSingleCoil,
+	     fcWriteSingleRegister:               fixedLength = 4
+	case fcReadExceptionStatus,
+	     fcGetCommEventCounter,
+	     fcGetCommEventLog,
+	     fcReportServerId:                    fixedLength = 0
+	case fcWriteMultipleCoils,
+	     fcWriteMultipleRegisters:            fixedLength, hasByteCount = 5, true
+	case fcReadFileRecord,
+	     fcWriteFileRecord:                   fixedLength, hasByteCount = 1, true
+	case fcMaskWriteRegister:                 fixedLength = 6
+	case fcReadWriteMultipleRegisters:        fixedLength, hasByteCount = 9, true
+	case fcReadFifoQueue:                     fixedLength = 2
+	case fcEncapsulatedInterface:             fixedLength = 3
+	// return query data (0x0000) diagnostics requests carry data of any
+	// length, which isn't announced by a byte count
+	case fcDiagnostics:                       fixedLength = -1
+	default:                                  fixedLength = -1
 	}
 
 	return
@@ -64,6 +64,7 @@ func TestRTUTransportReadRTUFrame(t *testing.T) {
 	var txchan	chan []byte
 	var err		error
 	var res		*pdu
+	var frame	[]byte
 
 	txchan		= make(chan []byte, 2)
 	p1, p2		= net.Pipe()
@@ -78,7 +79,7 @@ func TestRTUTransportReadRTUFrame(t *testing.T) {
 		0x02,       // exception code
 		0xc1, 0x6e, // CRC
 	}
-	res, err	= rt.readRTUFrame()
+	res, err	= rt.readRTUFrame(nil)
 	if err != nil {
 		t.Errorf("readRTUFrame() should have succeeded, got %v", err)
 	}
@@ -102,7 +103,7 @@ func TestRTUTransportReadRTUFrame(t *testing.T) {
 		0x12,       // exception code
 		0xc0, 0xa2, // CRC
 	}
-	res, err	= rt.readRTUFrame()
+	res, err	= rt.readRTUFrame(nil)
 	if err != ErrBadCRC {
 		t.Errorf("readRTUFrame() should have returned ErrBadCrc, got %v", err)
 	}
@@ -115,7 +116,7 @@ func TestRTUTransportReadRTUFrame(t *testing.T) {
 		0x33, 0x44, // register #2
 		0x7b, 0xc5, // CRC
 	}
-	res, err	= rt.readRTUFrame()
+	res, err	= rt.readRTUFrame(nil)
 	if err != nil {
 		t.Errorf("readRTUFrame() should have succeeded, got %v", err)
 	}
@@ -139,6 +140,278 @@ func TestRTUTransportReadRTUFrame(t *testing.T) {
 		}
 	}
 
+	// read a FIFO queue response (2-byte byte count)
+	txchan		<- rt.assembleRTUFrame(&pdu{
+		unitId:		0x31,
+		functionCode:	0x18,
+		payload:	[]byte{
+			0x00, 0x06, // byte count
+			0x00, 0x02, // FIFO count
+			0x01, 0xb8, // FIFO value #1
+			0x12, 0x84, // FIFO value #2
+		},
+	})
+	res, err	= rt.readRTUFrame(nil)
+	if err != nil {
+		t.Errorf("readRTUFrame() should have succeeded, got %v", err)
+	}
+	if res.functionCode != 0x18 {
+		t.Errorf("expected 0x18 as function code, got 0x%02x", res.functionCode)
+	}
+	if len(res.payload) != 8 {
+		t.Errorf("expected a length of 8, got %v", len(res.payload))
+	}
+	for i, b := range []byte{
+		0x00, 0x06,
+		0x00, 0x02,
+		0x01, 0xb8,
+		0x12, 0x84,
+	} {
+		if res.payload[i] != b {
+			t.Errorf("expected 0x%02x at position %v, got 0x%02x",
+				 b, i, res.payload[i])
+		}
+	}
+
+	// read a read file record response
+	txchan		<- rt.assembleRTUFrame(&pdu{
+		unitId:		0x31,
+		functionCode:	0x14,
+		payload:	[]byte{
+			0x0c,       // response data length
+			0x05, 0x06, // file response length and reference type
+			0x0d, 0xfe, // register #1
+			0x00, 0x20, // register #2
+			0x05, 0x06, // file response length and reference type
+			0x33, 0xcd, // register #1
+			0x00, 0x40, // register #2
+		},
+	})
+	res, err	= rt.readRTUFrame(nil)
+	if err != nil {
+		t.Errorf("readRTUFrame() should have succeeded, got %v", err)
+	}
+	if res.functionCode != 0x14 {
+		t.Errorf("expected 0x14 as function code, got 0x%02x", res.functionCode)
+	}
+	if len(res.payload) != 13 {
+		t.Errorf("expected a length of 13, got %v", len(res.payload))
+	}
+
+	// read a read device identification response
+	txchan		<- rt.assembleRTUFrame(&pdu{
+		unitId:		0x31,
+		functionCode:	0x2b,
+		payload:	[]byte{
+			0x0e,             // MEI type
+			0x01, 0x81,       // read device id code and conformity level
+			0x00, 0x00,       // more follows and next object id
+			0x02,             // number of objects
+			0x00, 0x03,       // object #0, 3 bytes long
+			'a', 'b', 'c',
+			0x02, 0x01,       // object #2, 1 byte long
+			'1',
+		},
+	})
+	res, err	= rt.readRTUFrame(nil)
+	if err != nil {
+		t.Errorf("readRTUFrame() should have succeeded, got %v", err)
+	}
+	if res.functionCode != 0x2b {
+		t.Errorf("expected 0x2b as function code, got 0x%02x", res.functionCode)
+	}
+	if len(res.payload) != 14 {
+		t.Errorf("expected a length of 14, got %v", len(res.payload))
+	}
+
+	// read diagnostics responses, including a return query data response
+	// carrying more than 2 bytes of data, sized after the request they answer
+	for _, payload := range [][]byte{
+		{0x00, 0x0b, 0x01, 0x2c},
+		{0x00, 0x00, 0xa1, 0xa2, 0xa3, 0xa4},
+	} {
+		var diagReq	*pdu
+
+		diagReq		= &pdu{
+			unitId:		0x31,
+			functionCode:	0x08,
+			payload:	payload,
+		}
+		txchan		<- rt.assembleRTUFrame(diagReq)
+		res, err	= rt.readRTUFrame(diagReq)
+		if err != nil {
+			t.Errorf("readRTUFrame() should have succeeded, got %v", err)
+		} else if res.functionCode != 0x08 || len(res.payload) != len(payload) ||
+			  res.payload[len(payload) - 1] != payload[len(payload) - 1] {
+			t.Errorf("unexpected response: %v", res)
+		}
+	}
+
+	// read a get comm event log response
+	txchan		<- rt.assembleRTUFrame(&pdu{
+		unitId:		0x31,
+		functionCode:	0x0c,
+		payload:	[]byte{
+			0x08,       // byte count
+			0x00, 0x00, // status
+			0x01, 0x08, // event count
+			0x01, 0x21, // message count
+			0x20, 0x00, // events
+		},
+	})
+	res, err	= rt.readRTUFrame(nil)
+	if err != nil {
+		t.Errorf("readRTUFrame() should have succeeded, got %v", err)
+	}
+	if res.functionCode != 0x0c {
+		t.Errorf("expected 0x0c as function code, got 0x%02x", res.functionCode)
+	}
+	if len(res.payload) != 9 {
+		t.Errorf("expected a length of 9, got %v", len(res.payload))
+	}
+
+	// read a read exception status response
+	txchan		<- rt.assembleRTUFrame(&pdu{
+		unitId:		0x31,
+		functionCode:	0x07,
+		payload:	[]byte{0x6d},
+	})
+	res, err	= rt.readRTUFrame(nil)
+	if err != nil {
+		t.Errorf("readRTUFrame() should have succeeded, got %v", err)
+	}
+	if res.functionCode != 0x07 {
+		t.Errorf("expected 0x07 as function code, got 0x%02x", res.functionCode)
+	}
+	if len(res.payload) != 1 || res.payload[0] != 0x6d {
+		t.Errorf("expected {0x6d} as payload, got %v", res.payload)
+	}
+
+	// read a report server id response
+	txchan		<- rt.assembleRTUFrame(&pdu{
+		unitId:		0x31,
+		functionCode:	0x11,
+		payload:	[]byte{
+			0x04,             // byte count
+			0x01, 0x02, 0x03, // server id
+			0xff,             // run indicator status
+		},
+	})
+	res, err	= rt.readRTUFrame(nil)
+	if err != nil {
+		t.Errorf("readRTUFrame() should have succeeded, got %v", err)
+	}
+	if res.functionCode != 0x11 {
+		t.Errorf("expected 0x11 as function code, got 0x%02x", res.functionCode)
+	}
+	if len(res.payload) != 5 {
+		t.Errorf("expected a length of 5, got %v", len(res.payload))
+	}
+
+	// read a response to a user-defined function code, whose length can only
+	// be determined by waiting for the link to fall silent
+	// (note: this leaves an expired deadline on the pipe)
+	frame		= rt.assembleRTUFrame(&pdu{
+		unitId:		0x31,
+		functionCode:	0x41,
+		payload:	[]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06},
+	})
+	txchan		<- frame[0:5]
+	txchan		<- frame[5:]
+	res, err	= rt.readRTUFrame(nil)
+	if err != nil {
+		t.Errorf("readRTUFrame() should have succeeded, got %v", err)
+	}
+	if res.functionCode != 0x41 {
+		t.Errorf("expected 0x41 as function code, got 0x%02x", res.functionCode)
+	}
+	for i, b := range []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06} {
+		if len(res.payload) != 6 || res.payload[i] != b {
+			t.Errorf("expected 0x%02x at position %v, got %v", b, i, res.payload)
+			break
+		}
+	}
+
+	p1.Close()
+	p2.Close()
+
+	return
+}
+
+func TestRTUClientMaskWriteRegister(t *testing.T) {
+	var mc		*ModbusClient
+	var p1, p2	net.Conn
+	var rxbuf	[]byte
+	var done	chan bool
+	var err		error
+
+	p1, p2		= net.Pipe()
+	done		= make(chan bool)
+
+	mc		= &ModbusClient{
+		logger:     newLogger("test-rtu-client", nil),
+		transport:  newRTUTransport(p2, "", 19200, 100 * time.Millisecond, nil),
+		unitId:     0x11,
+		endianness: BIG_ENDIAN,
+		wordOrder:  HIGH_WORD_FIRST,
+	}
+
+	// act as the remote device: expect a request, then echo it back
+	go func() {
+		rxbuf	= make([]byte, 10)
+		_, err	:= io.ReadFull(p1, rxbuf)
+		if err != nil {
+			t.Errorf("failed to read request: %v", err)
+		}
+		_, err	= p1.Write(rxbuf)
+		if err != nil {
+			t.Errorf("failed to write response: %v", err)
+		}
+		done <- true
+	}()
+
+	err		= mc.MaskWriteRegister(0x0004, 0x00f2, 0x0025)
+	if err != nil {
+		t.Errorf("MaskWriteRegister() should have succeeded, got: %v", err)
+	}
+	<-done
+
+	for i, b := range []byte{
+		0x11, 0x16, // unit id and function code
+		0x00, 0x04, // register address
+		0x00, 0xf2, // AND mask
+		0x00, 0x25, // OR mask
+		0x66, 0xe2, // CRC
+	} {
+		if rxbuf[i] != b {
+			t.Errorf("expected 0x%02x at position %v, got 0x%02x", b, i, rxbuf[i])
+		}
+	}
+
+	// an exception response should be mapped to an error
+	go func() {
+		rxbuf	= make([]byte, 10)
+		_, err	:= io.ReadFull(p1, rxbuf)
+		if err != nil {
+			t.Errorf("failed to read request: %v", err)
+		}
+		_, err	= p1.Write(mc.transport.(*rtuTransport).assembleRTUFrame(&pdu{
+			unitId:		0x11,
+			functionCode:	0x96,
+			payload:	[]byte{exIllegalDataAddress},
+		}))
+		if err != nil {
+			t.Errorf("failed to write response: %v", err)
+		}
+		done <- true
+	}()
+
+	err		= mc.MaskWriteRegister(0x0004, 0x00f2, 0x0025)
+	if err != ErrIllegalDataAddress {
+		t.Errorf("MaskWriteRegister() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+	<-done
+
 	p1.Close()
 	p2.Close()
 
@@ -1,6 +1,7 @@
 package modbus
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/asn1"
@@ -8,8 +9,11 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,67 +22,270 @@ var modbusRoleOID asn1.ObjectIdentifier = asn1.ObjectIdentifier{
 	1, 3, 6, 1, 4, 1, 50316, 802, 1,
 }
 
+type EvictionPolicy uint
+const (
+	// reject new client connections once MaxClients is reached
+	REJECT_NEW_CLIENTS          EvictionPolicy = 0
+	// close the client connection which has been idle for the longest time
+	// to make room for the new one
+	EVICT_LEAST_RECENTLY_ACTIVE EvictionPolicy = 1
+	// close the oldest client connection to make room for the new one
+	EVICT_OLDEST                EvictionPolicy = 2
+)
+
 // Server configuration object.
 type ServerConfiguration struct {
-	// URL defines where to listen at e.g. tcp://[::]:502
+	// URL defines where to listen at e.g. tcp://[::]:502, udp://[::]:502,
+	// rtuovertcp://[::]:502, rtuoverudp://[::]:502 or rtu:///dev/ttyUSB0
 	URL           string
+	// Speed sets the serial link speed (in bps, rtu, rtuovertcp and rtuoverudp
+	// only), used to compute inter-frame delays
+	Speed         uint
+	// DataBits sets the number of bits per serial character (rtu only)
+	DataBits      uint
+	// Parity sets the serial link parity mode (rtu only)
+	Parity        uint
+	// StopBits sets the number of serial stop bits (rtu only)
+	StopBits      uint
+	// UnitIds sets the unit ids (slave ids) the server answers for (rtu,
+	// rtuovertcp and rtuoverudp only). Requests addressed to other unit ids are
+	// silently ignored. If empty, rtu servers answer for unit id 1 and
+	// rtuovertcp/rtuoverudp servers for all unit ids.
+	// Broadcasts (unit id 0) are always accepted: handlers are invoked for
+	// write requests but no response is ever sent.
+	UnitIds       []uint8
 	// Timeout sets the idle session timeout (client connections will
 	// be closed if idle for this long)
 	Timeout	      time.Duration
 	// MaxClients sets the maximum number of concurrent client connections
 	MaxClients    uint
+	// EvictionPolicy defines how new client connections are handled once
+	// MaxClients is reached (tcp, tcp+tls and rtuovertcp only): either
+	// rejected (REJECT_NEW_CLIENTS, the default) or accepted after closing
+	// an existing connection (EVICT_LEAST_RECENTLY_ACTIVE or EVICT_OLDEST),
+	// e.g. to recover from half-open connections leaked by clients.
+	// Connections rejected due to MaxClientsPerIP never cause evictions.
+	EvictionPolicy EvictionPolicy
+	// MaxClientsPerIP sets the maximum number of concurrent client connections
+	// from a single IP address (tcp, tcp+tls and rtuovertcp only).
+	// If zero, only MaxClients applies.
+	MaxClientsPerIP uint
+	// RequestTimeout sets the maximum time handlers are given to serve a
+	// request. Requests not served in time are answered with a gateway target
+	// device failed to respond exception (0x0b) and their context is cancelled.
+	// Handlers ignoring the cancellation keep running in the background and
+	// may overlap with later requests of the same session, which they should
+	// be ready for.
+	// If zero, handlers are given as much time as they need.
+	RequestTimeout time.Duration
 	// TLSServerCert sets the server-side TLS key pair (tcp+tls only)
 	TLSServerCert *tls.Certificate
 	// TLSClientCAs sets the list of CA certificates used to authenticate
 	// client connections (tcp+tls only). Leaf (i.e. client) certificates can
 	// also be used in case of self-signed certs, or if cert pinning is required.
 	TLSClientCAs  *x509.CertPool
+	// TLSGetServerCert, if set, is called on every TLS handshake to obtain the
+	// server-side key pair, taking precedence over TLSServerCert (tcp+tls only).
+	// This allows certificates to be rotated without restarting the server
+	// (see KeyPairLoader): new handshakes pick up the new certificate while
+	// established sessions are left untouched.
+	TLSGetServerCert func(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+	// TLSGetClientCAs, if set, is called on every TLS handshake to obtain the
+	// CA certificates used to authenticate the client, taking precedence over
+	// TLSClientCAs (tcp+tls only, see CertPoolLoader).
+	TLSGetClientCAs  func() (*x509.CertPool, error)
+	// TLSCRLFiles lists certificate revocation list (CRL) files, each holding
+	// either a DER-encoded CRL or one or more PEM-encoded CRLs (tcp+tls only).
+	// Handshakes with clients presenting a revoked certificate (or a
+	// certificate issued by a revoked intermediate CA) are rejected.
+	TLSCRLFiles          []string
+	// TLSCRLReloadInterval sets how often CRL files are checked for changes
+	// and reloaded. Defaults to 1 minute.
+	TLSCRLReloadInterval time.Duration
+	// TLSConfig optionally sets the base TLS configuration of the server
+	// (tcp+tls only), e.g. to restrict cipher suites, require TLS 1.3 or
+	// tune session resumption. The configuration is cloned, then completed
+	// with the TLS options above, which take precedence over their
+	// equivalents in TLSConfig (e.g. Certificates and ClientCAs).
+	// Client certificates are always required and verified, TLS versions
+	// below 1.2 are never negotiated and CRL checks (see TLSCRLFiles) run
+	// after VerifyConnection. GetConfigForClient is not supported.
+	TLSConfig            *tls.Config
+	// DeviceIdentification sets the device identification objects served in
+	// response to read device identification requests (0x2b/0x0e), as a map
+	// of object ids (e.g. OBJECT_ID_VENDOR_NAME) to values.
+	// Values must not exceed 244 bytes and object ids 0x07-0x7f are reserved.
+	// If nil, read device identification requests are rejected with an illegal
+	// function exception.
+	DeviceIdentification map[uint8]string
+	// AuthorizationPolicy restricts the requests each client role is allowed
+	// to make (see AuthorizationPolicy and LoadAuthorizationPolicy()).
+	// Roles are extracted from client certificates on tcp+tls servers, while
+	// clients of other server types are subject to the rules of the "" role.
+	// Denied requests are answered with an illegal function or illegal data
+	// address exception, without invoking the handler.
+	// If nil, all requests are passed to the handler.
+	AuthorizationPolicy *AuthorizationPolicy
 	// Logger provides a custom sink for log messages.
 	// If nil, messages will be written to stdout.
 	Logger        *log.Logger
+	// AuditLogger provides a custom sink for the audit log, recording requests
+	// denied by the authorization policy.
+	// If nil, audit messages will be written to Logger.
+	AuditLogger   *log.Logger
+	// OnConnect, if set, is called whenever a client connects (tcp, tcp+tls
+	// and rtuovertcp only), after the TLS handshake if any and before any
+	// request is served. Returning an error rejects the client, whose
+	// connection is then closed.
+	// OnConnect is called from the goroutine serving the client and may block
+	// (e.g. to look up an allowlist) without affecting other clients.
+	OnConnect     func(info *ConnectionInfo) (err error)
+	// OnDisconnect, if set, is called whenever the session of a client
+	// accepted by OnConnect ends, along with the reason why it did:
+	// io.EOF if the client closed the connection, ErrRequestTimedOut if the
+	// client was idle for longer than Timeout, ErrProtocolError if the client
+	// sent a malformed request, ErrServerStopped if the server was stopped,
+	// or the underlying socket error.
+	OnDisconnect  func(info *ConnectionInfo, reason error)
+}
+
+// Connection information object, passed to connection hooks.
+type ConnectionInfo struct {
+	ClientAddr   string              // the source (client) IP address and port
+	ClientRole   string              // the client role as encoded in the client certificate (tcp+tls only)
+	Certificates []*x509.Certificate // the certificate chain presented by the client, leaf
+	                                 // certificate first (tcp+tls only)
+	ConnectedAt  time.Time           // the time at which the connection was accepted
 }
 
 // Request object passed to the coil handler.
 type CoilsRequest struct {
-	ClientAddr string  // the source (client) IP address
-	ClientRole string  // the client role as encoded in the client certificate (tcp+tls only)
-	UnitId     uint8   // the requested unit id (slave id)
-	Addr       uint16  // the base coil address requested
-	Quantity   uint16  // the number of consecutive coils covered by this request
-	                   // (first address: Addr, last address: Addr + Quantity - 1)
-	IsWrite    bool    // true if the request is a write, false if a read
-	Args       []bool  // a slice of bool values of the coils to be set, ordered
-	                   // from Addr to Addr + Quantity - 1 (for writes only)
+	ClientAddr string          // the source (client) IP address
+	ClientRole string          // the client role as encoded in the client certificate (tcp+tls only)
+	Context    context.Context // the request context, cancelled when the client disconnects,
+	                           // the server is stopped or the request times out
+	UnitId     uint8           // the requested unit id (slave id)
+	Addr       uint16          // the base coil address requested
+	Quantity   uint16          // the number of consecutive coils covered by this request
+	                           // (first address: Addr, last address: Addr + Quantity - 1)
+	IsWrite    bool            // true if the request is a write, false if a read
+	Args       []bool          // a slice of bool values of the coils to be set, ordered
+	                           // from Addr to Addr + Quantity - 1 (for writes only)
 }
 
 // Request object passed to the discrete input handler.
 type DiscreteInputsRequest struct {
-	ClientAddr string  // the source (client) IP address
-	ClientRole string  // the client role as encoded in the client certificate (tcp+tls only)
-	UnitId     uint8   // the requested unit id (slave id)
-	Addr       uint16  // the base discrete input address requested
-	Quantity   uint16  // the number of consecutive discrete inputs covered by this request
+	ClientAddr string          // the source (client) IP address
+	ClientRole string          // the client role as encoded in the client certificate (tcp+tls only)
+	Context    context.Context // the request context, cancelled when the client disconnects,
+	                           // the server is stopped or the request times out
+	UnitId     uint8           // the requested unit id (slave id)
+	Addr       uint16          // the base discrete input address requested
+	Quantity   uint16          // the number of consecutive discrete inputs covered by this request
 }
 
 // Request object passed to the holding register handler.
 type HoldingRegistersRequest struct {
-	ClientAddr string   // the source (client) IP address
-	ClientRole string   // the client role as encoded in the client certificate (tcp+tls only)
-	UnitId     uint8    // the requested unit id (slave id)
-	Addr       uint16   // the base register address requested
-	Quantity   uint16   // the number of consecutive registers covered by this request
-	IsWrite    bool     // true if the request is a write, false if a read
-	Args       []uint16 // a slice of register values to be set, ordered from
-	                    // Addr to Addr + Quantity - 1 (for writes only)
+	ClientAddr string          // the source (client) IP address
+	ClientRole string          // the client role as encoded in the client certificate (tcp+tls only)
+	Context    context.Context // the request context, cancelled when the client disconnects,
+	                           // the server is stopped or the request times out
+	UnitId     uint8           // the requested unit id (slave id)
+	Addr       uint16          // the base register address requested
+	Quantity   uint16          // the number of consecutive registers covered by this request
+	IsWrite    bool            // true if the request is a write, false if a read
+	Args       []uint16        // a slice of register values to be set, ordered from
+	                           // Addr to Addr + Quantity - 1 (for writes only)
 }
 
 // Request object passed to the input register handler.
 type InputRegistersRequest struct {
-	ClientAddr string   // the source (client) IP address
-	ClientRole string   // the client role as encoded in the client certificate (tcp+tls only)
-	UnitId     uint8    // the requested unit id (slave id)
-	Addr       uint16   // the base register address requested
-	Quantity   uint16   // the number of consecutive registers covered by this request
+	ClientAddr string          // the source (client) IP address
+	ClientRole string          // the client role as encoded in the client certificate (tcp+tls only)
+	Context    context.Context // the request context, cancelled when the client disconnects,
+	                           // the server is stopped or the request times out
+	UnitId     uint8           // the requested unit id (slave id)
+	Addr       uint16          // the base register address requested
+	Quantity   uint16          // the number of consecutive registers covered by this request
+}
+
+// Request object passed to the mask write register handler.
+type MaskWriteRegisterRequest struct {
+	ClientAddr string          // the source (client) IP address
+	ClientRole string          // the client role as encoded in the client certificate (tcp+tls only)
+	Context    context.Context // the request context, cancelled when the client disconnects,
+	                           // the server is stopped or the request times out
+	UnitId     uint8           // the requested unit id (slave id)
+	Addr       uint16          // the address of the holding register to modify
+	AndMask    uint16          // the AND mask to apply to the current register value
+	OrMask     uint16          // the OR mask to apply to the current register value
+}
+
+// Request object passed to the read/write multiple registers handler.
+type ReadWriteRegistersRequest struct {
+	ClientAddr    string          // the source (client) IP address
+	ClientRole    string          // the client role as encoded in the client certificate (tcp+tls only)
+	Context       context.Context // the request context, cancelled when the client disconnects,
+	                              // the server is stopped or the request times out
+	UnitId        uint8           // the requested unit id (slave id)
+	ReadAddr      uint16          // the base register address to read from
+	ReadQuantity  uint16          // the number of consecutive registers to read
+	WriteAddr     uint16          // the base register address to write to
+	WriteQuantity uint16          // the number of consecutive registers to write
+	Args          []uint16        // a slice of register values to be set, ordered from
+	                              // WriteAddr to WriteAddr + WriteQuantity - 1
+}
+
+// Request object passed to the FIFO queue handler.
+type FIFOQueueRequest struct {
+	ClientAddr string          // the source (client) IP address
+	ClientRole string          // the client role as encoded in the client certificate (tcp+tls only)
+	Context    context.Context // the request context, cancelled when the client disconnects,
+	                           // the server is stopped or the request times out
+	UnitId     uint8           // the requested unit id (slave id)
+	Addr       uint16          // the address of the FIFO pointer register
+}
+
+// Request object passed to the file record handler.
+type FileRecordsRequest struct {
+	ClientAddr string          // the source (client) IP address
+	ClientRole string          // the client role as encoded in the client certificate (tcp+tls only)
+	Context    context.Context // the request context, cancelled when the client disconnects,
+	                           // the server is stopped or the request times out
+	UnitId     uint8           // the requested unit id (slave id)
+	IsWrite    bool            // true if the request is a write, false if a read
+	Records    []FileRecord    // the list of file record sub-requests, each holding a
+	                           // file number, record number and either a length (for
+	                           // reads) or data to be written (for writes)
+}
+
+// Request object passed to the exception status handler.
+type ExceptionStatusRequest struct {
+	ClientAddr string          // the source (client) IP address
+	ClientRole string          // the client role as encoded in the client certificate (tcp+tls only)
+	Context    context.Context // the request context, cancelled when the client disconnects,
+	                           // the server is stopped or the request times out
+	UnitId     uint8           // the requested unit id (slave id)
+}
+
+// Request object passed to the server id handler.
+type ServerIdRequest struct {
+	ClientAddr string          // the source (client) IP address
+	ClientRole string          // the client role as encoded in the client certificate (tcp+tls only)
+	Context    context.Context // the request context, cancelled when the client disconnects,
+	                           // the server is stopped or the request times out
+	UnitId     uint8           // the requested unit id (slave id)
+}
+
+// Request object passed to the raw handler.
+type RawRequest struct {
+	ClientAddr   string          // the source (client) IP address
+	ClientRole   string          // the client role as encoded in the client certificate (tcp+tls only)
+	Context      context.Context // the request context, cancelled when the client disconnects,
+	                             // the server is stopped or the request times out
+	UnitId       uint8           // the requested unit id (slave id)
+	FunctionCode uint8           // the function code of the request
+	Payload      []byte          // the request data following the function code
 }
 
 // The RequestHandler interface should be implemented by the handler
@@ -86,6 +293,10 @@ type InputRegistersRequest struct {
 // After decoding and validating an incoming request, the server will
 // invoke the appropriate handler function, depending on the function code
 // of the request.
+// Handlers performing lengthy operations (e.g. forwarding requests to a remote
+// device) should honor the Context of request objects, which is cancelled when
+// the client disconnects, the server is stopped or the request times out (see
+// RequestTimeout in ServerConfiguration).
 type RequestHandler interface {
 	// HandleCoils handles the read coils (0x01), write single coil (0x05)
 	// and write multiple coils (0x0f) function codes.
@@ -139,18 +350,206 @@ type RequestHandler interface {
 	HandleInputRegisters	(req *InputRegistersRequest) (res []uint16, err error)
 }
 
+// The MaskWriteRegisterHandler interface may optionally be implemented by the
+// handler object passed to NewServer, in addition to RequestHandler.
+// If it isn't, mask write register requests (0x16) are served by reading then
+// writing the target register through HandleHoldingRegisters. The server
+// serializes these read-modify-write sequences, but handlers whose registers
+// can be modified through other means should implement this interface to
+// apply both masks atomically.
+type MaskWriteRegisterHandler interface {
+	// HandleMaskWriteRegister handles the mask write register (0x16) function code.
+	// A MaskWriteRegisterRequest object is passed to the handler (see above).
+	// The new register value should be computed as
+	// (current value AND AndMask) OR (OrMask AND (NOT AndMask)).
+	//
+	// Expected return values:
+	// - err:	either nil if no error occurred, a modbus error (see
+	//		mapErrorToExceptionCode() in modbus.go for a complete list),
+	//		or any other error.
+	HandleMaskWriteRegister	(req *MaskWriteRegisterRequest) (err error)
+}
+
+// The ReadWriteRegistersHandler interface may optionally be implemented by the
+// handler object passed to NewServer, in addition to RequestHandler.
+// If it isn't, read/write multiple registers requests (0x17) are served by
+// writing then reading holding registers through HandleHoldingRegisters, with
+// the same serialization guarantees as mask write register requests (see
+// MaskWriteRegisterHandler).
+type ReadWriteRegistersHandler interface {
+	// HandleReadWriteRegisters handles the read/write multiple registers (0x17)
+	// function code. A ReadWriteRegistersRequest object is passed to the handler
+	// (see above). The write operation must be performed before the read.
+	//
+	// Expected return values:
+	// - res:	a slice of uint16 containing the register values read after
+	//		the write operation, to be sent back to the client,
+	// - err:	either nil if no error occurred, a modbus error (see
+	//		mapErrorToExceptionCode() in modbus.go for a complete list),
+	//		or any other error.
+	HandleReadWriteRegisters	(req *ReadWriteRegistersRequest) (res []uint16, err error)
+}
+
+// The FIFOQueueHandler interface may optionally be implemented by the handler
+// object passed to NewServer, in addition to RequestHandler, to expose FIFO
+// queues. If it isn't, read FIFO queue requests (0x18) are rejected with an
+// illegal function exception.
+type FIFOQueueHandler interface {
+	// HandleFIFOQueue handles the read FIFO queue (0x18) function code.
+	// A FIFOQueueRequest object is passed to the handler (see above).
+	//
+	// Expected return values:
+	// - res:	a slice of uint16 containing the queued register values,
+	//		in queue order, to be sent back to the client. Queues of
+	//		more than 31 entries are answered with an illegal data
+	//		value exception, as mandated by the spec.
+	// - err:	either nil if no error occurred, a modbus error (see
+	//		mapErrorToExceptionCode() in modbus.go for a complete list),
+	//		or any other error.
+	HandleFIFOQueue	(req *FIFOQueueRequest) (res []uint16, err error)
+}
+
+// The FileRecordHandler interface may optionally be implemented by the handler
+// object passed to NewServer, in addition to RequestHandler, to expose files.
+// If it isn't, read file record (0x14) and write file record (0x15) requests
+// are rejected with an illegal function exception.
+type FileRecordHandler interface {
+	// HandleFileRecords handles the read file record (0x14) and write file
+	// record (0x15) function codes. A FileRecordsRequest object, covering all
+	// sub-requests of the modbus request, is passed to the handler (see above).
+	//
+	// Expected return values:
+	// - res:	a slice holding, for each sub-request and in the same order,
+	//		a slice of uint16 containing the record values to be sent back
+	//		to the client (only sent for reads),
+	// - err:	either nil if no error occurred, a modbus error (see
+	//		mapErrorToExceptionCode() in modbus.go for a complete list),
+	//		or any other error.
+	HandleFileRecords	(req *FileRecordsRequest) (res [][]uint16, err error)
+}
+
+// The ExceptionStatusHandler interface may optionally be implemented by the
+// handler object passed to NewServer, in addition to RequestHandler, to answer
+// read exception status requests (0x07). If it isn't, such requests are rejected
+// with an illegal function exception.
+type ExceptionStatusHandler interface {
+	// HandleExceptionStatus handles the read exception status (0x07) function
+	// code. An ExceptionStatusRequest object is passed to the handler (see above).
+	//
+	// Expected return values:
+	// - status:	the 8 exception status bits (device specific) to be sent
+	//		back to the client,
+	// - err:	either nil if no error occurred, a modbus error (see
+	//		mapErrorToExceptionCode() in modbus.go for a complete list),
+	//		or any other error.
+	HandleExceptionStatus	(req *ExceptionStatusRequest) (status uint8, err error)
+}
+
+// The ServerIdHandler interface may optionally be implemented by the handler
+// object passed to NewServer, in addition to RequestHandler, to answer report
+// server id requests (0x11). If it isn't, such requests are rejected with an
+// illegal function exception.
+type ServerIdHandler interface {
+	// HandleServerId handles the report server id (0x11) function code.
+	// A ServerIdRequest object is passed to the handler (see above).
+	//
+	// Expected return values:
+	// - id:	the server id bytes (device specific, 250 bytes max.),
+	// - running:	the run indicator status (true if the device is running),
+	// - err:	either nil if no error occurred, a modbus error (see
+	//		mapErrorToExceptionCode() in modbus.go for a complete list),
+	//		or any other error.
+	HandleServerId		(req *ServerIdRequest) (id []byte, running bool, err error)
+}
+
+// The RawHandler interface may optionally be implemented by the handler object
+// passed to NewServer, in addition to RequestHandler, to handle function codes
+// not otherwise supported by the server (e.g. user-defined function codes 65-72
+// and 100-110). If it isn't, such requests are rejected with an illegal
+// function exception.
+type RawHandler interface {
+	// HandleRaw handles all requests carrying a function code unknown to the
+	// server. A RawRequest object is passed to the handler (see above).
+	//
+	// Expected return values:
+	// - res:	the response data (252 bytes max.) to be sent back to the
+	//		client following the function code of the request,
+	// - err:	either nil if no error occurred, a modbus error (see
+	//		mapErrorToExceptionCode() in modbus.go for a complete list),
+	//		or any other error.
+	HandleRaw		(req *RawRequest) (res []byte, err error)
+}
+
 // Modbus server object.
 type ModbusServer struct {
 	conf		ServerConfiguration
 	logger		*logger
+	auditLogger	*logger
 	lock		sync.Mutex
 	started		bool
 	handler		RequestHandler
+	rmwLock		sync.Mutex
+	ctx		context.Context
+	cancel		context.CancelFunc
+	wg		sync.WaitGroup
+	middlewares	[]Middleware
+	chain		Handler
+	sessions	map[*session]bool
+	draining	bool
+	stats		serverStats
+	crls		*crlStore
+	tlsConfig	*tls.Config
 	tcpListener	net.Listener
-	tcpClients	[]net.Conn
+	tcpClients	[]*tcpClient
+	udpSock		*net.UDPConn
+	serialTransport	transport
+	unitIds		map[uint8]bool
 	transportType	transportType
 }
 
+// tcpClient wraps an active client connection, keeping track of its activity.
+type tcpClient struct {
+	// time of the last read from the connection, as nanoseconds since the
+	// unix epoch (accessed atomically, kept first for 64-bit alignment)
+	lastActivity int64
+	net.Conn
+	connectedAt  time.Time
+	// set (with ms.lock held) when the connection is closed to make room for
+	// a new one
+	evicted      bool
+	sess         *session
+}
+
+// session tracks a link served by handleTransport().
+type session struct {
+	clientAddr string
+	clientRole string
+	// called (with ms.lock held) by Shutdown() to unblock an idle session
+	// waiting for a request, without losing any data already received (nil
+	// if the link can't be interrupted)
+	interrupt  func()
+	// used to detect disconnections while serving requests (nil if the link
+	// can't be watched)
+	dw         *disconnectWatcher
+	// true from the first byte of a request until its response is sent
+	// (guarded by ms.lock, only ever written to by the session goroutine)
+	busy       bool
+	// set by Shutdown() when interrupting an idle session (guarded by ms.lock)
+	interrupted bool
+}
+
+// sessionLink wraps the link of a session to mark the session busy as soon as
+// the first byte of a request is received, so that Shutdown() never interrupts
+// a request being received, and to stop waiting for new requests once the
+// server is shutting down.
+// The embedded net.Conn is nil on serial links.
+type sessionLink struct {
+	net.Conn
+	link rtuLink
+	ms   *ModbusServer
+	sess *session
+}
+
 // Returns a new modbus server.
 // reqHandler should be a user-provided handler object satisfying the RequestHandler
 // interface.
@@ -162,7 +561,9 @@ func NewServer(conf *ServerConfiguration, reqHandler RequestHandler) (
 	ms = &ModbusServer{
 		conf:		*conf,
 		handler:	reqHandler,
+		sessions:	map[*session]bool{},
 	}
+	ms.chain	= HandlerFunc(ms.serveModbus)
 
 	splitURL = strings.SplitN(ms.conf.URL, "://", 2)
 	if len(splitURL) == 2 {
@@ -179,7 +580,102 @@ func NewServer(conf *ServerConfiguration, reqHandler RequestHandler) (
 		return
 	}
 
+	// take a private copy of device identification objects, making sure
+	// that each object fits in a response
+	if conf.DeviceIdentification != nil {
+		ms.conf.DeviceIdentification = make(map[uint8]string)
+
+		for id, value := range conf.DeviceIdentification {
+			if id >= 0x07 && id <= 0x7f {
+				ms.logger.Errorf("reserved device identification object id 0x%02x", id)
+				err = ErrConfigurationError
+				return
+			}
+
+			if len(value) > 244 {
+				ms.logger.Errorf("device identification object 0x%02x is too long " +
+						 "(%v bytes, max. 244)", id, len(value))
+				err = ErrConfigurationError
+				return
+			}
+
+			ms.conf.DeviceIdentification[id] = value
+		}
+	}
+
 	switch serverType {
+	case "rtu":
+		// set useful defaults (see NewClient())
+		if ms.conf.Speed == 0 {
+			ms.conf.Speed	= 19200
+		}
+
+		if ms.conf.DataBits == 0 {
+			ms.conf.DataBits = 8
+		}
+
+		if ms.conf.StopBits == 0 {
+			if ms.conf.Parity == PARITY_NONE {
+				ms.conf.StopBits = 2
+			} else {
+				ms.conf.StopBits = 1
+			}
+		}
+
+		if len(ms.conf.UnitIds) == 0 {
+			ms.conf.UnitIds	= []uint8{1}
+		}
+
+		err	= ms.setUnitIds()
+		if err != nil {
+			return
+		}
+
+		ms.transportType	= modbusRTU
+
+	case "udp":
+		ms.transportType	= modbusTCPOverUDP
+
+	case "rtuovertcp":
+		if ms.conf.Timeout == 0 {
+			ms.conf.Timeout = 120 * time.Second
+		}
+
+		if ms.conf.MaxClients == 0 {
+			ms.conf.MaxClients = 10
+		}
+
+		if ms.conf.Speed == 0 {
+			ms.conf.Speed	= 19200
+		}
+
+		// answer for all unit ids unless told otherwise
+		if len(ms.conf.UnitIds) > 0 {
+			err	= ms.setUnitIds()
+			if err != nil {
+				return
+			}
+		}
+
+		ms.transportType	= modbusRTUOverTCP
+
+	case "rtuoverudp":
+		// the serial link speed is only used to compute inter-frame
+		// delays (see NewClient())
+		if ms.conf.Speed == 0 {
+			ms.conf.Speed	= 19200
+		}
+
+		// answer for all unit ids unless told otherwise
+		if len(ms.conf.UnitIds) > 0 {
+			err	= ms.setUnitIds()
+			if err != nil {
+				return
+			}
+		}
+
+		ms.transportType	= modbusRTUOverUDP
+
 	case "tcp":
 		if ms.conf.Timeout == 0 {
 			ms.conf.Timeout = 120 * time.Second
@@ -200,17 +696,25 @@ func NewServer(conf *ServerConfiguration, reqHandler RequestHandler) (
 			ms.conf.MaxClients = 10
 		}
 
-		// expect a server-side certificate
-		if ms.conf.TLSServerCert == nil {
-			ms.logger.Errorf("missing server certificate")
-			err = ErrConfigurationError
-			return
+		// load certificate revocation lists, if any
+		if len(ms.conf.TLSCRLFiles) > 0 {
+			if ms.conf.TLSCRLReloadInterval == 0 {
+				ms.conf.TLSCRLReloadInterval = 1 * time.Minute
+			}
+
+			ms.crls, err = newCRLStore(ms.conf.TLSCRLFiles,
+				ms.conf.TLSCRLReloadInterval, ms.logger)
+			if err != nil {
+				ms.logger.Errorf("failed to load CRLs: %v", err)
+				err = ErrConfigurationError
+				return
+			}
 		}
 
-		// expect a CertPool object containing at least 1 CA or
-		// leaf certificate to validate client-side certificates
-		if ms.conf.TLSClientCAs == nil {
-			ms.logger.Errorf("missing CA/client certificates")
+		// build the TLS configuration shared by all handshakes
+		ms.tlsConfig, err = ms.buildTLSConfig()
+		if err != nil {
+			ms.logger.Errorf("%v", err)
 			err = ErrConfigurationError
 			return
 		}
@@ -222,6 +726,23 @@ func NewServer(conf *ServerConfiguration, reqHandler RequestHandler) (
 		return
 	}
 
+	if ms.conf.AuthorizationPolicy != nil {
+		err = ms.conf.AuthorizationPolicy.validate()
+		if err != nil {
+			ms.logger.Errorf("invalid authorization policy: %v", err)
+			err = ErrConfigurationError
+			return
+		}
+
+		if ms.conf.AuditLogger == nil {
+			ms.conf.AuditLogger = ms.conf.Logger
+		}
+
+		ms.auditLogger = newLogger(
+			fmt.Sprintf("modbus-server(%s) [audit]", ms.conf.URL),
+			ms.conf.AuditLogger)
+	}
+
 	return
 }
 
@@ -234,8 +755,12 @@ func (ms *ModbusServer) Start() (err error) {
 		return
 	}
 
+	// create the context of all requests served until Stop() is called
+	ms.ctx, ms.cancel	= context.WithCancel(context.Background())
+	ms.draining		= false
+
 	switch ms.transportType {
-	case modbusTCP, modbusTCPOverTLS:
+	case modbusTCP, modbusTCPOverTLS, modbusRTUOverTCP:
 		// bind to a TCP socket
 		ms.tcpListener, err	= net.Listen("tcp", ms.conf.URL)
 		if err != nil {
@@ -243,8 +768,61 @@ func (ms *ModbusServer) Start() (err error) {
 		}
 
 		// accept client connections in a goroutine
+		ms.wg.Add(1)
 		go ms.acceptTCPClients()
 
+	case modbusRTU:
+		var spw		*serialPortWrapper
+		var sess	*session
+
+		// create a serial port wrapper object
+		spw = newSerialPortWrapper(&serialPortConfig{
+			Device:		ms.conf.URL,
+			Speed:		ms.conf.Speed,
+			DataBits:	ms.conf.DataBits,
+			Parity:		ms.conf.Parity,
+			StopBits:	ms.conf.StopBits,
+		})
+
+		// open the serial device
+		err = spw.Open()
+		if err != nil {
+			return
+		}
+
+		// discard potentially stale serial data
+		discard(spw)
+
+		// create the RTU transport and serve requests in a goroutine.
+		// The serial port is polled, hence doesn't need interrupting.
+		sess	= &session{
+			clientAddr: ms.conf.URL,
+		}
+		ms.serialTransport	= newRTUTransport(
+			&sessionLink{link: spw, ms: ms, sess: sess},
+			ms.conf.URL, ms.conf.Speed, 1 * time.Second, ms.conf.Logger)
+		ms.sessions[sess]	= true
+		ms.wg.Add(1)
+		go ms.handleSerialLink(sess)
+
+	case modbusTCPOverUDP, modbusRTUOverUDP:
+		var addr	*net.UDPAddr
+
+		// bind to a UDP socket
+		addr, err	= net.ResolveUDPAddr("udp", ms.conf.URL)
+		if err != nil {
+			return
+		}
+
+		ms.udpSock, err	= net.ListenUDP("udp", addr)
+		if err != nil {
+			return
+		}
+
+		// serve requests in a goroutine
+		ms.wg.Add(1)
+		go ms.acceptUDPRequests()
+
 	default:
 		err = ErrConfigurationError
 		return
@@ -265,17 +843,93 @@ func (ms *ModbusServer) Stop() (err error) {
 	}
 
 	ms.started = false
+	err	   = ms.closeAll()
+
+	return
+}
+
+// Stops accepting new client connections and requests, lets requests being
+// received or served complete and their response be sent, then closes all
+// sessions.
+// Returns once all sessions are closed and all goroutines have returned, or as
+// soon as ctx expires, in which case any remaining session is closed as with
+// Stop() and ctx.Err() is returned.
+func (ms *ModbusServer) Shutdown(ctx context.Context) (err error) {
+	var done	chan struct{}
+
+	ms.lock.Lock()
+	if !ms.started {
+		ms.lock.Unlock()
+		return
+	}
+
+	ms.started	= false
+	ms.draining	= true
+
+	// stop accepting new client connections
+	if ms.isConnectionOriented() {
+		ms.tcpListener.Close()
+	}
+
+	// interrupt idle sessions right away, while busy sessions will end as
+	// soon as they're done serving their current request
+	for sess := range ms.sessions {
+		if !sess.busy && sess.interrupt != nil {
+			sess.interrupted	= true
+			sess.interrupt()
+		}
+	}
+	ms.lock.Unlock()
 
-	if ms.transportType == modbusTCP || ms.transportType == modbusTCPOverTLS {
+	done	= make(chan struct{})
+	go func() {
+		ms.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err	= ctx.Err()
+	}
+
+	// release all resources, forcibly closing sessions which didn't make it
+	// in time
+	ms.lock.Lock()
+	ms.closeAll()
+	ms.lock.Unlock()
+
+	return
+}
+
+/*** unexported methods ***/
+// Cancels the context of all requests being served, then closes all sockets
+// and serial ports.
+// Must be called with ms.lock held.
+func (ms *ModbusServer) closeAll() (err error) {
+	// cancel the context of all requests being served
+	ms.cancel()
+
+	if ms.isConnectionOriented() {
 		// close the server socket if we're listening over TCP
 		err	= ms.tcpListener.Close()
 
 		// close all active TCP clients
-		for _, sock := range ms.tcpClients{
-			sock.Close()
+		for _, tc := range ms.tcpClients {
+			tc.Close()
 		}
 	}
 
+	if ms.transportType == modbusRTU {
+		// close the serial port, causing the transport goroutine to return
+		err	= ms.serialTransport.Close()
+	}
+
+	if ms.transportType == modbusTCPOverUDP || ms.transportType == modbusRTUOverUDP {
+		// close the UDP socket, causing the serving goroutine to return
+		err	= ms.udpSock.Close()
+	}
+
 	return
 }
 
@@ -286,6 +940,11 @@ func (ms *ModbusServer) acceptTCPClients() {
 	var sock     net.Conn
 	var err      error
 	var accepted bool
+	var clientIP string
+	var tc       *tcpClient
+	var victim   *tcpClient
+
+	defer ms.wg.Done()
 
 	for {
 		sock, err = ms.tcpListener.Accept()
@@ -299,23 +958,55 @@ func (ms *ModbusServer) acceptTCPClients() {
 			continue
 		}
 
+		clientIP	= hostOf(sock.RemoteAddr())
+		tc		= newTCPClient(sock)
+		victim		= nil
+
 		ms.lock.Lock()
-		// apply a connection limit
-		if ms.started && uint(len(ms.tcpClients)) < ms.conf.MaxClients {
+		// apply connection limits
+		if !ms.started {
+			accepted = false
+		} else if ms.conf.MaxClientsPerIP > 0 &&
+			  ms.countTCPClients(clientIP) >= ms.conf.MaxClientsPerIP {
+			accepted = false
+			ms.stats.connectionRejected()
+			ms.logger.Warningf("max. number of concurrent connections " +
+					   "per IP reached, rejecting %v", sock.RemoteAddr())
+		} else if uint(len(ms.tcpClients)) >= ms.conf.MaxClients &&
+			  ms.conf.EvictionPolicy == REJECT_NEW_CLIENTS {
+			accepted = false
+			ms.stats.connectionRejected()
+			ms.logger.Warningf("max. number of concurrent connections " +
+					   "reached, rejecting %v", sock.RemoteAddr())
+		} else {
 			accepted = true
+
+			// make room for the new client if needed
+			if uint(len(ms.tcpClients)) >= ms.conf.MaxClients {
+				victim		= ms.evictTCPClient()
+				ms.stats.connectionEvicted()
+			}
+
 			// add the new client connection to the pool
-			ms.tcpClients = append(ms.tcpClients, sock)
-		} else {
-			accepted = false
+			ms.tcpClients = append(ms.tcpClients, tc)
+			ms.sessions[tc.sess]	= true
+			ms.wg.Add(1)
 		}
 		ms.lock.Unlock()
 
+		if victim != nil {
+			ms.logger.Warningf("max. number of concurrent connections " +
+					   "reached, evicting %v to accept %v",
+					   victim.RemoteAddr(), sock.RemoteAddr())
+			// close the evicted connection, causing its goroutine to
+			// return
+			victim.Close()
+		}
+
 		if accepted {
 			// spin a client handler goroutine to serve the new client
-			go ms.handleTCPClient(sock)
+			go ms.handleTCPClient(tc)
 		} else {
-			ms.logger.Warningf("max. number of concurrent connections " +
-					   "reached, rejecting %v", sock.RemoteAddr())
 			// discard the connection
 			sock.Close()
 		}
@@ -325,487 +1016,1778 @@ func (ms *ModbusServer) acceptTCPClients() {
 	return
 }
 
-// Handles a TCP client connection.
-// Once handleTransport() returns (i.e. the connection has either closed, timed
-// out, or an unrecoverable error happened), the TCP socket is closed and removed
-// from the list of active client connections.
-func (ms *ModbusServer) handleTCPClient(sock net.Conn) {
-	var err        error
-	var clientRole string
-	var tlsSock    net.Conn
+// Reads requests off the UDP socket, one per datagram, and serves them in turn.
+// Responses are sent back to the source address of each request.
+// Since datagrams from all clients are received on the same socket, diagnostic
+// counters are shared by all clients.
+func (ms *ModbusServer) acceptUDPRequests() {
+	var rxbuf	[]byte
+	var rxlen	int
+	var addr	*net.UDPAddr
+	var err		error
+	var t		transport
+	var dc		*udpDatagramConn
+	var diag	linkDiagnostics
+	var sess	*session
+
+	defer ms.wg.Done()
+
+	sess	= &session{
+		// unblock ReadFromUDP() without closing the socket, which is
+		// still needed to answer requests being served
+		interrupt: func() {
+			ms.udpSock.SetReadDeadline(time.Now())
+		},
+	}
+	ms.lock.Lock()
+	ms.sessions[sess]	= true
+	ms.lock.Unlock()
 
-	switch ms.transportType {
-	case modbusTCP:
-		// serve modbus requests over the raw TCP connection
-		ms.handleTransport(
-			newTCPTransport(sock, ms.conf.Timeout, ms.conf.Logger),
-			sock.RemoteAddr().String(), "")
+	defer ms.removeSession(sess)
 
-	case modbusTCPOverTLS:
-		// start TLS negotiation over the raw TCP connection
-		tlsSock, clientRole, err = ms.startTLS(sock)
+	rxbuf	= make([]byte, maxTCPFrameLength)
+
+	for {
+		// stop reading datagrams once the server is shutting down
+		if ms.isDraining() {
+			return
+		}
+
+		rxlen, addr, err = ms.udpSock.ReadFromUDP(rxbuf)
 		if err != nil {
-			ms.logger.Warningf("TLS handshake with %s failed: %v",
-				sock.RemoteAddr().String(), err)
-		} else {
-			// serve modbus requests over the TLS tunnel
-			ms.handleTransport(
-				newTCPTransport(tlsSock, ms.conf.Timeout, ms.conf.Logger),
-				sock.RemoteAddr().String(), clientRole)
+			// if the socket has just been closed or the server is
+			// shutting down, return here as this goroutine isn't going
+			// to see any new request
+			if errors.Is(err, net.ErrClosed) || ms.isDraining() {
+				return
+			}
+			ms.logger.Warningf("failed to read from UDP socket: %v", err)
+			continue
 		}
 
-	default:
-		ms.logger.Errorf("unimplemented transport type %v", ms.transportType)
+		// the request is now received: let Shutdown() know it's being
+		// served
+		ms.sessionBusy(sess)
+
+		// wrap the datagram so that transports can read the request it
+		// holds and send their response back to its source
+		dc	= newUDPDatagramConn(ms.udpSock, addr, rxbuf[0:rxlen])
+
+		switch ms.transportType {
+		case modbusTCPOverUDP:
+			t	= newTCPTransport(dc, ms.conf.Timeout, ms.conf.Logger)
+		case modbusRTUOverUDP:
+			t	= newRTUTransport(
+				dc, addr.String(), ms.conf.Speed, ms.conf.Timeout, ms.conf.Logger)
+		}
+
+		// handleTransport() returns as soon as the datagram is consumed
+		sess.clientAddr	= addr.String()
+		ms.handleTransport(ms.ctx, t, sess, &diag)
 	}
+}
+
+// Handles a TCP client connection.
+// Once the session ends (i.e. the connection has either closed, timed out, or an
+// unrecoverable error happened), the TCP socket is closed and removed from the
+// list of active client connections.
+func (ms *ModbusServer) handleTCPClient(tc *tcpClient) {
+	var info   *ConnectionInfo
+	var reason error
+
+	defer ms.wg.Done()
+
+	info, reason	= ms.serveTCPClient(tc)
 
 	// once done, remove our connection from the list of active client conns
+	// (unless evicted, in which case it was removed already)
 	ms.lock.Lock()
-	for i := range ms.tcpClients {
-		if ms.tcpClients[i] == sock {
-			ms.tcpClients[i] = ms.tcpClients[len(ms.tcpClients)-1]
-			ms.tcpClients	 = ms.tcpClients[:len(ms.tcpClients)-1]
-			break
-		}
+	if tc.evicted {
+		reason	= ErrSessionEvicted
+	} else {
+		ms.removeTCPClient(tc)
 	}
+	delete(ms.sessions, tc.sess)
 	ms.lock.Unlock()
 
 	// close the connection
-	sock.Close()
+	tc.Close()
+
+	// let the application know about the end of the session, if it ever
+	// started
+	if info != nil && ms.conf.OnDisconnect != nil {
+		ms.conf.OnDisconnect(info, reason)
+	}
 
 	return
 }
 
-// For each request read from the transport, performs decoding and validation,
-// calls the user-provided handler, then encodes and writes the response
-// to the transport.
-func (ms *ModbusServer) handleTransport(t transport, clientAddr string, clientRole string) {
-	var req		*pdu
-	var res		*pdu
-	var err		error
-	var addr	uint16
-	var quantity	uint16
+// Performs the TLS handshake (if applicable), submits the client to the
+// OnConnect hook then serves requests until the session ends.
+// Returns a nil info object if the session was never established, or the
+// reason why it ended otherwise.
+func (ms *ModbusServer) serveTCPClient(tc *tcpClient) (info *ConnectionInfo, reason error) {
+	var err     error
+	var link    net.Conn
+	var tlsSock *tls.Conn
+	var srvCtx  context.Context
+	var ctx     context.Context
+	var cancel  context.CancelFunc
+	var dw      *disconnectWatcher
+	var sl      *sessionLink
+	var t       transport
+
+	info	= &ConnectionInfo{
+		ClientAddr:  tc.RemoteAddr().String(),
+		ConnectedAt: tc.connectedAt,
+	}
+	link	= tc
+
+	if ms.transportType == modbusTCPOverTLS {
+		// start TLS negotiation over the raw TCP connection
+		tlsSock, info.ClientRole, err = ms.startTLS(tc)
+		if err != nil {
+			ms.stats.tlsHandshakeFailed()
+			ms.logger.Warningf("TLS handshake with %s failed: %v",
+				info.ClientAddr, err)
+			info	= nil
+			return
+		}
+
+		info.Certificates	= tlsSock.ConnectionState().PeerCertificates
+		link			= tlsSock
+	}
+
+	// let the application accept or reject the client
+	if ms.conf.OnConnect != nil {
+		err	= ms.conf.OnConnect(info)
+		if err != nil {
+			ms.stats.connectionRejected()
+			ms.logger.Warningf("connection from %s rejected: %v",
+				info.ClientAddr, err)
+			info	= nil
+			return
+		}
+	}
+
+	// the connection is only counted as accepted once the TLS handshake
+	// and the OnConnect hook have both succeeded
+	ms.stats.connectionAccepted()
+
+	// derive the session context from the server context, to be cancelled
+	// as soon as the client disconnects
+	srvCtx		= ms.ctx
+	ctx, cancel	= context.WithCancel(srvCtx)
+	defer cancel()
+
+	dw		= newDisconnectWatcher(link, cancel)
+	sl		= &sessionLink{Conn: dw, link: dw, ms: ms, sess: tc.sess}
+	tc.sess.dw	= dw
+	tc.sess.clientRole	= info.ClientRole
+
+	// from now on, let Shutdown() unblock the session with a read deadline
+	// rather than by closing the connection, which would cause requests
+	// being received to be lost
+	ms.lock.Lock()
+	tc.sess.interrupt	= func() {
+		link.SetReadDeadline(time.Now())
+	}
+	if ms.draining {
+		ms.lock.Unlock()
+		reason	= ErrServerStopped
+		return
+	}
+	ms.lock.Unlock()
+
+	switch ms.transportType {
+	case modbusTCP, modbusTCPOverTLS:
+		// serve modbus requests over the raw TCP connection or TLS tunnel
+		t	= newTCPTransport(sl, ms.conf.Timeout, ms.conf.Logger)
+
+	case modbusRTUOverTCP:
+		var rt	*rtuTransport
+
+		// serve modbus requests over the raw TCP connection, using RTU
+		// framing. The session timeout applies between requests while
+		// frames are expected to be received in one go.
+		rt		= newRTUTransport(sl, info.ClientAddr,
+					  ms.conf.Speed, 1 * time.Second, ms.conf.Logger)
+		rt.idleTimeout	= ms.conf.Timeout
+		t		= rt
+
+	default:
+		ms.logger.Errorf("unimplemented transport type %v", ms.transportType)
+		reason	= ErrConfigurationError
+		return
+	}
+
+	reason	= ms.handleTransport(ctx, t, tc.sess, &linkDiagnostics{})
+
+	// report sessions closed by Stop() as such rather than with whichever
+	// socket error they ended on
+	if srvCtx.Err() != nil {
+		reason	= ErrServerStopped
+	} else if os.IsTimeout(reason) {
+		reason	= ErrRequestTimedOut
+	}
+
+	return
+}
+
+// Serves requests received over the serial port until it is closed.
+func (ms *ModbusServer) handleSerialLink(sess *session) {
+	defer ms.wg.Done()
+	defer ms.removeSession(sess)
+
+	ms.handleTransport(ms.ctx, ms.serialTransport, sess, &linkDiagnostics{})
+
+	return
+}
+
+// Returns true if the server is shutting down.
+func (ms *ModbusServer) isDraining() (yes bool) {
+	ms.lock.Lock()
+	yes	= ms.draining
+	ms.lock.Unlock()
+
+	return
+}
+
+// Marks a session as idle (i.e. waiting for a request).
+func (ms *ModbusServer) sessionIdle(sess *session) {
+	ms.lock.Lock()
+	sess.busy	= false
+	ms.lock.Unlock()
+
+	return
+}
+
+// Marks a session as busy serving a request.
+// Returns true if Shutdown() interrupted the session while it was idle.
+func (ms *ModbusServer) sessionBusy(sess *session) (interrupted bool) {
+	ms.lock.Lock()
+	sess.busy		= true
+	interrupted		= sess.interrupted
+	sess.interrupted	= false
+	ms.lock.Unlock()
+
+	return
+}
+
+// Reads from the link, refusing to wait for a new request once the server is
+// shutting down and marking the session busy as soon as data is received.
+func (sl *sessionLink) Read(buf []byte) (rlen int, err error) {
+	// keep reading the rest of the request being received
+	if sl.sess.busy {
+		rlen, err	= sl.link.Read(buf)
+		return
+	}
+
+	// bytes left over from the previous request (e.g. pipelined requests)
+	// were received before the server started shutting down
+	if !sl.buffered() && sl.ms.isDraining() {
+		err	= ErrServerStopped
+		return
+	}
+
+	rlen, err	= sl.link.Read(buf)
+	if rlen > 0 {
+		// if Shutdown() interrupted the session in the meantime, give the
+		// rest of the request a chance to arrive
+		if sl.ms.sessionBusy(sl.sess) {
+			sl.link.SetDeadline(time.Now().Add(sl.ms.conf.Timeout))
+		}
+	} else if err != nil && sl.ms.isDraining() {
+		err	= ErrServerStopped
+	}
+
+	return
+}
+
+func (sl *sessionLink) Write(buf []byte) (wlen int, err error) {
+	wlen, err	= sl.link.Write(buf)
+
+	return
+}
+
+func (sl *sessionLink) Close() (err error) {
+	err	= sl.link.Close()
+
+	return
+}
+
+func (sl *sessionLink) SetDeadline(deadline time.Time) (err error) {
+	err	= sl.link.SetDeadline(deadline)
+
+	return
+}
+
+// Returns true if the link holds received data which can be read without
+// blocking.
+func (sl *sessionLink) buffered() (yes bool) {
+	var dw	*disconnectWatcher
+	var ok	bool
+
+	dw, ok	= sl.link.(*disconnectWatcher)
+	yes	= ok && len(dw.pending) > 0
+
+	return
+}
+
+// Removes a session from the list of active sessions.
+func (ms *ModbusServer) removeSession(sess *session) {
+	ms.lock.Lock()
+	delete(ms.sessions, sess)
+	ms.lock.Unlock()
+
+	return
+}
+
+// Returns the number of active client connections originating from clientIP.
+// Must be called with ms.lock held.
+func (ms *ModbusServer) countTCPClients(clientIP string) (count uint) {
+	for _, tc := range ms.tcpClients {
+		if hostOf(tc.RemoteAddr()) == clientIP {
+			count++
+		}
+	}
+
+	return
+}
+
+// Removes a connection from the list of active client connections.
+// Must be called with ms.lock held.
+func (ms *ModbusServer) removeTCPClient(tc *tcpClient) {
+	for i := range ms.tcpClients {
+		if ms.tcpClients[i] == tc {
+			ms.tcpClients[i] = ms.tcpClients[len(ms.tcpClients)-1]
+			ms.tcpClients	 = ms.tcpClients[:len(ms.tcpClients)-1]
+			break
+		}
+	}
+
+	return
+}
+
+// Picks an active client connection according to the eviction policy, removes
+// it from the list of active client connections and marks it as evicted.
+// The caller is expected to close the connection once ms.lock is released.
+// Must be called with ms.lock held.
+func (ms *ModbusServer) evictTCPClient() (victim *tcpClient) {
+	for _, tc := range ms.tcpClients {
+		if victim == nil {
+			victim	= tc
+			continue
+		}
+
+		switch ms.conf.EvictionPolicy {
+		case EVICT_LEAST_RECENTLY_ACTIVE:
+			if tc.lastActive().Before(victim.lastActive()) {
+				victim	= tc
+			}
+		case EVICT_OLDEST:
+			if tc.connectedAt.Before(victim.connectedAt) {
+				victim	= tc
+			}
+		}
+	}
+
+	if victim != nil {
+		victim.evicted	= true
+		ms.removeTCPClient(victim)
+	}
+
+	return
+}
+
+// For each request read from the transport, performs decoding and validation,
+// calls the user-provided handler, then encodes and writes the response
+// to the transport.
+// Diagnostic counters and the comm event log are kept in diag, which is owned
+// by the caller.
+// Request contexts are derived from ctx.
+// Returns the error which caused the link to be given up on.
+func (ms *ModbusServer) handleTransport(ctx context.Context, t transport,
+	sess *session, diag *linkDiagnostics) (err error) {
+	var req		*pdu
+	var res		*pdu
+	var broadcast	bool
+	var startedAt	time.Time
+	var clientAddr	= sess.clientAddr
+	var clientRole	= sess.clientRole
 
 	for {
+		// let Shutdown() know the session is waiting for a request: links
+		// wrapped in a sessionLink stop waiting once the server is
+		// shutting down
+		ms.sessionIdle(sess)
+
 		req, err = t.ReadRequest()
+		// corrupted frames are counted and dropped
+		if err == ErrBadCRC || err == ErrShortFrame {
+			diag.commErrorReceived()
+			ms.stats.protocolError()
+			continue
+		}
+		if err != nil {
+			if err == ErrProtocolError {
+				ms.stats.protocolError()
+			}
+			return
+		}
+
+		// let Shutdown() know a request is being served
+		ms.sessionBusy(sess)
+
+		// with RTU framing, unit id 0 is used for broadcasts, which are
+		// never answered. Only write requests are acted upon.
+		broadcast	= req.unitId == 0 && ms.isRTUFramed()
+		if broadcast {
+			diag.broadcastReceived()
+
+			if !isBroadcastable(req.functionCode) {
+				diag.noResponseSent()
+				continue
+			}
+		} else if ms.unitIds != nil && !ms.unitIds[req.unitId] {
+			// on serial links, silently ignore requests addressed to
+			// other devices
+			diag.busMessageReceived()
+			continue
+		} else {
+			diag.messageReceived()
+		}
+
+		// while in listen only mode, requests are monitored but neither acted
+		// upon nor answered, except for restart communications requests
+		if diag.isListenOnly() && !isRestartCommunications(req) {
+			diag.noResponseSent()
+			continue
+		}
+
+		// pass the request through the middleware chain, then enforce the
+		// authorization policy, decode and serve the request
+		startedAt	= time.Now()
+		res, err	= ms.serveRequest(
+			ctx, sess.dw, req, clientAddr, clientRole, diag)
+		ms.stats.requestServed(req.functionCode, time.Since(startedAt))
+
+		// if there was no error processing the request but the response is nil
+		// (which should never happen), emit a server failure exception code
+		// and log an error
+		if err == nil && res == nil {
+			err = ErrServerDeviceFailure
+			ms.logger.Errorf("internal server error (req: %v, res: %v, err: %v)",
+					 req, res, err)
+		}
+
+		// map go errors to modbus errors, unless the error is a protocol error,
+		// in which case close the transport and return.
+		if err != nil {
+			if err == ErrNoResponse {
+				// the handler asked for the request to be dropped
+				diag.noResponseSent()
+				continue
+			} else if err == ErrProtocolError && !ms.isConnectionOriented() {
+				// serial lines and UDP sockets can't be closed: drop
+				// the request
+				ms.stats.protocolError()
+				ms.logger.Warningf(
+					"protocol error, dropping request (client address: '%s')",
+					clientAddr)
+				diag.noResponseSent()
+				continue
+			} else if err == ErrProtocolError {
+				ms.stats.protocolError()
+				ms.logger.Warningf(
+					"protocol error, closing link (client address: '%s')",
+					clientAddr)
+				t.Close()
+				return
+			} else {
+				res = &pdu{
+					unitId:		req.unitId,
+					functionCode:	(0x80 | req.functionCode),
+					payload:	[]byte{mapErrorToExceptionCode(err)},
+				}
+			}
+		}
+
+		// do not answer broadcasts, even with an exception
+		if broadcast {
+			diag.noResponseSent()
+			continue
+		}
+
+		// update diagnostic counters and the comm event log
+		if res.functionCode & 0x80 == 0x80 {
+			diag.responseSent(req.functionCode, res.payload[0])
+			ms.stats.exceptionSent(res.payload[0])
+		} else {
+			diag.responseSent(req.functionCode, 0x00)
+		}
+
+		// write the response to the transport
+		err	= t.WriteResponse(res)
+		if err != nil {
+			ms.logger.Warningf("failed to write response: %v", err)
+		}
+
+		// avoid holding on to stale data
+		req	= nil
+		res	= nil
+	}
+
+	// never reached
+	return
+}
+
+// setUnitIds builds the set of unit ids the server answers for.
+func (ms *ModbusServer) setUnitIds() (err error) {
+	ms.unitIds	= make(map[uint8]bool)
+
+	// unit id 0 is reserved for broadcasts and 248-255 are reserved by the spec
+	for _, unitId := range ms.conf.UnitIds {
+		if unitId == 0 || unitId > 247 {
+			ms.logger.Errorf("invalid unit id %v (valid: 1-247)", unitId)
+			err = ErrConfigurationError
+			return
+		}
+		ms.unitIds[unitId]	= true
+	}
+
+	return
+}
+
+// Checks req against the authorization policy, if any.
+// Denied requests are logged to the audit log.
+func (ms *ModbusServer) authorize(req *pdu, clientAddr string, clientRole string) (err error) {
+	var accesses	[]tableAccess
+	var ok		bool
+
+	if ms.conf.AuthorizationPolicy == nil {
+		return
+	}
+
+	// deny requests which can't be decoded rather than letting them through
+	// unchecked, treating them as the protocol errors they are
+	accesses, ok	= describeAccesses(req)
+	if !ok {
+		err	= ErrProtocolError
+		ms.auditLogger.Warningf("denied malformed request (client address: '%s', " +
+					"role: '%s', unit id: %v, function code: 0x%02x): %v",
+					clientAddr, clientRole, req.unitId,
+					req.functionCode, err)
+		return
+	}
+
+	err		= ms.conf.AuthorizationPolicy.authorize(req, clientRole, accesses)
+	if err != nil {
+		ms.auditLogger.Warningf("denied request (client address: '%s', " +
+					"role: '%s', unit id: %v, function code: 0x%02x, " +
+					"accesses: %v): %v",
+					clientAddr, clientRole, req.unitId,
+					req.functionCode, accesses, err)
+	}
+
+	return
+}
+
+// isConnectionOriented returns true if the server runs over TCP, where links
+// can be closed on protocol errors.
+func (ms *ModbusServer) isConnectionOriented() (yes bool) {
+	yes	= ms.transportType == modbusTCP ||
+		  ms.transportType == modbusTCPOverTLS ||
+		  ms.transportType == modbusRTUOverTCP
+
+	return
+}
+
+// isRTUFramed returns true if the server uses RTU framing, where unit id 0 is
+// used for broadcasts.
+func (ms *ModbusServer) isRTUFramed() (yes bool) {
+	yes	= ms.transportType == modbusRTU ||
+		  ms.transportType == modbusRTUOverTCP ||
+		  ms.transportType == modbusRTUOverUDP
+
+	return
+}
+
+// isRestartCommunications returns true if req is a restart communications
+// option diagnostics request.
+func isRestartCommunications(req *pdu) (yes bool) {
+	yes	= req.functionCode == fcDiagnostics && len(req.payload) >= 2 &&
+		  bytesToUint16(BIG_ENDIAN, req.payload[0:2]) == diagRestartCommunications
+
+	return
+}
+
+// Serves a request through dispatch(), with a context cancelled when the
+// link goes down (if dw is not nil), when the server is stopped or when the
+// request times out.
+// Returns ErrGWTargetFailedToRespond if the request timed out, or ErrNoResponse
+// if the request was abandoned as the link went down or the server stopped.
+func (ms *ModbusServer) serveRequest(ctx context.Context, dw *disconnectWatcher,
+	req *pdu, clientAddr string, clientRole string, diag *linkDiagnostics) (
+	res *pdu, err error) {
+	var reqCtx	context.Context
+	var cancel	context.CancelFunc
+	var done	chan struct{}
+	var hRes	*pdu
+	var hErr	error
+
+	if ms.conf.RequestTimeout > 0 {
+		reqCtx, cancel	= context.WithTimeout(ctx, ms.conf.RequestTimeout)
+	} else {
+		reqCtx, cancel	= context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	// with nothing to wait for but the handler, call it from this goroutine
+	if dw == nil && ms.conf.RequestTimeout == 0 {
+		res, err	= ms.dispatch(reqCtx, req, clientAddr, clientRole, diag)
+		return
+	}
+
+	// otherwise, run the handler in the background while waiting for either
+	// its response, a disconnection, the server to stop or the deadline.
+	// Shutdown() waits for the handler to return even if it is given up on.
+	done	= make(chan struct{})
+	ms.wg.Add(1)
+	go func() {
+		defer ms.wg.Done()
+		hRes, hErr	= ms.dispatch(reqCtx, req, clientAddr, clientRole, diag)
+		close(done)
+	}()
+
+	if dw != nil {
+		dw.start()
+		defer dw.stop()
+	}
+
+	select {
+	case <-done:
+		res, err	= hRes, hErr
+
+	case <-reqCtx.Done():
+		if ctx.Err() != nil {
+			// the link went down or the server is stopping: there is
+			// nobody left to answer
+			err	= ErrNoResponse
+		} else {
+			ms.logger.Warningf("request timed out (client address: '%s', " +
+					   "unit id: %v, function code: 0x%02x)",
+					   clientAddr, req.unitId, req.functionCode)
+			err	= ErrGWTargetFailedToRespond
+		}
+	}
+
+	return
+}
+
+// Decodes and validates a request, calls the appropriate user-provided handler
+// then encodes its response.
+// Returns ErrNoResponse when no response is to be sent.
+func (ms *ModbusServer) handleRequest(ctx context.Context, req *pdu,
+	clientAddr string, clientRole string, diag *linkDiagnostics) (
+	res *pdu, err error) {
+	var addr	uint16
+	var quantity	uint16
+
+	switch req.functionCode {
+	case fcReadCoils, fcReadDiscreteInputs:
+		var coils	[]bool
+		var resCount	int
+
+		if len(req.payload) != 4 {
+			err = ErrProtocolError
+			break
+		}
+
+		// decode address and quantity fields
+		addr		= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
+		quantity	= bytesToUint16(BIG_ENDIAN, req.payload[2:4])
+
+		// ensure the reply never exceeds the maximum PDU length and we
+		// never read past 0xffff
+		if quantity > 2000 || quantity == 0 {
+			err	= ErrProtocolError
+			break
+		}
+		if uint32(addr) + uint32(quantity) - 1 > 0xffff {
+			err	= ErrIllegalDataAddress
+			break
+		}
+
+		// invoke the appropriate handler
+		if req.functionCode == fcReadCoils {
+			coils, err	= ms.handler.HandleCoils(&CoilsRequest{
+				ClientAddr: clientAddr,
+				ClientRole: clientRole,
+				Context:    ctx,
+				UnitId:     req.unitId,
+				Addr:       addr,
+				Quantity:   quantity,
+				IsWrite:    false,
+				Args:       nil,
+			})
+		} else {
+			coils, err	= ms.handler.HandleDiscreteInputs(
+				&DiscreteInputsRequest{
+					ClientAddr: clientAddr,
+					ClientRole: clientRole,
+					Context:    ctx,
+					UnitId:     req.unitId,
+					Addr:       addr,
+					Quantity:   quantity,
+				})
+		}
+		resCount	= len(coils)
+
+		// make sure the handler returned the expected number of items
+		if err == nil && resCount != int(quantity) {
+			ms.logger.Errorf("handler returned %v bools, " +
+				         "expected %v", resCount, quantity)
+			err = ErrServerDeviceFailure
+			break
+		}
+
+		if err != nil {
+			break
+		}
+
+		// assemble a response PDU
+		res = &pdu{
+			unitId:		req.unitId,
+			functionCode:	req.functionCode,
+			payload:	[]byte{0},
+		}
+
+		// byte count (1 byte for 8 coils)
+		res.payload[0]	= uint8(resCount / 8)
+		if resCount % 8 != 0 {
+			res.payload[0]++
+		}
+
+		// coil values
+		res.payload	= append(res.payload, encodeBools(coils)...)
+
+	case fcWriteSingleCoil:
+		if len(req.payload) != 4 {
+			err = ErrProtocolError
+			break
+		}
+
+		// decode the address field
+		addr	= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
+
+		// validate the value field (should be either 0xff00 or 0x0000)
+		if ((req.payload[2] != 0xff && req.payload[2] != 0x00) ||
+		    req.payload[3] != 0x00) {
+			err = ErrProtocolError
+			break
+		}
+
+		// invoke the coil handler
+		_, err	= ms.handler.HandleCoils(&CoilsRequest{
+			ClientAddr: clientAddr,
+			ClientRole: clientRole,
+			Context:    ctx,
+			UnitId:     req.unitId,
+			Addr:       addr,
+			Quantity:   1, // request for a single coil
+			IsWrite:    true, // this is a write request
+			Args:       []bool{(req.payload[2] == 0xff)},
+		})
+
 		if err != nil {
-			return
+			break
 		}
 
-		switch req.functionCode {
-		case fcReadCoils, fcReadDiscreteInputs:
-			var coils	[]bool
-			var resCount	int
+		// assemble a response PDU
+		res = &pdu{
+			unitId:		req.unitId,
+			functionCode:	req.functionCode,
+		}
 
-			if len(req.payload) != 4 {
-				err = ErrProtocolError
-				break
-			}
+		// echo the address and value in the response
+		res.payload	= append(res.payload,
+					 uint16ToBytes(BIG_ENDIAN, addr)...)
+		res.payload	= append(res.payload,
+					 req.payload[2], req.payload[3])
 
-			// decode address and quantity fields
-			addr		= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
-			quantity	= bytesToUint16(BIG_ENDIAN, req.payload[2:4])
+	case fcWriteMultipleCoils:
+		var expectedLen	int
 
-			// ensure the reply never exceeds the maximum PDU length and we
-			// never read past 0xffff
-			if quantity > 2000 || quantity == 0 {
-				err	= ErrProtocolError
-				break
-			}
-			if uint32(addr) + uint32(quantity) - 1 > 0xffff {
-				err	= ErrIllegalDataAddress
-				break
-			}
+		if len(req.payload) < 6 {
+			err = ErrProtocolError
+			break
+		}
+
+		// decode address and quantity fields
+		addr		= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
+		quantity	= bytesToUint16(BIG_ENDIAN, req.payload[2:4])
+
+		// ensure the reply never exceeds the maximum PDU length and we
+		// never read past 0xffff
+		if quantity > 0x7b0 || quantity == 0 {
+			err	= ErrProtocolError
+			break
+		}
+		if uint32(addr) + uint32(quantity) - 1 > 0xffff {
+			err	= ErrIllegalDataAddress
+			break
+		}
 
-			// invoke the appropriate handler
-			if req.functionCode == fcReadCoils {
-				coils, err	= ms.handler.HandleCoils(&CoilsRequest{
+		// validate the byte count field (1 byte for 8 coils)
+		expectedLen	= int(quantity) / 8
+		if quantity % 8 != 0 {
+			expectedLen++
+		}
+
+		if req.payload[4] != uint8(expectedLen) {
+			err	= ErrProtocolError
+			break
+		}
+
+		// make sure we have enough bytes
+		if len(req.payload) - 5 != expectedLen {
+			err	= ErrProtocolError
+			break
+		}
+
+		// invoke the coil handler
+		_, err	= ms.handler.HandleCoils(&CoilsRequest{
+			ClientAddr: clientAddr,
+			ClientRole: clientRole,
+			Context:    ctx,
+			UnitId:     req.unitId,
+			Addr:       addr,
+			Quantity:   quantity,
+			IsWrite:    true, // this is a write request
+			Args:       decodeBools(quantity, req.payload[5:]),
+		})
+
+		if err != nil {
+			break
+		}
+
+		// assemble a response PDU
+		res = &pdu{
+			unitId:		req.unitId,
+			functionCode:	req.functionCode,
+		}
+
+		// echo the address and quantity in the response
+		res.payload	= append(res.payload,
+					 uint16ToBytes(BIG_ENDIAN, addr)...)
+		res.payload	= append(res.payload,
+					 uint16ToBytes(BIG_ENDIAN, quantity)...)
+
+	case fcReadHoldingRegisters, fcReadInputRegisters:
+		var regs	[]uint16
+		var resCount	int
+
+		if len(req.payload) != 4 {
+			err = ErrProtocolError
+			break
+		}
+
+		// decode address and quantity fields
+		addr		= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
+		quantity	= bytesToUint16(BIG_ENDIAN, req.payload[2:4])
+
+		// ensure the reply never exceeds the maximum PDU length and we
+		// never read past 0xffff
+		if quantity > 0x007d || quantity == 0 {
+			err	= ErrProtocolError
+			break
+		}
+		if uint32(addr) + uint32(quantity) - 1 > 0xffff {
+			err	= ErrIllegalDataAddress
+			break
+		}
+
+		// invoke the appropriate handler
+		if req.functionCode == fcReadHoldingRegisters {
+			regs, err	= ms.handler.HandleHoldingRegisters(
+				&HoldingRegistersRequest{
 					ClientAddr: clientAddr,
 					ClientRole: clientRole,
+					Context:    ctx,
 					UnitId:     req.unitId,
 					Addr:       addr,
 					Quantity:   quantity,
 					IsWrite:    false,
 					Args:       nil,
 				})
-			} else {
-				coils, err	= ms.handler.HandleDiscreteInputs(
-					&DiscreteInputsRequest{
-						ClientAddr: clientAddr,
-						ClientRole: clientRole,
-						UnitId:     req.unitId,
-						Addr:       addr,
-						Quantity:   quantity,
-					})
-			}
-			resCount	= len(coils)
+		} else {
+			regs, err	= ms.handler.HandleInputRegisters(
+				&InputRegistersRequest{
+					ClientAddr: clientAddr,
+					ClientRole: clientRole,
+					Context:    ctx,
+					UnitId:     req.unitId,
+					Addr:       addr,
+					Quantity:   quantity,
+				})
+		}
+		resCount	= len(regs)
 
-			// make sure the handler returned the expected number of items
-			if err == nil && resCount != int(quantity) {
-				ms.logger.Errorf("handler returned %v bools, " +
-					         "expected %v", resCount, quantity)
-				err = ErrServerDeviceFailure
-				break
-			}
+		// make sure the handler returned the expected number of items
+		if err == nil && resCount != int(quantity) {
+			ms.logger.Errorf("handler returned %v 16-bit values, " +
+				         "expected %v", resCount, quantity)
+			err = ErrServerDeviceFailure
+			break
+		}
 
-			if err != nil {
-				break
-			}
+		if err != nil {
+			break
+		}
 
-			// assemble a response PDU
-			res = &pdu{
-				unitId:		req.unitId,
-				functionCode:	req.functionCode,
-				payload:	[]byte{0},
-			}
+		// assemble a response PDU
+		res = &pdu{
+			unitId:		req.unitId,
+			functionCode:	req.functionCode,
+			payload:	[]byte{0},
+		}
 
-			// byte count (1 byte for 8 coils)
-			res.payload[0]	= uint8(resCount / 8)
-			if resCount % 8 != 0 {
-				res.payload[0]++
-			}
+		// byte count (2 bytes per register)
+		res.payload[0]	= uint8(resCount * 2)
 
-			// coil values
-			res.payload	= append(res.payload, encodeBools(coils)...)
+		// register values
+		res.payload	= append(res.payload,
+					 uint16sToBytes(BIG_ENDIAN, regs)...)
 
-		case fcWriteSingleCoil:
-			if len(req.payload) != 4 {
-				err = ErrProtocolError
-				break
-			}
+	case fcWriteSingleRegister:
+		var value	uint16
 
-			// decode the address field
-			addr	= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
+		if len(req.payload) != 4 {
+			err = ErrProtocolError
+			break
+		}
 
-			// validate the value field (should be either 0xff00 or 0x0000)
-			if ((req.payload[2] != 0xff && req.payload[2] != 0x00) ||
-			    req.payload[3] != 0x00) {
-				err = ErrProtocolError
-				break
-			}
+		// decode address and value fields
+		addr	= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
+		value	= bytesToUint16(BIG_ENDIAN, req.payload[2:4])
+
+		// invoke the handler
+		_, err	= ms.handler.HandleHoldingRegisters(
+			&HoldingRegistersRequest{
+				ClientAddr: clientAddr,
+				ClientRole: clientRole,
+				Context:    ctx,
+				UnitId:     req.unitId,
+				Addr:       addr,
+				Quantity:   1, // request for a single register
+				IsWrite:    true, // request is a write
+				Args:       []uint16{value},
+			})
+
+		if err != nil {
+			break
+		}
+
+		// assemble a response PDU
+		res = &pdu{
+			unitId:		req.unitId,
+			functionCode:	req.functionCode,
+		}
+
+		// echo the address and value in the response
+		res.payload	= append(res.payload,
+					 uint16ToBytes(BIG_ENDIAN, addr)...)
+		res.payload	= append(res.payload,
+					 uint16ToBytes(BIG_ENDIAN, value)...)
+
+	case fcWriteMultipleRegisters:
+		var expectedLen	int
+
+		if len(req.payload) < 6 {
+			err = ErrProtocolError
+			break
+		}
+
+		// decode address and quantity fields
+		addr		= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
+		quantity	= bytesToUint16(BIG_ENDIAN, req.payload[2:4])
+
+		// ensure the reply never exceeds the maximum PDU length and we
+		// never read past 0xffff
+		if quantity > 0x007b || quantity == 0 {
+			err	= ErrProtocolError
+			break
+		}
+		if uint32(addr) + uint32(quantity) - 1 > 0xffff {
+			err	= ErrIllegalDataAddress
+			break
+		}
 
-			// invoke the coil handler
-			_, err	= ms.handler.HandleCoils(&CoilsRequest{
+		// validate the byte count field (2 bytes per register)
+		expectedLen	= int(quantity) * 2
+
+		if req.payload[4] != uint8(expectedLen) {
+			err	= ErrProtocolError
+			break
+		}
+
+		// make sure we have enough bytes
+		if len(req.payload) - 5 != expectedLen {
+			err	= ErrProtocolError
+			break
+		}
+
+		// invoke the holding register handler
+		_, err		= ms.handler.HandleHoldingRegisters(
+			&HoldingRegistersRequest{
 				ClientAddr: clientAddr,
 				ClientRole: clientRole,
+				Context:    ctx,
 				UnitId:     req.unitId,
 				Addr:       addr,
-				Quantity:   1, // request for a single coil
+				Quantity:   quantity,
 				IsWrite:    true, // this is a write request
-				Args:       []bool{(req.payload[2] == 0xff)},
+				Args:       bytesToUint16s(BIG_ENDIAN, req.payload[5:]),
 			})
+		if err != nil {
+			break
+		}
 
-			if err != nil {
-				break
-			}
+		// assemble a response PDU
+		res = &pdu{
+			unitId:		req.unitId,
+			functionCode:	req.functionCode,
+		}
 
-			// assemble a response PDU
-			res = &pdu{
-				unitId:		req.unitId,
-				functionCode:	req.functionCode,
-			}
+		// echo the address and quantity in the response
+		res.payload	= append(res.payload,
+					 uint16ToBytes(BIG_ENDIAN, addr)...)
+		res.payload	= append(res.payload,
+					 uint16ToBytes(BIG_ENDIAN, quantity)...)
 
-			// echo the address and value in the response
-			res.payload	= append(res.payload,
-						 uint16ToBytes(BIG_ENDIAN, addr)...)
-			res.payload	= append(res.payload,
-						 req.payload[2], req.payload[3])
+	case fcMaskWriteRegister:
+		if len(req.payload) != 6 {
+			err = ErrProtocolError
+			break
+		}
+
+		// decode address, AND mask and OR mask fields, then
+		// apply both masks to the target register
+		err	= ms.maskWriteRegister(&MaskWriteRegisterRequest{
+			ClientAddr: clientAddr,
+			ClientRole: clientRole,
+			Context:    ctx,
+			UnitId:     req.unitId,
+			Addr:       bytesToUint16(BIG_ENDIAN, req.payload[0:2]),
+			AndMask:    bytesToUint16(BIG_ENDIAN, req.payload[2:4]),
+			OrMask:     bytesToUint16(BIG_ENDIAN, req.payload[4:6]),
+		})
+		if err != nil {
+			break
+		}
+
+		// assemble a response PDU
+		res = &pdu{
+			unitId:		req.unitId,
+			functionCode:	req.functionCode,
+		}
+
+		// echo the address, AND mask and OR mask in the response
+		res.payload	= append(res.payload, req.payload...)
+
+	case fcReadWriteMultipleRegisters:
+		var regs		[]uint16
+		var readAddr		uint16
+		var readQuantity	uint16
+		var writeQuantity	uint16
+		var expectedLen		int
+
+		if len(req.payload) < 11 {
+			err = ErrProtocolError
+			break
+		}
+
+		// decode read address and quantity, then write address
+		// and quantity fields
+		readAddr	= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
+		readQuantity	= bytesToUint16(BIG_ENDIAN, req.payload[2:4])
+		addr		= bytesToUint16(BIG_ENDIAN, req.payload[4:6])
+		writeQuantity	= bytesToUint16(BIG_ENDIAN, req.payload[6:8])
+
+		// ensure the reply never exceeds the maximum PDU length and we
+		// never read or write past 0xffff
+		if readQuantity > 0x007d || readQuantity == 0 {
+			err	= ErrProtocolError
+			break
+		}
+		if writeQuantity > 0x0079 || writeQuantity == 0 {
+			err	= ErrProtocolError
+			break
+		}
+		if uint32(readAddr) + uint32(readQuantity) - 1 > 0xffff ||
+		   uint32(addr) + uint32(writeQuantity) - 1 > 0xffff {
+			err	= ErrIllegalDataAddress
+			break
+		}
+
+		// validate the byte count field (2 bytes per register)
+		expectedLen	= int(writeQuantity) * 2
+
+		if req.payload[8] != uint8(expectedLen) {
+			err	= ErrProtocolError
+			break
+		}
+
+		// make sure we have enough bytes
+		if len(req.payload) - 9 != expectedLen {
+			err	= ErrProtocolError
+			break
+		}
+
+		// perform the write, then the read
+		regs, err	= ms.readWriteRegisters(&ReadWriteRegistersRequest{
+			ClientAddr:    clientAddr,
+			ClientRole:    clientRole,
+			Context:       ctx,
+			UnitId:        req.unitId,
+			ReadAddr:      readAddr,
+			ReadQuantity:  readQuantity,
+			WriteAddr:     addr,
+			WriteQuantity: writeQuantity,
+			Args:          bytesToUint16s(BIG_ENDIAN, req.payload[9:]),
+		})
+
+		// make sure the handler returned the expected number of items
+		if err == nil && len(regs) != int(readQuantity) {
+			ms.logger.Errorf("handler returned %v 16-bit values, " +
+				         "expected %v", len(regs), readQuantity)
+			err = ErrServerDeviceFailure
+			break
+		}
+
+		if err != nil {
+			break
+		}
+
+		// assemble a response PDU
+		res = &pdu{
+			unitId:		req.unitId,
+			functionCode:	req.functionCode,
+			payload:	[]byte{0},
+		}
+
+		// byte count (2 bytes per register)
+		res.payload[0]	= uint8(len(regs) * 2)
+
+		// register values
+		res.payload	= append(res.payload,
+					 uint16sToBytes(BIG_ENDIAN, regs)...)
+
+	case fcReadExceptionStatus:
+		var esh		ExceptionStatusHandler
+		var ok		bool
+		var status	uint8
+
+		if len(req.payload) != 0 {
+			err = ErrProtocolError
+			break
+		}
+
+		// exception status requests are only supported if the handler
+		// implements ExceptionStatusHandler
+		esh, ok	= ms.handler.(ExceptionStatusHandler)
+		if !ok {
+			err	= ErrIllegalFunction
+			break
+		}
+
+		status, err	= esh.HandleExceptionStatus(&ExceptionStatusRequest{
+			ClientAddr: clientAddr,
+			ClientRole: clientRole,
+			Context:    ctx,
+			UnitId:     req.unitId,
+		})
+		if err != nil {
+			break
+		}
+
+		// assemble a response PDU
+		res = &pdu{
+			unitId:		req.unitId,
+			functionCode:	req.functionCode,
+			payload:	[]byte{status},
+		}
+
+	case fcReportServerId:
+		var sih		ServerIdHandler
+		var ok		bool
+		var id		[]byte
+		var running	bool
+
+		if len(req.payload) != 0 {
+			err = ErrProtocolError
+			break
+		}
+
+		// report server id requests are only supported if the handler
+		// implements ServerIdHandler
+		sih, ok	= ms.handler.(ServerIdHandler)
+		if !ok {
+			err	= ErrIllegalFunction
+			break
+		}
+
+		id, running, err	= sih.HandleServerId(&ServerIdRequest{
+			ClientAddr: clientAddr,
+			ClientRole: clientRole,
+			Context:    ctx,
+			UnitId:     req.unitId,
+		})
+		if err != nil {
+			break
+		}
+
+		// make sure the byte count, server id and run indicator fit
+		// in a single response
+		if len(id) > 250 {
+			ms.logger.Errorf("handler returned a %v-byte server id, " +
+					 "expected 250 bytes max.", len(id))
+			err	= ErrServerDeviceFailure
+			break
+		}
+
+		// assemble a response PDU
+		res = &pdu{
+			unitId:		req.unitId,
+			functionCode:	req.functionCode,
+		}
+
+		// byte count (server id + 1 byte of run indicator)
+		res.payload	= append(res.payload, uint8(len(id) + 1))
+		// server id
+		res.payload	= append(res.payload, id...)
+		// run indicator status
+		if running {
+			res.payload	= append(res.payload, 0xff)
+		} else {
+			res.payload	= append(res.payload, 0x00)
+		}
+
+	case fcReadFifoQueue:
+		var fh		FIFOQueueHandler
+		var ok		bool
+		var regs	[]uint16
+
+		if len(req.payload) != 2 {
+			err = ErrProtocolError
+			break
+		}
+
+		// FIFO queues are only supported if the handler implements
+		// FIFOQueueHandler
+		fh, ok	= ms.handler.(FIFOQueueHandler)
+		if !ok {
+			err	= ErrIllegalFunction
+			break
+		}
+
+		// decode the FIFO pointer address and invoke the handler
+		regs, err	= fh.HandleFIFOQueue(&FIFOQueueRequest{
+			ClientAddr: clientAddr,
+			ClientRole: clientRole,
+			Context:    ctx,
+			UnitId:     req.unitId,
+			Addr:       bytesToUint16(BIG_ENDIAN, req.payload[0:2]),
+		})
+		if err != nil {
+			break
+		}
+
+		// the queue count must not exceed 31
+		if len(regs) > 31 {
+			err	= ErrIllegalDataValue
+			break
+		}
+
+		// assemble a response PDU
+		res = &pdu{
+			unitId:		req.unitId,
+			functionCode:	req.functionCode,
+		}
+
+		// byte count (2 bytes of FIFO count + 2 bytes per register)
+		res.payload	= append(res.payload,
+					 uint16ToBytes(BIG_ENDIAN, uint16(2 + len(regs) * 2))...)
+		// FIFO count
+		res.payload	= append(res.payload,
+					 uint16ToBytes(BIG_ENDIAN, uint16(len(regs)))...)
+		// register values
+		res.payload	= append(res.payload,
+					 uint16sToBytes(BIG_ENDIAN, regs)...)
+
+	case fcReadFileRecord, fcWriteFileRecord:
+		var frh		FileRecordHandler
+		var ok		bool
+		var records	[]FileRecord
+		var values	[][]uint16
+
+		// validate the byte count field
+		if len(req.payload) < 1 ||
+		   int(req.payload[0]) != len(req.payload) - 1 {
+			err = ErrProtocolError
+			break
+		}
+
+		// file records are only supported if the handler implements
+		// FileRecordHandler
+		frh, ok	= ms.handler.(FileRecordHandler)
+		if !ok {
+			err	= ErrIllegalFunction
+			break
+		}
+
+		// decode sub-requests
+		records, err	= decodeFileRecords(
+			req.payload[1:], req.functionCode == fcWriteFileRecord)
+		if err != nil {
+			break
+		}
+
+		// invoke the file record handler
+		values, err	= frh.HandleFileRecords(&FileRecordsRequest{
+			ClientAddr: clientAddr,
+			ClientRole: clientRole,
+			Context:    ctx,
+			UnitId:     req.unitId,
+			IsWrite:    req.functionCode == fcWriteFileRecord,
+			Records:    records,
+		})
+		if err != nil {
+			break
+		}
+
+		// assemble a response PDU
+		res = &pdu{
+			unitId:		req.unitId,
+			functionCode:	req.functionCode,
+		}
+
+		// echo the request in write responses
+		if req.functionCode == fcWriteFileRecord {
+			res.payload	= append(res.payload, req.payload...)
+			break
+		}
 
-		case fcWriteMultipleCoils:
-			var expectedLen	int
+		// make sure the handler returned the expected number of items
+		if len(values) != len(records) {
+			ms.logger.Errorf("handler returned %v records, expected %v",
+					 len(values), len(records))
+			err	= ErrServerDeviceFailure
+			break
+		}
 
-			if len(req.payload) < 6 {
-				err = ErrProtocolError
+		// response data length, filled in below
+		res.payload	= []byte{0}
+
+		for i := range records {
+			if len(values[i]) != int(records[i].Length) {
+				ms.logger.Errorf("handler returned %v 16-bit values " +
+						 "for record #%v, expected %v",
+						 len(values[i]), i, records[i].Length)
+				err	= ErrServerDeviceFailure
 				break
 			}
 
-			// decode address and quantity fields
-			addr		= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
-			quantity	= bytesToUint16(BIG_ENDIAN, req.payload[2:4])
+			// file response length (1 byte of reference type +
+			// 2 bytes per register)
+			res.payload	= append(res.payload, uint8(1 + 2 * len(values[i])))
+			// reference type
+			res.payload	= append(res.payload, 0x06)
+			// record values
+			res.payload	= append(res.payload,
+						 uint16sToBytes(BIG_ENDIAN, values[i])...)
+		}
+
+		if err != nil {
+			break
+		}
+
+		res.payload[0]	= uint8(len(res.payload) - 1)
+
+	case fcEncapsulatedInterface:
+		var payload	[]byte
+
+		if len(req.payload) < 1 {
+			err = ErrProtocolError
+			break
+		}
+
+		// only the read device identification MEI type is supported,
+		// and only if device identification objects were configured
+		if req.payload[0] != meiReadDeviceIdentification ||
+		   ms.conf.DeviceIdentification == nil {
+			err	= ErrIllegalFunction
+			break
+		}
+
+		if len(req.payload) != 3 {
+			err = ErrProtocolError
+			break
+		}
+
+		// decode the read device id code and object id fields
+		payload, err	= ms.readDeviceIdentification(
+			DeviceIdCategory(req.payload[1]), req.payload[2])
+		if err != nil {
+			break
+		}
 
-			// ensure the reply never exceeds the maximum PDU length and we
-			// never read past 0xffff
-			if quantity > 0x7b0 || quantity == 0 {
-				err	= ErrProtocolError
-				break
-			}
-			if uint32(addr) + uint32(quantity) - 1 > 0xffff {
-				err	= ErrIllegalDataAddress
-				break
-			}
+		// assemble a response PDU
+		res = &pdu{
+			unitId:		req.unitId,
+			functionCode:	req.functionCode,
+			payload:	payload,
+		}
 
-			// validate the byte count field (1 byte for 8 coils)
-			expectedLen	= int(quantity) / 8
-			if quantity % 8 != 0 {
-				expectedLen++
-			}
+	case fcDiagnostics, fcGetCommEventCounter, fcGetCommEventLog:
+		res, err	= diag.handleRequest(req)
 
-			if req.payload[4] != uint8(expectedLen) {
-				err	= ErrProtocolError
-				break
-			}
+		// some diagnostics requests call for no response at all
+		if err == nil && res == nil {
+			err	= ErrNoResponse
+		}
 
-			// make sure we have enough bytes
-			if len(req.payload) - 5 != expectedLen {
-				err	= ErrProtocolError
-				break
-			}
+	default:
+		var rh		RawHandler
+		var ok		bool
+		var payload	[]byte
+
+		// pass unknown function codes to the handler if it implements
+		// RawHandler
+		rh, ok	= ms.handler.(RawHandler)
+		if !ok || req.functionCode & 0x80 == 0x80 {
+			// let the caller reply with an illegal function exception
+			// to indicate that the server does not know how to handle
+			// this function code
+			err	= ErrIllegalFunction
+			break
+		}
 
-			// invoke the coil handler
-			_, err	= ms.handler.HandleCoils(&CoilsRequest{
-				ClientAddr: clientAddr,
-				ClientRole: clientRole,
-				UnitId:     req.unitId,
-				Addr:       addr,
-				Quantity:   quantity,
-				IsWrite:    true, // this is a write request
-				Args:       decodeBools(quantity, req.payload[5:]),
-			})
+		payload, err	= rh.HandleRaw(&RawRequest{
+			ClientAddr:   clientAddr,
+			ClientRole:   clientRole,
+			Context:      ctx,
+			UnitId:       req.unitId,
+			FunctionCode: req.functionCode,
+			Payload:      req.payload,
+		})
+		if err != nil {
+			break
+		}
 
-			if err != nil {
-				break
-			}
+		// make sure the response fits in a single PDU
+		if len(payload) > 252 {
+			ms.logger.Errorf("handler returned %v bytes, " +
+					 "expected 252 bytes max.", len(payload))
+			err	= ErrServerDeviceFailure
+			break
+		}
 
-			// assemble a response PDU
-			res = &pdu{
-				unitId:		req.unitId,
-				functionCode:	req.functionCode,
-			}
+		// assemble a response PDU
+		res = &pdu{
+			unitId:		req.unitId,
+			functionCode:	req.functionCode,
+			payload:	payload,
+		}
+	}
 
-			// echo the address and quantity in the response
-			res.payload	= append(res.payload,
-						 uint16ToBytes(BIG_ENDIAN, addr)...)
-			res.payload	= append(res.payload,
-						 uint16ToBytes(BIG_ENDIAN, quantity)...)
+	return
+}
 
-		case fcReadHoldingRegisters, fcReadInputRegisters:
-			var regs	[]uint16
-			var resCount	int
+// maskWriteRegister applies the AND and OR masks of a mask write register request
+// to the target holding register, either by passing the request to the handler
+// if it implements MaskWriteRegisterHandler or by performing a read-modify-write
+// sequence through HandleHoldingRegisters.
+func (ms *ModbusServer) maskWriteRegister(req *MaskWriteRegisterRequest) (err error) {
+	var mwrh	MaskWriteRegisterHandler
+	var ok		bool
+
+	// let the handler apply the masks itself if it knows how to
+	mwrh, ok	= ms.handler.(MaskWriteRegisterHandler)
+	if ok {
+		err	= mwrh.HandleMaskWriteRegister(req)
+		return
+	}
 
-			if len(req.payload) != 4 {
-				err = ErrProtocolError
-				break
-			}
+	err	= rmwMaskWriteRegister(ms.handler, &ms.rmwLock, ms.logger, req)
 
-			// decode address and quantity fields
-			addr		= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
-			quantity	= bytesToUint16(BIG_ENDIAN, req.payload[2:4])
+	return
+}
 
-			// ensure the reply never exceeds the maximum PDU length and we
-			// never read past 0xffff
-			if quantity > 0x007d || quantity == 0 {
-				err	= ErrProtocolError
-				break
-			}
-			if uint32(addr) + uint32(quantity) - 1 > 0xffff {
-				err	= ErrIllegalDataAddress
-				break
-			}
+// rmwMaskWriteRegister applies a mask write register request by reading then
+// writing the target register through the HandleHoldingRegisters method of
+// handler, while holding rmwLock.
+func rmwMaskWriteRegister(handler RequestHandler, rmwLock *sync.Mutex, l *logger,
+	req *MaskWriteRegisterRequest) (err error) {
+	var regs	[]uint16
+	var value	uint16
+
+	// prevent concurrent read-modify-write sequences from interleaving
+	rmwLock.Lock()
+	defer rmwLock.Unlock()
+
+	// read the current register value
+	regs, err	= handler.HandleHoldingRegisters(&HoldingRegistersRequest{
+		ClientAddr: req.ClientAddr,
+		ClientRole: req.ClientRole,
+		Context:    req.Context,
+		UnitId:     req.UnitId,
+		Addr:       req.Addr,
+		Quantity:   1,
+		IsWrite:    false,
+		Args:       nil,
+	})
+	if err != nil {
+		return
+	}
 
-			// invoke the appropriate handler
-			if req.functionCode == fcReadHoldingRegisters {
-				regs, err	= ms.handler.HandleHoldingRegisters(
-					&HoldingRegistersRequest{
-						ClientAddr: clientAddr,
-						ClientRole: clientRole,
-						UnitId:     req.unitId,
-						Addr:       addr,
-						Quantity:   quantity,
-						IsWrite:    false,
-						Args:       nil,
-					})
-			} else {
-				regs, err	= ms.handler.HandleInputRegisters(
-					&InputRegistersRequest{
-						ClientAddr: clientAddr,
-						ClientRole: clientRole,
-						UnitId:     req.unitId,
-						Addr:       addr,
-						Quantity:   quantity,
-					})
-			}
-			resCount	= len(regs)
+	// make sure the handler returned the expected number of items
+	if len(regs) != 1 {
+		l.Errorf("handler returned %v 16-bit values, expected 1", len(regs))
+		err	= ErrServerDeviceFailure
+		return
+	}
 
-			// make sure the handler returned the expected number of items
-			if err == nil && resCount != int(quantity) {
-				ms.logger.Errorf("handler returned %v 16-bit values, " +
-					         "expected %v", resCount, quantity)
-				err = ErrServerDeviceFailure
-				break
-			}
+	// compute the new value (see section 6.16 of the modbus application
+	// protocol spec) and write it back
+	value		= (regs[0] & req.AndMask) | (req.OrMask & ^req.AndMask)
+	_, err		= handler.HandleHoldingRegisters(&HoldingRegistersRequest{
+		ClientAddr: req.ClientAddr,
+		ClientRole: req.ClientRole,
+		Context:    req.Context,
+		UnitId:     req.UnitId,
+		Addr:       req.Addr,
+		Quantity:   1,
+		IsWrite:    true,
+		Args:       []uint16{value},
+	})
 
-			if err != nil {
-				break
-			}
+	return
+}
 
-			// assemble a response PDU
-			res = &pdu{
-				unitId:		req.unitId,
-				functionCode:	req.functionCode,
-				payload:	[]byte{0},
-			}
+// readWriteRegisters performs the write then read operations of a read/write
+// multiple registers request, either by passing the request to the handler if
+// it implements ReadWriteRegistersHandler or through HandleHoldingRegisters.
+func (ms *ModbusServer) readWriteRegisters(req *ReadWriteRegistersRequest) (
+	res []uint16, err error) {
+	var rwrh	ReadWriteRegistersHandler
+	var ok		bool
+
+	// let the handler perform both operations itself if it knows how to
+	rwrh, ok	= ms.handler.(ReadWriteRegistersHandler)
+	if ok {
+		res, err	= rwrh.HandleReadWriteRegisters(req)
+		return
+	}
 
-			// byte count (2 bytes per register)
-			res.payload[0]	= uint8(resCount * 2)
+	res, err	= rmwReadWriteRegisters(ms.handler, &ms.rmwLock, req)
 
-			// register values
-			res.payload	= append(res.payload,
-						 uint16sToBytes(BIG_ENDIAN, regs)...)
+	return
+}
 
-		case fcWriteSingleRegister:
-			var value	uint16
+// rmwReadWriteRegisters performs the write then read operations of a read/write
+// multiple registers request through the HandleHoldingRegisters method of
+// handler, while holding rmwLock.
+func rmwReadWriteRegisters(handler RequestHandler, rmwLock *sync.Mutex,
+	req *ReadWriteRegistersRequest) (res []uint16, err error) {
+	// prevent concurrent read-modify-write sequences from interleaving
+	rmwLock.Lock()
+	defer rmwLock.Unlock()
+
+	// write first...
+	_, err		= handler.HandleHoldingRegisters(&HoldingRegistersRequest{
+		ClientAddr: req.ClientAddr,
+		ClientRole: req.ClientRole,
+		Context:    req.Context,
+		UnitId:     req.UnitId,
+		Addr:       req.WriteAddr,
+		Quantity:   req.WriteQuantity,
+		IsWrite:    true,
+		Args:       req.Args,
+	})
+	if err != nil {
+		return
+	}
 
-			if len(req.payload) != 4 {
-				err = ErrProtocolError
-				break
-			}
+	// ...then read
+	res, err	= handler.HandleHoldingRegisters(&HoldingRegistersRequest{
+		ClientAddr: req.ClientAddr,
+		ClientRole: req.ClientRole,
+		Context:    req.Context,
+		UnitId:     req.UnitId,
+		Addr:       req.ReadAddr,
+		Quantity:   req.ReadQuantity,
+		IsWrite:    false,
+		Args:       nil,
+	})
 
-			// decode address and value fields
-			addr	= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
-			value	= bytesToUint16(BIG_ENDIAN, req.payload[2:4])
+	return
+}
 
-			// invoke the handler
-			_, err	= ms.handler.HandleHoldingRegisters(
-				&HoldingRegistersRequest{
-					ClientAddr: clientAddr,
-					ClientRole: clientRole,
-					UnitId:     req.unitId,
-					Addr:       addr,
-					Quantity:   1, // request for a single register
-					IsWrite:    true, // request is a write
-					Args:       []uint16{value},
-				})
+// readDeviceIdentification encodes the configured device identification objects
+// matching the requested category, starting at objectId, as the payload of a
+// read device identification response.
+// Objects which do not fit in the response are left for the client to request
+// in a subsequent transaction (see the more follows and next object id fields).
+func (ms *ModbusServer) readDeviceIdentification(category DeviceIdCategory, objectId uint8) (
+	payload []byte, err error) {
+	var ids		[]int
+	var lastId	int
+	var conformity	uint8
+	var value	string
+	var ok		bool
+
+	// sort object ids to serve them in ascending order
+	for id := range ms.conf.DeviceIdentification {
+		ids	= append(ids, int(id))
+	}
+	sort.Ints(ids)
+
+	// derive the conformity level from the identification category of the
+	// objects we have: basic, regular (0x03-0x06) or extended (0x80-0xff),
+	// always with individual access support (0x80)
+	conformity	= 0x81
+	for _, id := range ids {
+		if id >= 0x03 && id <= 0x06 && conformity < 0x82 {
+			conformity	= 0x82
+		}
+		if id >= 0x80 {
+			conformity	= 0x83
+		}
+	}
 
-			if err != nil {
-				break
-			}
+	// MEI type, read device id code, conformity level, more follows,
+	// next object id and number of objects
+	payload	= []byte{
+		meiReadDeviceIdentification, uint8(category), conformity, 0x00, 0x00, 0x00,
+	}
 
-			// assemble a response PDU
-			res = &pdu{
-				unitId:		req.unitId,
-				functionCode:	req.functionCode,
-			}
+	switch category {
+	case DEVICE_ID_BASIC:		lastId	= 0x02
+	case DEVICE_ID_REGULAR:		lastId	= 0x06
+	case DEVICE_ID_EXTENDED:	lastId	= 0xff
+	case DEVICE_ID_INDIVIDUAL:
+		// individually accessed objects must exist
+		value, ok	= ms.conf.DeviceIdentification[objectId]
+		if !ok {
+			err	= ErrIllegalDataAddress
+			return
+		}
 
-			// echo the address and value in the response
-			res.payload	= append(res.payload,
-						 uint16ToBytes(BIG_ENDIAN, addr)...)
-			res.payload	= append(res.payload,
-						 uint16ToBytes(BIG_ENDIAN, value)...)
+		payload[5]	= 1
+		payload		= append(payload, objectId, uint8(len(value)))
+		payload		= append(payload, value...)
+		return
 
-		case fcWriteMultipleRegisters:
-			var expectedLen	int
+	default:
+		err	= ErrIllegalDataValue
+		return
+	}
 
-			if len(req.payload) < 6 {
-				err = ErrProtocolError
-				break
-			}
+	// restart from the first object if the requested object is unknown
+	// or not part of the requested category
+	_, ok	= ms.conf.DeviceIdentification[objectId]
+	if !ok || int(objectId) > lastId {
+		objectId	= 0x00
+	}
 
-			// decode address and quantity fields
-			addr		= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
-			quantity	= bytesToUint16(BIG_ENDIAN, req.payload[2:4])
+	for _, id := range ids {
+		if id < int(objectId) || id > lastId {
+			continue
+		}
+		value	= ms.conf.DeviceIdentification[uint8(id)]
+
+		// if this object doesn't fit in the response (252 bytes max.
+		// excluding the function code), let the client know that more
+		// objects follow, starting with this one
+		if len(payload) + 2 + len(value) > 252 {
+			payload[3]	= 0xff
+			payload[4]	= uint8(id)
+			break
+		}
 
-			// ensure the reply never exceeds the maximum PDU length and we
-			// never read past 0xffff
-			if quantity > 0x007b || quantity == 0 {
-				err	= ErrProtocolError
-				break
-			}
-			if uint32(addr) + uint32(quantity) - 1 > 0xffff {
-				err	= ErrIllegalDataAddress
-				break
-			}
+		payload		= append(payload, uint8(id), uint8(len(value)))
+		payload		= append(payload, value...)
+		payload[5]++
+	}
 
-			// validate the byte count field (2 bytes per register)
-			expectedLen	= int(quantity) * 2
+	return
+}
 
-			if req.payload[4] != uint8(expectedLen) {
-				err	= ErrProtocolError
-				break
-			}
+// decodeFileRecords decodes the sub-requests of a read file record (0x14) or
+// write file record (0x15) request, not including the leading byte count field.
+func decodeFileRecords(payload []byte, isWrite bool) (records []FileRecord, err error) {
+	var record	FileRecord
+	var resLength	int
 
-			// make sure we have enough bytes
-			if len(req.payload) - 5 != expectedLen {
-				err	= ErrProtocolError
-				break
-			}
+	// make sure the request fits in a PDU
+	if len(payload) > 0xfb || (!isWrite && len(payload) > 0xf5) {
+		err	= ErrProtocolError
+		return
+	}
 
-			// invoke the holding register handler
-			_, err		= ms.handler.HandleHoldingRegisters(
-				&HoldingRegistersRequest{
-					ClientAddr: clientAddr,
-					ClientRole: clientRole,
-					UnitId:     req.unitId,
-					Addr:       addr,
-					Quantity:   quantity,
-					IsWrite:    true, // this is a write request
-					Args:       bytesToUint16s(BIG_ENDIAN, req.payload[5:]),
-				})
-			if err != nil {
-				break
-			}
+	for len(payload) > 0 {
+		// each sub-request starts with a 7-byte header: reference type,
+		// file number, record number and record length
+		if len(payload) < 7 {
+			err	= ErrProtocolError
+			return
+		}
 
-			// assemble a response PDU
-			res = &pdu{
-				unitId:		req.unitId,
-				functionCode:	req.functionCode,
-			}
+		record	= FileRecord{
+			FileNumber:	bytesToUint16(BIG_ENDIAN, payload[1:3]),
+			RecordNumber:	bytesToUint16(BIG_ENDIAN, payload[3:5]),
+			Length:		bytesToUint16(BIG_ENDIAN, payload[5:7]),
+		}
 
-			// echo the address and quantity in the response
-			res.payload	= append(res.payload,
-						 uint16ToBytes(BIG_ENDIAN, addr)...)
-			res.payload	= append(res.payload,
-						 uint16ToBytes(BIG_ENDIAN, quantity)...)
-
-		default:
-			res = &pdu{
-				// reply with the request target unit ID
-				unitId:		req.unitId,
-				// set the error bit
-				functionCode:	(0x80 | req.functionCode),
-				// set the exception code to illegal function to indicate that
-				// the server does not know how to handle this function code.
-				payload:	[]byte{exIllegalFunction},
-			}
+		if record.Length == 0 {
+			err	= ErrProtocolError
+			return
 		}
 
-		// if there was no error processing the request but the response is nil
-		// (which should never happen), emit a server failure exception code
-		// and log an error
-		if err == nil && res == nil {
-			err = ErrServerDeviceFailure
-			ms.logger.Errorf("internal server error (req: %v, res: %v, err: %v)",
-					 req, res, err)
+		// the reference type must be 6, file numbers must be non-zero
+		// and record numbers must be in the 0-9999 range
+		if payload[0] != 0x06 || record.FileNumber == 0 ||
+		   record.RecordNumber > 0x270f {
+			err	= ErrIllegalDataAddress
+			return
 		}
 
-		// map go errors to modbus errors, unless the error is a protocol error,
-		// in which case close the transport and return.
-		if err != nil {
-			if err == ErrProtocolError {
-				ms.logger.Warningf(
-					"protocol error, closing link (client address: '%s')",
-					clientAddr)
-				t.Close()
+		if isWrite {
+			// make sure we have enough bytes of record data
+			if len(payload) - 7 < 2 * int(record.Length) {
+				err	= ErrProtocolError
 				return
-			} else {
-				res = &pdu{
-					unitId:		req.unitId,
-					functionCode:	(0x80 | req.functionCode),
-					payload:	[]byte{mapErrorToExceptionCode(err)},
-				}
 			}
-		}
 
-		// write the response to the transport
-		err	= t.WriteResponse(res)
-		if err != nil {
-			ms.logger.Warningf("failed to write response: %v", err)
+			record.Data	= bytesToUint16s(
+				BIG_ENDIAN, payload[7:7 + 2 * int(record.Length)])
+			payload		= payload[7 + 2 * int(record.Length):]
+		} else {
+			// ensure the reply never exceeds the maximum PDU length
+			resLength	+= 2 + 2 * int(record.Length)
+			if resLength > 0xf5 {
+				err	= ErrProtocolError
+				return
+			}
+
+			payload		= payload[7:]
 		}
 
-		// avoid holding on to stale data
-		req	= nil
-		res	= nil
+		records	= append(records, record)
 	}
 
-	// never reached
 	return
 }
 
@@ -822,17 +2804,7 @@ func (ms *ModbusServer) startTLS(tcpSock net.Conn) (
 	}
 
 	// start TLS negotiation over the raw TCP connection
-	tlsSock = tls.Server(tcpSock, &tls.Config{
-		Certificates: []tls.Certificate{
-			*ms.conf.TLSServerCert,
-		},
-		ClientCAs:    ms.conf.TLSClientCAs,
-		// require a valid (verified) certificate from the client
-		// (see R-06, R-08 and R-10 of the MBAPS spec)
-		ClientAuth:   tls.RequireAndVerifyClientCert,
-		// mandate TLSv1.2 or higher (see R-01 of the MBAPS spec)
-		MinVersion:   tls.VersionTLS12,
-	})
+	tlsSock = tls.Server(tcpSock, ms.tlsConfig)
 
 	// complete the full TLS handshake (with client cert validation)
 	err = tlsSock.Handshake()
@@ -854,6 +2826,105 @@ func (ms *ModbusServer) startTLS(tcpSock net.Conn) (
 	return
 }
 
+// buildTLSConfig clones the base TLS configuration, if any, and completes it
+// with the server certificate, client CAs and MBAPS requirements.
+// The same configuration is used for all handshakes, so that session tickets
+// issued to clients remain valid across connections.
+func (ms *ModbusServer) buildTLSConfig() (tlsConfig *tls.Config, err error) {
+	if ms.conf.TLSConfig != nil {
+		tlsConfig = ms.conf.TLSConfig.Clone()
+	} else {
+		tlsConfig = &tls.Config{}
+	}
+
+	// configurations returned by GetConfigForClient would escape the
+	// requirements enforced below
+	if tlsConfig.GetConfigForClient != nil {
+		err = errors.New("GetConfigForClient is not supported in TLSConfig")
+		return
+	}
+
+	// mandate TLSv1.2 or higher (see R-01 of the MBAPS spec)
+	err = requireTLS12(tlsConfig)
+	if err != nil {
+		return
+	}
+
+	// require a valid (verified) certificate from the client
+	// (see R-06, R-08 and R-10 of the MBAPS spec)
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+
+	if ms.conf.TLSServerCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{
+			*ms.conf.TLSServerCert,
+		}
+	}
+
+	// when set, the certificate provider is called on every handshake so
+	// that rotated certificates are picked up
+	if ms.conf.TLSGetServerCert != nil {
+		tlsConfig.GetCertificate = ms.conf.TLSGetServerCert
+	}
+
+	if ms.conf.TLSClientCAs != nil {
+		tlsConfig.ClientCAs = ms.conf.TLSClientCAs
+	}
+
+	// expect a server-side certificate
+	if len(tlsConfig.Certificates) == 0 && tlsConfig.GetCertificate == nil {
+		err = errors.New("missing server certificate")
+		return
+	}
+
+	// expect a CertPool object containing at least 1 CA or
+	// leaf certificate to validate client-side certificates
+	if tlsConfig.ClientCAs == nil && ms.conf.TLSGetClientCAs == nil {
+		err = errors.New("missing CA/client certificates")
+		return
+	}
+
+	// reject revoked client certificates, after any check from the base
+	// configuration
+	if ms.crls != nil {
+		tlsConfig.VerifyConnection = chainConnectionVerifiers(
+			tlsConfig.VerifyConnection, ms.crls.verifyConnection)
+	}
+
+	// fetch client CAs from the provider on every handshake
+	if ms.conf.TLSGetClientCAs != nil {
+		tlsConfig.GetConfigForClient = ms.getConfigForClient
+	}
+
+	return
+}
+
+// getConfigForClient returns the TLS configuration of a new handshake, using
+// client CAs obtained from the TLSGetClientCAs provider.
+// Session ticket keys of ms.tlsConfig keep being used (see
+// tls.Config.GetConfigForClient).
+func (ms *ModbusServer) getConfigForClient(*tls.ClientHelloInfo) (
+	tlsConfig *tls.Config, err error) {
+	var clientCAs	*x509.CertPool
+
+	clientCAs, err	= ms.conf.TLSGetClientCAs()
+	if err != nil {
+		err	= fmt.Errorf("failed to get client CAs: %w", err)
+		return
+	}
+
+	// never fall back to the system roots
+	if clientCAs == nil {
+		err	= errors.New("no client CAs available")
+		return
+	}
+
+	tlsConfig			= ms.tlsConfig.Clone()
+	tlsConfig.ClientCAs		= clientCAs
+	tlsConfig.GetConfigForClient	= nil
+
+	return
+}
+
 // extractRole looks for Modbus Role extensions in a certificate and returns the
 // role as a string.
 // If no role extension is found, a nil string is returned (R-23).
@@ -899,3 +2970,51 @@ func (ms *ModbusServer) extractRole(cert *x509.Certificate) (role string) {
 
 	return
 }
+
+// hostOf returns the host part of a network address, or the full address if it
+// has no port.
+func hostOf(addr net.Addr) (host string) {
+	var err	error
+
+	host, _, err	= net.SplitHostPort(addr.String())
+	if err != nil {
+		host	= addr.String()
+	}
+
+	return
+}
+
+func newTCPClient(sock net.Conn) (tc *tcpClient) {
+	tc = &tcpClient{
+		Conn:         sock,
+		connectedAt:  time.Now(),
+		lastActivity: time.Now().UnixNano(),
+	}
+	tc.sess	= &session{
+		clientAddr: sock.RemoteAddr().String(),
+		// until the session is established, simply close the connection
+		interrupt:  func() {
+			tc.Close()
+		},
+	}
+
+	return
+}
+
+// Reads from the connection, recording activity whenever data is received.
+func (tc *tcpClient) Read(buf []byte) (rlen int, err error) {
+	rlen, err	= tc.Conn.Read(buf)
+	if rlen > 0 {
+		atomic.StoreInt64(&tc.lastActivity, time.Now().UnixNano())
+	}
+
+	return
+}
+
+// Returns the time at which data was last received from the client, or the
+// connection time if none was ever received.
+func (tc *tcpClient) lastActive() (t time.Time) {
+	t	= time.Unix(0, atomic.LoadInt64(&tc.lastActivity))
+
+	return
+}
@@ -0,0 +1,317 @@
+package modbus
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRTUServer(t *testing.T) {
+	var server *ModbusServer
+	var client *ModbusClient
+	var p1, p2 net.Conn
+	var err    error
+	var regs   []uint16
+	var count  uint16
+
+	_, err	= NewServer(&ServerConfiguration{
+		URL:		"rtu:///dev/ttyUSB0",
+		UnitIds:	[]uint8{9, 0},
+	}, &tcpTestHandler{})
+	if err != ErrConfigurationError {
+		t.Errorf("NewServer() should have returned ErrConfigurationError, got: %v", err)
+	}
+
+	_, err	= NewServer(&ServerConfiguration{
+		URL:		"rtu:///dev/ttyUSB0",
+		UnitIds:	[]uint8{248},
+	}, &tcpTestHandler{})
+	if err != ErrConfigurationError {
+		t.Errorf("NewServer() should have returned ErrConfigurationError, got: %v", err)
+	}
+
+	server, err	= NewServer(&ServerConfiguration{
+		URL:		"rtu:///dev/ttyUSB0",
+		UnitIds:	[]uint8{9, 12},
+	}, &broadcastTestHandler{tcpTestHandler: &tcpTestHandler{}})
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+
+	// rather than opening a serial port, serve requests over a pipe
+	p1, p2		= net.Pipe()
+	go server.handleTransport(context.Background(),
+		newRTUTransport(p2, "", 19200, 100 * time.Millisecond, nil),
+		&session{clientAddr: "test-pipe"}, &linkDiagnostics{})
+
+	client		= &ModbusClient{
+		logger:        newLogger("test-rtu-client", nil),
+		transport:     newRTUTransport(p1, "", 19200, 100 * time.Millisecond, nil),
+		unitId:        9,
+		endianness:    BIG_ENDIAN,
+		wordOrder:     HIGH_WORD_FIRST,
+		transportType: modbusRTU,
+	}
+
+	// message #1
+	err		= client.WriteRegisters(2, []uint16{0x1122, 0x3344})
+	if err != nil {
+		t.Errorf("client.WriteRegisters() should have succeeded, got: %v", err)
+	}
+
+	// message #2
+	regs, err	= client.ReadRegisters(1, 3, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("client.ReadRegisters() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 3 || regs[0] != 0x0000 || regs[1] != 0x1122 || regs[2] != 0x3344 {
+		t.Errorf("unexpected register values: %v", regs)
+	}
+
+	// message #3: unit id #12 is served (the handler only knows about
+	// unit id #9 and returns an exception)
+	client.unitId	= 12
+	_, err		= client.ReadRegisters(1, 3, HOLDING_REGISTER)
+	if err != ErrIllegalFunction {
+		t.Errorf("client.ReadRegisters() should have returned ErrIllegalFunction, got: %v", err)
+	}
+
+	// message #4: requests to other unit ids should be silently ignored
+	client.unitId	= 10
+	_, err		= client.ReadRegisters(1, 3, HOLDING_REGISTER)
+	if err != ErrRequestTimedOut {
+		t.Errorf("client.ReadRegisters() should have returned ErrRequestTimedOut, got: %v", err)
+	}
+
+	// message #5: a frame with a bad CRC should be dropped
+	p1.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err		= p1.Write([]byte{
+		0x09, 0x03, // unit id and function code
+		0x00, 0x00, // register address
+		0x00, 0x02, // quantity
+		0xde, 0xad, // (bad) CRC
+	})
+	if err != nil {
+		t.Errorf("failed to write to test pipe: %v", err)
+	}
+
+	// give the server enough time to re-sync
+	time.Sleep(50 * time.Millisecond)
+
+	// message #6
+	client.unitId	= 9
+	regs, err	= client.ReadRegisters(2, 1, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("client.ReadRegisters() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 1 || regs[0] != 0x1122 {
+		t.Errorf("unexpected register values: %v", regs)
+	}
+
+	// message #7
+	count, err	= client.ReturnBusCommErrorCount()
+	if err != nil {
+		t.Errorf("client.ReturnBusCommErrorCount() should have succeeded, got: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("expected a comm error count of 1, got: %v", count)
+	}
+
+	// message #8: all messages seen on the bus are counted, but only
+	// those addressed to the server are counted as server messages
+	count, err	= client.ReturnBusMessageCount()
+	if err != nil {
+		t.Errorf("client.ReturnBusMessageCount() should have succeeded, got: %v", err)
+	}
+	if count != 8 {
+		t.Errorf("expected a bus message count of 8, got: %v", count)
+	}
+
+	// message #9
+	count, err	= client.ReturnServerMessageCount()
+	if err != nil {
+		t.Errorf("client.ReturnServerMessageCount() should have succeeded, got: %v", err)
+	}
+	if count != 7 {
+		t.Errorf("expected a server message count of 7, got: %v", count)
+	}
+
+	// message #10: broadcast writes should be acted upon but not answered
+	client.unitId	= 0
+	err		= client.WriteRegisters(2, []uint16{0x5566})
+	if err != nil {
+		t.Errorf("client.WriteRegisters() should have succeeded, got: %v", err)
+	}
+
+	// broadcast reads should be rejected by the client
+	_, err		= client.ReadRegisters(2, 1, HOLDING_REGISTER)
+	if err != ErrUnexpectedParameters {
+		t.Errorf("client.ReadRegisters() should have returned ErrUnexpectedParameters, got: %v", err)
+	}
+
+	// message #11
+	client.unitId	= 9
+	regs, err	= client.ReadRegisters(2, 1, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("client.ReadRegisters() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 1 || regs[0] != 0x5566 {
+		t.Errorf("unexpected register values: %v", regs)
+	}
+
+	// message #12: the broadcast is counted as a message left unanswered
+	count, err	= client.ReturnServerNoResponseCount()
+	if err != nil {
+		t.Errorf("client.ReturnServerNoResponseCount() should have succeeded, got: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("expected a server no response count of 1, got: %v", count)
+	}
+
+	// message #13: return query data requests may carry more than one word
+	// of data, all of which should be echoed back
+	err		= client.ReturnQueryData([]uint16{0x0102, 0x0304, 0x0506})
+	if err != nil {
+		t.Errorf("client.ReturnQueryData() should have succeeded, got: %v", err)
+	}
+
+	// message #14: query data not made of whole words should be dropped
+	_, err		= client.ExecuteRaw(fcDiagnostics, []byte{0x00, 0x00, 0x01, 0x02, 0x03})
+	if err != ErrRequestTimedOut {
+		t.Errorf("client.ExecuteRaw() should have returned ErrRequestTimedOut, got: %v", err)
+	}
+
+	p1.Close()
+	p2.Close()
+
+	return
+}
+
+// broadcastTestHandler serves broadcasts as if they were addressed to unit id #9.
+type broadcastTestHandler struct {
+	*tcpTestHandler
+}
+
+func (bth *broadcastTestHandler) HandleHoldingRegisters(req *HoldingRegistersRequest) (res []uint16, err error) {
+	if req.UnitId == 0 {
+		req.UnitId	= 9
+	}
+	res, err	= bth.tcpTestHandler.HandleHoldingRegisters(req)
+
+	return
+}
+
+func TestRTUOverTCPServer(t *testing.T) {
+	var server  *ModbusServer
+	var client1 *ModbusClient
+	var client2 *ModbusClient
+	var err     error
+	var regs    []uint16
+
+	server, err	= NewServer(&ServerConfiguration{
+		URL:		"rtuovertcp://localhost:5515",
+		MaxClients:	1,
+		Timeout:	200 * time.Millisecond,
+	}, &tcpTestHandler{})
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+
+	err	= server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+		return
+	}
+	defer server.Stop()
+
+	client1, err	= NewClient(&ClientConfiguration{
+		URL:		"rtuovertcp://localhost:5515",
+		Timeout:	100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+
+	err	= client1.Open()
+	if err != nil {
+		t.Errorf("failed to open client: %v", err)
+		return
+	}
+	defer client1.Close()
+
+	client1.SetUnitId(9)
+
+	err	= client1.WriteRegisters(2, []uint16{0x1122, 0x3344})
+	if err != nil {
+		t.Errorf("client1.WriteRegisters() should have succeeded, got: %v", err)
+	}
+
+	regs, err	= client1.ReadRegisters(1, 3, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("client1.ReadRegisters() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 3 || regs[0] != 0x0000 || regs[1] != 0x1122 || regs[2] != 0x3344 {
+		t.Errorf("unexpected register values: %v", regs)
+	}
+
+	// the server answers for all unit ids by default
+	client1.SetUnitId(12)
+	_, err		= client1.ReadRegisters(1, 3, HOLDING_REGISTER)
+	if err != ErrIllegalFunction {
+		t.Errorf("client1.ReadRegisters() should have returned ErrIllegalFunction, got: %v", err)
+	}
+
+	// a second client should be rejected as MaxClients is 1
+	client2, err	= NewClient(&ClientConfiguration{
+		URL:		"rtuovertcp://localhost:5515",
+		Timeout:	100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+
+	err	= client2.Open()
+	if err != nil {
+		t.Errorf("failed to open client: %v", err)
+		return
+	}
+	defer client2.Close()
+
+	client2.SetUnitId(9)
+	_, err		= client2.ReadRegisters(1, 3, HOLDING_REGISTER)
+	if err == nil {
+		t.Errorf("client2.ReadRegisters() should have failed")
+	}
+
+	// idle connections should be closed after the session timeout
+	time.Sleep(300 * time.Millisecond)
+
+	client1.SetUnitId(9)
+	_, err		= client1.ReadRegisters(1, 3, HOLDING_REGISTER)
+	if err == nil {
+		t.Errorf("client1.ReadRegisters() should have failed")
+	}
+
+	// the connection slot should now be free
+	client2.Close()
+	err	= client2.Open()
+	if err != nil {
+		t.Errorf("failed to open client: %v", err)
+		return
+	}
+
+	regs, err	= client2.ReadRegisters(2, 1, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("client2.ReadRegisters() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 1 || regs[0] != 0x1122 {
+		t.Errorf("unexpected register values: %v", regs)
+	}
+
+	return
+}
@@ -1,6 +1,11 @@
 package modbus
 
 import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
 	"testing"
 	"time"
 )
@@ -568,6 +573,1659 @@ func TestTCPServerHoldingAndInputRegisters(t *testing.T) {
 	return
 }
 
+func TestTCPServerMaskWriteRegister(t *testing.T) {
+	var server *ModbusServer
+	var err	   error
+	var client *ModbusClient
+	var th	   *tcpTestHandler
+
+	th = &tcpTestHandler{}
+
+	server, err = NewServer(&ServerConfiguration{
+		URL:		"tcp://localhost:5505",
+		MaxClients:	2,
+	}, th)
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+	}
+
+	client, err	= NewClient(&ClientConfiguration{
+		URL:		"tcp://localhost:5505",
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+	}
+
+	err		= client.Open()
+	if err != nil {
+		t.Errorf("client.Open() should have succeeded, got: %v", err)
+	}
+	client.SetUnitId(9)
+
+	// use the example values from the modbus application protocol spec
+	th.holding[4]	= 0x0012
+	err		= client.MaskWriteRegister(0x0004, 0x00f2, 0x0025)
+	if err != nil {
+		t.Errorf("client.MaskWriteRegister() should have succeeded, got: %v", err)
+	}
+	if th.holding[4] != 0x0017 {
+		t.Errorf("expected 0x0017 at handler index 4, got: 0x%04x", th.holding[4])
+	}
+
+	// an AND mask of 0x0000 should set the register to the OR mask
+	err		= client.MaskWriteRegister(0x0009, 0x0000, 0xbeef)
+	if err != nil {
+		t.Errorf("client.MaskWriteRegister() should have succeeded, got: %v", err)
+	}
+	if th.holding[9] != 0xbeef {
+		t.Errorf("expected 0xbeef at handler index 9, got: 0x%04x", th.holding[9])
+	}
+
+	// an AND mask of 0xffff and an OR mask of 0x0000 should leave the
+	// register untouched
+	err		= client.MaskWriteRegister(0x0009, 0xffff, 0x0000)
+	if err != nil {
+		t.Errorf("client.MaskWriteRegister() should have succeeded, got: %v", err)
+	}
+	if th.holding[9] != 0xbeef {
+		t.Errorf("expected 0xbeef at handler index 9, got: 0x%04x", th.holding[9])
+	}
+
+	// targeting a register past the end of the handler's array should fail
+	err		= client.MaskWriteRegister(0x000a, 0x00f2, 0x0025)
+	if err != ErrIllegalDataAddress {
+		t.Errorf("client.MaskWriteRegister() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	// so should targeting an unknown unit id
+	client.SetUnitId(2)
+	err		= client.MaskWriteRegister(0x0004, 0x00f2, 0x0025)
+	if err != ErrIllegalFunction {
+		t.Errorf("client.MaskWriteRegister() should have returned ErrIllegalFunction, got: %v", err)
+	}
+
+	client.Close()
+	server.Stop()
+
+	// handlers implementing MaskWriteRegisterHandler should be passed the
+	// request as is
+	th		= &tcpTestHandler{}
+	server, err = NewServer(&ServerConfiguration{
+		URL:		"tcp://localhost:5505",
+		MaxClients:	2,
+	}, &maskWriteTestHandler{tcpTestHandler: th})
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+	}
+
+	err		= client.Open()
+	if err != nil {
+		t.Errorf("client.Open() should have succeeded, got: %v", err)
+	}
+	client.SetUnitId(9)
+
+	err		= client.MaskWriteRegister(0x0002, 0xff00, 0x00aa)
+	if err != nil {
+		t.Errorf("client.MaskWriteRegister() should have succeeded, got: %v", err)
+	}
+	// the test handler stores the OR mask as the register value
+	if th.holding[2] != 0x00aa {
+		t.Errorf("expected 0x00aa at handler index 2, got: 0x%04x", th.holding[2])
+	}
+
+	client.Close()
+	server.Stop()
+
+	return
+}
+
+func TestTCPServerReadWriteRegisters(t *testing.T) {
+	var server *ModbusServer
+	var err	   error
+	var client *ModbusClient
+	var th	   *tcpTestHandler
+	var regs   []uint16
+	var u32s   []uint32
+	var f32s   []float32
+
+	th = &tcpTestHandler{}
+
+	server, err = NewServer(&ServerConfiguration{
+		URL:		"tcp://localhost:5506",
+		MaxClients:	2,
+	}, th)
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+	}
+
+	client, err	= NewClient(&ClientConfiguration{
+		URL:		"tcp://localhost:5506",
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+	}
+
+	err		= client.Open()
+	if err != nil {
+		t.Errorf("client.Open() should have succeeded, got: %v", err)
+	}
+	client.SetUnitId(9)
+
+	// write 2 registers at address 3 and read back 4 registers from address 2:
+	// the read should reflect the write
+	th.holding[2]	= 0x1122
+	th.holding[5]	= 0x3344
+	regs, err	= client.ReadWriteRegisters(0x0002, 4, 0x0003, []uint16{
+		0xaabb, 0xccdd,
+	})
+	if err != nil {
+		t.Errorf("client.ReadWriteRegisters() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 4 {
+		t.Errorf("expected 4 values, got: %v", len(regs))
+	} else {
+		for i, v := range []uint16{0x1122, 0xaabb, 0xccdd, 0x3344} {
+			if regs[i] != v {
+				t.Errorf("expected 0x%04x at position %v, got: 0x%04x",
+					 v, i, regs[i])
+			}
+		}
+	}
+
+	// typed variants should observe the word order
+	u32s, err	= client.ReadWriteUint32s(0x0000, 2, 0x0002, []uint32{
+		0x01020304,
+	})
+	if err != nil {
+		t.Errorf("client.ReadWriteUint32s() should have succeeded, got: %v", err)
+	}
+	if len(u32s) != 2 || u32s[1] != 0x01020304 {
+		t.Errorf("expected {0x00000000, 0x01020304}, got: %v", u32s)
+	}
+	if th.holding[2] != 0x0102 || th.holding[3] != 0x0304 {
+		t.Errorf("expected {0x0102, 0x0304} at handler indices 2-3, got: {0x%04x, 0x%04x}",
+			 th.holding[2], th.holding[3])
+	}
+
+	client.SetEncoding(BIG_ENDIAN, LOW_WORD_FIRST)
+	f32s, err	= client.ReadWriteFloat32s(0x0006, 2, 0x0008, []float32{
+		-1.5,
+	})
+	if err != nil {
+		t.Errorf("client.ReadWriteFloat32s() should have succeeded, got: %v", err)
+	}
+	if len(f32s) != 2 || f32s[1] != -1.5 {
+		t.Errorf("expected {0, -1.5}, got: %v", f32s)
+	}
+	if th.holding[8] != 0x0000 || th.holding[9] != 0xbfc0 {
+		t.Errorf("expected {0x0000, 0xbfc0} at handler indices 8-9, got: {0x%04x, 0x%04x}",
+			 th.holding[8], th.holding[9])
+	}
+	client.SetEncoding(BIG_ENDIAN, HIGH_WORD_FIRST)
+
+	// reads or writes past the end of the handler's array should fail
+	_, err		= client.ReadWriteRegisters(0x0009, 2, 0x0000, []uint16{0x0001})
+	if err != ErrIllegalDataAddress {
+		t.Errorf("client.ReadWriteRegisters() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+	_, err		= client.ReadWriteRegisters(0x0000, 1, 0x0009, []uint16{0x0001, 0x0002})
+	if err != ErrIllegalDataAddress {
+		t.Errorf("client.ReadWriteRegisters() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	// quantities outside of the allowed ranges should be rejected
+	// by the client
+	_, err		= client.ReadWriteRegisters(0x0000, 0, 0x0000, []uint16{0x0001})
+	if err != ErrUnexpectedParameters {
+		t.Errorf("client.ReadWriteRegisters() should have returned ErrUnexpectedParameters, got: %v", err)
+	}
+	_, err		= client.ReadWriteRegisters(0x0000, 126, 0x0000, []uint16{0x0001})
+	if err != ErrUnexpectedParameters {
+		t.Errorf("client.ReadWriteRegisters() should have returned ErrUnexpectedParameters, got: %v", err)
+	}
+	_, err		= client.ReadWriteRegisters(0x0000, 1, 0x0000, nil)
+	if err != ErrUnexpectedParameters {
+		t.Errorf("client.ReadWriteRegisters() should have returned ErrUnexpectedParameters, got: %v", err)
+	}
+	_, err		= client.ReadWriteRegisters(0x0000, 1, 0x0000, make([]uint16, 122))
+	if err != ErrUnexpectedParameters {
+		t.Errorf("client.ReadWriteRegisters() should have returned ErrUnexpectedParameters, got: %v", err)
+	}
+
+	client.Close()
+	server.Stop()
+
+	return
+}
+
+func TestTCPServerReadFIFOQueue(t *testing.T) {
+	var server *ModbusServer
+	var err	   error
+	var client *ModbusClient
+	var fh	   *fifoTestHandler
+	var regs   []uint16
+
+	fh = &fifoTestHandler{tcpTestHandler: &tcpTestHandler{}}
+
+	server, err = NewServer(&ServerConfiguration{
+		URL:		"tcp://localhost:5507",
+		MaxClients:	2,
+	}, fh)
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+	}
+
+	client, err	= NewClient(&ClientConfiguration{
+		URL:		"tcp://localhost:5507",
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+	}
+
+	err		= client.Open()
+	if err != nil {
+		t.Errorf("client.Open() should have succeeded, got: %v", err)
+	}
+	client.SetUnitId(9)
+
+	// an empty queue should yield no values
+	regs, err	= client.ReadFIFOQueue(0x04de)
+	if err != nil {
+		t.Errorf("client.ReadFIFOQueue() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 0 {
+		t.Errorf("expected 0 values, got: %v", len(regs))
+	}
+
+	fh.fifo		= []uint16{0x01b8, 0x1284}
+	regs, err	= client.ReadFIFOQueue(0x04de)
+	if err != nil {
+		t.Errorf("client.ReadFIFOQueue() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 2 || regs[0] != 0x01b8 || regs[1] != 0x1284 {
+		t.Errorf("expected {0x01b8, 0x1284}, got: %v", regs)
+	}
+
+	// 31 entries is the maximum allowed
+	fh.fifo		= make([]uint16, 31)
+	fh.fifo[30]	= 0xffee
+	regs, err	= client.ReadFIFOQueue(0x04de)
+	if err != nil {
+		t.Errorf("client.ReadFIFOQueue() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 31 || regs[30] != 0xffee {
+		t.Errorf("expected 31 values ending with 0xffee, got: %v", regs)
+	}
+
+	// queues of more than 31 entries should yield an illegal data value
+	// exception
+	fh.fifo		= make([]uint16, 32)
+	_, err		= client.ReadFIFOQueue(0x04de)
+	if err != ErrIllegalDataValue {
+		t.Errorf("client.ReadFIFOQueue() should have returned ErrIllegalDataValue, got: %v", err)
+	}
+
+	// unknown FIFO pointer addresses should be rejected by the handler
+	_, err		= client.ReadFIFOQueue(0x0001)
+	if err != ErrIllegalDataAddress {
+		t.Errorf("client.ReadFIFOQueue() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	client.Close()
+	server.Stop()
+
+	// handlers not implementing FIFOQueueHandler should cause the server
+	// to return an illegal function exception
+	server, err = NewServer(&ServerConfiguration{
+		URL:		"tcp://localhost:5507",
+		MaxClients:	2,
+	}, &tcpTestHandler{})
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+	}
+
+	err		= client.Open()
+	if err != nil {
+		t.Errorf("client.Open() should have succeeded, got: %v", err)
+	}
+
+	_, err		= client.ReadFIFOQueue(0x04de)
+	if err != ErrIllegalFunction {
+		t.Errorf("client.ReadFIFOQueue() should have returned ErrIllegalFunction, got: %v", err)
+	}
+
+	client.Close()
+	server.Stop()
+
+	return
+}
+
+func TestTCPServerFileRecords(t *testing.T) {
+	var server *ModbusServer
+	var err	   error
+	var client *ModbusClient
+	var fh	   *fileTestHandler
+	var values [][]uint16
+
+	fh = &fileTestHandler{tcpTestHandler: &tcpTestHandler{}}
+
+	server, err = NewServer(&ServerConfiguration{
+		URL:		"tcp://localhost:5508",
+		MaxClients:	2,
+	}, fh)
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+	}
+
+	client, err	= NewClient(&ClientConfiguration{
+		URL:		"tcp://localhost:5508",
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+	}
+
+	err		= client.Open()
+	if err != nil {
+		t.Errorf("client.Open() should have succeeded, got: %v", err)
+	}
+	client.SetUnitId(9)
+
+	// write two groups of records in a single request
+	err		= client.WriteFileRecords([]FileRecord{
+		{FileNumber: 4, RecordNumber: 1, Data: []uint16{0x0df5, 0x3344}},
+		{FileNumber: 4, RecordNumber: 7, Data: []uint16{0x1122, 0xaabb, 0xccdd}},
+	})
+	if err != nil {
+		t.Errorf("client.WriteFileRecords() should have succeeded, got: %v", err)
+	}
+	for i, v := range []uint16{
+		0x0000, 0x0df5, 0x3344, 0x0000, 0x0000, 0x0000, 0x0000, 0x1122,
+		0xaabb, 0xccdd, 0x0000, 0x0000, 0x0000, 0x0000, 0x0000, 0x0000,
+	} {
+		if fh.file[i] != v {
+			t.Errorf("expected 0x%04x at record %v, got: 0x%04x", v, i, fh.file[i])
+		}
+	}
+
+	// read them back, along with a few surrounding records
+	values, err	= client.ReadFileRecords([]FileRecord{
+		{FileNumber: 4, RecordNumber: 0, Length: 3},
+		{FileNumber: 4, RecordNumber: 8, Length: 1},
+		{FileNumber: 4, RecordNumber: 6, Length: 5},
+	})
+	if err != nil {
+		t.Errorf("client.ReadFileRecords() should have succeeded, got: %v", err)
+	}
+	if len(values) != 3 {
+		t.Errorf("expected 3 record groups, got: %v", len(values))
+	} else {
+		for i, expected := range [][]uint16{
+			{0x0000, 0x0df5, 0x3344},
+			{0xaabb},
+			{0x0000, 0x1122, 0xaabb, 0xccdd, 0x0000},
+		} {
+			if len(values[i]) != len(expected) {
+				t.Errorf("expected %v values in group %v, got: %v",
+					 len(expected), i, len(values[i]))
+				continue
+			}
+			for j := range expected {
+				if values[i][j] != expected[j] {
+					t.Errorf("expected 0x%04x at position %v of group %v, got: 0x%04x",
+						 expected[j], j, i, values[i][j])
+				}
+			}
+		}
+	}
+
+	// unknown files and records past the end of the file should be
+	// rejected by the handler
+	_, err		= client.ReadFileRecords([]FileRecord{
+		{FileNumber: 3, RecordNumber: 0, Length: 1},
+	})
+	if err != ErrIllegalDataAddress {
+		t.Errorf("client.ReadFileRecords() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+	err		= client.WriteFileRecords([]FileRecord{
+		{FileNumber: 4, RecordNumber: 15, Data: []uint16{0x0001, 0x0002}},
+	})
+	if err != ErrIllegalDataAddress {
+		t.Errorf("client.WriteFileRecords() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	// invalid sub-requests should be rejected by the client
+	_, err		= client.ReadFileRecords(nil)
+	if err != ErrUnexpectedParameters {
+		t.Errorf("client.ReadFileRecords() should have returned ErrUnexpectedParameters, got: %v", err)
+	}
+	_, err		= client.ReadFileRecords([]FileRecord{
+		{FileNumber: 0, RecordNumber: 0, Length: 1},
+	})
+	if err != ErrUnexpectedParameters {
+		t.Errorf("client.ReadFileRecords() should have returned ErrUnexpectedParameters, got: %v", err)
+	}
+	_, err		= client.ReadFileRecords([]FileRecord{
+		{FileNumber: 4, RecordNumber: 10000, Length: 1},
+	})
+	if err != ErrUnexpectedParameters {
+		t.Errorf("client.ReadFileRecords() should have returned ErrUnexpectedParameters, got: %v", err)
+	}
+	_, err		= client.ReadFileRecords([]FileRecord{
+		{FileNumber: 4, RecordNumber: 0, Length: 122},
+	})
+	if err != ErrUnexpectedParameters {
+		t.Errorf("client.ReadFileRecords() should have returned ErrUnexpectedParameters, got: %v", err)
+	}
+	err		= client.WriteFileRecords([]FileRecord{
+		{FileNumber: 4, RecordNumber: 0, Data: nil},
+	})
+	if err != ErrUnexpectedParameters {
+		t.Errorf("client.WriteFileRecords() should have returned ErrUnexpectedParameters, got: %v", err)
+	}
+
+	client.Close()
+	server.Stop()
+
+	// handlers not implementing FileRecordHandler should cause the server
+	// to return an illegal function exception
+	server, err = NewServer(&ServerConfiguration{
+		URL:		"tcp://localhost:5508",
+		MaxClients:	2,
+	}, &tcpTestHandler{})
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+	}
+
+	err		= client.Open()
+	if err != nil {
+		t.Errorf("client.Open() should have succeeded, got: %v", err)
+	}
+
+	_, err		= client.ReadFileRecords([]FileRecord{
+		{FileNumber: 4, RecordNumber: 0, Length: 1},
+	})
+	if err != ErrIllegalFunction {
+		t.Errorf("client.ReadFileRecords() should have returned ErrIllegalFunction, got: %v", err)
+	}
+
+	client.Close()
+	server.Stop()
+
+	return
+}
+
+func TestTCPServerReadDeviceIdentification(t *testing.T) {
+	var server  *ModbusServer
+	var err	    error
+	var client  *ModbusClient
+	var objects map[uint8]string
+	var longVal string
+
+	// three 200-byte extended objects can't fit in a single response
+	for i := 0; i < 200; i++ {
+		longVal	+= "x"
+	}
+
+	server, err = NewServer(&ServerConfiguration{
+		URL:		"tcp://localhost:5509",
+		MaxClients:	2,
+		DeviceIdentification: map[uint8]string{
+			OBJECT_ID_VENDOR_NAME:		"ACME",
+			OBJECT_ID_PRODUCT_CODE:		"AC-1",
+			OBJECT_ID_MAJOR_MINOR_REVISION:	"V1.2",
+			OBJECT_ID_PRODUCT_NAME:		"widget",
+			0x80:				longVal,
+			0x81:				longVal,
+			0x90:				longVal,
+		},
+	}, &tcpTestHandler{})
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+	}
+
+	client, err	= NewClient(&ClientConfiguration{
+		URL:		"tcp://localhost:5509",
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+	}
+
+	err		= client.Open()
+	if err != nil {
+		t.Errorf("client.Open() should have succeeded, got: %v", err)
+	}
+
+	// basic identification
+	objects, err	= client.ReadDeviceIdentification(DEVICE_ID_BASIC, 0)
+	if err != nil {
+		t.Errorf("client.ReadDeviceIdentification() should have succeeded, got: %v", err)
+	}
+	if len(objects) != 3 || objects[OBJECT_ID_VENDOR_NAME] != "ACME" ||
+	   objects[OBJECT_ID_PRODUCT_CODE] != "AC-1" ||
+	   objects[OBJECT_ID_MAJOR_MINOR_REVISION] != "V1.2" {
+		t.Errorf("unexpected basic identification objects: %v", objects)
+	}
+
+	// regular identification
+	objects, err	= client.ReadDeviceIdentification(DEVICE_ID_REGULAR, 0)
+	if err != nil {
+		t.Errorf("client.ReadDeviceIdentification() should have succeeded, got: %v", err)
+	}
+	if len(objects) != 4 || objects[OBJECT_ID_PRODUCT_NAME] != "widget" {
+		t.Errorf("unexpected regular identification objects: %v", objects)
+	}
+
+	// extended identification, spanning 3 transactions
+	objects, err	= client.ReadDeviceIdentification(DEVICE_ID_EXTENDED, 0)
+	if err != nil {
+		t.Errorf("client.ReadDeviceIdentification() should have succeeded, got: %v", err)
+	}
+	if len(objects) != 7 || objects[0x80] != longVal ||
+	   objects[0x81] != longVal || objects[0x90] != longVal {
+		t.Errorf("unexpected extended identification objects: %v", objects)
+	}
+
+	// individual access
+	objects, err	= client.ReadDeviceIdentification(DEVICE_ID_INDIVIDUAL, OBJECT_ID_PRODUCT_NAME)
+	if err != nil {
+		t.Errorf("client.ReadDeviceIdentification() should have succeeded, got: %v", err)
+	}
+	if len(objects) != 1 || objects[OBJECT_ID_PRODUCT_NAME] != "widget" {
+		t.Errorf("unexpected individual identification objects: %v", objects)
+	}
+
+	// individual access to an unknown object
+	_, err		= client.ReadDeviceIdentification(DEVICE_ID_INDIVIDUAL, OBJECT_ID_VENDOR_URL)
+	if err != ErrIllegalDataAddress {
+		t.Errorf("client.ReadDeviceIdentification() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	client.Close()
+	server.Stop()
+
+	// servers without device identification objects should return
+	// an illegal function exception
+	server, err = NewServer(&ServerConfiguration{
+		URL:		"tcp://localhost:5509",
+		MaxClients:	2,
+	}, &tcpTestHandler{})
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+	}
+
+	err		= client.Open()
+	if err != nil {
+		t.Errorf("client.Open() should have succeeded, got: %v", err)
+	}
+
+	_, err		= client.ReadDeviceIdentification(DEVICE_ID_BASIC, 0)
+	if err != ErrIllegalFunction {
+		t.Errorf("client.ReadDeviceIdentification() should have returned ErrIllegalFunction, got: %v", err)
+	}
+
+	client.Close()
+	server.Stop()
+
+	// objects too long to fit in a response should be rejected
+	_, err = NewServer(&ServerConfiguration{
+		URL:		"tcp://localhost:5509",
+		DeviceIdentification: map[uint8]string{
+			0x80:	longVal + longVal,
+		},
+	}, &tcpTestHandler{})
+	if err != ErrConfigurationError {
+		t.Errorf("NewServer() should have returned ErrConfigurationError, got: %v", err)
+	}
+
+	return
+}
+
+func TestTCPServerDiagnostics(t *testing.T) {
+	var server   *ModbusServer
+	var err	     error
+	var client   *ModbusClient
+	var count    uint16
+	var status   uint16
+	var eventLog *CommEventLog
+
+	server, err = NewServer(&ServerConfiguration{
+		URL:		"tcp://localhost:5510",
+		MaxClients:	2,
+	}, &tcpTestHandler{})
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+	}
+
+	client, err	= NewClient(&ClientConfiguration{
+		URL:		"tcp://localhost:5510",
+		Timeout:	200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+	}
+
+	err		= client.Open()
+	if err != nil {
+		t.Errorf("client.Open() should have succeeded, got: %v", err)
+	}
+	client.SetUnitId(9)
+
+	// message #1: loopback
+	err		= client.ReturnQueryData([]uint16{0x1234})
+	if err != nil {
+		t.Errorf("client.ReturnQueryData() should have succeeded, got: %v", err)
+	}
+
+	// no query data: rejected without sending anything
+	err		= client.ReturnQueryData(nil)
+	if err != ErrUnexpectedParameters {
+		t.Errorf("client.ReturnQueryData() should have returned ErrUnexpectedParameters, got: %v", err)
+	}
+
+	// message #2: a successful read
+	_, err		= client.ReadRegisters(0, 2, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("client.ReadRegisters() should have succeeded, got: %v", err)
+	}
+
+	// message #3: a read causing an exception
+	_, err		= client.ReadRegisters(8, 4, HOLDING_REGISTER)
+	if err != ErrIllegalDataAddress {
+		t.Errorf("client.ReadRegisters() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	// message #4
+	count, err	= client.ReturnBusMessageCount()
+	if err != nil {
+		t.Errorf("client.ReturnBusMessageCount() should have succeeded, got: %v", err)
+	}
+	if count != 4 {
+		t.Errorf("expected a bus message count of 4, got: %v", count)
+	}
+
+	// message #5
+	count, err	= client.ReturnBusExceptionErrorCount()
+	if err != nil {
+		t.Errorf("client.ReturnBusExceptionErrorCount() should have succeeded, got: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("expected an exception count of 1, got: %v", count)
+	}
+
+	// message #6
+	count, err	= client.ReturnServerMessageCount()
+	if err != nil {
+		t.Errorf("client.ReturnServerMessageCount() should have succeeded, got: %v", err)
+	}
+	if count != 6 {
+		t.Errorf("expected a server message count of 6, got: %v", count)
+	}
+
+	// message #7: all successful requests but the exception are counted
+	status, count, err	= client.GetCommEventCounter()
+	if err != nil {
+		t.Errorf("client.GetCommEventCounter() should have succeeded, got: %v", err)
+	}
+	if status != 0x0000 {
+		t.Errorf("expected a status of 0x0000, got: 0x%04x", status)
+	}
+	if count != 5 {
+		t.Errorf("expected an event count of 5, got: %v", count)
+	}
+
+	// message #8: get comm event counter requests do not increment the
+	// event counter
+	eventLog, err	= client.GetCommEventLog()
+	if err != nil {
+		t.Errorf("client.GetCommEventLog() should have succeeded, got: %v", err)
+	}
+	if eventLog.EventCount != 5 {
+		t.Errorf("expected an event count of 5, got: %v", eventLog.EventCount)
+	}
+	if eventLog.MessageCount != 8 {
+		t.Errorf("expected a message count of 8, got: %v", eventLog.MessageCount)
+	}
+	// 7 receive and send events, plus the receive event of this request
+	if len(eventLog.Events) != 15 {
+		t.Errorf("expected 15 events, got: %v", len(eventLog.Events))
+	}
+	// most recent events first
+	for i, ev := range []uint8{0x80, 0x40, 0x80, 0x40, 0x80, 0x40, 0x80, 0x40, 0x80, 0x41} {
+		if eventLog.Events[i] != ev {
+			t.Errorf("expected 0x%02x at event position %v, got: 0x%02x",
+				 ev, i, eventLog.Events[i])
+		}
+	}
+
+	// clear counters
+	err		= client.ClearCounters()
+	if err != nil {
+		t.Errorf("client.ClearCounters() should have succeeded, got: %v", err)
+	}
+	count, err	= client.ReturnBusMessageCount()
+	if err != nil {
+		t.Errorf("client.ReturnBusMessageCount() should have succeeded, got: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("expected a bus message count of 1, got: %v", count)
+	}
+
+	// unsupported sub-functions (here: change ASCII input delimiter)
+	// should be rejected
+	_, err		= client.diagnostics(0x0003, 0x0a00)
+	if err != ErrIllegalFunction {
+		t.Errorf("client.diagnostics() should have returned ErrIllegalFunction, got: %v", err)
+	}
+
+	// enter listen only mode: the server should stop responding
+	err		= client.ForceListenOnlyMode()
+	if err != nil {
+		t.Errorf("client.ForceListenOnlyMode() should have succeeded, got: %v", err)
+	}
+
+	_, err		= client.ReadRegisters(0, 2, HOLDING_REGISTER)
+	if err != ErrRequestTimedOut {
+		t.Errorf("client.ReadRegisters() should have returned ErrRequestTimedOut, got: %v", err)
+	}
+
+	// restarting communications should bring the server out of listen only
+	// mode, without a response
+	err		= client.RestartCommunications(false)
+	if err != ErrRequestTimedOut {
+		t.Errorf("client.RestartCommunications() should have returned ErrRequestTimedOut, got: %v", err)
+	}
+
+	count, err	= client.ReturnBusMessageCount()
+	if err != nil {
+		t.Errorf("client.ReturnBusMessageCount() should have succeeded, got: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("expected a bus message count of 1, got: %v", count)
+	}
+
+	// restart communications again, this time clearing the event log
+	err		= client.RestartCommunications(true)
+	if err != nil {
+		t.Errorf("client.RestartCommunications() should have succeeded, got: %v", err)
+	}
+
+	eventLog, err	= client.GetCommEventLog()
+	if err != nil {
+		t.Errorf("client.GetCommEventLog() should have succeeded, got: %v", err)
+	}
+	// receive event, restart response send event and restart event
+	if len(eventLog.Events) != 3 || eventLog.Events[0] != 0x80 ||
+	   eventLog.Events[1] != 0x40 || eventLog.Events[2] != 0x00 {
+		t.Errorf("unexpected events: %v", eventLog.Events)
+	}
+
+	client.Close()
+	server.Stop()
+
+	return
+}
+
+func TestTCPServerExceptionStatusAndServerId(t *testing.T) {
+	var server  *ModbusServer
+	var err	    error
+	var client  *ModbusClient
+	var ih      *identTestHandler
+	var status  uint8
+	var id      []byte
+	var running bool
+
+	ih = &identTestHandler{
+		tcpTestHandler:	&tcpTestHandler{},
+		status:		0xa5,
+		id:		[]byte{0x42, 'x', 'y'},
+		running:	true,
+	}
+
+	server, err = NewServer(&ServerConfiguration{
+		URL:		"tcp://localhost:5511",
+		MaxClients:	2,
+	}, ih)
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+	}
+
+	client, err	= NewClient(&ClientConfiguration{
+		URL:		"tcp://localhost:5511",
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+	}
+
+	err		= client.Open()
+	if err != nil {
+		t.Errorf("client.Open() should have succeeded, got: %v", err)
+	}
+	client.SetUnitId(9)
+
+	status, err	= client.ReadExceptionStatus()
+	if err != nil {
+		t.Errorf("client.ReadExceptionStatus() should have succeeded, got: %v", err)
+	}
+	if status != 0xa5 {
+		t.Errorf("expected 0xa5, got: 0x%02x", status)
+	}
+
+	id, running, err	= client.ReportServerID()
+	if err != nil {
+		t.Errorf("client.ReportServerID() should have succeeded, got: %v", err)
+	}
+	if len(id) != 3 || id[0] != 0x42 || id[1] != 'x' || id[2] != 'y' {
+		t.Errorf("unexpected server id: %v", id)
+	}
+	if !running {
+		t.Errorf("expected run indicator to be on")
+	}
+
+	// an empty server id with the run indicator off
+	ih.id		= nil
+	ih.running	= false
+	id, running, err	= client.ReportServerID()
+	if err != nil {
+		t.Errorf("client.ReportServerID() should have succeeded, got: %v", err)
+	}
+	if len(id) != 0 || running {
+		t.Errorf("unexpected server id (%v) or run indicator (%v)", id, running)
+	}
+
+	// server ids too long to fit in a response should cause a
+	// server device failure
+	ih.id		= make([]byte, 251)
+	_, _, err	= client.ReportServerID()
+	if err != ErrServerDeviceFailure {
+		t.Errorf("client.ReportServerID() should have returned ErrServerDeviceFailure, got: %v", err)
+	}
+
+	client.Close()
+	server.Stop()
+
+	// handlers implementing neither ExceptionStatusHandler nor ServerIdHandler
+	// should cause the server to return illegal function exceptions
+	server, err = NewServer(&ServerConfiguration{
+		URL:		"tcp://localhost:5511",
+		MaxClients:	2,
+	}, &tcpTestHandler{})
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+	}
+
+	err		= client.Open()
+	if err != nil {
+		t.Errorf("client.Open() should have succeeded, got: %v", err)
+	}
+
+	_, err		= client.ReadExceptionStatus()
+	if err != ErrIllegalFunction {
+		t.Errorf("client.ReadExceptionStatus() should have returned ErrIllegalFunction, got: %v", err)
+	}
+
+	_, _, err	= client.ReportServerID()
+	if err != ErrIllegalFunction {
+		t.Errorf("client.ReportServerID() should have returned ErrIllegalFunction, got: %v", err)
+	}
+
+	client.Close()
+	server.Stop()
+
+	return
+}
+
+func TestTCPServerRawRequests(t *testing.T) {
+	var server *ModbusServer
+	var err	   error
+	var client *ModbusClient
+	var res    *RawPDU
+
+	server, err = NewServer(&ServerConfiguration{
+		URL:		"tcp://localhost:5512",
+		MaxClients:	2,
+	}, &rawTestHandler{tcpTestHandler: &tcpTestHandler{}})
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+	}
+
+	client, err	= NewClient(&ClientConfiguration{
+		URL:		"tcp://localhost:5512",
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+	}
+
+	err		= client.Open()
+	if err != nil {
+		t.Errorf("client.Open() should have succeeded, got: %v", err)
+	}
+	client.SetUnitId(9)
+
+	res, err	= client.ExecuteRaw(0x41, []byte{0x01, 0x02, 0x03})
+	if err != nil {
+		t.Errorf("client.ExecuteRaw() should have succeeded, got: %v", err)
+	}
+	if res.UnitId != 9 || res.FunctionCode != 0x41 {
+		t.Errorf("unexpected unit id (%v) or function code (0x%02x)",
+			 res.UnitId, res.FunctionCode)
+	}
+	if len(res.Payload) != 3 || res.Payload[0] != 0x03 ||
+	   res.Payload[1] != 0x02 || res.Payload[2] != 0x01 {
+		t.Errorf("unexpected payload: %v", res.Payload)
+	}
+
+	// exceptions returned by the handler should be mapped to errors
+	_, err		= client.ExecuteRaw(0x41, nil)
+	if err != ErrIllegalDataValue {
+		t.Errorf("client.ExecuteRaw() should have returned ErrIllegalDataValue, got: %v", err)
+	}
+	_, err		= client.ExecuteRaw(0x64, []byte{0x01})
+	if err != ErrIllegalFunction {
+		t.Errorf("client.ExecuteRaw() should have returned ErrIllegalFunction, got: %v", err)
+	}
+
+	// regular function codes should not be passed to the raw handler
+	_, err		= client.ReadRegisters(0, 2, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("client.ReadRegisters() should have succeeded, got: %v", err)
+	}
+
+	// invalid function codes and payloads should be rejected by the client
+	_, err		= client.ExecuteRaw(0x00, nil)
+	if err != ErrUnexpectedParameters {
+		t.Errorf("client.ExecuteRaw() should have returned ErrUnexpectedParameters, got: %v", err)
+	}
+	_, err		= client.ExecuteRaw(0xc1, nil)
+	if err != ErrUnexpectedParameters {
+		t.Errorf("client.ExecuteRaw() should have returned ErrUnexpectedParameters, got: %v", err)
+	}
+	_, err		= client.ExecuteRaw(0x41, make([]byte, 253))
+	if err != ErrUnexpectedParameters {
+		t.Errorf("client.ExecuteRaw() should have returned ErrUnexpectedParameters, got: %v", err)
+	}
+
+	client.Close()
+	server.Stop()
+
+	// handlers not implementing RawHandler should cause the server to return
+	// an illegal function exception
+	server, err = NewServer(&ServerConfiguration{
+		URL:		"tcp://localhost:5512",
+		MaxClients:	2,
+	}, &tcpTestHandler{})
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+	}
+
+	err		= client.Open()
+	if err != nil {
+		t.Errorf("client.Open() should have succeeded, got: %v", err)
+	}
+
+	_, err		= client.ExecuteRaw(0x41, []byte{0x01})
+	if err != ErrIllegalFunction {
+		t.Errorf("client.ExecuteRaw() should have returned ErrIllegalFunction, got: %v", err)
+	}
+
+	client.Close()
+	server.Stop()
+
+	return
+}
+
+func TestTCPServerRequestContext(t *testing.T) {
+	var server  *ModbusServer
+	var err     error
+	var client  *ModbusClient
+	var client2 *ModbusClient
+	var th      *ctxTestHandler
+	var regs    []uint16
+	var done    chan error
+
+	th	= &ctxTestHandler{
+		tcpTestHandler: &tcpTestHandler{},
+		cancelled:      make(chan error, 4),
+	}
+	th.input[1]	= 0x1234
+
+	server, err = NewServer(&ServerConfiguration{
+		URL:		"tcp://localhost:5519",
+		RequestTimeout:	500 * time.Millisecond,
+	}, th)
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+		return
+	}
+	defer server.Stop()
+
+	client, err	= NewClient(&ClientConfiguration{
+		URL:		"tcp://localhost:5519",
+		Timeout:	2 * time.Second,
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+
+	err	= client.Open()
+	if err != nil {
+		t.Errorf("failed to open client: %v", err)
+		return
+	}
+	defer client.Close()
+	client.SetUnitId(9)
+
+	// input register #5 blocks until the request is cancelled: the server
+	// should give up after RequestTimeout
+	_, err	= client.ReadRegisters(5, 1, INPUT_REGISTER)
+	if err != ErrGWTargetFailedToRespond {
+		t.Errorf("client.ReadRegisters() should have returned ErrGWTargetFailedToRespond, got: %v", err)
+	}
+
+	select {
+	case err = <-th.cancelled:
+		if err != context.DeadlineExceeded {
+			t.Errorf("expected context.DeadlineExceeded, got: %v", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Errorf("the request context should have been cancelled")
+	}
+
+	// the session should still be usable
+	regs, err	= client.ReadRegisters(0, 2, INPUT_REGISTER)
+	if err != nil {
+		t.Errorf("client.ReadRegisters() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 2 || regs[0] != 0x0000 || regs[1] != 0x1234 {
+		t.Errorf("unexpected register values: %v", regs)
+	}
+
+	// the request context should be cancelled as soon as the client
+	// disconnects, well before the request times out
+	client2, err	= NewClient(&ClientConfiguration{
+		URL:		"tcp://localhost:5519",
+		Timeout:	50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+
+	err	= client2.Open()
+	if err != nil {
+		t.Errorf("failed to open client: %v", err)
+		return
+	}
+	client2.SetUnitId(9)
+
+	_, err	= client2.ReadRegisters(5, 1, INPUT_REGISTER)
+	if err != ErrRequestTimedOut {
+		t.Errorf("client.ReadRegisters() should have returned ErrRequestTimedOut, got: %v", err)
+	}
+	client2.Close()
+
+	select {
+	case err = <-th.cancelled:
+		if err != context.Canceled {
+			t.Errorf("expected context.Canceled, got: %v", err)
+		}
+	case <-time.After(300 * time.Millisecond):
+		t.Errorf("the request context should have been cancelled")
+	}
+
+	// stopping the server should cancel pending requests as well
+	done	= make(chan error)
+	go func() {
+		_, err := client.ReadRegisters(5, 1, INPUT_REGISTER)
+		done <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	server.Stop()
+
+	select {
+	case err = <-th.cancelled:
+		if err != context.Canceled {
+			t.Errorf("expected context.Canceled, got: %v", err)
+		}
+	case <-time.After(300 * time.Millisecond):
+		t.Errorf("the request context should have been cancelled")
+	}
+
+	err	= <-done
+	if err == nil {
+		t.Errorf("client.ReadRegisters() should have failed")
+	}
+
+	return
+}
+
+func TestTCPServerConnectionHooks(t *testing.T) {
+	var server    *ModbusServer
+	var err       error
+	var clients   [4]*ModbusClient
+	var lock      sync.Mutex
+	var rejectAll bool
+	var connects  chan *ConnectionInfo
+	var reasons   chan error
+	var info      *ConnectionInfo
+
+	connects	= make(chan *ConnectionInfo, 8)
+	reasons		= make(chan error, 8)
+
+	server, err = NewServer(&ServerConfiguration{
+		URL:		"tcp://localhost:5520",
+		MaxClientsPerIP:	2,
+		OnConnect:	func(info *ConnectionInfo) (err error) {
+			lock.Lock()
+			defer lock.Unlock()
+
+			connects <- info
+			if rejectAll {
+				err	= errors.New("not on the allowlist")
+			}
+
+			return
+		},
+		OnDisconnect:	func(info *ConnectionInfo, reason error) {
+			reasons <- reason
+		},
+	}, &tcpTestHandler{})
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+		return
+	}
+	defer server.Stop()
+
+	for i := range clients {
+		clients[i], err	= NewClient(&ClientConfiguration{
+			URL:		"tcp://localhost:5520",
+			Timeout:	200 * time.Millisecond,
+		})
+		if err != nil {
+			t.Errorf("failed to create client: %v", err)
+			return
+		}
+		clients[i].SetUnitId(9)
+		defer clients[i].Close()
+	}
+
+	// the first two clients should be accepted
+	for i := 0; i < 2; i++ {
+		err	= clients[i].Open()
+		if err != nil {
+			t.Errorf("failed to open client #%v: %v", i, err)
+			return
+		}
+
+		_, err	= clients[i].ReadRegisters(0, 1, HOLDING_REGISTER)
+		if err != nil {
+			t.Errorf("client #%v should have been served, got: %v", i, err)
+		}
+
+		select {
+		case info = <-connects:
+			if info.ClientAddr == "" || info.ConnectedAt.IsZero() ||
+			   info.ClientRole != "" || info.Certificates != nil {
+				t.Errorf("unexpected connection info: %v", info)
+			}
+		default:
+			t.Errorf("OnConnect should have been called")
+		}
+	}
+
+	// the third one should hit the per-IP limit, without reaching OnConnect
+	err	= clients[2].Open()
+	if err != nil {
+		t.Errorf("failed to open client #2: %v", err)
+		return
+	}
+
+	_, err	= clients[2].ReadRegisters(0, 1, HOLDING_REGISTER)
+	if err == nil {
+		t.Errorf("client #2 should have been rejected")
+	}
+
+	if len(connects) != 0 || len(reasons) != 0 {
+		t.Errorf("connection hooks should not have been called")
+	}
+
+	// closing the first client should report io.EOF and free up a slot
+	clients[0].Close()
+
+	select {
+	case err = <-reasons:
+		if err != io.EOF {
+			t.Errorf("expected io.EOF, got: %v", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Errorf("OnDisconnect should have been called")
+	}
+
+	// clients rejected by OnConnect should be disconnected without a call
+	// to OnDisconnect
+	lock.Lock()
+	rejectAll	= true
+	lock.Unlock()
+
+	err	= clients[3].Open()
+	if err != nil {
+		t.Errorf("failed to open client #3: %v", err)
+		return
+	}
+
+	_, err	= clients[3].ReadRegisters(0, 1, HOLDING_REGISTER)
+	if err == nil {
+		t.Errorf("client #3 should have been rejected")
+	}
+
+	if len(connects) != 1 {
+		t.Errorf("OnConnect should have been called once, got: %v", len(connects))
+	}
+
+	// stopping the server should end the remaining session
+	server.Stop()
+
+	select {
+	case err = <-reasons:
+		if err != ErrServerStopped {
+			t.Errorf("expected ErrServerStopped, got: %v", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Errorf("OnDisconnect should have been called")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if len(reasons) != 0 {
+		t.Errorf("OnDisconnect should not have been called again")
+	}
+
+	return
+}
+
+func TestTCPServerEvictionPolicies(t *testing.T) {
+	var server  *ModbusServer
+	var err     error
+	var clients [3]*ModbusClient
+
+	for _, tc := range []struct {
+		url    string
+		policy EvictionPolicy
+		victim int
+	}{
+		// client #0 is the oldest but client #1 is the least recently active
+		{"tcp://localhost:5521", EVICT_LEAST_RECENTLY_ACTIVE, 1},
+		{"tcp://localhost:5522", EVICT_OLDEST,                0},
+	} {
+		// use a distinct channel per server, as stopping a server may
+		// trigger OnDisconnect calls after the next one is started
+		var reasons	= make(chan error, 4)
+
+		server, err = NewServer(&ServerConfiguration{
+			URL:		tc.url,
+			MaxClients:	2,
+			EvictionPolicy:	tc.policy,
+			OnDisconnect:	func(info *ConnectionInfo, reason error) {
+				reasons <- reason
+			},
+		}, &tcpTestHandler{})
+		if err != nil {
+			t.Errorf("failed to create server: %v", err)
+			return
+		}
+
+		err = server.Start()
+		if err != nil {
+			t.Errorf("failed to start server: %v", err)
+			return
+		}
+
+		for i := range clients {
+			clients[i], err	= NewClient(&ClientConfiguration{
+				URL:		tc.url,
+				Timeout:	200 * time.Millisecond,
+			})
+			if err != nil {
+				t.Errorf("failed to create client: %v", err)
+				return
+			}
+			clients[i].SetUnitId(9)
+		}
+
+		for i := 0; i < 2; i++ {
+			err	= clients[i].Open()
+			if err != nil {
+				t.Errorf("failed to open client #%v: %v", i, err)
+			}
+
+			_, err	= clients[i].ReadRegisters(0, 1, HOLDING_REGISTER)
+			if err != nil {
+				t.Errorf("client #%v should have been served, got: %v", i, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		_, err	= clients[0].ReadRegisters(0, 1, HOLDING_REGISTER)
+		if err != nil {
+			t.Errorf("client #0 should have been served, got: %v", err)
+		}
+
+		// the third client should be served at the expense of the victim
+		err	= clients[2].Open()
+		if err != nil {
+			t.Errorf("failed to open client #2: %v", err)
+		}
+
+		_, err	= clients[2].ReadRegisters(0, 1, HOLDING_REGISTER)
+		if err != nil {
+			t.Errorf("client #2 should have been served, got: %v", err)
+		}
+
+		select {
+		case err = <-reasons:
+			if err != ErrSessionEvicted {
+				t.Errorf("expected ErrSessionEvicted, got: %v", err)
+			}
+		case <-time.After(1 * time.Second):
+			t.Errorf("OnDisconnect should have been called")
+		}
+
+		for i := range clients {
+			_, err	= clients[i].ReadRegisters(0, 1, HOLDING_REGISTER)
+			if i == tc.victim && err == nil {
+				t.Errorf("client #%v should have been evicted (%s)", i, tc.url)
+			} else if i != tc.victim && err != nil {
+				t.Errorf("client #%v should have been served, got: %v (%s)",
+					 i, err, tc.url)
+			}
+			clients[i].Close()
+		}
+
+		server.Stop()
+	}
+
+	return
+}
+
+func TestTCPServerShutdown(t *testing.T) {
+	var server  *ModbusServer
+	var err     error
+	var idle    *ModbusClient
+	var busy    *ModbusClient
+	var th      *ctxTestHandler
+	var ctx     context.Context
+	var cancel  context.CancelFunc
+	var done    chan error
+	var partial chan error
+	var sock    net.Conn
+	var start   time.Time
+
+	th	= &ctxTestHandler{
+		tcpTestHandler: &tcpTestHandler{},
+		cancelled:      make(chan error, 4),
+		delay:          300 * time.Millisecond,
+	}
+	th.input[5]	= 0x5555
+
+	for _, deadline := range []time.Duration{2 * time.Second, 50 * time.Millisecond} {
+		server, err = NewServer(&ServerConfiguration{
+			URL:		"tcp://localhost:5523",
+		}, th)
+		if err != nil {
+			t.Errorf("failed to create server: %v", err)
+			return
+		}
+
+		err = server.Start()
+		if err != nil {
+			t.Errorf("failed to start server: %v", err)
+			return
+		}
+
+		idle, err	= NewClient(&ClientConfiguration{
+			URL:		"tcp://localhost:5523",
+			Timeout:	1 * time.Second,
+		})
+		if err != nil {
+			t.Errorf("failed to create client: %v", err)
+			return
+		}
+
+		busy, err	= NewClient(&ClientConfiguration{
+			URL:		"tcp://localhost:5523",
+			Timeout:	1 * time.Second,
+		})
+		if err != nil {
+			t.Errorf("failed to create client: %v", err)
+			return
+		}
+
+		for _, c := range []*ModbusClient{idle, busy} {
+			err	= c.Open()
+			if err != nil {
+				t.Errorf("failed to open client: %v", err)
+				return
+			}
+			c.SetUnitId(9)
+		}
+
+		// serve a slow request while shutting down
+		done	= make(chan error)
+		go func() {
+			var regs	[]uint16
+			var err		error
+
+			regs, err	= busy.ReadRegisters(5, 1, INPUT_REGISTER)
+			if err == nil && (len(regs) != 1 || regs[0] != 0x5555) {
+				t.Errorf("unexpected register values: %v", regs)
+			}
+			done <- err
+		}()
+
+		// start sending a request before shutting down, then send the rest
+		// of it once shutdown has started: it should still be served
+		sock, err	= net.Dial("tcp", "localhost:5523")
+		if err != nil {
+			t.Errorf("failed to dial server: %v", err)
+			return
+		}
+		sock.SetDeadline(time.Now().Add(2 * time.Second))
+		sock.Write([]byte{0x00, 0x01, 0x00, 0x00, 0x00})
+
+		partial	= make(chan error)
+		go func() {
+			var rxbuf	= make([]byte, 11)
+			var err		error
+
+			time.Sleep(150 * time.Millisecond)
+			sock.Write([]byte{0x06, 0x09, 0x04, 0x00, 0x05, 0x00, 0x01})
+			_, err	= io.ReadFull(sock, rxbuf)
+			if err == nil && (rxbuf[9] != 0x55 || rxbuf[10] != 0x55) {
+				t.Errorf("unexpected response: %v", rxbuf)
+			}
+			sock.Close()
+			partial <- err
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		start		= time.Now()
+		ctx, cancel	= context.WithTimeout(context.Background(), deadline)
+		err		= server.Shutdown(ctx)
+		cancel()
+
+		if deadline > 1 * time.Second {
+			// the in-flight request should have been allowed to complete
+			if err != nil {
+				t.Errorf("server.Shutdown() should have succeeded, got: %v", err)
+			}
+			if time.Since(start) < 100 * time.Millisecond {
+				t.Errorf("server.Shutdown() should have waited for the request")
+			}
+
+			err	= <-done
+			if err != nil {
+				t.Errorf("in-flight request should have succeeded, got: %v", err)
+			}
+
+			err	= <-partial
+			if err != nil {
+				t.Errorf("partially received request should have been served, got: %v", err)
+			}
+		} else {
+			// the in-flight request should have been cut short
+			if err != context.DeadlineExceeded {
+				t.Errorf("server.Shutdown() should have returned " +
+					 "context.DeadlineExceeded, got: %v", err)
+			}
+
+			select {
+			case err = <-th.cancelled:
+				if err != context.Canceled {
+					t.Errorf("expected context.Canceled, got: %v", err)
+				}
+			case <-time.After(500 * time.Millisecond):
+				t.Errorf("the request context should have been cancelled")
+			}
+
+			err	= <-done
+			if err == nil {
+				t.Errorf("in-flight request should have failed")
+			}
+			<-partial
+		}
+
+		// idle sessions should have been closed and no new connection
+		// should be accepted
+		_, err	= idle.ReadRegisters(0, 1, INPUT_REGISTER)
+		if err == nil {
+			t.Errorf("idle session should have been closed")
+		}
+
+		idle.Close()
+		busy.Close()
+
+		err	= busy.Open()
+		if err == nil {
+			_, err	= busy.ReadRegisters(0, 1, INPUT_REGISTER)
+			busy.Close()
+		}
+		if err == nil {
+			t.Errorf("new connections should have been refused")
+		}
+	}
+
+	return
+}
+
+func TestTCPClientForceListenOnlyModeTimeout(t *testing.T) {
+	var client *ModbusClient
+	var p1, p2 net.Conn
+	var err    error
+
+	// nobody reads from the other end of the pipe: the write should time out
+	p1, p2	= net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+
+	client	= &ModbusClient{
+		logger:        newLogger("test-tcp-client", nil),
+		transport:     newTCPTransport(p1, 50 * time.Millisecond, nil),
+		unitId:        1,
+		endianness:    BIG_ENDIAN,
+		wordOrder:     HIGH_WORD_FIRST,
+		transportType: modbusTCP,
+	}
+
+	err	= client.ForceListenOnlyMode()
+	if err != ErrRequestTimedOut {
+		t.Errorf("client.ForceListenOnlyMode() should have returned ErrRequestTimedOut, got: %v", err)
+	}
+
+	return
+}
+
 type tcpTestHandler struct {
 	coils	[10]bool
 	di	[10]bool
@@ -656,3 +2314,168 @@ func (th *tcpTestHandler) HandleInputRegisters(req *InputRegistersRequest) (res
 
 	return
 }
+
+// maskWriteTestHandler wraps tcpTestHandler to implement MaskWriteRegisterHandler.
+type maskWriteTestHandler struct {
+	*tcpTestHandler
+}
+
+func (mh *maskWriteTestHandler) HandleMaskWriteRegister(req *MaskWriteRegisterRequest) (err error) {
+	if req.UnitId != 9 || req.AndMask != 0xff00 {
+		err	= ErrIllegalFunction
+		return
+	}
+
+	if req.Addr >= uint16(len(mh.holding)) {
+		err = ErrIllegalDataAddress
+		return
+	}
+
+	mh.holding[req.Addr] = req.OrMask
+
+	return
+}
+
+// fifoTestHandler wraps tcpTestHandler to implement FIFOQueueHandler.
+type fifoTestHandler struct {
+	*tcpTestHandler
+	fifo	[]uint16
+}
+
+func (fh *fifoTestHandler) HandleFIFOQueue(req *FIFOQueueRequest) (res []uint16, err error) {
+	if req.UnitId != 9 {
+		err	= ErrIllegalFunction
+		return
+	}
+
+	// only expose a single FIFO queue at address 0x04de
+	if req.Addr != 0x04de {
+		err	= ErrIllegalDataAddress
+		return
+	}
+
+	res	= fh.fifo
+
+	return
+}
+
+// fileTestHandler wraps tcpTestHandler to implement FileRecordHandler.
+// It exposes a single file (#4) of 16 records.
+type fileTestHandler struct {
+	*tcpTestHandler
+	file	[16]uint16
+}
+
+func (fh *fileTestHandler) HandleFileRecords(req *FileRecordsRequest) (res [][]uint16, err error) {
+	if req.UnitId != 9 {
+		err	= ErrIllegalFunction
+		return
+	}
+
+	// validate all sub-requests before touching the file
+	for _, record := range req.Records {
+		if record.FileNumber != 4 ||
+		   int(record.RecordNumber) + int(record.Length) > len(fh.file) {
+			err	= ErrIllegalDataAddress
+			return
+		}
+	}
+
+	for _, record := range req.Records {
+		if req.IsWrite {
+			copy(fh.file[record.RecordNumber:], record.Data)
+		} else {
+			res = append(res, append([]uint16{},
+				fh.file[record.RecordNumber:record.RecordNumber + record.Length]...))
+		}
+	}
+
+	return
+}
+
+// identTestHandler answers read exception status and report server id requests.
+type identTestHandler struct {
+	*tcpTestHandler
+	status	uint8
+	id	[]byte
+	running	bool
+}
+
+func (ih *identTestHandler) HandleExceptionStatus(req *ExceptionStatusRequest) (status uint8, err error) {
+	if req.UnitId != 9 {
+		err	= ErrIllegalFunction
+		return
+	}
+
+	status	= ih.status
+
+	return
+}
+
+func (ih *identTestHandler) HandleServerId(req *ServerIdRequest) (id []byte, running bool, err error) {
+	if req.UnitId != 9 {
+		err	= ErrIllegalFunction
+		return
+	}
+
+	id	= ih.id
+	running	= ih.running
+
+	return
+}
+
+// rawTestHandler answers user-defined function code 0x41 by echoing the
+// request payload in reverse order, and rejects all other unknown function codes.
+type rawTestHandler struct {
+	*tcpTestHandler
+}
+
+func (rh *rawTestHandler) HandleRaw(req *RawRequest) (res []byte, err error) {
+	if req.UnitId != 9 || req.FunctionCode != 0x41 {
+		err	= ErrIllegalFunction
+		return
+	}
+
+	if len(req.Payload) == 0 {
+		err	= ErrIllegalDataValue
+		return
+	}
+
+	for i := len(req.Payload) - 1; i >= 0; i-- {
+		res	= append(res, req.Payload[i])
+	}
+
+	return
+}
+
+// ctxTestHandler blocks reads of input register #5 until the request context is
+// cancelled (or, if delay is set, for up to delay), then reports the context
+// error if any.
+type ctxTestHandler struct {
+	*tcpTestHandler
+	cancelled	chan error
+	delay		time.Duration
+}
+
+func (ch *ctxTestHandler) HandleInputRegisters(req *InputRegistersRequest) (res []uint16, err error) {
+	var timeout	<-chan time.Time
+
+	if req.Addr != 5 {
+		res, err	= ch.tcpTestHandler.HandleInputRegisters(req)
+		return
+	}
+
+	if ch.delay > 0 {
+		timeout	= time.After(ch.delay)
+	}
+
+	select {
+	case <-req.Context.Done():
+		ch.cancelled <- req.Context.Err()
+		err	= ErrServerDeviceFailure
+	case <-timeout:
+		res, err	= ch.tcpTestHandler.HandleInputRegisters(req)
+	}
+
+	return
+}
@@ -5,6 +5,8 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 )
@@ -398,6 +400,333 @@ func (th *tlsTestHandler) HandleInputRegisters(req *InputRegistersRequest) (res
 	return
 }
 
+// TestTLSServerCertRotation tests that rotated server certificates and client
+// CAs are picked up by new sessions without affecting established ones.
+func TestTLSServerCertRotation(t *testing.T) {
+	var err        error
+	var dir        string
+	var server     *ModbusServer
+	var kpl        *KeyPairLoader
+	var cpl        *CertPoolLoader
+	var serverCA   tls.Certificate
+	var clientCA1  tls.Certificate
+	var clientCA2  tls.Certificate
+	var client1    tls.Certificate
+	var client2    tls.Certificate
+	var rootCAs    *x509.CertPool
+	var certPEM    []byte
+	var keyPEM     []byte
+	var c1         *ModbusClient
+	var c2         *ModbusClient
+	var c3         *ModbusClient
+	var newClient  = func(keyPair *tls.Certificate) (mc *ModbusClient) {
+		mc, err	= NewClient(&ClientConfiguration{
+			URL:           "tcp+tls://localhost:5526",
+			Timeout:       1 * time.Second,
+			TLSClientCert: keyPair,
+			TLSRootCAs:    rootCAs,
+		})
+		if err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+		mc.SetUnitId(9)
+
+		err	= mc.Open()
+		if err != nil {
+			t.Fatalf("failed to open client: %v", err)
+		}
+
+		return
+	}
+	var serverCN   = func() (cn string) {
+		var conn	*tls.Conn
+
+		conn, err	= tls.Dial("tcp", "localhost:5526", &tls.Config{
+			Certificates: []tls.Certificate{client1},
+			RootCAs:      rootCAs,
+		})
+		if err != nil {
+			t.Fatalf("failed to dial server: %v", err)
+		}
+		cn	= conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		conn.Close()
+
+		return
+	}
+
+	dir		= t.TempDir()
+	serverCA, certPEM, _	= genTestKeyPair(t, "server ca", nil)
+	rootCAs		= x509.NewCertPool()
+	rootCAs.AppendCertsFromPEM(certPEM)
+
+	clientCA1, certPEM, _	= genTestKeyPair(t, "client ca 1", nil)
+	writeTestFile(t, filepath.Join(dir, "client-cas.pem"), certPEM, 1)
+	clientCA2, _, _	= genTestKeyPair(t, "client ca 2", nil)
+	client1, _, _	= genTestKeyPair(t, "client 1", &clientCA1)
+	client2, _, _	= genTestKeyPair(t, "client 2", &clientCA2)
+
+	_, certPEM, keyPEM	= genTestKeyPair(t, "server 1", &serverCA)
+	writeTestFile(t, filepath.Join(dir, "server.crt"), certPEM, 1)
+	writeTestFile(t, filepath.Join(dir, "server.key"), keyPEM, 1)
+
+	kpl, err	= NewKeyPairLoader(filepath.Join(dir, "server.crt"),
+					   filepath.Join(dir, "server.key"))
+	if err != nil {
+		t.Fatalf("NewKeyPairLoader() should have succeeded, got: %v", err)
+	}
+
+	cpl, err	= NewCertPoolLoader(filepath.Join(dir, "client-cas.pem"))
+	if err != nil {
+		t.Fatalf("NewCertPoolLoader() should have succeeded, got: %v", err)
+	}
+
+	server, err	= NewServer(&ServerConfiguration{
+		URL:              "tcp+tls://localhost:5526",
+		MaxClients:       5,
+		TLSGetServerCert: kpl.GetCertificate,
+		TLSGetClientCAs:  cpl.GetCertPool,
+	}, &tcpTestHandler{})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	err	= server.Start()
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Stop()
+
+	c1	= newClient(&client1)
+	defer c1.Close()
+
+	_, err	= c1.ReadRegisters(0, 2, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("c1.ReadRegisters() should have succeeded, got: %v", err)
+	}
+
+	if serverCN() != "server 1" {
+		t.Errorf("expected server 1 to be presented")
+	}
+
+	// rotate the server certificate: new sessions should be presented with
+	// the new one
+	_, certPEM, keyPEM	= genTestKeyPair(t, "server 2", &serverCA)
+	writeTestFile(t, filepath.Join(dir, "server.crt"), certPEM, 2)
+	writeTestFile(t, filepath.Join(dir, "server.key"), keyPEM, 2)
+
+	if serverCN() != "server 2" {
+		t.Errorf("expected server 2 to be presented")
+	}
+
+	// replace the first client CA with the second one
+	certPEM	= pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: clientCA2.Leaf.Raw,
+	})
+	writeTestFile(t, filepath.Join(dir, "client-cas.pem"), certPEM, 2)
+
+	// clients issued by the first CA should now be rejected...
+	c2	= newClient(&client1)
+	defer c2.Close()
+
+	_, err	= c2.ReadRegisters(0, 2, HOLDING_REGISTER)
+	if err == nil {
+		t.Errorf("c2.ReadRegisters() should have failed")
+	}
+
+	// ... while clients issued by the second one are accepted
+	c3	= newClient(&client2)
+	defer c3.Close()
+
+	_, err	= c3.ReadRegisters(0, 2, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("c3.ReadRegisters() should have succeeded, got: %v", err)
+	}
+
+	// the established session should be unaffected
+	_, err	= c1.ReadRegisters(0, 2, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("c1.ReadRegisters() should have succeeded, got: %v", err)
+	}
+
+	return
+}
+
+// TestTLSBaseConfig tests that base TLS configurations are honored by both
+// clients and servers, without weakening MBAPS requirements.
+func TestTLSBaseConfig(t *testing.T) {
+	var err       error
+	var server    *ModbusServer
+	var client    *ModbusClient
+	var ca        tls.Certificate
+	var serverKp  tls.Certificate
+	var clientKp  tls.Certificate
+	var cp        *x509.CertPool
+	var lock      sync.Mutex
+	var sni       []string
+	var resumed   []bool
+	var conn      *tls.Conn
+	var clientConfig = func(base *tls.Config) (conf *ClientConfiguration) {
+		conf	= &ClientConfiguration{
+			URL:           "tcp+tls://127.0.0.1:5528",
+			Timeout:       1 * time.Second,
+			TLSClientCert: &clientKp,
+			TLSRootCAs:    cp,
+			TLSConfig:     base,
+		}
+
+		return
+	}
+
+	ca, _, _	= genTestKeyPair(t, "ca", nil)
+	serverKp, _, _	= genTestKeyPair(t, "server", &ca)
+	clientKp, _, _	= genTestKeyPair(t, "client", &ca)
+	cp		= x509.NewCertPool()
+	cp.AddCert(ca.Leaf)
+
+	// TLS versions below 1.2 and per-client configurations should be refused
+	for _, base := range []*tls.Config{
+		{MaxVersion: tls.VersionTLS11},
+		{GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return nil, nil
+		}},
+	} {
+		_, err	= NewServer(&ServerConfiguration{
+			URL:           "tcp+tls://localhost:5528",
+			TLSServerCert: &serverKp,
+			TLSClientCAs:  cp,
+			TLSConfig:     base,
+		}, &tcpTestHandler{})
+		if err != ErrConfigurationError {
+			t.Errorf("NewServer() should have returned ErrConfigurationError, got: %v", err)
+		}
+	}
+
+	// so should disabling server certificate verification
+	_, err	= NewClient(clientConfig(&tls.Config{InsecureSkipVerify: true}))
+	if err != ErrConfigurationError {
+		t.Errorf("NewClient() should have returned ErrConfigurationError, got: %v", err)
+	}
+
+	// the server certificate may come from the base configuration, while
+	// mutual authentication and TLS 1.2+ are enforced regardless of the base
+	// configuration
+	server, err	= NewServer(&ServerConfiguration{
+		URL:          "tcp+tls://localhost:5528",
+		MaxClients:   5,
+		TLSClientCAs: cp,
+		TLSConfig:    &tls.Config{
+			Certificates: []tls.Certificate{serverKp},
+			ClientAuth:   tls.NoClientCert,
+			MinVersion:   tls.VersionTLS10,
+		},
+	}, &tcpTestHandler{})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	if server.tlsConfig.MinVersion != tls.VersionTLS12 ||
+	   server.tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("MBAPS requirements should have been enforced")
+	}
+
+	// require TLS 1.3 and record the server name sent by clients
+	server, err	= NewServer(&ServerConfiguration{
+		URL:           "tcp+tls://localhost:5528",
+		MaxClients:    5,
+		TLSServerCert: &serverKp,
+		TLSClientCAs:  cp,
+		TLSConfig:     &tls.Config{
+			MinVersion:       tls.VersionTLS13,
+			VerifyConnection: func(state tls.ConnectionState) error {
+				lock.Lock()
+				sni	= append(sni, state.ServerName)
+				lock.Unlock()
+
+				return nil
+			},
+		},
+	}, &tcpTestHandler{})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	err	= server.Start()
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Stop()
+
+	// clients limited to TLS 1.2 should fail to connect
+	client, err	= NewClient(clientConfig(&tls.Config{MaxVersion: tls.VersionTLS12}))
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	err	= client.Open()
+	if err == nil {
+		client.Close()
+		t.Errorf("client.Open() should have failed")
+	}
+
+	// clients without certificates should be rejected
+	conn, err	= tls.Dial("tcp", "localhost:5528", &tls.Config{RootCAs: cp})
+	if err == nil {
+		conn.Write([]byte{0x00, 0x01, 0x00, 0x00, 0x00, 0x06, 0x09, 0x03, 0x00, 0x00, 0x00, 0x01})
+		_, err	= conn.Read(make([]byte, 16))
+		conn.Close()
+	}
+	if err == nil {
+		t.Errorf("clients without certificates should have been rejected")
+	}
+
+	// set the server name explicitly (the URL holds an IP address) and
+	// enable session resumption
+	client, err	= NewClient(clientConfig(&tls.Config{
+		ServerName:         "localhost",
+		ClientSessionCache: tls.NewLRUClientSessionCache(4),
+		VerifyConnection:   func(state tls.ConnectionState) error {
+			lock.Lock()
+			resumed	= append(resumed, state.DidResume)
+			lock.Unlock()
+
+			return nil
+		},
+	}))
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	client.SetUnitId(9)
+
+	for i := 0; i < 2; i++ {
+		err	= client.Open()
+		if err != nil {
+			t.Fatalf("client.Open() should have succeeded, got: %v", err)
+		}
+
+		// reading the response also processes session tickets
+		_, err	= client.ReadRegisters(0, 2, HOLDING_REGISTER)
+		if err != nil {
+			t.Errorf("client.ReadRegisters() should have succeeded, got: %v", err)
+		}
+
+		client.Close()
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if len(resumed) != 2 || resumed[0] || !resumed[1] {
+		t.Errorf("expected the second session to be resumed, got: %v", resumed)
+	}
+
+	if len(sni) != 2 || sni[0] != "localhost" || sni[1] != "localhost" {
+		t.Errorf("unexpected server names: %v", sni)
+	}
+
+	return
+}
+
 func TestServerExtractRole(t *testing.T) {
 	var ms       *ModbusServer
 	var pemBlock *pem.Block
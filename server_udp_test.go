@@ -0,0 +1,216 @@
+package modbus
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUDPServer(t *testing.T) {
+	var server *ModbusServer
+	var client *ModbusClient
+	var th     *udpTestHandler
+	var err    error
+	var regs   []uint16
+	var count  uint16
+
+	th	= &udpTestHandler{tcpTestHandler: &tcpTestHandler{}}
+	server, err	= NewServer(&ServerConfiguration{
+		URL:	"udp://localhost:5513",
+	}, th)
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+
+	err	= server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+		return
+	}
+	defer server.Stop()
+
+	client, err	= NewClient(&ClientConfiguration{
+		URL:		"udp://localhost:5513",
+		Timeout:	100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+
+	err	= client.Open()
+	if err != nil {
+		t.Errorf("failed to open client: %v", err)
+		return
+	}
+	defer client.Close()
+
+	client.SetUnitId(9)
+
+	err	= client.WriteRegisters(2, []uint16{0x1122, 0x3344})
+	if err != nil {
+		t.Errorf("client.WriteRegisters() should have succeeded, got: %v", err)
+	}
+
+	regs, err	= client.ReadRegisters(1, 3, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("client.ReadRegisters() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 3 || regs[0] != 0x0000 || regs[1] != 0x1122 || regs[2] != 0x3344 {
+		t.Errorf("unexpected register values: %v", regs)
+	}
+
+	// the client address should be set to the source of the datagram
+	_, err		= client.ReadRegisters(0, 1, INPUT_REGISTER)
+	if err != nil {
+		t.Errorf("client.ReadRegisters() should have succeeded, got: %v", err)
+	}
+	th.lock.Lock()
+	if !strings.HasPrefix(th.lastClientAddr, "127.0.0.1:") ||
+	   strings.HasSuffix(th.lastClientAddr, ":5513") {
+		t.Errorf("unexpected client address: '%s'", th.lastClientAddr)
+	}
+	th.lock.Unlock()
+
+	// exceptions should be returned as with TCP
+	_, err		= client.ReadRegisters(8, 4, HOLDING_REGISTER)
+	if err != ErrIllegalDataAddress {
+		t.Errorf("client.ReadRegisters() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	// diagnostic counters are shared by all datagrams
+	count, err	= client.ReturnServerMessageCount()
+	if err != nil {
+		t.Errorf("client.ReturnServerMessageCount() should have succeeded, got: %v", err)
+	}
+	if count != 5 {
+		t.Errorf("expected a server message count of 5, got: %v", count)
+	}
+
+	return
+}
+
+func TestRTUOverUDPServer(t *testing.T) {
+	var server *ModbusServer
+	var client *ModbusClient
+	var err    error
+	var regs   []uint16
+	var status uint8
+	var res    *RawPDU
+
+	_, err	= NewServer(&ServerConfiguration{
+		URL:		"rtuoverudp://localhost:5514",
+		UnitIds:	[]uint8{0},
+	}, &tcpTestHandler{})
+	if err != ErrConfigurationError {
+		t.Errorf("NewServer() should have returned ErrConfigurationError, got: %v", err)
+	}
+
+	server, err	= NewServer(&ServerConfiguration{
+		URL:		"rtuoverudp://localhost:5514",
+		UnitIds:	[]uint8{9},
+	}, &udpTestHandler{tcpTestHandler: &tcpTestHandler{}})
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+
+	err	= server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+		return
+	}
+	defer server.Stop()
+
+	client, err	= NewClient(&ClientConfiguration{
+		URL:		"rtuoverudp://localhost:5514",
+		Timeout:	100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+
+	err	= client.Open()
+	if err != nil {
+		t.Errorf("failed to open client: %v", err)
+		return
+	}
+	defer client.Close()
+
+	client.SetUnitId(9)
+
+	err	= client.WriteRegisters(2, []uint16{0x1122, 0x3344})
+	if err != nil {
+		t.Errorf("client.WriteRegisters() should have succeeded, got: %v", err)
+	}
+
+	regs, err	= client.ReadRegisters(1, 3, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("client.ReadRegisters() should have succeeded, got: %v", err)
+	}
+	if len(regs) != 3 || regs[0] != 0x0000 || regs[1] != 0x1122 || regs[2] != 0x3344 {
+		t.Errorf("unexpected register values: %v", regs)
+	}
+
+	status, err	= client.ReadExceptionStatus()
+	if err != nil {
+		t.Errorf("client.ReadExceptionStatus() should have succeeded, got: %v", err)
+	}
+	if status != 0x5a {
+		t.Errorf("expected an exception status of 0x5a, got: 0x%02x", status)
+	}
+
+	// requests of unknown length should be framed by the datagram
+	res, err	= client.ExecuteRaw(0x41, []byte{0x01, 0x02, 0x03})
+	if err != nil {
+		t.Errorf("client.ExecuteRaw() should have succeeded, got: %v", err)
+	}
+	if res == nil || res.FunctionCode != 0x41 || len(res.Payload) != 3 ||
+	   res.Payload[0] != 0x01 || res.Payload[2] != 0x03 {
+		t.Errorf("unexpected response: %v", res)
+	}
+
+	// requests to other unit ids should be silently ignored
+	client.SetUnitId(10)
+	_, err		= client.ReadRegisters(1, 3, HOLDING_REGISTER)
+	if err != ErrRequestTimedOut {
+		t.Errorf("client.ReadRegisters() should have returned ErrRequestTimedOut, got: %v", err)
+	}
+
+	return
+}
+
+// udpTestHandler records the client address of input register requests.
+type udpTestHandler struct {
+	*tcpTestHandler
+	// lastClientAddr is written to by the server goroutine and read by
+	// the test, hence guarded by lock
+	lock		sync.Mutex
+	lastClientAddr	string
+}
+
+func (uth *udpTestHandler) HandleInputRegisters(req *InputRegistersRequest) (res []uint16, err error) {
+	uth.lock.Lock()
+	uth.lastClientAddr	= req.ClientAddr
+	uth.lock.Unlock()
+
+	res, err		= uth.tcpTestHandler.HandleInputRegisters(req)
+
+	return
+}
+
+func (uth *udpTestHandler) HandleExceptionStatus(req *ExceptionStatusRequest) (status uint8, err error) {
+	status	= 0x5a
+
+	return
+}
+
+func (uth *udpTestHandler) HandleRaw(req *RawRequest) (res []byte, err error) {
+	// echo the request back
+	res	= req.Payload
+
+	return
+}
@@ -0,0 +1,299 @@
+package modbus
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upper bounds of request latency histogram buckets
+var latencyBuckets = []time.Duration{
+	1 * time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond,
+	25 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond,
+	250 * time.Millisecond, 500 * time.Millisecond, 1 * time.Second,
+	2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+// Server statistics object, as returned by ModbusServer.Stats().
+// All counters are cumulative since the creation of the server.
+type ServerStats struct {
+	// number of active client sessions (tcp, tcp+tls and rtuovertcp only)
+	ActiveSessions       uint64
+	// number of client connections accepted (i.e. having passed connection
+	// limits, the TLS handshake and OnConnect) and rejected, either due to
+	// connection limits (MaxClients, MaxClientsPerIP) or by OnConnect
+	AcceptedConnections  uint64
+	RejectedConnections  uint64
+	// number of sessions closed to make room for new ones (see EvictionPolicy)
+	EvictedConnections   uint64
+	// number of failed TLS handshakes (tcp+tls only), which are counted as
+	// neither accepted nor rejected connections
+	TLSHandshakeFailures uint64
+	// number of malformed requests and frames (including CRC errors)
+	ProtocolErrors       uint64
+	// number of requests served, by function code
+	Requests             map[uint8]uint64
+	// number of exception responses sent, by exception code
+	Exceptions           map[uint8]uint64
+	// request latency (from the time the request is received to the time
+	// its response is ready to be sent), by function code
+	Latency              map[uint8]*LatencyHistogram
+}
+
+// Latency histogram object.
+type LatencyHistogram struct {
+	// upper bounds of the histogram buckets
+	Bounds []time.Duration
+	// number of observations less than or equal to each bound (cumulative)
+	Counts []uint64
+	// total number of observations and sum of all observations
+	Count  uint64
+	Sum    time.Duration
+}
+
+// serverStats collects server statistics.
+type serverStats struct {
+	lock           sync.Mutex
+	accepted       uint64
+	rejected       uint64
+	evicted        uint64
+	tlsFailures    uint64
+	protocolErrors uint64
+	requests       [256]uint64
+	exceptions     [256]uint64
+	// non-cumulative bucket counts (the last bucket holding observations
+	// above the highest bound), allocated on the first observation
+	latency        [256][]uint64
+	latencySum     [256]time.Duration
+}
+
+// Returns a snapshot of server statistics.
+func (ms *ModbusServer) Stats() (stats *ServerStats) {
+	ms.lock.Lock()
+	stats	= ms.stats.snapshot()
+	stats.ActiveSessions	= uint64(len(ms.tcpClients))
+	ms.lock.Unlock()
+
+	return
+}
+
+// Returns an http.Handler rendering server statistics in the Prometheus text
+// exposition format, e.g. to be served at /metrics:
+//	http.Handle("/metrics", server.MetricsHandler())
+func (ms *ModbusServer) MetricsHandler() (h http.Handler) {
+	h	= http.HandlerFunc(ms.serveMetrics)
+
+	return
+}
+
+/*** unexported methods ***/
+// Writes server statistics in the Prometheus text exposition format.
+func (ms *ModbusServer) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var stats	*ServerStats
+	var sb		strings.Builder
+
+	stats	= ms.Stats()
+
+	writeMetric(&sb, "modbus_server_active_sessions", "gauge",
+		"Number of active client sessions.", stats.ActiveSessions)
+	writeMetric(&sb, "modbus_server_connections_accepted_total", "counter",
+		"Number of client connections accepted.", stats.AcceptedConnections)
+	writeMetric(&sb, "modbus_server_connections_rejected_total", "counter",
+		"Number of client connections rejected.", stats.RejectedConnections)
+	writeMetric(&sb, "modbus_server_connections_evicted_total", "counter",
+		"Number of client sessions evicted to make room for new ones.",
+		stats.EvictedConnections)
+	writeMetric(&sb, "modbus_server_tls_handshake_failures_total", "counter",
+		"Number of failed TLS handshakes.", stats.TLSHandshakeFailures)
+	writeMetric(&sb, "modbus_server_protocol_errors_total", "counter",
+		"Number of malformed requests and frames.", stats.ProtocolErrors)
+
+	sb.WriteString("# HELP modbus_server_requests_total Number of requests served, " +
+		       "by function code.\n")
+	sb.WriteString("# TYPE modbus_server_requests_total counter\n")
+	for _, fc := range sortedKeys(stats.Requests) {
+		fmt.Fprintf(&sb, "modbus_server_requests_total{function_code=\"0x%02x\"} %v\n",
+			    fc, stats.Requests[fc])
+	}
+
+	sb.WriteString("# HELP modbus_server_exceptions_total Number of exception " +
+		       "responses sent, by exception code.\n")
+	sb.WriteString("# TYPE modbus_server_exceptions_total counter\n")
+	for _, code := range sortedKeys(stats.Exceptions) {
+		fmt.Fprintf(&sb, "modbus_server_exceptions_total{exception_code=\"0x%02x\"} %v\n",
+			    code, stats.Exceptions[code])
+	}
+
+	sb.WriteString("# HELP modbus_server_request_duration_seconds Request latency, " +
+		       "by function code.\n")
+	sb.WriteString("# TYPE modbus_server_request_duration_seconds histogram\n")
+	for _, fc := range sortedLatencyKeys(stats.Latency) {
+		var hist	= stats.Latency[fc]
+
+		for i, bound := range hist.Bounds {
+			fmt.Fprintf(&sb, "modbus_server_request_duration_seconds_bucket" +
+				    "{function_code=\"0x%02x\",le=\"%v\"} %v\n",
+				    fc, bound.Seconds(), hist.Counts[i])
+		}
+		fmt.Fprintf(&sb, "modbus_server_request_duration_seconds_bucket" +
+			    "{function_code=\"0x%02x\",le=\"+Inf\"} %v\n", fc, hist.Count)
+		fmt.Fprintf(&sb, "modbus_server_request_duration_seconds_sum" +
+			    "{function_code=\"0x%02x\"} %v\n", fc, hist.Sum.Seconds())
+		fmt.Fprintf(&sb, "modbus_server_request_duration_seconds_count" +
+			    "{function_code=\"0x%02x\"} %v\n", fc, hist.Count)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(sb.String()))
+
+	return
+}
+
+// Returns a copy of all counters, turning bucket counts into cumulative counts.
+func (ss *serverStats) snapshot() (stats *ServerStats) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	stats	= &ServerStats{
+		AcceptedConnections:  ss.accepted,
+		RejectedConnections:  ss.rejected,
+		EvictedConnections:   ss.evicted,
+		TLSHandshakeFailures: ss.tlsFailures,
+		ProtocolErrors:       ss.protocolErrors,
+		Requests:             map[uint8]uint64{},
+		Exceptions:           map[uint8]uint64{},
+		Latency:              map[uint8]*LatencyHistogram{},
+	}
+
+	for i := 0; i < 256; i++ {
+		if ss.requests[i] > 0 {
+			stats.Requests[uint8(i)]	= ss.requests[i]
+		}
+
+		if ss.exceptions[i] > 0 {
+			stats.Exceptions[uint8(i)]	= ss.exceptions[i]
+		}
+
+		if ss.latency[i] != nil {
+			var hist	= &LatencyHistogram{
+				Bounds: latencyBuckets,
+				Counts: make([]uint64, len(latencyBuckets)),
+				Sum:    ss.latencySum[i],
+			}
+
+			for j, count := range ss.latency[i] {
+				hist.Count	+= count
+				if j < len(latencyBuckets) {
+					hist.Counts[j]	= hist.Count
+				}
+			}
+
+			stats.Latency[uint8(i)]	= hist
+		}
+	}
+
+	return
+}
+
+func (ss *serverStats) connectionAccepted() {
+	ss.lock.Lock()
+	ss.accepted++
+	ss.lock.Unlock()
+
+	return
+}
+
+func (ss *serverStats) connectionRejected() {
+	ss.lock.Lock()
+	ss.rejected++
+	ss.lock.Unlock()
+
+	return
+}
+
+func (ss *serverStats) connectionEvicted() {
+	ss.lock.Lock()
+	ss.evicted++
+	ss.lock.Unlock()
+
+	return
+}
+
+func (ss *serverStats) tlsHandshakeFailed() {
+	ss.lock.Lock()
+	ss.tlsFailures++
+	ss.lock.Unlock()
+
+	return
+}
+
+func (ss *serverStats) protocolError() {
+	ss.lock.Lock()
+	ss.protocolErrors++
+	ss.lock.Unlock()
+
+	return
+}
+
+func (ss *serverStats) exceptionSent(code uint8) {
+	ss.lock.Lock()
+	ss.exceptions[code]++
+	ss.lock.Unlock()
+
+	return
+}
+
+// Records a request along with the time it took to serve it.
+func (ss *serverStats) requestServed(fc uint8, latency time.Duration) {
+	var bucket	int
+
+	// find the first bucket the observation fits in, if any
+	for bucket = 0; bucket < len(latencyBuckets); bucket++ {
+		if latency <= latencyBuckets[bucket] {
+			break
+		}
+	}
+
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	ss.requests[fc]++
+
+	if ss.latency[fc] == nil {
+		ss.latency[fc]	= make([]uint64, len(latencyBuckets) + 1)
+	}
+	ss.latency[fc][bucket]++
+	ss.latencySum[fc]	+= latency
+
+	return
+}
+
+// Writes a single, unlabelled metric.
+func writeMetric(sb *strings.Builder, name string, metricType string, help string,
+	value uint64) {
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s %s\n%s %v\n",
+		    name, help, name, metricType, name, value)
+
+	return
+}
+
+func sortedKeys(m map[uint8]uint64) (keys []uint8) {
+	for k := range m {
+		keys	= append(keys, k)
+	}
+	sort.Slice(keys, func(i int, j int) bool { return keys[i] < keys[j] })
+
+	return
+}
+
+func sortedLatencyKeys(m map[uint8]*LatencyHistogram) (keys []uint8) {
+	for k := range m {
+		keys	= append(keys, k)
+	}
+	sort.Slice(keys, func(i int, j int) bool { return keys[i] < keys[j] })
+
+	return
+}
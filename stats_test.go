@@ -0,0 +1,244 @@
+package modbus
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerStats(t *testing.T) {
+	var err    error
+	var server *ModbusServer
+	var client *ModbusClient
+	var sock   net.Conn
+	var stats  *ServerStats
+	var hist   *LatencyHistogram
+	var rec    *httptest.ResponseRecorder
+	var body   string
+
+	server, err	= NewServer(&ServerConfiguration{
+		URL:		"tcp://localhost:5525",
+		MaxClients:	1,
+	}, &tcpTestHandler{})
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+
+	err	= server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+		return
+	}
+	defer server.Stop()
+
+	client, err	= NewClient(&ClientConfiguration{
+		URL:		"tcp://localhost:5525",
+		Timeout:	1 * time.Second,
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+
+	err	= client.Open()
+	if err != nil {
+		t.Errorf("failed to open client: %v", err)
+		return
+	}
+
+	// two successful reads, one illegal data address and one illegal function
+	// exception
+	client.SetUnitId(9)
+	_, err	= client.ReadRegisters(0, 2, HOLDING_REGISTER)
+	if err != nil {
+		t.Errorf("client.ReadRegisters() should have succeeded, got: %v", err)
+	}
+
+	_, err	= client.ReadRegisters(0, 2, INPUT_REGISTER)
+	if err != nil {
+		t.Errorf("client.ReadRegisters() should have succeeded, got: %v", err)
+	}
+
+	_, err	= client.ReadRegisters(9, 2, HOLDING_REGISTER)
+	if err != ErrIllegalDataAddress {
+		t.Errorf("client.ReadRegisters() should have returned ErrIllegalDataAddress, got: %v", err)
+	}
+
+	client.SetUnitId(1)
+	_, err	= client.ReadRegisters(0, 1, HOLDING_REGISTER)
+	if err != ErrIllegalFunction {
+		t.Errorf("client.ReadRegisters() should have returned ErrIllegalFunction, got: %v", err)
+	}
+
+	// a second connection should be rejected
+	sock, err	= net.Dial("tcp", "localhost:5525")
+	if err != nil {
+		t.Errorf("failed to dial server: %v", err)
+		return
+	}
+	sock.SetReadDeadline(time.Now().Add(1 * time.Second))
+	ioutil.ReadAll(sock)
+	sock.Close()
+
+	stats	= server.Stats()
+	if stats.ActiveSessions != 1 || stats.AcceptedConnections != 1 ||
+	   stats.RejectedConnections != 1 || stats.EvictedConnections != 0 {
+		t.Errorf("unexpected connection counters: %+v", stats)
+	}
+
+	client.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// send a frame with an MBAP length of 0, which should cause the server
+	// to close the connection
+	sock, err	= net.Dial("tcp", "localhost:5525")
+	if err != nil {
+		t.Errorf("failed to dial server: %v", err)
+		return
+	}
+	sock.SetDeadline(time.Now().Add(1 * time.Second))
+	sock.Write([]byte{0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x09})
+	ioutil.ReadAll(sock)
+	sock.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	stats	= server.Stats()
+	if stats.ActiveSessions != 0 || stats.AcceptedConnections != 2 ||
+	   stats.RejectedConnections != 1 || stats.ProtocolErrors != 1 ||
+	   stats.TLSHandshakeFailures != 0 {
+		t.Errorf("unexpected counters: %+v", stats)
+	}
+
+	if len(stats.Requests) != 2 || stats.Requests[fcReadHoldingRegisters] != 3 ||
+	   stats.Requests[fcReadInputRegisters] != 1 {
+		t.Errorf("unexpected request counters: %v", stats.Requests)
+	}
+
+	if len(stats.Exceptions) != 2 || stats.Exceptions[exIllegalFunction] != 1 ||
+	   stats.Exceptions[exIllegalDataAddress] != 1 {
+		t.Errorf("unexpected exception counters: %v", stats.Exceptions)
+	}
+
+	hist	= stats.Latency[fcReadHoldingRegisters]
+	if hist == nil || hist.Count != 3 ||
+	   len(hist.Counts) != len(hist.Bounds) ||
+	   hist.Counts[len(hist.Counts) - 1] != 3 {
+		t.Errorf("unexpected latency histogram: %+v", hist)
+	}
+
+	// render the metrics in the prometheus text format
+	rec	= httptest.NewRecorder()
+	server.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type: %s", rec.Header().Get("Content-Type"))
+	}
+
+	body	= rec.Body.String()
+	for _, line := range []string{
+		"# TYPE modbus_server_active_sessions gauge",
+		"modbus_server_active_sessions 0",
+		"modbus_server_connections_accepted_total 2",
+		"modbus_server_connections_rejected_total 1",
+		"modbus_server_protocol_errors_total 1",
+		"modbus_server_tls_handshake_failures_total 0",
+		`modbus_server_requests_total{function_code="0x03"} 3`,
+		`modbus_server_requests_total{function_code="0x04"} 1`,
+		`modbus_server_exceptions_total{exception_code="0x01"} 1`,
+		`modbus_server_exceptions_total{exception_code="0x02"} 1`,
+		"# TYPE modbus_server_request_duration_seconds histogram",
+		`modbus_server_request_duration_seconds_bucket{function_code="0x03",le="10"} 3`,
+		`modbus_server_request_duration_seconds_bucket{function_code="0x03",le="+Inf"} 3`,
+		`modbus_server_request_duration_seconds_count{function_code="0x04"} 1`,
+	} {
+		if !strings.Contains(body, line + "\n") {
+			t.Errorf("expected metrics to contain '%s', got:\n%s", line, body)
+		}
+	}
+
+	return
+}
+
+func TestServerStatsRefusedConnections(t *testing.T) {
+	var err      error
+	var server   *ModbusServer
+	var client   *ModbusClient
+	var sock     net.Conn
+	var stats    *ServerStats
+	var ca       tls.Certificate
+	var serverKp tls.Certificate
+	var clientKp tls.Certificate
+	var cp       *x509.CertPool
+
+	ca, _, _	= genTestKeyPair(t, "ca", nil)
+	serverKp, _, _	= genTestKeyPair(t, "server", &ca)
+	clientKp, _, _	= genTestKeyPair(t, "client", &ca)
+	cp		= x509.NewCertPool()
+	cp.AddCert(ca.Leaf)
+
+	server, err	= NewServer(&ServerConfiguration{
+		URL:           "tcp+tls://localhost:5529",
+		MaxClients:    2,
+		TLSServerCert: &serverKp,
+		TLSClientCAs:  cp,
+		OnConnect:     func(info *ConnectionInfo) (err error) {
+			err	= errors.New("go away")
+			return
+		},
+	}, &tcpTestHandler{})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	err	= server.Start()
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Stop()
+
+	// fail the TLS handshake by sending garbage
+	sock, err	= net.Dial("tcp", "localhost:5529")
+	if err != nil {
+		t.Fatalf("failed to dial server: %v", err)
+	}
+	sock.SetDeadline(time.Now().Add(1 * time.Second))
+	sock.Write([]byte("not a client hello"))
+	ioutil.ReadAll(sock)
+	sock.Close()
+
+	// complete the handshake, only to be turned away by OnConnect
+	client, err	= NewClient(&ClientConfiguration{
+		URL:           "tcp+tls://localhost:5529",
+		Timeout:       1 * time.Second,
+		TLSClientCert: &clientKp,
+		TLSRootCAs:    cp,
+	})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	err	= client.Open()
+	if err == nil {
+		_, err	= client.ReadRegisters(0, 1, HOLDING_REGISTER)
+		client.Close()
+	}
+	if err == nil {
+		t.Errorf("the client should have been rejected")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	stats	= server.Stats()
+	if stats.AcceptedConnections != 0 || stats.RejectedConnections != 1 ||
+	   stats.TLSHandshakeFailures != 1 || stats.ActiveSessions != 0 {
+		t.Errorf("unexpected connection counters: %+v", stats)
+	}
+
+	return
+}
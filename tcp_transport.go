@@ -40,6 +40,18 @@ func (tt *tcpTransport) Close() (err error) {
 
 // Runs a request across the socket and returns a response.
 func (tt *tcpTransport) ExecuteRequest(req *pdu) (res *pdu, err error) {
+	err	= tt.WriteRequest(req)
+	if err != nil {
+		return
+	}
+
+	res, err = tt.readResponse()
+
+	return
+}
+
+// Writes a request to the socket without waiting for a response.
+func (tt *tcpTransport) WriteRequest(req *pdu) (err error) {
 	// set an i/o deadline on the socket (read and write)
 	err	= tt.socket.SetDeadline(time.Now().Add(tt.timeout))
 	if err != nil {
@@ -54,8 +66,6 @@ func (tt *tcpTransport) ExecuteRequest(req *pdu) (res *pdu, err error) {
 		return
 	}
 
-	res, err = tt.readResponse()
-
 	return
 }
 
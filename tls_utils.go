@@ -1,11 +1,13 @@
 package modbus
 
 import (
+	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -38,6 +40,277 @@ func LoadCertPool(filePath string) (cp *x509.CertPool, err error) {
 	return
 }
 
+// requireTLS12 raises the minimum TLS version of tlsConfig to 1.2 if lower (see
+// R-01 of the MBAPS spec), and fails if TLS 1.2 or higher can't be negotiated.
+func requireTLS12(tlsConfig *tls.Config) (err error) {
+	if tlsConfig.MinVersion < tls.VersionTLS12 {
+		tlsConfig.MinVersion	= tls.VersionTLS12
+	}
+
+	if tlsConfig.MaxVersion != 0 && tlsConfig.MaxVersion < tls.VersionTLS12 {
+		err	= fmt.Errorf("TLS versions below 1.2 are not allowed (max. version: 0x%04x)",
+				     tlsConfig.MaxVersion)
+		return
+	}
+
+	return
+}
+
+// chainConnectionVerifiers returns a tls.Config.VerifyConnection function
+// calling first (if not nil), then second.
+func chainConnectionVerifiers(first func(tls.ConnectionState) error,
+	second func(tls.ConnectionState) error) (verifier func(tls.ConnectionState) error) {
+	if first == nil {
+		verifier	= second
+		return
+	}
+
+	verifier	= func(state tls.ConnectionState) (err error) {
+		err	= first(state)
+		if err != nil {
+			return
+		}
+
+		err	= second(state)
+
+		return
+	}
+
+	return
+}
+
+// KeyPairLoader loads a TLS key pair from PEM files and reloads it whenever
+// either file changes, so that rotated certificates are picked up without
+// restarting the server:
+//	kpl, err := modbus.NewKeyPairLoader("server.crt", "server.key")
+//	...
+//	server, err := modbus.NewServer(&modbus.ServerConfiguration{
+//		URL:              "tcp+tls://[::]:802",
+//		TLSGetServerCert: kpl.GetCertificate,
+//		...
+// Files are checked for changes (size and modification time) on every handshake.
+// Should reloading fail (e.g. while files are being rewritten), the previously
+// loaded key pair keeps being used until the next successful reload.
+type KeyPairLoader struct {
+	certFile string
+	keyFile  string
+	lock     sync.Mutex
+	watcher  *fileWatcher
+	keyPair  *tls.Certificate
+}
+
+// Loads a key pair from certFile and keyFile and returns a loader watching
+// both files for changes.
+func NewKeyPairLoader(certFile string, keyFile string) (kpl *KeyPairLoader, err error) {
+	kpl	= &KeyPairLoader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		watcher:  newFileWatcher(certFile, keyFile),
+	}
+
+	err	= kpl.Reload()
+	if err != nil {
+		kpl	= nil
+		return
+	}
+
+	return
+}
+
+// Returns the current key pair, reloading it first if files have changed.
+// The signature matches that of tls.Config.GetCertificate.
+func (kpl *KeyPairLoader) GetCertificate(*tls.ClientHelloInfo) (
+	keyPair *tls.Certificate, err error) {
+	kpl.lock.Lock()
+	defer kpl.lock.Unlock()
+
+	if kpl.watcher.changed() {
+		// keep using the current key pair on failure
+		kpl.reload()
+	}
+
+	keyPair	= kpl.keyPair
+
+	return
+}
+
+// Unconditionally reloads the key pair from disk.
+func (kpl *KeyPairLoader) Reload() (err error) {
+	kpl.lock.Lock()
+	defer kpl.lock.Unlock()
+
+	err	= kpl.reload()
+
+	return
+}
+
+// Loads the key pair, must be called with kpl.lock held.
+func (kpl *KeyPairLoader) reload() (err error) {
+	var keyPair	tls.Certificate
+
+	// stat files before reading them so that changes made while loading
+	// are picked up on the next check
+	kpl.watcher.update()
+
+	keyPair, err	= tls.LoadX509KeyPair(kpl.certFile, kpl.keyFile)
+	if err == nil && keyPair.Leaf == nil {
+		// older go versions leave the leaf certificate unparsed
+		keyPair.Leaf, err	= x509.ParseCertificate(keyPair.Certificate[0])
+	}
+	if err != nil {
+		// try again on the next check
+		kpl.watcher.reset()
+		return
+	}
+
+	kpl.keyPair	= &keyPair
+
+	return
+}
+
+// CertPoolLoader loads a certificate store into a CertPool object (see
+// LoadCertPool()) and reloads it whenever the file changes, e.g. to rotate
+// the CAs used to authenticate clients without restarting the server:
+//	cpl, err := modbus.NewCertPoolLoader("client-cas.pem")
+//	...
+//	server, err := modbus.NewServer(&modbus.ServerConfiguration{
+//		TLSGetClientCAs: cpl.GetCertPool,
+//		...
+// As with KeyPairLoader, the previously loaded pool keeps being used should
+// reloading fail.
+type CertPoolLoader struct {
+	filePath string
+	lock     sync.Mutex
+	watcher  *fileWatcher
+	certPool *x509.CertPool
+}
+
+// Loads a certificate store from filePath and returns a loader watching it for
+// changes.
+func NewCertPoolLoader(filePath string) (cpl *CertPoolLoader, err error) {
+	cpl	= &CertPoolLoader{
+		filePath: filePath,
+		watcher:  newFileWatcher(filePath),
+	}
+
+	err	= cpl.Reload()
+	if err != nil {
+		cpl	= nil
+		return
+	}
+
+	return
+}
+
+// Returns the current cert pool, reloading it first if the file has changed.
+func (cpl *CertPoolLoader) GetCertPool() (cp *x509.CertPool, err error) {
+	cpl.lock.Lock()
+	defer cpl.lock.Unlock()
+
+	if cpl.watcher.changed() {
+		// keep using the current pool on failure
+		cpl.reload()
+	}
+
+	cp	= cpl.certPool
+
+	return
+}
+
+// Unconditionally reloads the cert pool from disk.
+func (cpl *CertPoolLoader) Reload() (err error) {
+	cpl.lock.Lock()
+	defer cpl.lock.Unlock()
+
+	err	= cpl.reload()
+
+	return
+}
+
+// Loads the cert pool, must be called with cpl.lock held.
+func (cpl *CertPoolLoader) reload() (err error) {
+	var cp	*x509.CertPool
+
+	cpl.watcher.update()
+
+	cp, err	= LoadCertPool(cpl.filePath)
+	if err != nil {
+		cpl.watcher.reset()
+		return
+	}
+
+	cpl.certPool	= cp
+
+	return
+}
+
+// fileWatcher detects changes to a set of files by comparing their size and
+// modification time to those recorded by the last call to update().
+type fileWatcher struct {
+	paths  []string
+	stamps []fileStamp
+}
+
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+func newFileWatcher(paths ...string) (fw *fileWatcher) {
+	fw	= &fileWatcher{
+		paths:  paths,
+		stamps: make([]fileStamp, len(paths)),
+	}
+
+	return
+}
+
+// Returns true if any of the files changed since the last call to update(), or
+// can't be accessed.
+func (fw *fileWatcher) changed() (yes bool) {
+	for i, stamp := range fw.stat() {
+		if stamp != fw.stamps[i] {
+			yes	= true
+			return
+		}
+	}
+
+	return
+}
+
+// Records the current size and modification time of all files.
+func (fw *fileWatcher) update() {
+	fw.stamps	= fw.stat()
+
+	return
+}
+
+// Forgets recorded stamps, causing changed() to report a change on the next call.
+func (fw *fileWatcher) reset() {
+	fw.stamps	= make([]fileStamp, len(fw.paths))
+
+	return
+}
+
+func (fw *fileWatcher) stat() (stamps []fileStamp) {
+	var fi	os.FileInfo
+	var err	error
+
+	stamps	= make([]fileStamp, len(fw.paths))
+	for i, path := range fw.paths {
+		fi, err	= os.Stat(path)
+		if err != nil {
+			// never matches any recorded stamp, even after reset()
+			stamps[i]	= fileStamp{size: -1}
+			continue
+		}
+
+		stamps[i]	= fileStamp{size: fi.Size(), modTime: fi.ModTime()}
+	}
+
+	return
+}
+
 // tlsSockWrapper wraps a TLS socket to work around odd error handling in
 // TLSConn on internal connection state corruption.
 // tlsSockWrapper implements the net.Conn interface to allow its
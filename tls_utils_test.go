@@ -1,10 +1,20 @@
 package modbus
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 // random certs from /etc/ssl/certs
@@ -149,3 +159,211 @@ func TestLoadCertPool(t *testing.T) {
 
 	return
 }
+
+func TestKeyPairLoader(t *testing.T) {
+	var err      error
+	var dir      string
+	var kpl      *KeyPairLoader
+	var keyPair  *tls.Certificate
+	var certPEM  []byte
+	var keyPEM   []byte
+
+	dir	= t.TempDir()
+
+	// missing files: should fail
+	_, err	= NewKeyPairLoader(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	if err == nil {
+		t.Errorf("NewKeyPairLoader() should have failed")
+	}
+
+	_, certPEM, keyPEM	= genTestKeyPair(t, "server 1", nil)
+	writeTestFile(t, filepath.Join(dir, "server.crt"), certPEM, 1)
+	writeTestFile(t, filepath.Join(dir, "server.key"), keyPEM, 1)
+
+	kpl, err	= NewKeyPairLoader(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	if err != nil {
+		t.Errorf("NewKeyPairLoader() should have succeeded, got: %v", err)
+		return
+	}
+
+	keyPair, err	= kpl.GetCertificate(nil)
+	if err != nil || keyPair.Leaf.Subject.CommonName != "server 1" {
+		t.Errorf("unexpected key pair: %v, err: %v", keyPair, err)
+	}
+
+	// rotate the key pair: the new one should be picked up
+	_, certPEM, keyPEM	= genTestKeyPair(t, "server 2", nil)
+	writeTestFile(t, filepath.Join(dir, "server.crt"), certPEM, 2)
+	writeTestFile(t, filepath.Join(dir, "server.key"), keyPEM, 2)
+
+	keyPair, err	= kpl.GetCertificate(nil)
+	if err != nil || keyPair.Leaf.Subject.CommonName != "server 2" {
+		t.Errorf("unexpected key pair: %v, err: %v", keyPair, err)
+	}
+
+	// a partial update (mismatched cert and key) should leave the current
+	// key pair in place
+	_, certPEM, keyPEM	= genTestKeyPair(t, "server 3", nil)
+	writeTestFile(t, filepath.Join(dir, "server.crt"), certPEM, 3)
+
+	keyPair, err	= kpl.GetCertificate(nil)
+	if err != nil || keyPair.Leaf.Subject.CommonName != "server 2" {
+		t.Errorf("unexpected key pair: %v, err: %v", keyPair, err)
+	}
+
+	err	= kpl.Reload()
+	if err == nil {
+		t.Errorf("Reload() should have failed")
+	}
+
+	// ... until the update is complete
+	writeTestFile(t, filepath.Join(dir, "server.key"), keyPEM, 3)
+
+	keyPair, err	= kpl.GetCertificate(nil)
+	if err != nil || keyPair.Leaf.Subject.CommonName != "server 3" {
+		t.Errorf("unexpected key pair: %v, err: %v", keyPair, err)
+	}
+
+	return
+}
+
+func TestCertPoolLoader(t *testing.T) {
+	var err      error
+	var path     string
+	var cpl      *CertPoolLoader
+	var cp       *x509.CertPool
+	var ca1      tls.Certificate
+	var ca2      tls.Certificate
+	var certPEM  []byte
+
+	path	= filepath.Join(t.TempDir(), "cas.pem")
+
+	ca1, certPEM, _	= genTestKeyPair(t, "ca 1", nil)
+	writeTestFile(t, path, certPEM, 1)
+
+	cpl, err	= NewCertPoolLoader(path)
+	if err != nil {
+		t.Errorf("NewCertPoolLoader() should have succeeded, got: %v", err)
+		return
+	}
+
+	cp, err	= cpl.GetCertPool()
+	if err != nil || !poolHasCert(cp, ca1.Leaf) {
+		t.Errorf("expected the pool to contain ca 1, err: %v", err)
+	}
+
+	// garbage should be ignored
+	writeTestFile(t, path, []byte("somejunk"), 2)
+
+	cp, err	= cpl.GetCertPool()
+	if err != nil || !poolHasCert(cp, ca1.Leaf) {
+		t.Errorf("expected the pool to contain ca 1, err: %v", err)
+	}
+
+	ca2, certPEM, _	= genTestKeyPair(t, "ca 2", nil)
+	writeTestFile(t, path, certPEM, 3)
+
+	cp, err	= cpl.GetCertPool()
+	if err != nil || !poolHasCert(cp, ca2.Leaf) || poolHasCert(cp, ca1.Leaf) {
+		t.Errorf("expected the pool to only contain ca 2, err: %v", err)
+	}
+
+	return
+}
+
+// genTestKeyPair generates an ECDSA key pair for cn, signed by parent or
+// self-signed (and usable as a CA) if parent is nil. The certificate is valid
+// for localhost, for both server and client authentication.
+func genTestKeyPair(t *testing.T, cn string, parent *tls.Certificate) (
+	keyPair tls.Certificate, certPEM []byte, keyPEM []byte) {
+	var err      error
+	var key      *ecdsa.PrivateKey
+	var template *x509.Certificate
+	var der      []byte
+	var keyDer   []byte
+
+	key, err	= ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	template	= &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign |
+				       x509.KeyUsageCRLSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth,
+		},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+
+	if parent == nil {
+		der, err	= x509.CreateCertificate(rand.Reader, template, template,
+						       &key.PublicKey, key)
+	} else {
+		der, err	= x509.CreateCertificate(rand.Reader, template, parent.Leaf,
+						       &key.PublicKey, parent.PrivateKey)
+	}
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+
+	keyDer, err	= x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	certPEM	= pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM	= pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+
+	keyPair, err	= tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("failed to load key pair: %v", err)
+	}
+
+	keyPair.Leaf, err	= x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+
+	return
+}
+
+// writeTestFile writes buf to path and sets its modification time to version
+// minutes past a fixed date, so that rewrites are always detected regardless
+// of the resolution of file timestamps.
+func writeTestFile(t *testing.T, path string, buf []byte, version int) {
+	var err	error
+	var ts	= time.Date(2020, 1, 1, 0, version, 0, 0, time.UTC)
+
+	err	= ioutil.WriteFile(path, buf, 0600)
+	if err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+
+	err	= os.Chtimes(path, ts, ts)
+	if err != nil {
+		t.Fatalf("failed to set the modification time of %s: %v", path, err)
+	}
+
+	return
+}
+
+func poolHasCert(cp *x509.CertPool, cert *x509.Certificate) (yes bool) {
+	var err	error
+
+	// self-signed certificates verify against pools containing them
+	_, err	= cert.Verify(x509.VerifyOptions{
+		Roots:     cp,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	yes	= err == nil
+
+	return
+}
@@ -13,6 +13,7 @@ const (
 type transport interface {
 	Close()              (error)
 	ExecuteRequest(*pdu) (*pdu, error)
+	WriteRequest(*pdu)   (error)
 	ReadRequest()        (*pdu, error)
 	WriteResponse(*pdu)  (error)
 }
@@ -1,6 +1,7 @@
 package modbus
 
 import (
+	"io"
 	"net"
 	"time"
 )
@@ -100,3 +101,72 @@ func (usw *udpSockWrapper) RemoteAddr() (addr net.Addr) {
 
 	return
 }
+
+// udpDatagramConn wraps a single datagram received on a server-side UDP socket
+// to allow transports to read the request it holds as a stream of bytes, and
+// to send responses back to the source address of the datagram.
+// Reads return io.EOF once the datagram has been consumed.
+type udpDatagramConn struct {
+	sock  *net.UDPConn
+	addr  *net.UDPAddr
+	rxbuf []byte
+}
+
+func newUDPDatagramConn(sock *net.UDPConn, addr *net.UDPAddr, datagram []byte) (
+	udc *udpDatagramConn) {
+	udc = &udpDatagramConn{
+		sock:  sock,
+		addr:  addr,
+		rxbuf: datagram,
+	}
+
+	return
+}
+
+func (udc *udpDatagramConn) Read(buf []byte) (rlen int, err error) {
+	if len(udc.rxbuf) == 0 {
+		err = io.EOF
+		return
+	}
+
+	rlen      = copy(buf, udc.rxbuf)
+	udc.rxbuf = udc.rxbuf[rlen:]
+
+	return
+}
+
+func (udc *udpDatagramConn) Write(buf []byte) (wlen int, err error) {
+	wlen, err = udc.sock.WriteToUDP(buf, udc.addr)
+
+	return
+}
+
+// Close is a no-op, as the underlying socket is shared by all clients.
+func (udc *udpDatagramConn) Close() (err error) {
+	return
+}
+
+// Deadlines are ignored, as the datagram has already been received.
+func (udc *udpDatagramConn) SetDeadline(deadline time.Time) (err error) {
+	return
+}
+
+func (udc *udpDatagramConn) SetReadDeadline(deadline time.Time) (err error) {
+	return
+}
+
+func (udc *udpDatagramConn) SetWriteDeadline(deadline time.Time) (err error) {
+	return
+}
+
+func (udc *udpDatagramConn) LocalAddr() (addr net.Addr) {
+	addr = udc.sock.LocalAddr()
+
+	return
+}
+
+func (udc *udpDatagramConn) RemoteAddr() (addr net.Addr) {
+	addr = udc.addr
+
+	return
+}
@@ -0,0 +1,418 @@
+package modbus
+
+import (
+	"log"
+	"reflect"
+	"sync"
+)
+
+type UnknownUnitIdPolicy uint
+const (
+	// answer requests addressed to unknown unit ids with a gateway path
+	// unavailable exception (0x0a)
+	UNKNOWN_UNIT_ID_PATH_UNAVAILABLE UnknownUnitIdPolicy = 0
+	// answer requests addressed to unknown unit ids with a gateway target
+	// device failed to respond exception (0x0b)
+	UNKNOWN_UNIT_ID_TARGET_FAILED    UnknownUnitIdPolicy = 1
+	// silently drop requests addressed to unknown unit ids
+	UNKNOWN_UNIT_ID_NO_RESPONSE      UnknownUnitIdPolicy = 2
+)
+
+// Unit id multiplexer object, dispatching requests to per-unit id handlers.
+// UnitMux satisfies the RequestHandler interface (as well as all optional handler
+// interfaces) and can be passed to NewServer to serve multiple virtual devices
+// from a single server, e.g. to emulate a gateway.
+// Optional handler interfaces not implemented by the target handler are served
+// the same way the server would serve them (e.g. mask write register requests
+// are turned into read-modify-write sequences).
+// Unless a handler is registered for unit id 0, write coil(s), write
+// register(s), mask write register and write file record requests addressed to
+// unit id 0 (i.e. RTU broadcasts) are passed to every registered handler in
+// turn, while other requests addressed to unit id 0 are subject to the unknown
+// unit id policy.
+type UnitMux struct {
+	lock          sync.RWMutex
+	rmwLock       sync.Mutex
+	logger        *logger
+	handlers      [256]RequestHandler
+	unknownPolicy UnknownUnitIdPolicy
+}
+
+// Returns a new unit id multiplexer, handling requests addressed to unit ids
+// without a registered handler according to unknownPolicy.
+func NewUnitMux(unknownPolicy UnknownUnitIdPolicy) (mux *UnitMux) {
+	mux = &UnitMux{
+		logger:        newLogger("unit-mux", nil),
+		unknownPolicy: unknownPolicy,
+	}
+
+	return
+}
+
+// Sets the logger used to report errors.
+// If customLogger is nil, messages are written to stdout.
+func (mux *UnitMux) SetLogger(customLogger *log.Logger) {
+	mux.lock.Lock()
+	mux.logger	= newLogger("unit-mux", customLogger)
+	mux.lock.Unlock()
+
+	return
+}
+
+// Registers handler as the handler of unit id unitId, replacing any previously
+// registered handler. A nil handler unregisters the unit id.
+func (mux *UnitMux) Handle(unitId uint8, handler RequestHandler) {
+	mux.HandleRange(unitId, unitId, handler)
+
+	return
+}
+
+// Registers handler as the handler of unit ids first to last (inclusive),
+// replacing any previously registered handler.
+func (mux *UnitMux) HandleRange(first uint8, last uint8, handler RequestHandler) {
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+
+	for id := int(first); id <= int(last); id++ {
+		mux.handlers[id]	= handler
+	}
+
+	return
+}
+
+// HandleCoils implements the RequestHandler interface.
+func (mux *UnitMux) HandleCoils(req *CoilsRequest) (res []bool, err error) {
+	var h	RequestHandler
+
+	if req.IsWrite && mux.isBroadcast(req.UnitId) {
+		err	= mux.broadcast(func(h RequestHandler) (err error) {
+			_, err	= h.HandleCoils(req)
+			return
+		})
+		return
+	}
+
+	h, err	= mux.lookup(req.UnitId)
+	if err == nil {
+		res, err	= h.HandleCoils(req)
+	}
+
+	return
+}
+
+// HandleDiscreteInputs implements the RequestHandler interface.
+func (mux *UnitMux) HandleDiscreteInputs(req *DiscreteInputsRequest) (res []bool, err error) {
+	var h	RequestHandler
+
+	h, err	= mux.lookup(req.UnitId)
+	if err == nil {
+		res, err	= h.HandleDiscreteInputs(req)
+	}
+
+	return
+}
+
+// HandleHoldingRegisters implements the RequestHandler interface.
+func (mux *UnitMux) HandleHoldingRegisters(req *HoldingRegistersRequest) (res []uint16, err error) {
+	var h	RequestHandler
+
+	if req.IsWrite && mux.isBroadcast(req.UnitId) {
+		err	= mux.broadcast(func(h RequestHandler) (err error) {
+			_, err	= h.HandleHoldingRegisters(req)
+			return
+		})
+		return
+	}
+
+	h, err	= mux.lookup(req.UnitId)
+	if err == nil {
+		res, err	= h.HandleHoldingRegisters(req)
+	}
+
+	return
+}
+
+// HandleInputRegisters implements the RequestHandler interface.
+func (mux *UnitMux) HandleInputRegisters(req *InputRegistersRequest) (res []uint16, err error) {
+	var h	RequestHandler
+
+	h, err	= mux.lookup(req.UnitId)
+	if err == nil {
+		res, err	= h.HandleInputRegisters(req)
+	}
+
+	return
+}
+
+// HandleMaskWriteRegister implements the MaskWriteRegisterHandler interface.
+func (mux *UnitMux) HandleMaskWriteRegister(req *MaskWriteRegisterRequest) (err error) {
+	var h	RequestHandler
+
+	if mux.isBroadcast(req.UnitId) {
+		err	= mux.broadcast(func(h RequestHandler) (err error) {
+			err	= mux.maskWriteRegister(h, req)
+			return
+		})
+		return
+	}
+
+	h, err	= mux.lookup(req.UnitId)
+	if err != nil {
+		return
+	}
+
+	err	= mux.maskWriteRegister(h, req)
+
+	return
+}
+
+// HandleReadWriteRegisters implements the ReadWriteRegistersHandler interface.
+func (mux *UnitMux) HandleReadWriteRegisters(req *ReadWriteRegistersRequest) (res []uint16, err error) {
+	var h		RequestHandler
+	var rwrh	ReadWriteRegistersHandler
+	var ok		bool
+
+	h, err	= mux.lookup(req.UnitId)
+	if err != nil {
+		return
+	}
+
+	rwrh, ok	= h.(ReadWriteRegistersHandler)
+	if ok {
+		res, err	= rwrh.HandleReadWriteRegisters(req)
+	} else {
+		res, err	= rmwReadWriteRegisters(h, &mux.rmwLock, req)
+	}
+
+	return
+}
+
+// HandleFIFOQueue implements the FIFOQueueHandler interface.
+func (mux *UnitMux) HandleFIFOQueue(req *FIFOQueueRequest) (res []uint16, err error) {
+	var h	RequestHandler
+	var fqh	FIFOQueueHandler
+	var ok	bool
+
+	h, err	= mux.lookup(req.UnitId)
+	if err != nil {
+		return
+	}
+
+	fqh, ok	= h.(FIFOQueueHandler)
+	if ok {
+		res, err	= fqh.HandleFIFOQueue(req)
+	} else {
+		err		= ErrIllegalFunction
+	}
+
+	return
+}
+
+// HandleFileRecords implements the FileRecordHandler interface.
+func (mux *UnitMux) HandleFileRecords(req *FileRecordsRequest) (res [][]uint16, err error) {
+	var h	RequestHandler
+	var frh	FileRecordHandler
+	var ok	bool
+
+	if req.IsWrite && mux.isBroadcast(req.UnitId) {
+		err	= mux.broadcast(func(h RequestHandler) (err error) {
+			var frh	FileRecordHandler
+			var ok	bool
+
+			frh, ok	= h.(FileRecordHandler)
+			if ok {
+				_, err	= frh.HandleFileRecords(req)
+			}
+			return
+		})
+		return
+	}
+
+	h, err	= mux.lookup(req.UnitId)
+	if err != nil {
+		return
+	}
+
+	frh, ok	= h.(FileRecordHandler)
+	if ok {
+		res, err	= frh.HandleFileRecords(req)
+	} else {
+		err		= ErrIllegalFunction
+	}
+
+	return
+}
+
+// HandleExceptionStatus implements the ExceptionStatusHandler interface.
+func (mux *UnitMux) HandleExceptionStatus(req *ExceptionStatusRequest) (status uint8, err error) {
+	var h	RequestHandler
+	var esh	ExceptionStatusHandler
+	var ok	bool
+
+	h, err	= mux.lookup(req.UnitId)
+	if err != nil {
+		return
+	}
+
+	esh, ok	= h.(ExceptionStatusHandler)
+	if ok {
+		status, err	= esh.HandleExceptionStatus(req)
+	} else {
+		err		= ErrIllegalFunction
+	}
+
+	return
+}
+
+// HandleServerId implements the ServerIdHandler interface.
+func (mux *UnitMux) HandleServerId(req *ServerIdRequest) (id []byte, running bool, err error) {
+	var h	RequestHandler
+	var sih	ServerIdHandler
+	var ok	bool
+
+	h, err	= mux.lookup(req.UnitId)
+	if err != nil {
+		return
+	}
+
+	sih, ok	= h.(ServerIdHandler)
+	if ok {
+		id, running, err	= sih.HandleServerId(req)
+	} else {
+		err			= ErrIllegalFunction
+	}
+
+	return
+}
+
+// HandleRaw implements the RawHandler interface.
+func (mux *UnitMux) HandleRaw(req *RawRequest) (res []byte, err error) {
+	var h	RequestHandler
+	var rh	RawHandler
+	var ok	bool
+
+	h, err	= mux.lookup(req.UnitId)
+	if err != nil {
+		return
+	}
+
+	rh, ok	= h.(RawHandler)
+	if ok {
+		res, err	= rh.HandleRaw(req)
+	} else {
+		err		= ErrIllegalFunction
+	}
+
+	return
+}
+
+/*** unexported methods ***/
+// Returns the handler registered for unitId or, if there is none, the error
+// mandated by the unknown unit id policy.
+func (mux *UnitMux) lookup(unitId uint8) (h RequestHandler, err error) {
+	mux.lock.RLock()
+	h	= mux.handlers[unitId]
+	mux.lock.RUnlock()
+
+	if h != nil {
+		return
+	}
+
+	switch mux.unknownPolicy {
+	case UNKNOWN_UNIT_ID_TARGET_FAILED:
+		err	= ErrGWTargetFailedToRespond
+	case UNKNOWN_UNIT_ID_NO_RESPONSE:
+		err	= ErrNoResponse
+	default:
+		err	= ErrGWPathUnavailable
+	}
+
+	return
+}
+
+// Returns true if requests addressed to unitId are to be broadcast to all
+// registered handlers, i.e. if unitId is 0 and has no handler of its own.
+func (mux *UnitMux) isBroadcast(unitId uint8) (yes bool) {
+	if unitId != 0 {
+		return
+	}
+
+	mux.lock.RLock()
+	yes	= mux.handlers[0] == nil
+	mux.lock.RUnlock()
+
+	return
+}
+
+// Calls fn once with each distinct registered handler, in ascending unit id
+// order. All handlers are called even if some of them fail, in which case the
+// first error is returned.
+func (mux *UnitMux) broadcast(fn func(h RequestHandler) error) (err error) {
+	var handlers	[]RequestHandler
+	var hErr	error
+
+	mux.lock.RLock()
+	for _, h := range mux.handlers {
+		if h != nil && !containsHandler(handlers, h) {
+			handlers	= append(handlers, h)
+		}
+	}
+	mux.lock.RUnlock()
+
+	for _, h := range handlers {
+		hErr	= fn(h)
+		if hErr != nil && err == nil {
+			err	= hErr
+		}
+	}
+
+	return
+}
+
+// Passes a mask write register request to h, either directly if h implements
+// MaskWriteRegisterHandler or as a read-modify-write sequence.
+func (mux *UnitMux) maskWriteRegister(h RequestHandler, req *MaskWriteRegisterRequest) (err error) {
+	var mwrh	MaskWriteRegisterHandler
+	var logger	*logger
+	var ok		bool
+
+	mwrh, ok	= h.(MaskWriteRegisterHandler)
+	if ok {
+		err	= mwrh.HandleMaskWriteRegister(req)
+		return
+	}
+
+	mux.lock.RLock()
+	logger	= mux.logger
+	mux.lock.RUnlock()
+
+	err	= rmwMaskWriteRegister(h, &mux.rmwLock, logger, req)
+
+	return
+}
+
+// Returns true if handlers holds h.
+func containsHandler(handlers []RequestHandler, h RequestHandler) (yes bool) {
+	for _, other := range handlers {
+		if sameHandler(other, h) {
+			yes	= true
+			return
+		}
+	}
+
+	return
+}
+
+// Returns true if a and b are the same handler. Handlers of non-comparable
+// types (e.g. structs holding slices, which would cause == to panic) can't be
+// told apart, hence are never considered the same.
+func sameHandler(a RequestHandler, b RequestHandler) (yes bool) {
+	if a == nil || b == nil ||
+	   !reflect.TypeOf(a).Comparable() || !reflect.TypeOf(b).Comparable() {
+		return
+	}
+
+	yes	= a == b
+
+	return
+}
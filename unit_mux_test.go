@@ -0,0 +1,256 @@
+package modbus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUnitMux(t *testing.T) {
+	var server *ModbusServer
+	var client *ModbusClient
+	var mux    *UnitMux
+	var mem1   *MemoryStore
+	var mem2   *MemoryStore
+	var err    error
+	var regs   []uint16
+
+	mem1, err	= NewMemoryStore(&MemoryStoreConfiguration{
+		HoldingRegisters:	[]AddressRange{{Start: 0, End: 9}},
+	})
+	if err != nil {
+		t.Errorf("NewMemoryStore() should have succeeded, got: %v", err)
+		return
+	}
+
+	mem2, err	= NewMemoryStore(&MemoryStoreConfiguration{
+		HoldingRegisters:	[]AddressRange{{Start: 0, End: 9}},
+	})
+	if err != nil {
+		t.Errorf("NewMemoryStore() should have succeeded, got: %v", err)
+		return
+	}
+
+	mux	= NewUnitMux(UNKNOWN_UNIT_ID_NO_RESPONSE)
+	mux.Handle(1, mem1)
+	mux.HandleRange(10, 12, mem2)
+	mux.Handle(9, &tcpTestHandler{})
+
+	server, err	= NewServer(&ServerConfiguration{
+		URL:	"tcp://localhost:5517",
+	}, mux)
+	if err != nil {
+		t.Errorf("failed to create server: %v", err)
+		return
+	}
+
+	err	= server.Start()
+	if err != nil {
+		t.Errorf("failed to start server: %v", err)
+		return
+	}
+	defer server.Stop()
+
+	client, err	= NewClient(&ClientConfiguration{
+		URL:		"tcp://localhost:5517",
+		Timeout:	100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Errorf("failed to create client: %v", err)
+		return
+	}
+
+	err	= client.Open()
+	if err != nil {
+		t.Errorf("failed to open client: %v", err)
+		return
+	}
+	defer client.Close()
+
+	client.SetUnitId(1)
+	err	= client.WriteRegister(0, 0x1111)
+	if err != nil {
+		t.Errorf("client.WriteRegister() should have succeeded, got: %v", err)
+	}
+
+	client.SetUnitId(11)
+	err	= client.WriteRegister(0, 0x2222)
+	if err != nil {
+		t.Errorf("client.WriteRegister() should have succeeded, got: %v", err)
+	}
+
+	// unit ids 10 to 12 share the same handler
+	client.SetUnitId(12)
+	regs, err	= client.ReadRegisters(0, 1, HOLDING_REGISTER)
+	if err != nil || len(regs) != 1 || regs[0] != 0x2222 {
+		t.Errorf("client.ReadRegisters() should have returned [0x2222], got: %v (%v)", regs, err)
+	}
+
+	client.SetUnitId(1)
+	regs, err	= client.ReadRegisters(0, 1, HOLDING_REGISTER)
+	if err != nil || len(regs) != 1 || regs[0] != 0x1111 {
+		t.Errorf("client.ReadRegisters() should have returned [0x1111], got: %v (%v)", regs, err)
+	}
+
+	// mask write register requests should be served through
+	// HandleHoldingRegisters if the target handler has no better way
+	client.SetUnitId(9)
+	err	= client.WriteRegister(0, 0x00ff)
+	if err != nil {
+		t.Errorf("client.WriteRegister() should have succeeded, got: %v", err)
+	}
+
+	err	= client.MaskWriteRegister(0, 0x0f0f, 0xf000)
+	if err != nil {
+		t.Errorf("client.MaskWriteRegister() should have succeeded, got: %v", err)
+	}
+
+	regs, err	= client.ReadRegisters(0, 1, HOLDING_REGISTER)
+	if err != nil || len(regs) != 1 || regs[0] != 0xf00f {
+		t.Errorf("client.ReadRegisters() should have returned [0xf00f], got: %v (%v)", regs, err)
+	}
+
+	// optional interfaces not implemented by the target handler should
+	// yield illegal function exceptions
+	_, err	= client.ReadFIFOQueue(0)
+	if err != ErrIllegalFunction {
+		t.Errorf("client.ReadFIFOQueue() should have returned ErrIllegalFunction, got: %v", err)
+	}
+
+	// requests to unknown unit ids should be left unanswered
+	client.SetUnitId(2)
+	_, err	= client.ReadRegisters(0, 1, HOLDING_REGISTER)
+	if err != ErrRequestTimedOut {
+		t.Errorf("client.ReadRegisters() should have returned ErrRequestTimedOut, got: %v", err)
+	}
+
+	return
+}
+
+func TestUnitMuxUnknownUnitIdPolicy(t *testing.T) {
+	var mux *UnitMux
+	var err error
+
+	for _, tc := range []struct {
+		policy UnknownUnitIdPolicy
+		err    error
+	}{
+		{UNKNOWN_UNIT_ID_PATH_UNAVAILABLE, ErrGWPathUnavailable},
+		{UNKNOWN_UNIT_ID_TARGET_FAILED,    ErrGWTargetFailedToRespond},
+		{UNKNOWN_UNIT_ID_NO_RESPONSE,      ErrNoResponse},
+	} {
+		mux	= NewUnitMux(tc.policy)
+		mux.Handle(5, &tcpTestHandler{})
+
+		_, err	= mux.HandleInputRegisters(&InputRegistersRequest{
+			UnitId: 6, Addr: 0, Quantity: 1,
+		})
+		if err != tc.err {
+			t.Errorf("expected %v, got: %v", tc.err, err)
+		}
+
+		_, _, err	= mux.HandleServerId(&ServerIdRequest{UnitId: 4})
+		if err != tc.err {
+			t.Errorf("expected %v, got: %v", tc.err, err)
+		}
+	}
+
+	// unregistering a unit id should make it unknown
+	mux.Handle(5, nil)
+	_, err	= mux.HandleCoils(&CoilsRequest{UnitId: 5, Addr: 0, Quantity: 1})
+	if err != ErrNoResponse {
+		t.Errorf("expected ErrNoResponse, got: %v", err)
+	}
+
+	return
+}
+
+func TestUnitMuxBroadcast(t *testing.T) {
+	var mux   *UnitMux
+	var mem1  *MemoryStore
+	var mem2  *MemoryStore
+	var err   error
+	var reg   uint16
+	var coil  bool
+
+	mem1, _	= NewMemoryStore(&MemoryStoreConfiguration{
+		Coils:			[]AddressRange{{Start: 0, End: 9}},
+		HoldingRegisters:	[]AddressRange{{Start: 0, End: 9}},
+	})
+	mem2, _	= NewMemoryStore(&MemoryStoreConfiguration{
+		Coils:			[]AddressRange{{Start: 0, End: 9}},
+		HoldingRegisters:	[]AddressRange{{Start: 0, End: 9}},
+	})
+
+	mux	= NewUnitMux(UNKNOWN_UNIT_ID_NO_RESPONSE)
+	mux.Handle(1, mem1)
+	mux.HandleRange(10, 12, mem2)
+
+	// writes to unit id 0 should reach every handler
+	_, err	= mux.HandleHoldingRegisters(&HoldingRegistersRequest{
+		UnitId: 0, Addr: 1, Quantity: 1, IsWrite: true, Args: []uint16{0x4242},
+	})
+	if err != nil {
+		t.Errorf("expected nil, got: %v", err)
+	}
+
+	_, err	= mux.HandleCoils(&CoilsRequest{
+		UnitId: 0, Addr: 2, Quantity: 1, IsWrite: true, Args: []bool{true},
+	})
+	if err != nil {
+		t.Errorf("expected nil, got: %v", err)
+	}
+
+	err	= mux.HandleMaskWriteRegister(&MaskWriteRegisterRequest{
+		UnitId: 0, Addr: 1, AndMask: 0x00ff, OrMask: 0x0100,
+	})
+	if err != nil {
+		t.Errorf("expected nil, got: %v", err)
+	}
+
+	for _, mem := range []*MemoryStore{mem1, mem2} {
+		reg, _	= mem.GetRegister(1, HOLDING_REGISTER)
+		coil, _	= mem.GetCoil(2)
+		if reg != 0x0142 || !coil {
+			t.Errorf("unexpected values: 0x%04x, %v", reg, coil)
+		}
+	}
+
+	// reads are not broadcast
+	_, err	= mux.HandleHoldingRegisters(&HoldingRegistersRequest{
+		UnitId: 0, Addr: 1, Quantity: 1,
+	})
+	if err != ErrNoResponse {
+		t.Errorf("expected ErrNoResponse, got: %v", err)
+	}
+
+	// the first error should be returned, once all handlers were called
+	// (tcpTestHandler only serves unit id 9)
+	mux.Handle(5, &tcpTestHandler{})
+	_, err	= mux.HandleHoldingRegisters(&HoldingRegistersRequest{
+		UnitId: 0, Addr: 1, Quantity: 1, IsWrite: true, Args: []uint16{0x1234},
+	})
+	if err != ErrIllegalFunction {
+		t.Errorf("expected ErrIllegalFunction, got: %v", err)
+	}
+
+	reg, _	= mem2.GetRegister(1, HOLDING_REGISTER)
+	if reg != 0x1234 {
+		t.Errorf("expected 0x1234, got: 0x%04x", reg)
+	}
+
+	// a handler registered for unit id 0 takes precedence
+	mux.Handle(0, mem1)
+	_, err	= mux.HandleHoldingRegisters(&HoldingRegistersRequest{
+		UnitId: 0, Addr: 1, Quantity: 1, IsWrite: true, Args: []uint16{0x5678},
+	})
+	if err != nil {
+		t.Errorf("expected nil, got: %v", err)
+	}
+
+	reg, _	= mem2.GetRegister(1, HOLDING_REGISTER)
+	if reg != 0x1234 {
+		t.Errorf("expected 0x1234, got: 0x%04x", reg)
+	}
+
+	return
+}